@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// apiRunRequest is the body of POST /runs.
+type apiRunRequest struct {
+	Command    string   `json:"command"`    // discover, scrape or crawl
+	Source     string   `json:"source"`     // for discover, as -source, listing by default
+	Sections   []string `json:"sections"`   // for discover, -sections by default
+	Categories string   `json:"categories"` // as -categories
+	Limit      int      `json:"limit"`      // for scrape, as -limit
+	MaxPages   int      `json:"max_pages"`  // for discover, as -max-pages
+}
+
+// apiRun is a run as returned by the /runs API: the crawl_runs record with
+// its progress.
+type apiRun struct {
+	*crawlRun
+	Queued int64 `json:"queued"` // product URLs handed to workers and not completed yet
+	Done   int64 `json:"done"`   // products saved
+	Failed int64 `json:"failed"` // product URLs that failed
+}
+
+func newAPIRun(run *crawlRun) apiRun {
+	return apiRun{
+		crawlRun: run,
+		Queued:   run.Stats["dispatched"] - run.Stats["completed"],
+		Done:     run.Stats["products"],
+		Failed:   run.Stats["failed"],
+	}
+}
+
+// apiError is the body of an error response.
+type apiError struct {
+	Error string  `json:"error"`
+	Run   *apiRun `json:"run,omitempty"` // the active run, on 409
+}
+
+// apiHandlers adds the /runs API to mux, for starting, following and
+// cancelling discover and scrape runs from a dashboard. The runs are the
+// same as those of the CLI and recorded in crawl_runs.
+func (d *daemon) apiHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("POST /runs", d.postRun)
+	mux.HandleFunc("GET /runs", d.listRuns)
+	mux.HandleFunc("GET /runs/{id}", d.getRun)
+	mux.HandleFunc("DELETE /runs/{id}", d.deleteRun)
+}
+
+// postRun starts a run, answering 409 Conflict while another one is active.
+func (d *daemon) postRun(w http.ResponseWriter, r *http.Request) {
+	var req apiRunRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: fmt.Sprintf("invalid request body: %v", err)})
+		return
+	}
+	fn, err := d.runRequestFunc(req)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: err.Error()})
+		return
+	}
+	started, active := d.start("api", req.Command, fn)
+	if active != nil {
+		run := newAPIRun(active)
+		writeJSON(w, http.StatusConflict, apiError{Error: "another run is active", Run: &run})
+		return
+	}
+	writeJSON(w, http.StatusAccepted, newAPIRun(started))
+}
+
+// runRequestFunc validates req and returns the work of its run.
+func (d *daemon) runRequestFunc(req apiRunRequest) (runFunc, error) {
+	if req.Limit < 0 || req.MaxPages < 0 {
+		return nil, fmt.Errorf("limit and max_pages must not be negative")
+	}
+	if len(req.Sections) == 0 {
+		req.Sections = d.cfg.crawlSections()
+	}
+	selected, err := parseSections(strings.Join(req.Sections, ","))
+	if err != nil {
+		return nil, err
+	}
+	filter, err := compileCategoryFilter(req.Categories)
+	if err != nil {
+		return nil, err
+	}
+
+	switch req.Source {
+	case "":
+		req.Source = sourceListing
+	case sourceListing, sourceSitemap:
+	default:
+		return nil, fmt.Errorf("source must be %s or %s, got %q", sourceListing, sourceSitemap, req.Source)
+	}
+
+	switch req.Command {
+	case "discover":
+		opts := discoverOptions{Source: req.Source, Sections: selected, Categories: filter, MaxPages: req.MaxPages}
+		if opts.Source == sourceSitemap {
+			return func(ctx context.Context, store Storage, stats *crawlStats) error {
+				return withRun(ctx, d.cfg, store, "discover", stats, func(store Storage, _ []productSink) error {
+					return discoverSitemap(ctx, d.cfg, opts, store, stats)
+				})
+			}, nil
+		}
+		return func(ctx context.Context, store Storage, stats *crawlStats) error {
+			sessions, err := newSessionFactory(d.cfg, stats)
+			if err != nil {
+				return err
+			}
+			defer sessions.close()
+			return withRun(ctx, d.cfg, store, "discover", stats, func(store Storage, _ []productSink) error {
+				return discover(ctx, d.cfg, opts, sessions, store, stats)
+			})
+		}, nil
+	case "scrape":
+		opts := scrapeOptions{Categories: filter, Limit: req.Limit}
+		return func(ctx context.Context, store Storage, stats *crawlStats) error {
+			sessions, err := newSessionFactory(d.cfg, stats)
+			if err != nil {
+				return err
+			}
+			defer sessions.close()
+			return withRun(ctx, d.cfg, store, "scrape", stats, func(store Storage, sinks []productSink) error {
+				return scrape(ctx, d.cfg, opts, sessions, store, sinks, stats)
+			})
+		}, nil
+	case "crawl":
+		return d.crawl, nil
+	}
+	return nil, fmt.Errorf("command must be discover, scrape or crawl, got %q", req.Command)
+}
+
+// listRuns returns the most recent runs, ?limit= of them, 20 by default. The
+// active run is shown with its current counts.
+func (d *daemon) listRuns(w http.ResponseWriter, r *http.Request) {
+	limit := 20
+	if s := r.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			writeJSON(w, http.StatusBadRequest, apiError{Error: fmt.Sprintf("limit must be a positive number, got %q", s)})
+			return
+		}
+		limit = n
+	}
+	runs, err := d.store.recentRuns(r.Context(), limit)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, apiError{Error: err.Error()})
+		return
+	}
+	d.mu.Lock()
+	active := d.progress()
+	d.mu.Unlock()
+
+	list := make([]apiRun, len(runs))
+	for i := range runs {
+		if active != nil && runs[i].ID == active.ID {
+			list[i] = newAPIRun(active)
+			continue
+		}
+		list[i] = newAPIRun(&runs[i])
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// getRun returns one run, live while it is active.
+func (d *daemon) getRun(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	d.mu.Lock()
+	active := d.progress()
+	d.mu.Unlock()
+	if active != nil && active.ID == id {
+		writeJSON(w, http.StatusOK, newAPIRun(active))
+		return
+	}
+
+	run, err := d.store.findRun(r.Context(), id)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, apiError{Error: err.Error()})
+		return
+	}
+	if run == nil {
+		writeJSON(w, http.StatusNotFound, apiError{Error: fmt.Sprintf("no run %q", id)})
+		return
+	}
+	writeJSON(w, http.StatusOK, newAPIRun(run))
+}
+
+// deleteRun cancels the active run. It ends as interrupted once the workers
+// have finished the pages they are on.
+func (d *daemon) deleteRun(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if d.cancelRun(id) {
+		d.mu.Lock()
+		active := d.progress()
+		d.mu.Unlock()
+		if active == nil {
+			// It ended in the meantime.
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		writeJSON(w, http.StatusAccepted, newAPIRun(active))
+		return
+	}
+
+	run, err := d.store.findRun(r.Context(), id)
+	switch {
+	case err != nil:
+		writeJSON(w, http.StatusInternalServerError, apiError{Error: err.Error()})
+	case run == nil:
+		writeJSON(w, http.StatusNotFound, apiError{Error: fmt.Sprintf("no run %q", id)})
+	default:
+		writeJSON(w, http.StatusConflict, apiError{Error: fmt.Sprintf("run %q is not active", id)})
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// snapshotPage snapshots the page of productURL last loaded by ex when its
+// scrape failed with the failure class, when product came back without one
+// of the -critical-fields or, with -snapshot-all, always. It returns the
+// paths of the files saved.
+func snapshotPage(ctx context.Context, cfg *Config, artifacts *artifactStore, ex Extractor, productURL ProductURL, product *Product, sectionErrs []*SectionError, failure string) []string {
+	var missing []string
+	if failure == "" && product != nil && findSectionError(sectionErrs, "page") == nil {
+		missing = missingFields(product, splitList(cfg.CriticalFields))
+	}
+	if failure == "" && len(missing) == 0 && !cfg.SnapshotAll {
+		return nil
+	}
+
+	name := extractProductNumber(productURL.URL)
+	if product != nil && product.ProductNumber != "" {
+		name = product.ProductNumber
+	}
+	paths := artifacts.capture(ctx, ex, name)
+	if len(missing) > 0 {
+		slog.WarnContext(ctx, "Critical product fields came back empty", "fields", missing, "artifacts", paths)
+	} else if len(paths) > 0 {
+		slog.DebugContext(ctx, "Saved page snapshot", "failure", failure, "artifacts", paths)
+	}
+	return paths
+}
+
+// artifactStore saves a screenshot and the page source of product pages
+// into -artifacts-dir, as <product number>-<timestamp>.png and .html. The
+// files already in the directory count towards its limits, so that it stays
+// bounded across runs; once a limit is reached nothing more is saved until
+// old files are removed.
+type artifactStore struct {
+	dir      string
+	maxFiles int
+	maxBytes int64
+
+	mu    sync.Mutex
+	files int
+	bytes int64
+	full  bool // a limit was reached, logged once
+}
+
+// newArtifactStore returns the artifact store of cfg, nil without
+// -artifacts-dir.
+func newArtifactStore(cfg *Config) (*artifactStore, error) {
+	if cfg.ArtifactsDir == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(cfg.ArtifactsDir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create artifacts directory: %v", err)
+	}
+	a := &artifactStore{
+		dir:      cfg.ArtifactsDir,
+		maxFiles: cfg.ArtifactsMaxFiles,
+		maxBytes: int64(cfg.ArtifactsMaxSize) << 20,
+	}
+	err := filepath.WalkDir(a.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		a.files++
+		a.bytes += info.Size()
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read artifacts directory: %v", err)
+	}
+	return a, nil
+}
+
+// capture saves the screenshot, when the page was rendered in a browser
+// session, and the source of the page last loaded by ex under name. It
+// returns the paths of the files saved, which is fewer than two when a limit
+// was reached or the page could not be read.
+func (a *artifactStore) capture(ctx context.Context, ex Extractor, name string) []string {
+	if a == nil {
+		return nil
+	}
+	base := filepath.Join(a.dir, fmt.Sprintf("%s-%s", artifactName(name), time.Now().UTC().Format("20060102T150405.000Z")))
+	var paths []string
+	if wd := ex.browser(); wd != nil {
+		if png, err := wd.Screenshot(); err != nil {
+			slog.WarnContext(ctx, "Failed to take screenshot", "err", err)
+		} else if a.save(ctx, base+".png", png) {
+			paths = append(paths, base+".png")
+		}
+	}
+	if source, err := ex.pageSource(); err != nil {
+		slog.WarnContext(ctx, "Failed to read page source", "err", err)
+	} else if a.save(ctx, base+".html", []byte(source)) {
+		paths = append(paths, base+".html")
+	}
+	return paths
+}
+
+// save writes data to path if it fits within the limits.
+func (a *artifactStore) save(ctx context.Context, path string, data []byte) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if (a.maxFiles > 0 && a.files >= a.maxFiles) || (a.maxBytes > 0 && a.bytes+int64(len(data)) > a.maxBytes) {
+		if !a.full {
+			a.full = true
+			slog.WarnContext(ctx, "Artifacts directory is full, no more page snapshots are saved", "dir", a.dir, "files", a.files, "bytes", a.bytes)
+		}
+		return false
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		slog.WarnContext(ctx, "Failed to save page snapshot", "path", path, "err", err)
+		return false
+	}
+	a.files++
+	a.bytes += int64(len(data))
+	return true
+}
+
+// artifactName makes name safe to use in a file name.
+func artifactName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == ':' || r < ' ' {
+			return '_'
+		}
+		return r
+	}, name)
+	if name == "" {
+		return "unknown"
+	}
+	return name
+}
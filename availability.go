@@ -0,0 +1,135 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Availability values of a Product.
+const (
+	availabilityInStock      = "in_stock"
+	availabilityOutOfStock   = "out_of_stock"
+	availabilityComingSoon   = "coming_soon"
+	availabilityDiscontinued = "discontinued"
+)
+
+var (
+	comingSoonMarkers   = []string{"発売予定", "近日発売", "coming soon", "発売開始"}
+	discontinuedMarkers = []string{"販売終了", "取り扱い終了", "取扱終了"}
+	outOfStockMarkers   = []string{"再入荷", "在庫なし", "在庫切れ", "sold out", "売り切れ"}
+)
+
+// purchaseAreaSelector matches the purchase button and the status banners
+// shown around it.
+const purchaseAreaSelector = ".articlePurchaseBox, .purchaseBox, .comingSoonMessage, .restockMessage, .soldOutMessage"
+
+// addToCartSelector matches the purchase button.
+const addToCartSelector = ".addToCartButton, .test-addToCart, button[class*='addToCart']"
+
+var (
+	releaseDateKanjiPattern = regexp.MustCompile(`(\d{4})年\s*(\d{1,2})月\s*(\d{1,2})日`)
+	releaseDateSlashPattern = regexp.MustCompile(`(?:(\d{4})[/.-])?(\d{1,2})[/.-](\d{1,2})`)
+	releaseTimePattern      = regexp.MustCompile(`(\d{1,2}):(\d{2})`)
+)
+
+// scrapeAvailability works out whether the product can be bought from the
+// purchase button, the banners around it and the size buttons, and the
+// announced release date of a product that is not on sale yet.
+func scrapeAvailability(dom DOM, sizes []SizeOption) (string, *time.Time) {
+	var texts []string
+	if elems, err := dom.findElements(purchaseAreaSelector); err == nil {
+		for _, elem := range elems {
+			if text, err := elem.text(); err == nil {
+				texts = append(texts, text)
+			}
+		}
+	}
+
+	buttonEnabled := false
+	if button, err := findElement(dom, addToCartSelector); err == nil {
+		if disabled, _ := button.attr("disabled"); disabled != "true" {
+			class, _ := button.attr("class")
+			buttonEnabled = !strings.Contains(strings.ToLower(class), "disabled")
+		}
+		if text, err := button.text(); err == nil {
+			texts = append(texts, text)
+		}
+	}
+
+	statusText := strings.Join(texts, "\n")
+	availability := classifyAvailability(statusText, buttonEnabled, sizes)
+	if availability == availabilityComingSoon {
+		if date, ok := parseReleaseDate(statusText, time.Now()); ok {
+			return availability, &date
+		}
+	}
+	return availability, nil
+}
+
+// classifyAvailability derives the availability of a product from the text of
+// its purchase area, the state of the purchase button and its sizes.
+func classifyAvailability(statusText string, buttonEnabled bool, sizes []SizeOption) string {
+	lower := strings.ToLower(statusText)
+	switch {
+	case containsAny(lower, comingSoonMarkers):
+		return availabilityComingSoon
+	case containsAny(lower, discontinuedMarkers):
+		return availabilityDiscontinued
+	}
+
+	anyInStock := false
+	for _, size := range sizes {
+		if size.InStock {
+			anyInStock = true
+			break
+		}
+	}
+	if containsAny(lower, outOfStockMarkers) && !anyInStock {
+		return availabilityOutOfStock
+	}
+	if len(sizes) > 0 && !anyInStock {
+		return availabilityOutOfStock
+	}
+	if len(sizes) == 0 && !buttonEnabled {
+		return availabilityOutOfStock
+	}
+	return availabilityInStock
+}
+
+// parseReleaseDate finds a release date such as "2024年3月1日" or "3/1(金)
+// 10:00" in text. Dates without a year are taken to be the next occurrence
+// after now.
+func parseReleaseDate(text string, now time.Time) (time.Time, bool) {
+	now = now.In(jst)
+	var year, month, day int
+	if m := releaseDateKanjiPattern.FindStringSubmatch(text); m != nil {
+		year, _ = strconv.Atoi(m[1])
+		month, _ = strconv.Atoi(m[2])
+		day, _ = strconv.Atoi(m[3])
+	} else if m := releaseDateSlashPattern.FindStringSubmatch(text); m != nil {
+		year, _ = strconv.Atoi(m[1])
+		month, _ = strconv.Atoi(m[2])
+		day, _ = strconv.Atoi(m[3])
+	} else {
+		return time.Time{}, false
+	}
+	if month < 1 || month > 12 || day < 1 || day > 31 {
+		return time.Time{}, false
+	}
+
+	hour, minute := 0, 0
+	if m := releaseTimePattern.FindStringSubmatch(text); m != nil {
+		hour, _ = strconv.Atoi(m[1])
+		minute, _ = strconv.Atoi(m[2])
+	}
+
+	if year == 0 {
+		year = now.Year()
+		if time.Date(year, time.Month(month), day, hour, minute, 0, 0, jst).Before(now.AddDate(0, 0, -1)) {
+			year++
+		}
+	}
+	return time.Date(year, time.Month(month), day, hour, minute, 0, 0, jst).UTC(), true
+}
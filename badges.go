@@ -0,0 +1,113 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Badges of listing cards and product pages, as stored. A badge the shop
+// shows under a label of none of them is stored as shown.
+const (
+	badgeNew         = "new"
+	badgeLimited     = "limited"
+	badgeOnlineOnly  = "online_only"
+	badgeMembersOnly = "members_only"
+	badgeSale        = "sale"
+)
+
+// Selectors of the badges of a listing card and of a product page.
+const (
+	listingBadgeSelector = ".articleDisplayCard-badge, .articleDisplayCard-children .badge"
+	productBadgeSelector = ".articleInformation .badge, .articleBadge, .test-articleBadge"
+)
+
+// badgeLabels map the labels the shop shows, normalized by badgeKey, to the
+// badges they stand for. A label stands for a badge when it contains its
+// text, or is it for an exact one: NEW is also part of longer words. They are
+// tried in order, so that オンライン限定 is online_only before 限定 makes it
+// limited.
+var badgeLabels = []struct {
+	text  string
+	exact bool
+	badge string
+}{
+	{"ONLINEONLY", false, badgeOnlineOnly},
+	{"ONLINEEXCLUSIVE", false, badgeOnlineOnly},
+	{"オンライン限定", false, badgeOnlineOnly},
+	{"オンラインストア限定", false, badgeOnlineOnly},
+	{"MEMBERSONLY", false, badgeMembersOnly},
+	{"MEMBEREXCLUSIVE", false, badgeMembersOnly},
+	{"会員限定", false, badgeMembersOnly},
+	{"ADICLUB限定", false, badgeMembersOnly},
+	{"限定", false, badgeLimited},
+	{"LIMITED", false, badgeLimited},
+	{"NEW", true, badgeNew},
+	{"NEWARRIVAL", true, badgeNew},
+	{"新商品", false, badgeNew},
+	{"新着", false, badgeNew},
+	{"%OFF", false, badgeSale},
+	{"SALE", false, badgeSale},
+	{"セール", false, badgeSale},
+}
+
+// saleBadgePattern matches the discount of a badge such as 30%OFF, once
+// normalized by badgeKey.
+var saleBadgePattern = regexp.MustCompile(`(\d+(?:\.\d+)?)%OFF`)
+
+// badgeKey normalizes a badge label for matching: full-width letters, digits
+// and signs become their ASCII forms, letters are upper-cased and white space
+// is dropped.
+func badgeKey(label string) string {
+	return strings.Join(strings.Fields(strings.ToUpper(norm.NFKC.String(label))), "")
+}
+
+// normalizeBadge returns the badge label stands for, or label itself with its
+// white space collapsed when it is of no known badge.
+func normalizeBadge(label string) string {
+	key := badgeKey(label)
+	for _, l := range badgeLabels {
+		if key == l.text || !l.exact && strings.Contains(key, l.text) {
+			return l.badge
+		}
+	}
+	return strings.Join(strings.Fields(label), " ")
+}
+
+// normalizeBadges returns the badges of labels, each once, in the order they
+// are first shown.
+func normalizeBadges(labels []string) []string {
+	var badges []string
+	seen := make(map[string]bool)
+	for _, label := range labels {
+		badge := normalizeBadge(label)
+		if badge == "" || seen[badge] {
+			continue
+		}
+		seen[badge] = true
+		badges = append(badges, badge)
+	}
+	return badges
+}
+
+// saleBadgePercent returns the discount a badge of labels shows, such as 30
+// for 30%OFF, and false when none shows one.
+func saleBadgePercent(labels []string) (float64, bool) {
+	for _, label := range labels {
+		if match := saleBadgePattern.FindStringSubmatch(badgeKey(label)); match != nil {
+			percent, err := strconv.ParseFloat(match[1], 64)
+			if err == nil && percent > 0 && percent < 100 {
+				return percent, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// extractBadges reads the badge labels of dom, the badges of a product page
+// or of a listing card, without normalizing them.
+func extractBadges(dom DOM, selector string) ([]string, error) {
+	return elementTexts(dom, selector)
+}
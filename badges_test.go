@@ -0,0 +1,103 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestNormalizeBadge(t *testing.T) {
+	tests := []struct {
+		label, want string
+	}{
+		{"オンライン限定", badgeOnlineOnly},
+		{"オンラインストア限定", badgeOnlineOnly},
+		{"ONLINE ONLY", badgeOnlineOnly},
+		{"Online Exclusive", badgeOnlineOnly},
+		{"限定", badgeLimited},
+		{"数量限定", badgeLimited},
+		{"Limited", badgeLimited},
+		{"会員限定", badgeMembersOnly},
+		{"adiClub限定", badgeMembersOnly},
+		{"ＭＥＭＢＥＲＳ ＯＮＬＹ", badgeMembersOnly},
+		{"NEW", badgeNew},
+		{" new ", badgeNew},
+		{"ＮＥＷ", badgeNew},
+		{"New Arrival", badgeNew},
+		{"新商品", badgeNew},
+		{"NEWS", "NEWS"},
+		{"RENEWAL", "RENEWAL"},
+		{"30%OFF", badgeSale},
+		{"３０％ＯＦＦ", badgeSale},
+		{"セール", badgeSale},
+		{"送料無料  対象", "送料無料 対象"},
+	}
+	for _, tt := range tests {
+		if got := normalizeBadge(tt.label); got != tt.want {
+			t.Errorf("normalizeBadge(%q) = %q, want %q", tt.label, got, tt.want)
+		}
+	}
+}
+
+func TestNormalizeBadges(t *testing.T) {
+	got := normalizeBadges([]string{"NEW", "オンライン限定", "new", "ONLINE ONLY", "30%OFF", "セール"})
+	if want := []string{badgeNew, badgeOnlineOnly, badgeSale}; !slices.Equal(got, want) {
+		t.Errorf("normalizeBadges() = %q, want %q", got, want)
+	}
+}
+
+func TestSaleBadgePercent(t *testing.T) {
+	tests := []struct {
+		labels []string
+		want   float64
+		ok     bool
+	}{
+		{[]string{"30%OFF"}, 30, true},
+		{[]string{"NEW", "３０％ＯＦＦ"}, 30, true},
+		{[]string{"最大 50% OFF"}, 50, true},
+		{[]string{"12.5%OFF"}, 12.5, true},
+		{[]string{"0%OFF", "20%OFF"}, 20, true},
+		{[]string{"100%OFF"}, 0, false},
+		{[]string{"セール"}, 0, false},
+		{nil, 0, false},
+	}
+	for _, tt := range tests {
+		if got, ok := saleBadgePercent(tt.labels); got != tt.want || ok != tt.ok {
+			t.Errorf("saleBadgePercent(%q) = %v, %v, want %v, %v", tt.labels, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+// TestApplySaleBadge checks that a sale badge only counts when the page
+// shows no crossed-out price, which applySalePrice reads first.
+func TestApplySaleBadge(t *testing.T) {
+	type sale struct {
+		original, price int
+		onSale          bool
+		discount        float64
+	}
+	tests := []struct {
+		name         string
+		price        int
+		originalText string
+		labels       []string
+		want         sale
+	}{
+		{"crossed-out price wins", 8470, "¥12,100", []string{"20%OFF"}, sale{12100, 8470, true, 30}},
+		{"badge without a crossed-out price", 8470, "", []string{"NEW", "30%OFF"}, sale{0, 8470, true, 30}},
+		{"no sale", 12100, "", []string{"NEW"}, sale{12100, 0, false, 0}},
+		{"crossed-out price not above the price", 12100, "¥12,100", []string{"30%OFF"}, sale{0, 12100, true, 30}},
+		{"badge without a price", 0, "", []string{"30%OFF"}, sale{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var product Product
+			product.PriceJPY = tt.price
+			applySalePrice(&product, tt.originalText)
+			applySaleBadge(&product, tt.labels)
+			got := sale{product.OriginalPriceJPY, product.SalePriceJPY, product.OnSale, product.DiscountPercent}
+			if got != tt.want {
+				t.Errorf("original, sale price, on sale, discount = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// batchStorage is the Storage handed to the scrape workers. With a batch size
+// above 1 it collects the products they save and writes them with one
+// saveProducts once size products are waiting or interval has passed; each
+// saveProduct returns when its batch has been written. It counts the product
+// writes either way.
+type batchStorage struct {
+	Storage
+	size     int
+	interval time.Duration
+	stats    *crawlStats
+	saves    chan productSave // nil when products are written one by one
+	done     chan struct{}
+}
+
+// productSave is a product waiting in a batch and where to report how
+// saving it went.
+type productSave struct {
+	product *Product
+	result  chan productSaved
+}
+
+type productSaved struct {
+	outcome string
+	err     error
+}
+
+// newBatchStorage wraps store. stop must be called once no more products are
+// saved.
+func newBatchStorage(store Storage, size int, interval time.Duration, stats *crawlStats) *batchStorage {
+	s := &batchStorage{Storage: store, size: size, interval: interval, stats: stats}
+	if size > 1 {
+		s.saves = make(chan productSave)
+		s.done = make(chan struct{})
+		go s.run()
+	}
+	return s
+}
+
+func (s *batchStorage) saveProduct(ctx context.Context, product *Product) (string, error) {
+	if s.saves == nil {
+		s.stats.ProductWrites.Add(1)
+		return s.Storage.saveProduct(ctx, product)
+	}
+	// The batch is written without ctx, which names the worker.
+	stampProduct(ctx, product)
+	save := productSave{product: product, result: make(chan productSaved, 1)}
+	s.saves <- save
+	saved := <-save.result
+	return saved.outcome, saved.err
+}
+
+// run collects the products saved and flushes them until stop.
+func (s *batchStorage) run() {
+	defer close(s.done)
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	var pending []productSave
+	for {
+		select {
+		case save, ok := <-s.saves:
+			if !ok {
+				s.flush(pending)
+				return
+			}
+			pending = append(pending, save)
+			if len(pending) >= s.size {
+				s.flush(pending)
+				pending = nil
+			}
+		case <-ticker.C:
+			s.flush(pending)
+			pending = nil
+		}
+	}
+}
+
+// flush writes pending in one saveProducts. It does not take a context, so
+// that a shutdown does not lose the products already scraped.
+func (s *batchStorage) flush(pending []productSave) {
+	if len(pending) == 0 {
+		return
+	}
+	products := make([]*Product, len(pending))
+	for i, save := range pending {
+		products[i] = save.product
+	}
+	outcomes, errs := s.Storage.saveProducts(context.Background(), products)
+	s.stats.ProductWrites.Add(1)
+	for i, save := range pending {
+		save.result <- productSaved{outcome: outcomes[i], err: errs[i]}
+	}
+}
+
+// stop writes the products still waiting and stops collecting them.
+func (s *batchStorage) stop() {
+	if s.saves == nil {
+		return
+	}
+	close(s.saves)
+	<-s.done
+}
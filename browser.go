@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tebeka/selenium"
+	"github.com/tebeka/selenium/chrome"
+	"github.com/tebeka/selenium/firefox"
+)
+
+// The browsers -browser selects.
+const (
+	browserChrome  = "chrome"
+	browserFirefox = "firefox"
+)
+
+// browserCapabilities returns the capabilities of the browser -browser
+// selects.
+func browserCapabilities(cfg *Config) selenium.Capabilities {
+	if cfg.Browser == browserFirefox {
+		return firefoxCapabilities(cfg)
+	}
+	return chromeCapabilities(cfg)
+}
+
+// firstW3CChromeDriver is the first ChromeDriver major version that reads
+// options from the goog:chromeOptions capability.
+const firstW3CChromeDriver = 75
+
+func chromeCapabilities(cfg *Config) selenium.Capabilities {
+	var args []string
+	if cfg.Headless {
+		args = append(args, "--headless=new", "--no-sandbox", "--disable-gpu")
+	} else {
+		args = append(args, "--start-fullscreen")
+	}
+	args = append(args, "--window-size="+cfg.WindowSize, "--lang="+cfg.AcceptLanguage)
+	// Hide the most obvious signs of an automated browser.
+	args = append(args, "--disable-blink-features=AutomationControlled", "--disable-infobars")
+
+	// The local driver says nothing about the one behind -webdriver-url.
+	key := chrome.CapabilitiesKey
+	w3c := true
+	if cfg.WebDriverURL == "" {
+		if major, ok := localChromeDriverMajorVersion(cfg.ChromeDriverPath); ok && major < firstW3CChromeDriver {
+			slog.Info("ChromeDriver predates goog:chromeOptions, using the legacy chromeOptions capability", "chromedriver_version", major)
+			key = chrome.DeprecatedCapabilitiesKey
+			w3c = false
+		}
+	}
+
+	return selenium.Capabilities{
+		"browserName":      "chrome",
+		"pageLoadStrategy": cfg.PageLoadStrategy,
+		key: chrome.Capabilities{
+			Args:            args,
+			ExcludeSwitches: []string{"enable-automation"},
+			Prefs:           map[string]interface{}{"intl.accept_languages": cfg.AcceptLanguage},
+			W3C:             w3c,
+			Path:            cfg.chromeBinaryPath(),
+		},
+	}
+}
+
+func firefoxCapabilities(cfg *Config) selenium.Capabilities {
+	width, height, _ := strings.Cut(cfg.WindowSize, ",")
+	args := []string{"--width=" + width, "--height=" + height}
+	if cfg.Headless {
+		args = append(args, "-headless")
+	}
+	return selenium.Capabilities{
+		"browserName":      "firefox",
+		"pageLoadStrategy": cfg.PageLoadStrategy,
+		firefox.CapabilitiesKey: firefox.Capabilities{
+			Binary: cfg.firefoxBinaryPath(),
+			Args:   args,
+			Prefs: map[string]interface{}{
+				"intl.accept_languages": cfg.AcceptLanguage,
+				// Hide navigator.webdriver, the most obvious sign of an
+				// automated browser.
+				"dom.webdriver.enabled":  false,
+				"useAutomationExtension": false,
+			},
+		},
+	}
+}
+
+// newWebDriver opens a browser session with the configured timeouts. Implicit
+// waits are disabled so that looking up an optional element that is not on
+// the page fails immediately; waits are always explicit, see waitForElement.
+func newWebDriver(cfg *Config, caps selenium.Capabilities) (selenium.WebDriver, error) {
+	wd, err := selenium.NewRemote(caps, cfg.webDriverURL())
+	if err != nil {
+		return nil, err
+	}
+	if err := wd.SetPageLoadTimeout(cfg.PageLoadTimeout); err != nil {
+		wd.Quit()
+		return nil, fmt.Errorf("failed to set page load timeout: %v", err)
+	}
+	if err := wd.SetImplicitWaitTimeout(0); err != nil {
+		wd.Quit()
+		return nil, fmt.Errorf("failed to set implicit wait timeout: %v", err)
+	}
+	return wd, nil
+}
+
+// isTimeoutError reports whether err is a WebDriver timeout, such as a page
+// that did not finish loading within the page load timeout.
+func isTimeoutError(err error) bool {
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "timeout") || strings.Contains(msg, "timed out")
+}
+
+// chromeDriverMajorVersion runs the driver with --version and returns its
+// major version. Old drivers report versions such as "ChromeDriver 2.46".
+func chromeDriverMajorVersion(path string) (int, bool) {
+	out, err := exec.Command(path, "--version").Output()
+	if err != nil {
+		return 0, false
+	}
+	matches := regexp.MustCompile(`ChromeDriver (\d+)\.`).FindSubmatch(out)
+	if len(matches) < 2 {
+		return 0, false
+	}
+	major, err := strconv.Atoi(string(matches[1]))
+	if err != nil {
+		return 0, false
+	}
+	return major, true
+}
+
+// localChromeDriver holds the major version of the local ChromeDriver, which
+// is asked once per process rather than for every session factory.
+var localChromeDriver struct {
+	once  sync.Once
+	major int
+	ok    bool
+}
+
+// localChromeDriverMajorVersion returns chromeDriverMajorVersion of path, the
+// -chromedriver-path of the run, running the driver only the first time.
+func localChromeDriverMajorVersion(path string) (int, bool) {
+	localChromeDriver.once.Do(func() {
+		localChromeDriver.major, localChromeDriver.ok = chromeDriverMajorVersion(path)
+	})
+	return localChromeDriver.major, localChromeDriver.ok
+}
+
+// sessionErrorMarkers are fragments of WebDriver errors meaning the browser
+// session is gone, so every further command on it would fail as well.
+var sessionErrorMarkers = []string{
+	"invalid session id",
+	"no such session",
+	"session deleted",
+	"chrome not reachable",
+	"connection refused",
+	"connection reset",
+	"broken pipe",
+}
+
+// isSessionError reports whether err means the WebDriver session is dead.
+func isSessionError(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := strings.ToLower(err.Error())
+	for _, marker := range sessionErrorMarkers {
+		if strings.Contains(msg, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// findSessionError returns the first section error caused by a dead session.
+func findSessionError(errs []*SectionError) error {
+	for _, err := range errs {
+		if isSessionError(err.Err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// webDriverStatus is the part of a WebDriver /status response the crawler
+// reads. Selenium Grid 4 and the standalone containers list their nodes and
+// session slots; plain drivers only report readiness.
+type webDriverStatus struct {
+	Value struct {
+		Ready   bool   `json:"ready"`
+		Message string `json:"message"`
+		Nodes   []struct {
+			Availability string `json:"availability"`
+			Slots        []struct {
+				Session *json.RawMessage `json:"session"`
+			} `json:"slots"`
+		} `json:"nodes"`
+	} `json:"value"`
+}
+
+// checkRemoteWebDriver makes sure the WebDriver endpoint at cfg.WebDriverURL
+// is up and, for a grid, has a free session for every session the workers
+// open, see browserSessions.
+func checkRemoteWebDriver(cfg *Config) error {
+	statusURL := strings.TrimSuffix(cfg.WebDriverURL, "/") + "/status"
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(statusURL)
+	if err != nil {
+		return fmt.Errorf("WebDriver endpoint %s is unreachable: %v", cfg.WebDriverURL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("WebDriver endpoint %s answered %s", statusURL, resp.Status)
+	}
+
+	var status webDriverStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return fmt.Errorf("failed to decode %s: %v", statusURL, err)
+	}
+	if !status.Value.Ready {
+		return fmt.Errorf("WebDriver endpoint %s is not ready: %s", cfg.WebDriverURL, status.Value.Message)
+	}
+
+	if len(status.Value.Nodes) == 0 {
+		slog.Info("Using WebDriver endpoint", "url", cfg.WebDriverURL)
+		return nil
+	}
+
+	free := 0
+	for _, node := range status.Value.Nodes {
+		if node.Availability != "" && node.Availability != "UP" {
+			continue
+		}
+		for _, slot := range node.Slots {
+			if slot.Session == nil {
+				free++
+			}
+		}
+	}
+	if free == 0 {
+		return fmt.Errorf("WebDriver grid %s has no free sessions", cfg.WebDriverURL)
+	}
+	if sessions := cfg.browserSessions(); sessions > free {
+		return fmt.Errorf("WebDriver grid %s has %d free sessions, but the workers open up to %d; lower -workers, -discover-workers or -scrape-workers",
+			cfg.WebDriverURL, free, sessions)
+	}
+	slog.Info("Using WebDriver grid", "url", cfg.WebDriverURL, "free_sessions", free)
+	return nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/tebeka/selenium"
+)
+
+const (
+	// maxCarouselClicks bounds how often the next control of a carousel is
+	// clicked, in case it never reports itself disabled.
+	maxCarouselClicks = 20
+	// carouselRenderTimeout is how long to wait for the items revealed by a
+	// click to render.
+	carouselRenderTimeout = 3 * time.Second
+)
+
+// carouselNextSelector matches the next arrow of a product carousel.
+const carouselNextSelector = ".carouselNextButton, .carousel-next, .slick-next, button[class*='next'], button[class*='Next']"
+
+// articleNumberPattern matches an adidas article number such as IP0418.
+var articleNumberPattern = regexp.MustCompile(`^[A-Z0-9]{6}$`)
+
+// expandCarousel clicks the next control of the carousel in container until
+// it is disabled, hidden or no longer reveals new items, so that lazily
+// rendered items get their images and links.
+func expandCarousel(container selenium.WebElement, itemSelector string) {
+	for i := 0; i < maxCarouselClicks; i++ {
+		next, err := container.FindElement(selenium.ByCSSSelector, carouselNextSelector)
+		if err != nil || !carouselControlEnabled(next) {
+			return
+		}
+		before := renderedCarouselItems(container, itemSelector)
+		if err := next.Click(); err != nil {
+			return
+		}
+
+		deadline := time.Now().Add(carouselRenderTimeout)
+		for renderedCarouselItems(container, itemSelector) <= before {
+			if time.Now().After(deadline) {
+				// Every item was already rendered; the carousel only scrolled.
+				break
+			}
+			time.Sleep(scrollPollInterval)
+		}
+	}
+}
+
+// carouselControlEnabled reports whether a carousel arrow can be clicked.
+func carouselControlEnabled(control selenium.WebElement) bool {
+	if displayed, err := control.IsDisplayed(); err != nil || !displayed {
+		return false
+	}
+	disabled, _ := control.GetAttribute("disabled")
+	ariaDisabled, _ := control.GetAttribute("aria-disabled")
+	class, _ := control.GetAttribute("class")
+	return disabled == "" && ariaDisabled != "true" && !strings.Contains(strings.ToLower(class), "disabled")
+}
+
+// renderedCarouselItems counts the items of a carousel whose image has loaded.
+func renderedCarouselItems(container selenium.WebElement, itemSelector string) int {
+	imgs, err := container.FindElements(selenium.ByCSSSelector, itemSelector+" img")
+	if err != nil {
+		return 0
+	}
+	n := 0
+	for _, img := range imgs {
+		if src, _ := img.GetAttribute("src"); src != "" && !strings.HasPrefix(src, "data:") {
+			n++
+		}
+	}
+	return n
+}
+
+// readCarouselItem reads a product tile of a carousel on the page at pageURL.
+func readCarouselItem(item DOMElement, pageURL string) CoordinatedProduct {
+	var coorProduct CoordinatedProduct
+
+	// Get product name and image URL
+	imageURL := ""
+	if imgElement, err := findElement(item, "img"); err == nil {
+		coorProduct.Title, _ = imgElement.attr("alt")
+		imageURL, _ = imgElement.attr("src")
+		coorProduct.Path = resolveURL(pageURL, imageURL)
+	}
+
+	// Get price
+	if priceElement, err := findElement(item, ".price-value"); err == nil {
+		if price, err := priceElement.text(); err == nil {
+			itemText, _ := item.text()
+			coorProduct.PriceInfo, _ = parsePrice(price, itemText)
+		}
+	}
+
+	// Get product page URL, from the tile's own link
+	href, _ := item.attr("href")
+	if href == "" {
+		if linkElement, err := findElement(item, "a"); err == nil {
+			href, _ = linkElement.attr("href")
+		}
+	}
+	coorProduct.ProductURL = resolveURL(pageURL, href)
+	coorProduct.ProductNumber = extractProductNumber(coorProduct.ProductURL)
+
+	// Tiles without a link carry the product number in the image path.
+	if coorProduct.ProductNumber == "" {
+		coorProduct.ProductNumber = articleNumberFromImage(imageURL)
+		if coorProduct.ProductNumber != "" {
+			coorProduct.ProductURL = resolveURL(siteURL, "/products/"+coorProduct.ProductNumber+"/")
+		}
+	}
+
+	return coorProduct
+}
+
+// articleNumberFromImage returns the article number among the path segments
+// of a product image URL, or "" when there is none.
+func articleNumberFromImage(imageURL string) string {
+	for _, part := range strings.Split(imageURL, "/") {
+		if articleNumberPattern.MatchString(part) {
+			return part
+		}
+	}
+	return ""
+}
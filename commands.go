@@ -0,0 +1,1009 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// command is a crawler subcommand. Each command parses its own flags, on top
+// of the shared Config flags.
+type command struct {
+	Name  string
+	Usage string
+	Run   func(ctx context.Context, args []string) error
+}
+
+func commandList() []command {
+	return []command{
+		{"discover", "walk the category listings and store product URLs", runDiscover},
+		{"scrape", "scrape the stored product URLs into the products collection", runScrape},
+		{"export", "write the products to a CSV or Excel file, or a collection to NDJSON", runExport},
+		{"import", "load an NDJSON file written by export back into a collection", runImport},
+		{"init-db", "create the database indexes, optionally removing duplicates first", runInitDB},
+		{"runs", "list recent crawl runs and their counts", runRuns},
+		{"retry-failed", "scrape the product URLs whose last scrape failed again", runRetryFailed},
+		{"history", "print the price and stock changes of a product", runHistory},
+		{"validate", "check the stored products against the required fields and list the least complete", runValidate},
+		{"report", "print the fill rates, prices, duplicates and least complete products of the products collection", runReport},
+		{"diff", "compare the catalog between two runs: new, disappeared and changed products", runDiff},
+		{"scrape-one", "scrape one product URL and report what each section of it gave", runScrapeOne},
+	}
+}
+
+// runCommand dispatches args to the named subcommand. Without a subcommand the
+// crawler behaves as it always has: discover product URLs if none are stored
+// yet, scrape them and export the products to Excel.
+func runCommand(ctx context.Context, args []string) error {
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		for _, cmd := range commandList() {
+			if cmd.Name == args[0] {
+				return cmd.Run(ctx, args[1:])
+			}
+		}
+		return fmt.Errorf("unknown command %q, run with -help for a list of commands", args[0])
+	}
+	return runDefault(ctx, args)
+}
+
+// withResources starts the browser, see withBrowser, and opens the storage,
+// calls fn and releases everything again.
+func withResources(cfg *Config, fn func(store Storage) error) error {
+	return withBrowser(cfg, func() error {
+		return withStorage(cfg, fn)
+	})
+}
+
+// withBrowser starts the Selenium server, or checks the remote WebDriver
+// endpoint when one is configured, calls fn and stops the server again.
+func withBrowser(cfg *Config, fn func() error) error {
+	if cfg.WebDriverURL != "" {
+		if err := checkRemoteWebDriver(cfg); err != nil {
+			return err
+		}
+	} else {
+		if err := prepareLocalDriver(cfg); err != nil {
+			return err
+		}
+		service, err := startSelenium(cfg)
+		if err != nil {
+			return err
+		}
+		defer service.Stop()
+	}
+	return fn()
+}
+
+// withStorage opens the storage, calls fn and closes it again, for commands
+// that need no browser.
+func withStorage(cfg *Config, fn func(store Storage) error) error {
+	store, err := openStorage(cfg)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := store.close(); err != nil {
+			slog.Error("Failed to close storage", "err", err)
+		}
+	}()
+	return fn(store)
+}
+
+// withDatabase connects to MongoDB, calls fn and disconnects again, for
+// commands that work on the collections directly and need no browser.
+func withDatabase(cfg *Config, fn func(productUrlCollection, productCollection *mongo.Collection) error) error {
+	client, err := connectMongo(cfg)
+	if err != nil {
+		return err
+	}
+	defer disconnectMongo(client)
+
+	db := client.Database(cfg.DBName)
+	return fn(db.Collection(cfg.ProductURLCollection), db.Collection(cfg.ProductCollection))
+}
+
+func runDefault(ctx context.Context, args []string) error {
+	cfg := &Config{}
+	fs := newFlagSet("crawler", cfg)
+	flagUsage := fs.Usage
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: crawler [command] [flags]\n\nCommands:\n")
+		for _, cmd := range commandList() {
+			fmt.Fprintf(fs.Output(), "  %-13s %s\n", cmd.Name, cmd.Usage)
+		}
+		fmt.Fprintf(fs.Output(), "\nWithout a command, product URLs are discovered when none are stored yet,\nthen scraped and exported to products.xlsx.\n\n")
+		flagUsage()
+	}
+	var opts daemonOptions
+	daemonMode := fs.Bool("daemon", false, "stay up and crawl on -schedule instead of crawling once")
+	schedule := fs.String("schedule", defaultSchedule, "when daemon runs start, in crontab format: minute hour day-of-month month day-of-week")
+	fs.StringVar(&opts.StatusAddr, "status-addr", "", "address the daemon serves /healthz, /status and POST /run on, e.g. :8080; empty for none")
+	fs.StringVar(&opts.APIAddr, "api-addr", "", "address the /runs API for starting, following and cancelling runs is served on, e.g. :8081; without -daemon, runs start only through it")
+	fs.BoolVar(&opts.CancelOnShutdown, "cancel-on-shutdown", false, "on shutdown, cancel the active daemon run instead of waiting for it to finish")
+	if err := parseConfig(fs, cfg, args); err != nil {
+		return err
+	}
+	if *daemonMode {
+		var err error
+		if opts.Schedule, err = cron.ParseStandard(*schedule); err != nil {
+			return fmt.Errorf("invalid schedule %q: %v", *schedule, err)
+		}
+		return runDaemon(ctx, cfg, opts)
+	}
+	if opts.APIAddr != "" {
+		return runDaemon(ctx, cfg, opts)
+	}
+	if opts.StatusAddr != "" || opts.CancelOnShutdown {
+		return fmt.Errorf("status-addr and cancel-on-shutdown require -daemon or -api-addr")
+	}
+
+	slog.Info("Crawling starting")
+
+	var stats crawlStats
+	err := withResources(cfg, func(store Storage) error {
+		return crawl(ctx, cfg, store, false, &stats)
+	})
+	if err != nil {
+		return err
+	}
+
+	logSummary(ctx, "Crawling", &stats)
+	return nil
+}
+
+// crawl discovers product URLs, when none are stored yet or discoverAlways
+// is set, scrapes the pending ones and exports the products to Excel, as one
+// run. The browser must be running.
+func crawl(ctx context.Context, cfg *Config, store Storage, discoverAlways bool, stats *crawlStats) error {
+	sessions, err := newSessionFactory(cfg, stats)
+	if err != nil {
+		return err
+	}
+	defer sessions.close()
+
+	productURLCount, err := store.countProductURLs(context.Background())
+	if err != nil {
+		return fmt.Errorf("failed to count product URLs: %v", err)
+	}
+
+	err = withRun(ctx, cfg, store, "crawl", stats, func(store Storage, sinks []productSink) error {
+		if productURLCount == 0 || discoverAlways {
+			if err := discover(ctx, cfg, discoverOptions{Sections: cfg.crawlSections()}, sessions, store, stats); err != nil {
+				return err
+			}
+			if ctx.Err() != nil {
+				return nil
+			}
+		}
+		return scrape(ctx, cfg, scrapeOptions{}, sessions, store, sinks, stats)
+	})
+	if err != nil {
+		return err
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+
+	mongoStore, ok := store.(*mongoStorage)
+	if !ok {
+		// Without a database the product files are the output.
+		return nil
+	}
+	exported, err := exportProducts(ctx, mongoStore.products, exportOptions{Format: formatXLSX, Path: "products.xlsx"})
+	if err != nil {
+		return err
+	}
+	slog.Info("Exported products", "products", exported, "path", "products.xlsx")
+	return nil
+}
+
+func runDiscover(ctx context.Context, args []string) error {
+	cfg := &Config{}
+	fs := newFlagSet("crawler discover", cfg)
+	source := fs.String("source", sourceListing, "where to find product URLs: listing walks the category listing pages in the browser, sitemap reads the sitemap over HTTP")
+	categories := fs.String("categories", "", "categories to walk, as a comma-separated list or regular expressions, empty for all")
+	maxPages := fs.Int("max-pages", 0, "maximum number of listing pages per category, 0 for all")
+	if err := parseConfig(fs, cfg, args); err != nil {
+		return err
+	}
+	if *maxPages < 0 {
+		return fmt.Errorf("max-pages must not be negative, got %d", *maxPages)
+	}
+	if *source != sourceListing && *source != sourceSitemap {
+		return fmt.Errorf("unknown source %q, expected %s or %s", *source, sourceListing, sourceSitemap)
+	}
+	filter, err := compileCategoryFilter(*categories)
+	if err != nil {
+		return err
+	}
+	opts := discoverOptions{Source: *source, Sections: cfg.crawlSections(), Categories: filter, MaxPages: *maxPages}
+
+	slog.Info("Discovery starting", "source", opts.Source)
+
+	var stats crawlStats
+	if opts.Source == sourceSitemap {
+		err = withStorage(cfg, func(store Storage) error {
+			return withRun(ctx, cfg, store, "discover", &stats, func(store Storage, _ []productSink) error {
+				return discoverSitemap(ctx, cfg, opts, store, &stats)
+			})
+		})
+	} else {
+		err = withResources(cfg, func(store Storage) error {
+			sessions, err := newSessionFactory(cfg, &stats)
+			if err != nil {
+				return err
+			}
+			defer sessions.close()
+			return withRun(ctx, cfg, store, "discover", &stats, func(store Storage, _ []productSink) error {
+				return discover(ctx, cfg, opts, sessions, store, &stats)
+			})
+		})
+	}
+	if err != nil {
+		return err
+	}
+
+	logSummary(ctx, "Discovery", &stats)
+	return nil
+}
+
+func runScrape(ctx context.Context, args []string) error {
+	cfg := &Config{}
+	fs := newFlagSet("crawler scrape", cfg)
+	categories := fs.String("categories", "", "categories to scrape, as a comma-separated list or regular expressions, empty for all")
+	limit := fs.Int("limit", 0, "maximum number of product URLs to scrape, 0 for all")
+	refreshOlderThan := fs.Duration("refresh-older-than", 0, "instead of the pending product URLs, scrape those whose product is missing or was last scraped longer ago than this, the stalest first, e.g. 72h")
+	urlsFile := fs.String("urls-file", "", "instead of the stored product URLs, scrape the product URLs listed in this file, one per line, or read from stdin with -")
+	force := fs.Bool("force", false, "with -urls-file, also scrape the URLs of products that are already stored")
+	if err := parseConfig(fs, cfg, args); err != nil {
+		return err
+	}
+	if *urlsFile != "" && *refreshOlderThan > 0 {
+		return fmt.Errorf("urls-file and refresh-older-than cannot be combined")
+	}
+	if *force && *urlsFile == "" {
+		return fmt.Errorf("force requires -urls-file")
+	}
+	if *limit < 0 {
+		return fmt.Errorf("limit must not be negative, got %d", *limit)
+	}
+	if *refreshOlderThan < 0 {
+		return fmt.Errorf("refresh-older-than must not be negative, got %v", *refreshOlderThan)
+	}
+	filter, err := compileCategoryFilter(*categories)
+	if err != nil {
+		return err
+	}
+	opts := scrapeOptions{Categories: filter, Limit: *limit}
+
+	slog.Info("Scraping starting")
+
+	var stats crawlStats
+	err = withResources(cfg, func(store Storage) error {
+		sessions, err := newSessionFactory(cfg, &stats)
+		if err != nil {
+			return err
+		}
+		defer sessions.close()
+		return withRun(ctx, cfg, store, "scrape", &stats, func(store Storage, sinks []productSink) error {
+			if *refreshOlderThan > 0 {
+				if opts, err = requeueStale(ctx, store, opts, *refreshOlderThan); err != nil {
+					return err
+				}
+			}
+			if *urlsFile != "" {
+				if opts.Feed, err = loadURLFeed(ctx, store, *urlsFile, *force); err != nil {
+					return err
+				}
+			}
+			return scrape(ctx, cfg, opts, sessions, store, sinks, &stats)
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	logSummary(ctx, "Scraping", &stats)
+	return nil
+}
+
+func runExport(ctx context.Context, args []string) error {
+	cfg := &Config{}
+	fs := newFlagSet("crawler export", cfg)
+	format := fs.String("format", "", "output format, csv, xlsx or ndjson; by default taken from the -out extension")
+	output := fs.String("out", "products.xlsx", "file to write; NDJSON is gzip-compressed when the name ends in .gz")
+	collectionName := fs.String("collection", "products", "collection to export, products or product_urls; product_urls only as ndjson")
+	categories := fs.String("categories", "", "categories to export, as a comma-separated list or regular expressions, empty for all")
+	since := fs.String("since", "", "only export products updated on or after this date, YYYY-MM-DD")
+	until := fs.String("until", "", "only export products updated before this date, YYYY-MM-DD")
+	query := fs.String("query", "", `additional MongoDB filter in extended JSON, e.g. {"on_sale": true}`)
+	if err := parseConfig(fs, cfg, args); err != nil {
+		return err
+	}
+
+	opts := exportOptions{Format: strings.ToLower(*format), Path: *output}
+	if opts.Format == "" {
+		opts.Format = strings.ToLower(strings.TrimPrefix(filepath.Ext(strings.TrimSuffix(*output, ".gz")), "."))
+	}
+	if opts.Format != formatCSV && opts.Format != formatXLSX && opts.Format != formatNDJSON {
+		return fmt.Errorf("unknown export format %q, expected %s, %s or %s", opts.Format, formatCSV, formatXLSX, formatNDJSON)
+	}
+	if _, err := collectionKey(*collectionName); err != nil {
+		return err
+	}
+	if *collectionName != "products" && opts.Format != formatNDJSON {
+		return fmt.Errorf("%s can only be exported as %s", *collectionName, formatNDJSON)
+	}
+
+	filter, err := parseExportQuery(*query)
+	if err != nil {
+		return err
+	}
+	categoryFilter, err := compileCategoryFilter(*categories)
+	if err != nil {
+		return err
+	}
+	if categoryFilter != nil {
+		filter["category"] = bson.M{"$regex": categoryFilter.String()}
+	}
+	updated := bson.M{}
+	for op, value := range map[string]string{"$gte": *since, "$lt": *until} {
+		if value == "" {
+			continue
+		}
+		day, err := time.ParseInLocation(time.DateOnly, value, time.Local)
+		if err != nil {
+			return fmt.Errorf("invalid date %q, expected YYYY-MM-DD", value)
+		}
+		updated[op] = day
+	}
+	if len(updated) > 0 {
+		filter["updated_at"] = updated
+	}
+	opts.Filter = filter
+
+	return withDatabase(cfg, func(productUrlCollection, productCollection *mongo.Collection) error {
+		var exported int
+		var err error
+		switch {
+		case opts.Format == formatNDJSON && *collectionName == "product_urls":
+			exported, err = exportNDJSON(ctx, productUrlCollection, opts.Path, opts.Filter)
+		case opts.Format == formatNDJSON:
+			exported, err = exportNDJSON(ctx, productCollection, opts.Path, opts.Filter)
+		default:
+			exported, err = exportProducts(ctx, productCollection, opts)
+		}
+		if err != nil {
+			return err
+		}
+		slog.Info("Exported collection", "collection", *collectionName, "documents", exported, "path", opts.Path)
+		return nil
+	})
+}
+
+func runImport(ctx context.Context, args []string) error {
+	cfg := &Config{}
+	fs := newFlagSet("crawler import", cfg)
+	input := fs.String("in", "", "NDJSON file to load, gunzipped when the name ends in .gz")
+	collectionName := fs.String("collection", "products", "collection to load into, products or product_urls")
+	if err := parseConfig(fs, cfg, args); err != nil {
+		return err
+	}
+	if *input == "" {
+		return fmt.Errorf("in must name the file to import")
+	}
+	key, err := collectionKey(*collectionName)
+	if err != nil {
+		return err
+	}
+
+	return withDatabase(cfg, func(productUrlCollection, productCollection *mongo.Collection) error {
+		collection := productCollection
+		ensureIndexes := ensureProductIndexes
+		if *collectionName == "product_urls" {
+			collection = productUrlCollection
+			ensureIndexes = ensureProductURLIndexes
+		}
+		if err := ensureIndexes(ctx, collection); err != nil {
+			return err
+		}
+		inserted, replaced, err := importNDJSON(ctx, collection, *input, key)
+		if err != nil {
+			return err
+		}
+		slog.Info("Imported collection", "path", *input, "collection", collection.Name(), "new", inserted, "replaced", replaced)
+		return nil
+	})
+}
+
+func runInitDB(ctx context.Context, args []string) error {
+	cfg := &Config{}
+	fs := newFlagSet("crawler init-db", cfg)
+	dedupe := fs.Bool("dedupe", false, "first delete product URLs and products stored twice, keeping the newest, so the unique indexes can be built")
+	if err := parseConfig(fs, cfg, args); err != nil {
+		return err
+	}
+
+	return withStorage(cfg, func(store Storage) error {
+		if *dedupe {
+			mongoStore, ok := store.(*mongoStorage)
+			if !ok {
+				return fmt.Errorf("dedupe only applies to MongoDB, the other storages cannot store duplicates")
+			}
+			if err := mongoStore.dedupe(ctx); err != nil {
+				return err
+			}
+		}
+		if err := store.prepare(ctx); err != nil {
+			return err
+		}
+		slog.Info("Database initialized")
+		return nil
+	})
+}
+
+func runRuns(ctx context.Context, args []string) error {
+	cfg := &Config{}
+	fs := newFlagSet("crawler runs", cfg)
+	limit := fs.Int("limit", 20, "number of runs to list, the most recent first")
+	if err := parseConfig(fs, cfg, args); err != nil {
+		return err
+	}
+	if *limit <= 0 {
+		return fmt.Errorf("limit must be greater than 0, got %d", *limit)
+	}
+
+	return withStorage(cfg, func(store Storage) error {
+		runs, err := store.recentRuns(ctx, *limit)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "RUN ID\tCOMMAND\tSTARTED\tDURATION\tSTATUS\tDISCOVERED\tSCRAPED\tNEW\tCHANGED\tUNCHANGED\tFAILED")
+		for _, run := range runs {
+			duration := "-"
+			if !run.FinishedAt.IsZero() {
+				duration = (time.Duration(run.DurationSeconds) * time.Second).String()
+			}
+			products, created, unchanged := run.Stats["products"], run.Stats["new_products"], run.Stats["unchanged_products"]
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\t%d\t%d\t%d\t%d\t%d\n",
+				run.ID, run.Command, run.StartedAt.Local().Format("2006-01-02 15:04:05"), duration, run.Status,
+				run.Stats["product_urls"], products, created, products-created-unchanged, unchanged, run.Stats["failed"])
+		}
+		return w.Flush()
+	})
+}
+
+func runHistory(ctx context.Context, args []string) error {
+	cfg := &Config{}
+	fs := newFlagSet("crawler history", cfg)
+	// The product number may come before or after the flags.
+	var productNumber string
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		productNumber, args = args[0], args[1:]
+	}
+	if err := parseConfig(fs, cfg, args); err != nil {
+		return err
+	}
+	if productNumber == "" {
+		productNumber = fs.Arg(0)
+	}
+	if productNumber == "" {
+		return fmt.Errorf("usage: crawler history <product number> [flags]")
+	}
+
+	return withStorage(cfg, func(store Storage) error {
+		entries, err := store.productHistory(ctx, productNumber)
+		if err != nil {
+			return err
+		}
+		if len(entries) == 0 {
+			slog.Info("No recorded changes", "product_number", productNumber)
+			return nil
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "CHANGED\tFIELD\tOLD\tNEW\tRUN ID")
+		for _, e := range entries {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n",
+				e.ChangedAt.Local().Format("2006-01-02 15:04:05"), e.Field, historyValue(e.Old), historyValue(e.New), e.RunID)
+		}
+		return w.Flush()
+	})
+}
+
+// historyValue formats a value of a historyEntry, with - for a size that was
+// not offered.
+func historyValue(v any) string {
+	if v == nil {
+		return "-"
+	}
+	return fmt.Sprint(v)
+}
+
+func runValidate(ctx context.Context, args []string) error {
+	cfg := &Config{}
+	fs := newFlagSet("crawler validate", cfg)
+	limit := fs.Int("limit", 20, "number of the least complete products to list")
+	if err := parseConfig(fs, cfg, args); err != nil {
+		return err
+	}
+	if *limit < 0 {
+		return fmt.Errorf("limit must not be negative, got %d", *limit)
+	}
+
+	// Only what is listed is kept of each product.
+	type offender struct {
+		productNumber string
+		url           string
+		score         float64
+		missing       []string
+	}
+	required := splitList(cfg.RequiredFields)
+	var offenders []offender
+	var products, incomplete int
+	var scores float64
+	missingCounts := make(map[string]int)
+	err := withStorage(cfg, func(store Storage) error {
+		return store.eachProduct(ctx, func(product *Product) bool {
+			products++
+			score := completenessScore(product)
+			scores += score
+			missing := missingFields(product, completenessFields)
+			for _, name := range missing {
+				missingCounts[name]++
+			}
+			if len(missingFields(product, required)) > 0 {
+				incomplete++
+			}
+			offenders = append(offenders, offender{product.ProductNumber, product.ProductURL, score, missing})
+			return ctx.Err() == nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	if products == 0 {
+		slog.Info("No stored products")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "products\t%d\n", products)
+	fmt.Fprintf(w, "missing a required field\t%d\t(%s)\n", incomplete, strings.Join(required, ", "))
+	fmt.Fprintf(w, "average completeness\t%.3f\n", scores/float64(products))
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "FIELD\tMISSING")
+	for _, name := range completenessFields {
+		fmt.Fprintf(w, "%s\t%d\n", name, missingCounts[name])
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	slices.SortStableFunc(offenders, func(a, b offender) int {
+		return cmp.Compare(a.score, b.score)
+	})
+	offenders = offenders[:min(*limit, len(offenders))]
+	if len(offenders) == 0 || offenders[0].score == 1 {
+		return nil
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "PRODUCT NUMBER\tSCORE\tMISSING\tURL")
+	for _, o := range offenders {
+		if o.score == 1 {
+			break
+		}
+		fmt.Fprintf(w, "%s\t%.3f\t%s\t%s\n", o.productNumber, o.score, strings.Join(o.missing, ","), o.url)
+	}
+	return w.Flush()
+}
+
+func runReport(ctx context.Context, args []string) error {
+	cfg := &Config{}
+	fs := newFlagSet("crawler report", cfg)
+	format := fs.String("format", "text", "output format, text or json")
+	runID := fs.String("run", "", "only report on the products last scraped by this run")
+	categories := fs.String("categories", "", "categories to report on, as a comma-separated list or regular expressions, empty for all")
+	if err := parseConfig(fs, cfg, args); err != nil {
+		return err
+	}
+	if *format != "text" && *format != "json" {
+		return fmt.Errorf("format must be text or json, got %q", *format)
+	}
+	filter := bson.M{}
+	if *runID != "" {
+		filter["run_id"] = *runID
+	}
+	categoryFilter, err := compileCategoryFilter(*categories)
+	if err != nil {
+		return err
+	}
+	if categoryFilter != nil {
+		filter["category"] = bson.M{"$regex": categoryFilter.String()}
+	}
+
+	return withStorage(cfg, func(store Storage) error {
+		mongoStore, ok := store.(*mongoStorage)
+		if !ok {
+			return fmt.Errorf("report only applies to MongoDB, see validate for the other storages")
+		}
+		report, err := buildProductReport(ctx, mongoStore, filter)
+		if err != nil {
+			return err
+		}
+		report.RunID, report.Category = *runID, *categories
+		if *format == "json" {
+			return writeIndentedJSON(os.Stdout, report)
+		}
+		return writeReport(os.Stdout, report)
+	})
+}
+
+func runDiff(ctx context.Context, args []string) error {
+	cfg := &Config{}
+	fs := newFlagSet("crawler diff", cfg)
+	fromRef := fs.String("from", "", "run to compare from, a run ID or YYYY-MM-DD for the last run that scraped products by that day")
+	toRef := fs.String("to", "", "run to compare to, as -from; the last run that scraped products by default")
+	format := fs.String("format", "text", "output format, text, json or csv")
+	output := fs.String("out", "", "file to write, stdout by default")
+	if err := parseConfig(fs, cfg, args); err != nil {
+		return err
+	}
+	if *fromRef == "" {
+		return fmt.Errorf("usage: crawler diff -from <run ID|YYYY-MM-DD> [-to <run ID|YYYY-MM-DD>] [flags]")
+	}
+	if *format != "text" && *format != "json" && *format != "csv" {
+		return fmt.Errorf("format must be text, json or csv, got %q", *format)
+	}
+
+	return withStorage(cfg, func(store Storage) error {
+		from, err := resolveDiffRun(ctx, store, *fromRef)
+		if err != nil {
+			return err
+		}
+		var to *crawlRun
+		if *toRef != "" {
+			to, err = resolveDiffRun(ctx, store, *toRef)
+		} else {
+			to, err = store.lastScrapeRun(ctx, time.Now())
+		}
+		if err != nil {
+			return err
+		}
+		if to == nil || !from.StartedAt.Before(to.StartedAt) {
+			return fmt.Errorf("-to must name a run started after run %s", from.ID)
+		}
+		diff, err := buildRunDiff(ctx, store, from, to)
+		if err != nil {
+			return err
+		}
+		if diff.CoverageUnknown {
+			slog.Warn("A run did not record its categories, comparing all of them; products of categories only one run scraped show up as new or disappeared")
+		} else if len(diff.OnlyFrom) > 0 || len(diff.OnlyTo) > 0 {
+			slog.Warn("The runs scraped different categories, comparing the ones both scraped",
+				"only_from", diff.OnlyFrom, "only_to", diff.OnlyTo)
+		}
+
+		out := os.Stdout
+		if *output != "" {
+			if out, err = os.Create(*output); err != nil {
+				return fmt.Errorf("failed to create %s: %v", *output, err)
+			}
+			defer out.Close()
+		}
+		switch *format {
+		case "json":
+			err = writeIndentedJSON(out, diff)
+		case "csv":
+			err = writeRunDiffCSV(out, diff)
+		default:
+			err = writeRunDiff(out, diff)
+		}
+		if err != nil {
+			return err
+		}
+		if out != os.Stdout {
+			return out.Close()
+		}
+		return nil
+	})
+}
+
+func runScrapeOne(ctx context.Context, args []string) error {
+	cfg := &Config{}
+	fs := newFlagSet("crawler scrape-one", cfg)
+	asJSON := fs.Bool("json", false, "print the product and the extraction report as one JSON document instead of the product and a report table")
+	noDB := fs.Bool("no-db", false, "do not save the product")
+	// The URL may come before or after the flags.
+	var url string
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		url, args = args[0], args[1:]
+	}
+	if err := parseConfig(fs, cfg, args); err != nil {
+		return err
+	}
+	if url == "" {
+		url = fs.Arg(0)
+	}
+	if url == "" {
+		return fmt.Errorf("usage: crawler scrape-one <url> [flags]")
+	}
+
+	var product *Product
+	var sectionErrs []*SectionError
+	scrape := func() error {
+		sessions, err := newSessionFactory(cfg, nil)
+		if err != nil {
+			return err
+		}
+		defer sessions.close()
+		if cfg.Engine == engineHTTP {
+			fetcher, err := newHTTPExtractor(cfg, sessions)
+			if err != nil {
+				return err
+			}
+			product, sectionErrs = scrapeProduct(cfg, fetcher, url)
+			product.Proxy = fetcher.proxy
+		}
+		if product == nil || needsBrowser(product, sectionErrs) {
+			if product != nil {
+				slog.Info("Loading the product page in the browser, plain HTTP fell short", "url", url, "page_error", findSectionError(sectionErrs, "page"))
+			}
+			wd, proxy, err := sessions.open()
+			if err != nil {
+				return fmt.Errorf("error connecting to the WebDriver server: %v", err)
+			}
+			defer wd.Quit()
+
+			product, sectionErrs = scrapeProduct(cfg, seleniumExtractor{wd}, url)
+			product.Proxy = proxy
+		}
+		if !cfg.DebugTimings {
+			product.Timings = nil
+		}
+		classifyProduct(product)
+		// The listing section of an ad hoc URL is unknown; the gender is
+		// the closest to it.
+		product.Section = product.Gender
+		if !partialScrape(product) {
+			product.CompletenessScore = completenessScore(product)
+			product.ContentHash = contentHash(product, splitList(cfg.HashExclude))
+		}
+		return nil
+	}
+	save := func(store Storage) error {
+		if err := scrape(); err != nil {
+			return err
+		}
+		if findSectionError(sectionErrs, "page") != nil || product.ProductNumber == "" {
+			slog.Warn("Not saving the product, its page could not be scraped", "url", url)
+			return nil
+		}
+		if missing := missingFields(product, splitList(cfg.RequiredFields)); len(missing) > 0 {
+			slog.Warn("Not saving incomplete product", "url", url, "missing_fields", missing)
+			return nil
+		}
+		outcome, err := store.saveProduct(ctx, product)
+		if err != nil {
+			return fmt.Errorf("failed to save product: %v", err)
+		}
+		logSavedProduct(ctx, product, outcome, sectionErrs)
+		return nil
+	}
+
+	var err error
+	if *noDB {
+		err = withBrowser(cfg, scrape)
+	} else {
+		err = withResources(cfg, save)
+	}
+	if err != nil {
+		return err
+	}
+
+	report := extractionReport(product, sectionErrs)
+	if *asJSON {
+		err = writeIndentedJSON(os.Stdout, struct {
+			Product  *Product        `json:"product"`
+			Sections []sectionResult `json:"sections"`
+		}{product, report})
+	} else {
+		if err = writeIndentedJSON(os.Stdout, product); err == nil {
+			err = writeExtractionReport(os.Stderr, report)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if product.Title == "" || product.PriceText == "" {
+		return fmt.Errorf("no title or price could be extracted from %s", url)
+	}
+	return nil
+}
+
+// writeIndentedJSON writes v to w as indented JSON.
+func writeIndentedJSON(w io.Writer, v any) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	return enc.Encode(v)
+}
+
+func runRetryFailed(ctx context.Context, args []string) error {
+	cfg := &Config{}
+	fs := newFlagSet("crawler retry-failed", cfg)
+	classList := fs.String("classes", "", "error classes to retry, as a comma-separated list of "+strings.Join(failureClasses, ", ")+"; empty for all")
+	limit := fs.Int("limit", 0, "maximum number of failed URLs to retry, 0 for all")
+	if err := parseConfig(fs, cfg, args); err != nil {
+		return err
+	}
+	if *limit < 0 {
+		return fmt.Errorf("limit must not be negative, got %d", *limit)
+	}
+	classes := splitList(*classList)
+	for _, class := range classes {
+		if !slices.Contains(failureClasses, class) {
+			return fmt.Errorf("unknown error class %q, expected one of %s", class, strings.Join(failureClasses, ", "))
+		}
+	}
+
+	slog.Info("Retrying failed product URLs")
+
+	var stats crawlStats
+	err := withResources(cfg, func(store Storage) error {
+		sessions, err := newSessionFactory(cfg, &stats)
+		if err != nil {
+			return err
+		}
+		defer sessions.close()
+		return withRun(ctx, cfg, store, "retry-failed", &stats, func(store Storage, sinks []productSink) error {
+			urls, err := requeueFailures(ctx, store, classes, *limit)
+			if err != nil {
+				return err
+			}
+			if len(urls) == 0 {
+				slog.InfoContext(ctx, "No failed product URLs to retry")
+				return nil
+			}
+			slog.InfoContext(ctx, "Queued failed product URLs", "urls", len(urls))
+			return scrape(ctx, cfg, scrapeOptions{URLs: urls}, sessions, store, sinks, &stats)
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	logSummary(ctx, "Retry", &stats)
+	return nil
+}
+
+// requeueFailures sets up to limit failed URLs of classes, 0 and nil for all,
+// back to pending and returns their URLs.
+func requeueFailures(ctx context.Context, store Storage, classes []string, limit int) (map[string]struct{}, error) {
+	var productURLs []ProductURL
+	err := store.eachFailure(ctx, classes, func(f failedURL) bool {
+		productURLs = append(productURLs, ProductURL{URL: f.URL, Section: f.Section, Category: f.Category, PageNo: f.PageNo})
+		return limit == 0 || len(productURLs) < limit
+	})
+	if err != nil {
+		return nil, err
+	}
+	return requeueProductURLs(ctx, store, productURLs)
+}
+
+// requeueStale sets up to opts.Limit product URLs in opts.Categories whose
+// product was not scraped for longer than olderThan back to pending. It
+// returns the options that scrape them, the stalest first.
+func requeueStale(ctx context.Context, store Storage, opts scrapeOptions, olderThan time.Duration) (scrapeOptions, error) {
+	// Never nil, so that no stale URLs scrapes nothing rather than the
+	// pending product URLs.
+	productURLs := []ProductURL{}
+	err := store.eachStaleProductURL(ctx, opts.Categories, time.Now().Add(-olderThan), opts.Limit, func(u ProductURL) bool {
+		productURLs = append(productURLs, u)
+		return true
+	})
+	if err != nil {
+		return scrapeOptions{}, err
+	}
+	if _, err := requeueProductURLs(ctx, store, productURLs); err != nil {
+		return scrapeOptions{}, err
+	}
+	slog.InfoContext(ctx, "Queued stale product URLs", "urls", len(productURLs), "older_than", olderThan)
+	// The limit was applied when selecting the stale URLs.
+	return scrapeOptions{Feed: productURLs, Stored: true}, nil
+}
+
+// requeueProductURLs sets productURLs back to pending, storing those that
+// were pruned again, and returns their URLs. A URL whose status is not known
+// is set to pending regardless.
+func requeueProductURLs(ctx context.Context, store Storage, productURLs []ProductURL) (map[string]struct{}, error) {
+	urls := make(map[string]struct{}, len(productURLs))
+	for _, productURL := range productURLs {
+		status := productURL.Status
+		productURL.Status = statusPending
+		created, err := store.saveProductURL(ctx, productURL)
+		if err != nil {
+			return nil, fmt.Errorf("failed to queue %s: %v", productURL.URL, err)
+		}
+		if !created && status != statusPending {
+			if err := store.markProductURL(ctx, productURL.URL, statusPending, nil, nil); err != nil {
+				return nil, fmt.Errorf("failed to queue %s: %v", productURL.URL, err)
+			}
+		}
+		urls[productURL.URL] = struct{}{}
+	}
+	return urls, nil
+}
+
+// collectionKey returns the field that identifies the documents of a
+// collection named on the command line, as used by import to upsert them.
+func collectionKey(name string) (string, error) {
+	switch name {
+	case "products":
+		return "product_number", nil
+	case "product_urls":
+		return "url", nil
+	}
+	return "", fmt.Errorf("unknown collection %q, expected products or product_urls", name)
+}
+
+// splitList splits a comma-separated flag value, dropping empty entries.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// crawlSections returns the sections -sections selects.
+func (c *Config) crawlSections() []string {
+	selected, _ := parseSections(c.Sections) // checked by validate
+	return selected
+}
+
+// parseSections validates a -sections value against the known sections.
+func parseSections(s string) ([]string, error) {
+	selected := splitList(s)
+	if len(selected) == 0 {
+		return nil, fmt.Errorf("sections must not be empty")
+	}
+	for _, section := range selected {
+		if !slices.Contains(sections, section) {
+			return nil, fmt.Errorf("unknown section %q, expected one of %s", section, strings.Join(sections, ", "))
+		}
+	}
+	return selected, nil
+}
+
+// compileCategoryFilter turns a -categories value into a regular expression
+// matching whole category names. Each comma-separated entry may itself be a
+// regular expression, so "wear,shoes" and "wear|shoes" are equivalent. An
+// empty value returns nil, meaning no restriction.
+func compileCategoryFilter(s string) (*regexp.Regexp, error) {
+	entries := splitList(s)
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	re, err := regexp.Compile("^(?:" + strings.Join(entries, "|") + ")$")
+	if err != nil {
+		return nil, fmt.Errorf("invalid categories filter %q: %v", s, err)
+	}
+	return re, nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestRequeueStale checks that -refresh-older-than queues again the product
+// URLs whose product was last seen before the cutoff, and only those, and
+// that scrape dispatches them the stalest first.
+func TestRequeueStale(t *testing.T) {
+	ctx := context.Background()
+	store, err := openFileStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.close()
+
+	const (
+		oldURL   = "https://shop.adidas.jp/products/GZ0127/"
+		olderURL = "https://shop.adidas.jp/products/HT3432/"
+		freshURL = "https://shop.adidas.jp/products/IK7351/"
+	)
+	for _, p := range []*Product{
+		{ProductURL: oldURL, ProductNumber: "GZ0127"},
+		{ProductURL: olderURL, ProductNumber: "HT3432"},
+		{ProductURL: freshURL, ProductNumber: "IK7351"},
+	} {
+		if _, err := store.saveProductURL(ctx, ProductURL{Section: "men", Category: "shoes", URL: p.ProductURL, Status: statusPending}); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.markProductURL(ctx, p.ProductURL, statusDone, nil, nil); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.saveProduct(ctx, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The old product was last seen four days ago, the older one five.
+	for productNumber, age := range map[string]time.Duration{"GZ0127": 96 * time.Hour, "HT3432": 120 * time.Hour} {
+		path, err := store.productPath(productNumber)
+		if err != nil {
+			t.Fatal(err)
+		}
+		old, err := store.readProduct(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		old.LastSeenAt = time.Now().UTC().Add(-age)
+		if err := store.writeProduct(path, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	opts, err := requeueStale(ctx, store, scrapeOptions{}, 72*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var feed []string
+	for _, u := range opts.Feed {
+		feed = append(feed, u.URL)
+	}
+	if want := []string{olderURL, oldURL}; !slices.Equal(feed, want) {
+		t.Errorf("requeueStale() feed = %q, want %q, the stalest first", feed, want)
+	}
+	var pending []string
+	store.eachPendingProductURL(ctx, nil, 0, func(u ProductURL) bool {
+		pending = append(pending, u.URL)
+		return true
+	})
+	slices.Sort(pending)
+	if want := []string{oldURL, olderURL}; !slices.Equal(pending, want) {
+		t.Errorf("pending = %q, want the stale URLs queued again", pending)
+	}
+
+	// A single worker loads the pages in the order they are dispatched.
+	cfg := testConfig(t, "-workers=1", "-max-rps=0", "-ignore-robots")
+	stats := &crawlStats{}
+	sessions := newFakeSessions(cfg, stats, nil)
+	defer sessions.close()
+	var mu sync.Mutex
+	var loaded []string
+	sessions.get = func(url string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		loaded = append(loaded, url)
+		return nil
+	}
+	if err := scrape(ctx, cfg, opts, sessions.sessionFactory, store, nil, stats); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{olderURL, oldURL}; !slices.Equal(slices.Compact(loaded), want) {
+		t.Errorf("loaded %q, want %q", loaded, want)
+	}
+	if n, err := store.countPendingProductURLs(ctx, nil); err != nil || n != 0 {
+		t.Errorf("countPendingProductURLs() = %d, %v, want the stale URLs claimed and marked", n, err)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// testConfig returns the default configuration with the given flags set.
+func testConfig(t *testing.T, args ...string) *Config {
+	t.Helper()
+	cfg := &Config{}
+	if err := parseFlags(newFlagSet("test", cfg), args); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func TestEnvName(t *testing.T) {
+	for flagName, want := range map[string]string{
+		"workers":               "ADIDAS_WORKERS",
+		"mongo-uri":             "ADIDAS_MONGO_URI",
+		"challenge-max-backoff": "ADIDAS_CHALLENGE_MAX_BACKOFF",
+	} {
+		if got := envName(flagName); got != want {
+			t.Errorf("envName(%q) = %q, want %q", flagName, got, want)
+		}
+	}
+}
+
+// TestEnvOverrides checks that ADIDAS_* variables override the defaults and
+// that flags given on the command line override both.
+func TestEnvOverrides(t *testing.T) {
+	t.Setenv("ADIDAS_WORKERS", "4")
+	t.Setenv("ADIDAS_PORT", "4445")
+	t.Setenv("ADIDAS_HEADLESS", "false")
+	t.Setenv("ADIDAS_MONGO_URI", "mongodb://db.internal:27017")
+
+	cfg := testConfig(t, "-port=5555")
+	if cfg.NumWorkers != 4 || cfg.Headless || cfg.MongoURI != "mongodb://db.internal:27017" {
+		t.Errorf("workers %d, headless %v, mongo-uri %q, want the environment", cfg.NumWorkers, cfg.Headless, cfg.MongoURI)
+	}
+	if cfg.Port != 5555 {
+		t.Errorf("port = %d, want the flag over ADIDAS_PORT", cfg.Port)
+	}
+	if cfg.DBName != defaultDBName {
+		t.Errorf("db = %q, want the default without an override", cfg.DBName)
+	}
+}
+
+func TestEnvOverrideInvalid(t *testing.T) {
+	t.Setenv("ADIDAS_WORKERS", "four")
+	err := parseFlags(newFlagSet("test", &Config{}), nil)
+	if err == nil || !strings.Contains(err.Error(), "ADIDAS_WORKERS") {
+		t.Errorf("parseFlags() = %v, want an error naming ADIDAS_WORKERS", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		args    []string
+		wantErr string // "" for a valid configuration
+	}{
+		{nil, ""},
+		{[]string{"-port=0"}, "port must be between"},
+		{[]string{"-port=65536"}, "port must be between"},
+		{[]string{"-window-size=1920x1080"}, "window-size"},
+		{[]string{"-browser=safari"}, "browser must be"},
+		{[]string{"-browser=firefox"}, ""},
+		{[]string{"-workers=0"}, "workers must be greater than 0"},
+		{[]string{"-scrape-workers=-1"}, "scrape-workers"},
+		{[]string{"-mongo-uri="}, "mongo-uri"},
+		{[]string{"-mongo-password=secret"}, "need mongo-username"},
+		{[]string{"-output=dir://"}, "output must be"},
+		{[]string{"-output=dir:///tmp/adidas"}, ""},
+		{[]string{"-storage=postgres"}, "postgres-dsn is required"},
+		{[]string{"-storage=postgres", "-postgres-dsn=postgres://localhost/adidas"}, ""},
+		{[]string{"-storage=sqlite"}, "storage must be"},
+		{[]string{"-page-load-strategy=lazy"}, "page-load-strategy"},
+		{[]string{"-wait-timeout=0s"}, "wait-timeout"},
+		{[]string{"-proxy=http://proxy:8080", "-proxy-file=proxies.txt"}, "cannot be used together"},
+	}
+	for _, tt := range tests {
+		cfg := &Config{}
+		if err := parseFlags(newFlagSet("test", cfg), tt.args); err != nil {
+			t.Fatal(err)
+		}
+		err := cfg.validate()
+		switch {
+		case tt.wantErr == "" && err != nil:
+			t.Errorf("validate(%q) = %v, want nil", tt.args, err)
+		case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+			t.Errorf("validate(%q) = %v, want an error containing %q", tt.args, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"reflect"
+	"strings"
+)
+
+// volatileProductFields are always left out of the content hash, since they
+// change with every scrape of an unchanged product.
+var volatileProductFields = []string{"first_crawled_at", "updated_at", "last_seen_at", "content_hash", "run_id", "proxy", "provenance", "crawler_version", "source_worker", "timings", "scraped_sections"}
+
+// contentHash returns the hex SHA-256 of product without the volatile fields
+// and those in exclude, named by their JSON keys. The fields are hashed as JSON
+// with sorted keys, so the hash only changes with the content. It returns ""
+// for a product that cannot be encoded, which then always counts as changed.
+func contentHash(product *Product, exclude []string) string {
+	data, err := json.Marshal(product)
+	if err != nil {
+		return ""
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return ""
+	}
+	for _, name := range volatileProductFields {
+		delete(fields, name)
+	}
+	for _, name := range exclude {
+		delete(fields, name)
+	}
+	normalized, err := json.Marshal(fields)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(normalized)
+	return hex.EncodeToString(sum[:])
+}
+
+// productJSONFields returns the JSON keys of the fields of a Product, for
+// checking -hash-exclude.
+func productJSONFields() []string {
+	var names []string
+	var walk func(t reflect.Type)
+	walk = func(t reflect.Type) {
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+			switch {
+			case field.Anonymous && name == "":
+				walk(field.Type)
+			case name == "":
+				names = append(names, field.Name)
+			case name != "-":
+				names = append(names, name)
+			}
+		}
+	}
+	walk(reflect.TypeOf(Product{}))
+	return names
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/tebeka/selenium"
+)
+
+// cookieJar keeps the cookies of the browser sessions in -cookie-jar across
+// runs, one file per profile, so that a new session resumes as a returning
+// visitor: consent given, bot checks passed. A profile is the browser and
+// proxy of a session, as the shop ties its bot check cookies to both.
+type cookieJar struct {
+	dir string
+	mu  sync.Mutex // serializes the writes of sessions of the same profile
+}
+
+// clearCookiesOnce makes -clear-cookies reset the jar once per process
+// rather than for every command the daemon or API runs.
+var clearCookiesOnce sync.Once
+
+// openCookieJar returns the jar of -cookie-jar, or nil when cookies are not
+// kept.
+func openCookieJar(cfg *Config) (*cookieJar, error) {
+	if cfg.CookieJar == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(cfg.CookieJar, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create cookie jar: %v", err)
+	}
+	jar := &cookieJar{dir: cfg.CookieJar}
+	if cfg.ClearCookies {
+		var err error
+		clearCookiesOnce.Do(func() { err = jar.clear() })
+		if err != nil {
+			return nil, err
+		}
+	}
+	return jar, nil
+}
+
+// clear removes the cookie files of every profile.
+func (j *cookieJar) clear() error {
+	files, err := filepath.Glob(filepath.Join(j.dir, "cookies-*.json"))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if err := os.Remove(file); err != nil {
+			return fmt.Errorf("failed to clear cookie jar: %v", err)
+		}
+	}
+	slog.Info("Cleared cookie jar", "dir", j.dir, "profiles", len(files))
+	return nil
+}
+
+var unsafeProfileChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// path returns the cookie file of the profile of browser and proxy.
+func (j *cookieJar) path(browser, proxy string) string {
+	profile := browser
+	if proxy != "" {
+		profile += "-" + unsafeProfileChars.ReplaceAllString(proxy, "_")
+	}
+	return filepath.Join(j.dir, "cookies-"+profile+".json")
+}
+
+// load returns the stored cookies of the profile, without those that have
+// expired and without session cookies, which a browser drops when it closes.
+func (j *cookieJar) load(browser, proxy string) ([]selenium.Cookie, error) {
+	data, err := os.ReadFile(j.path(browser, proxy))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cookie jar: %v", err)
+	}
+	var stored []selenium.Cookie
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, fmt.Errorf("failed to decode cookie jar %s: %v", j.path(browser, proxy), err)
+	}
+	now := uint(time.Now().Unix())
+	cookies := stored[:0]
+	for _, c := range stored {
+		if c.Expiry > now {
+			cookies = append(cookies, c)
+		}
+	}
+	return cookies, nil
+}
+
+// restore loads the stored cookies of the profile into the session wd. A
+// WebDriver only sets cookies of the site it is on, so the session first
+// opens the shop's robots.txt, the lightest page of the site.
+func (j *cookieJar) restore(wd selenium.WebDriver, browser, proxy string) {
+	cookies, err := j.load(browser, proxy)
+	if err != nil {
+		slog.Warn("Failed to load cookies", "err", err)
+		return
+	}
+	if len(cookies) == 0 {
+		return
+	}
+	if err := wd.Get(siteURL + "/robots.txt"); err != nil {
+		slog.Debug("Failed to open the shop to restore cookies", "err", err)
+		return
+	}
+	restored := 0
+	for i := range cookies {
+		if err := wd.AddCookie(&cookies[i]); err != nil {
+			slog.Debug("Failed to restore cookie", "name", cookies[i].Name, "err", err)
+			continue
+		}
+		restored++
+	}
+	slog.Debug("Restored cookies", "cookies", restored, "proxy", proxy)
+}
+
+// store saves the cookies of the session wd as those of the profile.
+func (j *cookieJar) store(wd selenium.WebDriver, browser, proxy string) {
+	cookies, err := wd.GetCookies()
+	if err != nil {
+		slog.Debug("Failed to read session cookies", "err", err)
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	err = writeFileAtomic(j.path(browser, proxy), func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(cookies)
+	})
+	if err != nil {
+		slog.Warn("Failed to save cookies", "err", err)
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// defaultSchedule starts a daemon run every night at 2:00.
+const defaultSchedule = "0 2 * * *"
+
+// daemonOptions configures the long-running mode started with -daemon or
+// -api-addr.
+type daemonOptions struct {
+	Schedule         cron.Schedule // nil without -daemon, runs are then only started through the API
+	StatusAddr       string
+	APIAddr          string
+	CancelOnShutdown bool
+}
+
+// Daemon states reported on /status.
+const (
+	daemonIdle    = "idle"
+	daemonRunning = "running"
+)
+
+// runFunc does the work of a daemon run, with the browser running.
+type runFunc func(ctx context.Context, store Storage, stats *crawlStats) error
+
+// daemon starts runs on a schedule, on SIGHUP or through the HTTP API, never
+// more than one at a time. A trigger while a run is active is skipped, so
+// overlapping runs cannot fight over the claimed product URLs. The storage is
+// opened once and shared by all runs.
+type daemon struct {
+	cfg   *Config
+	opts  daemonOptions
+	store Storage
+	// runCtx is the parent context of every run: it is only cancelled by a
+	// shutdown with -cancel-on-shutdown.
+	runCtx context.Context
+
+	mu      sync.Mutex
+	active  *crawlRun
+	stats   *crawlStats // of the active run
+	cancel  context.CancelFunc
+	done    chan struct{} // closed when the active run ends
+	last    *crawlRun
+	nextRun time.Time
+}
+
+// runDaemon runs the daemon until ctx is cancelled, then waits for the active
+// run to finish, or cancels it with -cancel-on-shutdown.
+func runDaemon(ctx context.Context, cfg *Config, opts daemonOptions) error {
+	return withStorage(cfg, func(store Storage) error {
+		// Runs outlive a shutdown signal unless -cancel-on-shutdown is set;
+		// a second signal still terminates the process.
+		d := &daemon{cfg: cfg, opts: opts, store: store, runCtx: context.WithoutCancel(ctx)}
+		if opts.CancelOnShutdown {
+			d.runCtx = ctx
+		}
+
+		// Both addresses serve every endpoint, so one given twice is served once.
+		addrs := []string{opts.StatusAddr}
+		if opts.APIAddr != opts.StatusAddr {
+			addrs = append(addrs, opts.APIAddr)
+		}
+		for _, addr := range addrs {
+			if addr == "" {
+				continue
+			}
+			shutdown, err := d.serve(addr)
+			if err != nil {
+				return err
+			}
+			defer shutdown()
+		}
+
+		hangups := make(chan os.Signal, 1)
+		signal.Notify(hangups, syscall.SIGHUP)
+		defer signal.Stop(hangups)
+
+		for {
+			// Without a schedule the timer channel stays nil and never fires.
+			var scheduled <-chan time.Time
+			stopTimer := func() bool { return false }
+			if opts.Schedule != nil {
+				next := opts.Schedule.Next(time.Now())
+				d.mu.Lock()
+				d.nextRun = next
+				d.mu.Unlock()
+				slog.Info("Daemon waiting", "next_run", next.Local().Format(time.RFC3339))
+				timer := time.NewTimer(time.Until(next))
+				scheduled, stopTimer = timer.C, timer.Stop
+			}
+
+			select {
+			case <-ctx.Done():
+				stopTimer()
+				d.wait()
+				return nil
+			case <-scheduled:
+				d.start("schedule", "crawl", d.crawl)
+			case <-hangups:
+				stopTimer()
+				d.start("SIGHUP", "crawl", d.crawl)
+			}
+		}
+	})
+}
+
+// crawl is the run started by the schedule and SIGHUP.
+func (d *daemon) crawl(ctx context.Context, store Storage, stats *crawlStats) error {
+	return crawl(ctx, d.cfg, store, true, stats)
+}
+
+// serve serves the daemon endpoints on addr until the returned function is
+// called.
+func (d *daemon) serve(addr string) (func(), error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to serve on %s: %v", addr, err)
+	}
+	server := &http.Server{Handler: d.handler()}
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("HTTP server stopped", "addr", addr, "err", err)
+		}
+	}()
+	slog.Info("Serving daemon endpoints", "addr", addr)
+	return func() { server.Shutdown(context.Background()) }, nil
+}
+
+// start begins a run of fn, recorded as command, in the background unless a
+// run is active. It returns the new run, or nil and the active one.
+func (d *daemon) start(trigger, command string, fn runFunc) (started, active *crawlRun) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.active != nil {
+		slog.Warn("Skipping run, the previous run is still active", "trigger", trigger, "active_run_id", d.active.ID)
+		return nil, d.progress()
+	}
+
+	start := time.Now().UTC()
+	run := &crawlRun{
+		ID:        newRunID(start),
+		Command:   command,
+		Config:    configSnapshot(d.cfg),
+		StartedAt: start,
+		Status:    runRunning,
+	}
+	stats := &crawlStats{}
+	ctx, cancel := context.WithCancel(withRunID(d.runCtx, run.ID))
+	done := make(chan struct{})
+	d.active, d.stats, d.cancel, d.done = run, stats, cancel, done
+
+	go func() {
+		defer close(done)
+		defer cancel()
+		slog.Info("Run starting", "trigger", trigger, "command", command, "run_id", run.ID)
+		err := withBrowser(d.cfg, func() error {
+			return fn(ctx, d.store, stats)
+		})
+		logSummary(ctx, "Run", stats)
+		if err != nil {
+			slog.Error("Run failed", "run_id", run.ID, "err", err)
+		}
+
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		run.finish(ctx, stats, err)
+		d.last, d.active, d.stats, d.cancel = run, nil, nil, nil
+	}()
+	return d.progress(), nil
+}
+
+// progress returns a copy of the active run with its current counts, or nil.
+// The caller holds d.mu.
+func (d *daemon) progress() *crawlRun {
+	if d.active == nil {
+		return nil
+	}
+	run := *d.active
+	run.Stats = d.stats.snapshot()
+	return &run
+}
+
+// cancelRun cancels the active run if it has the given ID, and reports
+// whether it did.
+func (d *daemon) cancelRun(id string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.active == nil || d.active.ID != id {
+		return false
+	}
+	slog.Info("Cancelling run", "run_id", id)
+	d.cancel()
+	return true
+}
+
+// wait blocks until the active run, if any, has ended.
+func (d *daemon) wait() {
+	d.mu.Lock()
+	active, done := d.active != nil, d.done
+	d.mu.Unlock()
+	if !active {
+		return
+	}
+	if d.opts.CancelOnShutdown {
+		slog.Info("Cancelling the active run")
+	} else {
+		slog.Info("Waiting for the active run to finish, send the signal again to force exit")
+	}
+	<-done
+}
+
+// daemonStatus is the body of /status.
+type daemonStatus struct {
+	State   string     `json:"state"`              // idle or running
+	NextRun *time.Time `json:"next_run,omitempty"` // without -daemon there is no schedule
+	Current *crawlRun  `json:"current,omitempty"`
+	LastRun *crawlRun  `json:"last_run,omitempty"`
+}
+
+func (d *daemon) status() daemonStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	status := daemonStatus{State: daemonIdle, Current: d.progress(), LastRun: d.last}
+	if status.Current != nil {
+		status.State = daemonRunning
+	}
+	if !d.nextRun.IsZero() {
+		next := d.nextRun
+		status.NextRun = &next
+	}
+	return status
+}
+
+// handler serves /healthz for liveness checks, /status with the state of the
+// daemon and its last run, POST /run to start a crawl right away and the
+// /runs API, see apiHandlers.
+func (d *daemon) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("GET /status", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, d.status())
+	})
+	mux.HandleFunc("POST /run", func(w http.ResponseWriter, r *http.Request) {
+		if _, active := d.start("http", "crawl", d.crawl); active != nil {
+			writeJSON(w, http.StatusConflict, d.status())
+			return
+		}
+		writeJSON(w, http.StatusAccepted, d.status())
+	})
+	d.apiHandlers(mux)
+	return mux
+}
+
+// writeJSON writes v as the JSON body of a response with code.
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,453 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"reflect"
+	"slices"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ensureProductURLIndexes creates the unique index on product_urls.url that
+// keeps discovery from storing a product URL twice, and the indexes the
+// pending, stale and per-run selections filter on. Creating an index that
+// exists is a no-op.
+func ensureProductURLIndexes(ctx context.Context, collection *mongo.Collection) error {
+	_, err := collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "url", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return uniqueIndexError(collection, "url", err)
+	}
+	return ensureSecondaryIndexes(ctx, collection, "status", "category", "updated_at", "run_id")
+}
+
+// ensureSecondaryIndexes creates an ascending index on each of fields.
+func ensureSecondaryIndexes(ctx context.Context, collection *mongo.Collection, fields ...string) error {
+	models := make([]mongo.IndexModel, len(fields))
+	for i, field := range fields {
+		models[i] = mongo.IndexModel{Keys: bson.D{{Key: field, Value: 1}}}
+	}
+	if _, err := collection.Indexes().CreateMany(ctx, models); err != nil {
+		return fmt.Errorf("failed to create indexes on %s: %v", collection.Name(), err)
+	}
+	return nil
+}
+
+// uniqueIndexError describes err, the failure to create the unique index on
+// field of collection, pointing to init-db -dedupe when documents sharing a
+// value are in the way.
+func uniqueIndexError(collection *mongo.Collection, field string, err error) error {
+	if mongo.IsDuplicateKeyError(err) {
+		return fmt.Errorf("failed to create unique index on %s.%s, documents with the same %s are stored; remove them with `crawler init-db -dedupe`: %v", collection.Name(), field, field, err)
+	}
+	return fmt.Errorf("failed to create unique index on %s.%s: %v", collection.Name(), field, err)
+}
+
+// dedupeCollection deletes the documents of collection that share a value of
+// field with a newer one, by updated_at and then insertion order, and returns
+// how many were deleted.
+func dedupeCollection(ctx context.Context, collection *mongo.Collection, field string) (int64, error) {
+	cursor, err := collection.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{field: bson.M{"$type": "string"}}}},
+		{{Key: "$sort", Value: bson.D{{Key: "updated_at", Value: -1}, {Key: "_id", Value: -1}}}},
+		{{Key: "$group", Value: bson.M{"_id": "$" + field, "ids": bson.M{"$push": "$_id"}, "count": bson.M{"$sum": 1}}}},
+		{{Key: "$match", Value: bson.M{"count": bson.M{"$gt": 1}}}},
+	}, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return 0, fmt.Errorf("failed to find duplicates in %s: %v", collection.Name(), err)
+	}
+	defer cursor.Close(ctx)
+
+	var deleted int64
+	for cursor.Next(ctx) {
+		var group struct {
+			IDs []any `bson:"ids"`
+		}
+		if err := cursor.Decode(&group); err != nil {
+			return deleted, fmt.Errorf("failed to read duplicates in %s: %v", collection.Name(), err)
+		}
+		res, err := collection.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": group.IDs[1:]}})
+		if err != nil {
+			return deleted, fmt.Errorf("failed to delete duplicates in %s: %v", collection.Name(), err)
+		}
+		deleted += res.DeletedCount
+	}
+	if err := cursor.Err(); err != nil {
+		return deleted, fmt.Errorf("failed to iterate over duplicates in %s: %v", collection.Name(), err)
+	}
+	return deleted, nil
+}
+
+// mongoWriteRetryDelay is the wait before the second attempt of a write; it
+// doubles with every further attempt.
+const mongoWriteRetryDelay = time.Second
+
+// retryWrite calls write up to attempts times while it fails with an error a
+// later attempt may not run into: a network error, a timeout, such as no
+// primary being found during a failover, or an error the server labels
+// retryable. Writes given to it must be safe to repeat.
+func retryWrite(ctx context.Context, attempts int, write func() error) error {
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if attempt > 1 {
+			delay := mongoWriteRetryDelay << (attempt - 2)
+			slog.WarnContext(ctx, "Retrying MongoDB write", "attempt", attempt, "of", attempts, "delay", delay, "err", err)
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return err
+			}
+		}
+		if err = write(); err == nil || !transientMongoError(err) {
+			return err
+		}
+	}
+	return err
+}
+
+// transientMongoError reports whether err is worth retrying, see retryWrite.
+func transientMongoError(err error) bool {
+	if mongo.IsNetworkError(err) || mongo.IsTimeout(err) {
+		return true
+	}
+	var labeled mongo.LabeledError
+	return errors.As(err, &labeled) && labeled.HasErrorLabel("RetryableWriteError")
+}
+
+// saveProductURL stores productURL unless its URL is already known. It
+// reports whether a new document was inserted.
+func saveProductURL(ctx context.Context, collection *mongo.Collection, productURL ProductURL) (bool, error) {
+	stampProductURL(ctx, &productURL, time.Now().UTC())
+	res, err := collection.UpdateOne(ctx,
+		bson.M{"url": productURL.URL},
+		bson.M{"$setOnInsert": productURL},
+		options.Update().SetUpsert(true),
+	)
+	if mongo.IsDuplicateKeyError(err) {
+		// Another worker inserted the same URL between our lookup and insert.
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return res.UpsertedCount > 0, nil
+}
+
+// saveProductURLs stores the product URLs whose URL is not known yet with one
+// unordered bulk write of upserts and returns how many were inserted.
+func saveProductURLs(ctx context.Context, collection *mongo.Collection, productURLs []ProductURL) (int, error) {
+	if len(productURLs) == 0 {
+		return 0, nil
+	}
+	now := time.Now().UTC()
+	writes := make([]mongo.WriteModel, len(productURLs))
+	for i, productURL := range productURLs {
+		stampProductURL(ctx, &productURL, now)
+		writes[i] = mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"url": productURL.URL}).
+			SetUpdate(bson.M{"$setOnInsert": productURL}).
+			SetUpsert(true)
+	}
+	res, err := collection.BulkWrite(ctx, writes, options.BulkWrite().SetOrdered(false))
+	if res == nil {
+		return 0, err
+	}
+	// Duplicate keys are URLs another worker inserted between our lookup
+	// and insert; they are known, and the rest was written.
+	if err != nil && !onlyDuplicateKeys(err) {
+		return int(res.UpsertedCount), err
+	}
+	return int(res.UpsertedCount), nil
+}
+
+// onlyDuplicateKeys reports whether err is a bulk write error whose every
+// write error is a duplicate key.
+func onlyDuplicateKeys(err error) bool {
+	var bulkErr mongo.BulkWriteException
+	if !errors.As(err, &bulkErr) || bulkErr.WriteConcernError != nil || len(bulkErr.WriteErrors) == 0 {
+		return false
+	}
+	for _, writeErr := range bulkErr.WriteErrors {
+		if !mongo.IsDuplicateKeyError(writeErr) {
+			return false
+		}
+	}
+	return true
+}
+
+// ensureProductIndexes creates the unique index on products.product_number
+// used as the upsert key, and the indexes the stale selection, exports and
+// per-run lookups use. Documents stored before product numbers were recorded
+// lack the field and are left out of the unique index.
+func ensureProductIndexes(ctx context.Context, collection *mongo.Collection) error {
+	_, err := collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "product_number", Value: 1}},
+		Options: options.Index().
+			SetUnique(true).
+			SetPartialFilterExpression(bson.M{"product_number": bson.M{"$type": "string"}}),
+	})
+	if err != nil {
+		return uniqueIndexError(collection, "product_number", err)
+	}
+	// The stale product URL selection joins the products on their URL,
+	// stored as producturl, and orders them by last_seen_at.
+	return ensureSecondaryIndexes(ctx, collection, "producturl", "last_seen_at", "category", "updated_at", "run_id")
+}
+
+// touchProduct bumps last_seen_at of the stored product when its content hash
+// is the one of product, and reports whether it did. product then takes over
+// the stored timestamps.
+func touchProduct(ctx context.Context, collection *mongo.Collection, product *Product) (bool, error) {
+	if product.ContentHash == "" {
+		return false, nil
+	}
+	product.LastSeenAt = time.Now().UTC()
+	set := scrapedSectionsSet(product)
+	set["last_seen_at"] = product.LastSeenAt
+	var stored Product
+	err := collection.FindOneAndUpdate(ctx,
+		bson.M{"product_number": product.ProductNumber, "content_hash": product.ContentHash},
+		bson.M{"$set": set},
+		options.FindOneAndUpdate().SetProjection(bson.M{"first_crawled_at": 1, "updated_at": 1}),
+	).Decode(&stored)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	product.FirstCrawledAt, product.UpdatedAt = stored.FirstCrawledAt, stored.UpdatedAt
+	return true, nil
+}
+
+// productSet returns the $set of an update that stores product. The times
+// its sections were scraped are set one by one so that those of sections
+// it skipped are kept, and so are the fields of those sections.
+func productSet(product *Product) (bson.M, error) {
+	data, err := bson.Marshal(product)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode product %s: %v", product.ProductNumber, err)
+	}
+	var set bson.M
+	if err := bson.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("failed to encode product %s: %v", product.ProductNumber, err)
+	}
+	for _, name := range skippedFields(product) {
+		delete(set, productBSONKey(name))
+	}
+	delete(set, "scraped_sections")
+	maps.Copy(set, scrapedSectionsSet(product))
+	return set, nil
+}
+
+// productUnset returns the $unset of an update that stores product: the
+// fields set leaves out because product has them empty. Without it a badge,
+// member price or release date the page no longer shows would keep its
+// stored value. The fields of skipped sections are kept, first_crawled_at is
+// only set on insert and scraped_sections is set per section.
+func productUnset(product *Product, set bson.M) bson.M {
+	skipped := skippedFields(product)
+	unset := bson.M{}
+	productType := reflect.TypeOf(Product{})
+	for i := range productType.NumField() {
+		field := productType.Field(i)
+		if field.Anonymous || slices.Contains(skipped, field.Name) {
+			continue
+		}
+		key := productBSONKey(field.Name)
+		if _, ok := set[key]; ok || key == "first_crawled_at" || key == "scraped_sections" {
+			continue
+		}
+		unset[key] = ""
+	}
+	return unset
+}
+
+// productUpdate returns the update that stores product, inserting it with
+// now as its first crawl time when it is new.
+func productUpdate(product *Product, now time.Time) (bson.M, error) {
+	set, err := productSet(product)
+	if err != nil {
+		return nil, err
+	}
+	update := bson.M{
+		"$set":         set,
+		"$setOnInsert": bson.M{"first_crawled_at": now},
+	}
+	if unset := productUnset(product, set); len(unset) > 0 {
+		update["$unset"] = unset
+	}
+	return update, nil
+}
+
+// scrapedSectionsSet returns the $set fields of the times the sections of
+// product were scraped.
+func scrapedSectionsSet(product *Product) bson.M {
+	set := make(bson.M, len(product.ScrapedSections))
+	for section, at := range product.ScrapedSections {
+		set["scraped_sections."+section] = at
+	}
+	return set
+}
+
+// historyProjection selects the fields of a stored product that
+// productChanges compares.
+var historyProjection = bson.M{"price_jpy": 1, "on_sale": 1, "availability": 1, "title": 1, "description": 1, "size_options": 1}
+
+// saveProduct inserts product or refreshes the stored document with the same
+// product number. An update rather than a ReplaceOne is used so that the
+// fields of the sections a partial scrape skipped are kept, see
+// productUpdate. It returns the fields of historyProjection as they were
+// stored before, or nil when the product was new.
+func saveProduct(ctx context.Context, collection *mongo.Collection, product *Product) (*Product, error) {
+	if product.ProductNumber == "" {
+		return nil, fmt.Errorf("product %s has no product number", product.ProductURL)
+	}
+
+	now := time.Now().UTC()
+	product.FirstCrawledAt = time.Time{}
+	product.UpdatedAt = now
+	product.LastSeenAt = now
+	stampProduct(ctx, product)
+
+	update, err := productUpdate(product, now)
+	if err != nil {
+		return nil, err
+	}
+	var stored Product
+	err = collection.FindOneAndUpdate(ctx,
+		bson.M{"product_number": product.ProductNumber},
+		update,
+		options.FindOneAndUpdate().
+			SetUpsert(true).
+			SetReturnDocument(options.Before).
+			SetProjection(historyProjection),
+	).Decode(&stored)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &stored, nil
+}
+
+// Status values of a ProductURL as it moves through the scrape phase.
+const (
+	statusPending    = "pending"
+	statusInProgress = "in_progress"
+	statusDone       = "done"
+	statusFailed     = "failed"
+	// statusComingSoon marks a product that was announced but is not on sale
+	// yet. It is not pending, so it is only scraped again when asked for.
+	statusComingSoon = "coming_soon"
+	// Product URLs that do not lead to a product page.
+	statusNotFound   = "not_found"
+	statusRedirected = "redirected"
+	statusBlocked    = "blocked"
+)
+
+// pendingFilter matches product URLs that still need scraping. Documents
+// discovered before statuses were recorded have no status at all.
+func pendingFilter() bson.M {
+	return bson.M{"status": bson.M{"$in": bson.A{statusPending, nil}}}
+}
+
+// claimProductURL moves url from pending to in_progress. It reports false when
+// the URL was already claimed by another worker or process.
+func claimProductURL(ctx context.Context, collection *mongo.Collection, url string) (bool, error) {
+	filter := pendingFilter()
+	filter["url"] = url
+	now := time.Now().UTC()
+	err := collection.FindOneAndUpdate(ctx, filter, bson.M{
+		"$set": bson.M{
+			"status":          statusInProgress,
+			"claimed_at":      now,
+			"updated_at":      now,
+			"crawler_version": crawlerVersion,
+			"source_worker":   sourceWorker(ctx),
+		},
+	}).Err()
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// markProductURL records the outcome of scraping url. scrapeErr is stored as
+// the error message of a failed URL and cleared otherwise; fields are stored
+// on the document as they are.
+func markProductURL(ctx context.Context, collection *mongo.Collection, url, status string, scrapeErr error, fields bson.M) error {
+	now := time.Now().UTC()
+	set := bson.M{"status": status, "updated_at": now, "crawler_version": crawlerVersion, "source_worker": sourceWorker(ctx)}
+	if urlScraped(status) {
+		set["crawled_at"] = now
+	}
+	for k, v := range fields {
+		set[k] = v
+	}
+	update := bson.M{
+		"$set":   set,
+		"$unset": bson.M{"claimed_at": ""},
+	}
+	if scrapeErr != nil {
+		update["$set"].(bson.M)["error"] = scrapeErr.Error()
+	} else {
+		update["$unset"].(bson.M)["error"] = ""
+	}
+	if status != statusNotFound {
+		// Only consecutive misses count towards -prune-dead.
+		update["$unset"].(bson.M)["not_found_count"] = ""
+	}
+	_, err := collection.UpdateOne(ctx, bson.M{"url": url}, update)
+	return err
+}
+
+// countNotFound increments the number of consecutive scrapes that found no
+// page at url and returns the new count.
+func countNotFound(ctx context.Context, collection *mongo.Collection, url string) (int, error) {
+	var doc struct {
+		NotFoundCount int `bson:"not_found_count"`
+	}
+	err := collection.FindOneAndUpdate(ctx,
+		bson.M{"url": url},
+		bson.M{"$inc": bson.M{"not_found_count": 1}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&doc)
+	if err != nil {
+		return 0, err
+	}
+	return doc.NotFoundCount, nil
+}
+
+// deleteProductURL removes url from the product URLs.
+func deleteProductURL(ctx context.Context, collection *mongo.Collection, url string) error {
+	_, err := collection.DeleteOne(ctx, bson.M{"url": url})
+	return err
+}
+
+// releaseStaleClaims puts product URLs that have been in progress for longer
+// than timeout back to pending. Such claims are left behind by a worker or
+// process that died mid-scrape.
+func releaseStaleClaims(ctx context.Context, collection *mongo.Collection, timeout time.Duration) (int64, error) {
+	res, err := collection.UpdateMany(ctx,
+		bson.M{"status": statusInProgress, "claimed_at": bson.M{"$lt": time.Now().UTC().Add(-timeout)}},
+		bson.M{"$set": bson.M{"status": statusPending, "updated_at": time.Now().UTC()}, "$unset": bson.M{"claimed_at": ""}},
+	)
+	if err != nil {
+		return 0, err
+	}
+	return res.ModifiedCount, nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// detailLabelPattern splits a specification line into its label and value.
+// The value may also follow the label on the next line.
+var detailLabelPattern = regexp.MustCompile(`^\s*(素材|材質|組成|アッパー素材|洗濯表示|お手入れ方法|お手入れ|取り扱い|原産国|生産国|製造国)\s*[:：]?\s*([\s\S]*?)\s*$`)
+
+// detailListSeparators split a materials or care value into its entries.
+var detailListSeparators = regexp.MustCompile(`\s*[、,，/／\n]\s*`)
+
+// productDetails are the labelled lines of the specifications block that have
+// fields of their own.
+type productDetails struct {
+	Materials        []string
+	CareInstructions []string
+	CountryOfOrigin  string
+	Unmatched        []string // lines that are none of the above
+}
+
+// parseProductDetails picks the materials, care instructions and country of
+// origin out of the specification lines.
+func parseProductDetails(lines []string) productDetails {
+	var details productDetails
+	for _, line := range lines {
+		m := detailLabelPattern.FindStringSubmatch(line)
+		if m == nil || strings.TrimSpace(m[2]) == "" {
+			details.Unmatched = append(details.Unmatched, line)
+			continue
+		}
+		switch m[1] {
+		case "素材", "材質", "組成", "アッパー素材":
+			details.Materials = append(details.Materials, splitDetailList(m[2])...)
+		case "洗濯表示", "お手入れ方法", "お手入れ", "取り扱い":
+			details.CareInstructions = append(details.CareInstructions, splitDetailList(m[2])...)
+		case "原産国", "生産国", "製造国":
+			details.CountryOfOrigin = strings.TrimSpace(m[2])
+		}
+	}
+	return details
+}
+
+// splitDetailList splits a materials or care value into its entries.
+func splitDetailList(value string) []string {
+	var items []string
+	for _, item := range detailListSeparators.Split(value, -1) {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// scrapeDetailTable reads the table presentation of the specifications, as
+// used on apparel pages, as "label：value" lines.
+func scrapeDetailTable(dom DOM) []string {
+	var lines []string
+	rows, err := dom.findElements(".description_part table tr, .articleFeatures table tr")
+	if err == nil {
+		for _, row := range rows {
+			labelElement, err := findElement(row, "th")
+			if err != nil {
+				continue
+			}
+			valueElement, err := findElement(row, "td")
+			if err != nil {
+				continue
+			}
+			label, _ := labelElement.text()
+			value, _ := valueElement.text()
+			if label = strings.TrimSpace(label); label != "" {
+				lines = append(lines, label+"："+strings.TrimSpace(value))
+			}
+		}
+	}
+
+	// Every term of a definition list goes with the first definition after it.
+	lists, err := dom.findElements(".description_part dl")
+	if err == nil {
+		for _, list := range lists {
+			items, err := list.findElements("dt, dd")
+			if err != nil {
+				continue
+			}
+			label := ""
+			for _, item := range items {
+				tag, _ := item.tagName()
+				text, _ := item.text()
+				switch {
+				case tag == "dt":
+					label = strings.TrimSpace(text)
+				case label != "":
+					lines = append(lines, label+"："+strings.TrimSpace(text))
+					label = ""
+				}
+			}
+		}
+	}
+	return lines
+}
+
+// TechnologyBadge is a technology or sustainability callout of a product page,
+// such as BOOST or Primegreen.
+type TechnologyBadge struct {
+	Name        string `json:"name" bson:"name"`
+	Description string `json:"description,omitempty" bson:"description,omitempty"`
+	IconURL     string `json:"icon_url,omitempty" bson:"icon_url,omitempty"`
+}
+
+// scrapeTechnologyBadges reads the icon blocks of the technology and
+// sustainability modules, without duplicates.
+func scrapeTechnologyBadges(dom DOM, pageURL string) []TechnologyBadge {
+	badges := []TechnologyBadge{}
+	elems, err := dom.findElements(".tecIconList .tecIconItem, .technologies .technologyItem, .sustainability .sustainabilityItem")
+	if err != nil {
+		return badges
+	}
+
+	seen := make(map[string]bool)
+	for _, elem := range elems {
+		var badge TechnologyBadge
+		if imgElement, err := findElement(elem, "img"); err == nil {
+			badge.Name, _ = imgElement.attr("alt")
+			src, _ := imgElement.attr("src")
+			badge.IconURL = resolveURL(pageURL, src)
+		}
+		if nameElement, err := findElement(elem, ".tecIconTitle, .technologyName, .sustainabilityName"); err == nil {
+			if name, _ := nameElement.text(); strings.TrimSpace(name) != "" {
+				badge.Name = name
+			}
+		}
+		if descriptionElement, err := findElement(elem, ".tecIconText, .technologyDescription, .sustainabilityDescription, p"); err == nil {
+			description, _ := descriptionElement.text()
+			badge.Description = strings.TrimSpace(description)
+		}
+
+		badge.Name = strings.TrimSpace(badge.Name)
+		key := strings.ToLower(badge.Name)
+		if badge.Name == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+		badges = append(badges, badge)
+	}
+	return badges
+}
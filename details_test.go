@@ -0,0 +1,47 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseProductDetails(t *testing.T) {
+	tests := []struct {
+		fixture string
+		want    productDetails
+	}{
+		{"details_apparel_bullets.html", productDetails{
+			Materials:        []string{"綿 100%"},
+			CareInstructions: []string{"洗濯機洗い可", "タンブル乾燥禁止"},
+			CountryOfOrigin:  "ベトナム",
+			Unmatched:        []string{"レギュラーフィット", "商品番号：IC9334"},
+		}},
+		{"details_apparel_table.html", productDetails{
+			Materials:        []string{"ポリエステル 100%（リサイクル素材）"},
+			CareInstructions: []string{"洗濯ネット使用", "裏返して洗濯"},
+			CountryOfOrigin:  "カンボジア",
+			Unmatched:        []string{"フルジップ"},
+		}},
+		{"details_footwear_bullets.html", productDetails{
+			Materials:       []string{"テキスタイル", "合成皮革"},
+			CountryOfOrigin: "インドネシア",
+			Unmatched:       []string{"レースクロージャー"},
+		}},
+		{"details_footwear_table.html", productDetails{
+			Materials:        []string{"天然皮革", "スエード"},
+			CareInstructions: []string{"水洗い不可"},
+			CountryOfOrigin:  "インド",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.fixture, func(t *testing.T) {
+			lines, err := extractSpecifications(loadFixture(t, tt.fixture))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := parseProductDetails(lines); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseProductDetails(%q) = %+v, want %+v", lines, got, tt.want)
+			}
+		})
+	}
+}
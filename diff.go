@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// diffFields are the history fields diff reports, see productChanges.
+var diffFields = []string{"price_jpy", "on_sale", "availability", "title", "description"}
+
+// diffValueLimit is the number of runes a changed value is cut to in the text
+// output.
+const diffValueLimit = 60
+
+// catalogDiff is how the catalog changed from one run to a later one.
+type catalogDiff struct {
+	From diffRun `json:"from"`
+	To   diffRun `json:"to"`
+	// Categories are the categories both runs scraped, which New,
+	// Disappeared and Changes are restricted to; OnlyFrom and OnlyTo are
+	// those scraped by one run only. Without the coverage of both runs,
+	// recorded since the runs count their categories, everything is
+	// compared and CoverageUnknown is set.
+	Categories      []string      `json:"categories,omitempty"`
+	OnlyFrom        []string      `json:"only_from,omitempty"`
+	OnlyTo          []string      `json:"only_to,omitempty"`
+	CoverageUnknown bool          `json:"coverage_unknown,omitempty"`
+	New             []diffProduct `json:"new"`
+	Disappeared     []diffProduct `json:"disappeared"`
+	Changes         []diffChange  `json:"changes"`
+}
+
+type diffRun struct {
+	RunID      string    `json:"run_id"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at,omitempty"`
+}
+
+type diffProduct struct {
+	ProductNumber string `json:"product_number"`
+	Category      string `json:"category"`
+	Title         string `json:"title"`
+	URL           string `json:"url"`
+}
+
+// diffChange is a field of a product that changed between the runs, with its
+// value before the first and after the last change in between.
+type diffChange struct {
+	ProductNumber string `json:"product_number"`
+	Category      string `json:"category"`
+	Field         string `json:"field"`
+	Old           any    `json:"old"`
+	New           any    `json:"new"`
+}
+
+// resolveDiffRun returns the run ref names: a run ID or, as YYYY-MM-DD, the
+// last run that scraped products started on or before that day.
+func resolveDiffRun(ctx context.Context, store Storage, ref string) (*crawlRun, error) {
+	if day, err := time.ParseInLocation(time.DateOnly, ref, time.Local); err == nil {
+		run, err := store.lastScrapeRun(ctx, day.AddDate(0, 0, 1))
+		if err != nil {
+			return nil, err
+		}
+		if run == nil {
+			return nil, fmt.Errorf("no run scraped products on or before %s", ref)
+		}
+		return run, nil
+	}
+	run, err := store.findRun(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	if run == nil {
+		return nil, fmt.Errorf("no run with ID %q", ref)
+	}
+	return run, nil
+}
+
+// buildRunDiff compares the catalog as the from run left it with the catalog
+// as the to run left it. New products are those first crawled after from
+// finished, up to the end of to; disappeared ones were seen since from
+// started but not by to or later, which is exact while to is the last run;
+// changes come from the product history of the runs after from up to to.
+func buildRunDiff(ctx context.Context, store Storage, from, to *crawlRun) (*catalogDiff, error) {
+	diff := &catalogDiff{
+		From:        diffRun{RunID: from.ID, StartedAt: from.StartedAt, FinishedAt: from.FinishedAt},
+		To:          diffRun{RunID: to.ID, StartedAt: to.StartedAt, FinishedAt: to.FinishedAt},
+		New:         []diffProduct{},
+		Disappeared: []diffProduct{},
+		Changes:     []diffChange{},
+	}
+	covered := func(string) bool { return true }
+	if len(from.Categories) == 0 || len(to.Categories) == 0 {
+		diff.CoverageUnknown = true
+	} else {
+		for category := range from.Categories {
+			if _, ok := to.Categories[category]; ok {
+				diff.Categories = append(diff.Categories, category)
+			} else {
+				diff.OnlyFrom = append(diff.OnlyFrom, category)
+			}
+		}
+		for category := range to.Categories {
+			if _, ok := from.Categories[category]; !ok {
+				diff.OnlyTo = append(diff.OnlyTo, category)
+			}
+		}
+		slices.Sort(diff.Categories)
+		slices.Sort(diff.OnlyFrom)
+		slices.Sort(diff.OnlyTo)
+		covered = func(category string) bool {
+			_, ok := slices.BinarySearch(diff.Categories, category)
+			return ok
+		}
+	}
+
+	fromEnd, toEnd := runEnd(from), runEnd(to)
+	categories := make(map[string]string)
+	err := store.eachProduct(ctx, func(p *Product) bool {
+		categories[p.ProductNumber] = p.Category
+		if !covered(p.Category) {
+			return true
+		}
+		product := diffProduct{ProductNumber: p.ProductNumber, Category: p.Category, Title: p.Title, URL: p.ProductURL}
+		switch {
+		case p.FirstCrawledAt.After(fromEnd) && !p.FirstCrawledAt.After(toEnd):
+			diff.New = append(diff.New, product)
+		case !p.LastSeenAt.IsZero() && !p.LastSeenAt.Before(from.StartedAt) && p.LastSeenAt.Before(to.StartedAt):
+			diff.Disappeared = append(diff.Disappeared, product)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	type changeKey struct{ productNumber, field string }
+	changes := make(map[changeKey]int)
+	err = store.eachHistory(ctx, from.ID, to.ID, func(e historyEntry) bool {
+		if !slices.Contains(diffFields, e.Field) {
+			return true
+		}
+		category, ok := categories[e.ProductNumber]
+		if ok && !covered(category) {
+			return true
+		}
+		key := changeKey{e.ProductNumber, e.Field}
+		if i, ok := changes[key]; ok {
+			diff.Changes[i].New = e.New
+			return true
+		}
+		changes[key] = len(diff.Changes)
+		diff.Changes = append(diff.Changes, diffChange{ProductNumber: e.ProductNumber, Category: category, Field: e.Field, Old: e.Old, New: e.New})
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	// A value changed back and forth in between is no change.
+	diff.Changes = slices.DeleteFunc(diff.Changes, func(c diffChange) bool {
+		return fmt.Sprint(c.Old) == fmt.Sprint(c.New)
+	})
+	slices.SortStableFunc(diff.Changes, func(a, b diffChange) int {
+		if c := strings.Compare(a.ProductNumber, b.ProductNumber); c != 0 {
+			return c
+		}
+		return slices.Index(diffFields, a.Field) - slices.Index(diffFields, b.Field)
+	})
+	return diff, nil
+}
+
+// runEnd returns when run finished, now while it is still running.
+func runEnd(run *crawlRun) time.Time {
+	if run.FinishedAt.IsZero() {
+		return time.Now()
+	}
+	return run.FinishedAt
+}
+
+// writeRunDiff writes diff as tables.
+func writeRunDiff(out io.Writer, diff *catalogDiff) error {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "from run %s, started %s\n", diff.From.RunID, diff.From.StartedAt.Local().Format("2006-01-02 15:04:05"))
+	fmt.Fprintf(w, "to run %s, started %s\n", diff.To.RunID, diff.To.StartedAt.Local().Format("2006-01-02 15:04:05"))
+	if diff.CoverageUnknown {
+		fmt.Fprintf(w, "the categories of a run are unknown, all categories are compared\n")
+	} else {
+		fmt.Fprintf(w, "compared categories\t%s\n", listOrNone(diff.Categories))
+		if len(diff.OnlyFrom) > 0 {
+			fmt.Fprintf(w, "only in %s, left out\t%s\n", diff.From.RunID, strings.Join(diff.OnlyFrom, ", "))
+		}
+		if len(diff.OnlyTo) > 0 {
+			fmt.Fprintf(w, "only in %s, left out\t%s\n", diff.To.RunID, strings.Join(diff.OnlyTo, ", "))
+		}
+	}
+
+	for _, section := range []struct {
+		name     string
+		products []diffProduct
+	}{
+		{"new products", diff.New},
+		{"disappeared products", diff.Disappeared},
+	} {
+		fmt.Fprintf(w, "\n%s: %d\n", section.name, len(section.products))
+		if len(section.products) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "  PRODUCT\tCATEGORY\tTITLE\tURL\n")
+		for _, p := range section.products {
+			fmt.Fprintf(w, "  %s\t%s\t%s\t%s\n", p.ProductNumber, p.Category, truncateText(p.Title, diffValueLimit), p.URL)
+		}
+	}
+
+	fmt.Fprintf(w, "\nchanges: %d\n", len(diff.Changes))
+	if len(diff.Changes) > 0 {
+		fmt.Fprintf(w, "  PRODUCT\tCATEGORY\tFIELD\tOLD\tNEW\n")
+	}
+	for _, c := range diff.Changes {
+		fmt.Fprintf(w, "  %s\t%s\t%s\t%s\t%s\n", c.ProductNumber, c.Category, c.Field,
+			truncateText(historyValue(c.Old), diffValueLimit), truncateText(historyValue(c.New), diffValueLimit))
+	}
+	return w.Flush()
+}
+
+// listOrNone joins values, or returns "none".
+func listOrNone(values []string) string {
+	if len(values) == 0 {
+		return "none"
+	}
+	return strings.Join(values, ", ")
+}
+
+// writeRunDiffCSV writes diff as one CSV table with a row per new or
+// disappeared product and per changed field.
+func writeRunDiffCSV(out io.Writer, diff *catalogDiff) error {
+	w := csv.NewWriter(out)
+	w.Write([]string{"change", "product_number", "category", "field", "old", "new", "title", "url"})
+	for _, p := range diff.New {
+		w.Write([]string{"new", p.ProductNumber, p.Category, "", "", "", p.Title, p.URL})
+	}
+	for _, p := range diff.Disappeared {
+		w.Write([]string{"disappeared", p.ProductNumber, p.Category, "", "", "", p.Title, p.URL})
+	}
+	for _, c := range diff.Changes {
+		w.Write([]string{"changed", c.ProductNumber, c.Category, c.Field, csvHistoryValue(c.Old), csvHistoryValue(c.New), "", ""})
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// csvHistoryValue formats a value of a historyEntry, empty for none.
+func csvHistoryValue(v any) string {
+	if v == nil {
+		return ""
+	}
+	return fmt.Sprint(v)
+}
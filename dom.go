@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/tebeka/selenium"
+	"golang.org/x/net/html"
+)
+
+// DOM is a product page, or an element of it, as the selectors read it. It is
+// implemented over the page rendered in a browser session and over the HTML
+// fetched by the HTTP engine, so that scrapeProduct reads both alike.
+type DOM interface {
+	// findElements returns the elements matching a CSS selector, in
+	// document order.
+	findElements(selector string) ([]DOMElement, error)
+}
+
+// DOMElement is an element of a DOM.
+type DOMElement interface {
+	DOM
+	// text returns the text of the element, one line per block.
+	text() (string, error)
+	// tagName returns the lower-case name of the element.
+	tagName() (string, error)
+	// attr returns the value of an attribute, "true" for a boolean
+	// attribute that is set, and an error when the element does not have it.
+	attr(name string) (string, error)
+	// html returns the markup inside the element, unsanitized.
+	html() (string, error)
+}
+
+// findElement returns the first element of dom matching selector.
+func findElement(dom DOM, selector string) (DOMElement, error) {
+	elems, err := dom.findElements(selector)
+	if err != nil {
+		return nil, err
+	}
+	if len(elems) == 0 {
+		return nil, fmt.Errorf("no element matches %q", selector)
+	}
+	return elems[0], nil
+}
+
+// webElement returns the browser element behind el, for what only a browser
+// can do with it such as clicking, or false for an element of fetched HTML.
+func webElement(el DOMElement) (selenium.WebElement, bool) {
+	e, ok := el.(seleniumElement)
+	return e.WebElement, ok
+}
+
+// seleniumDOM is the page loaded in a browser session.
+type seleniumDOM struct {
+	wd selenium.WebDriver
+}
+
+func (d seleniumDOM) findElements(selector string) ([]DOMElement, error) {
+	elems, err := d.wd.FindElements(selenium.ByCSSSelector, selector)
+	return seleniumElements(d.wd, elems), err
+}
+
+// seleniumElement is an element of the page loaded in a browser session.
+type seleniumElement struct {
+	selenium.WebElement
+	wd selenium.WebDriver // session of the page, for reading properties
+}
+
+func seleniumElements(wd selenium.WebDriver, elems []selenium.WebElement) []DOMElement {
+	wrapped := make([]DOMElement, len(elems))
+	for i, elem := range elems {
+		wrapped[i] = seleniumElement{elem, wd}
+	}
+	return wrapped
+}
+
+func (e seleniumElement) findElements(selector string) ([]DOMElement, error) {
+	elems, err := e.FindElements(selenium.ByCSSSelector, selector)
+	return seleniumElements(e.wd, elems), err
+}
+
+func (e seleniumElement) text() (string, error) {
+	return e.Text()
+}
+
+func (e seleniumElement) tagName() (string, error) {
+	tag, err := e.TagName()
+	return strings.ToLower(tag), err
+}
+
+func (e seleniumElement) attr(name string) (string, error) {
+	return e.GetAttribute(name)
+}
+
+// html reads the innerHTML property by script, as GeckoDriver only returns
+// attributes, which innerHTML is not.
+func (e seleniumElement) html() (string, error) {
+	result, err := e.wd.ExecuteScript("return arguments[0].innerHTML;", []any{e.WebElement})
+	if err != nil {
+		return "", err
+	}
+	markup, _ := result.(string)
+	return markup, nil
+}
+
+// booleanAttributes are the attributes whose presence is their value, which a
+// browser reports as "true".
+var booleanAttributes = map[string]bool{"disabled": true, "checked": true, "selected": true, "hidden": true, "readonly": true}
+
+// htmlElement is a document, or an element of one, fetched by the HTTP
+// engine.
+type htmlElement struct {
+	sel *goquery.Selection
+}
+
+func (e htmlElement) findElements(selector string) ([]DOMElement, error) {
+	found := e.sel.Find(selector)
+	elems := make([]DOMElement, found.Length())
+	for i := range elems {
+		elems[i] = htmlElement{found.Eq(i)}
+	}
+	return elems, nil
+}
+
+func (e htmlElement) text() (string, error) {
+	return innerText(e.sel), nil
+}
+
+func (e htmlElement) tagName() (string, error) {
+	return goquery.NodeName(e.sel), nil
+}
+
+func (e htmlElement) attr(name string) (string, error) {
+	value, ok := e.sel.Attr(name)
+	if !ok {
+		return "", fmt.Errorf("element has no %s attribute", name)
+	}
+	if booleanAttributes[name] {
+		return "true", nil
+	}
+	return value, nil
+}
+
+func (e htmlElement) html() (string, error) {
+	return e.sel.Html()
+}
+
+// blockElements are the elements whose text a browser puts on lines of its
+// own.
+var blockElements = map[string]bool{
+	"address": true, "article": true, "aside": true, "blockquote": true, "dd": true, "div": true, "dl": true,
+	"dt": true, "figcaption": true, "figure": true, "footer": true, "form": true, "h1": true, "h2": true,
+	"h3": true, "h4": true, "h5": true, "h6": true, "header": true, "li": true, "main": true, "nav": true,
+	"ol": true, "p": true, "section": true, "table": true, "tr": true, "ul": true,
+}
+
+// innerText approximates the text a browser renders for sel: scripts and
+// styles are left out, blocks and line breaks start new lines and runs of
+// white space collapse into one space.
+func innerText(sel *goquery.Selection) string {
+	var b strings.Builder
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		switch n.Type {
+		case html.TextNode:
+			b.WriteString(n.Data)
+			return
+		case html.ElementNode:
+			switch n.Data {
+			case "script", "style", "noscript", "template":
+				return
+			case "br":
+				b.WriteString("\n")
+				return
+			}
+		}
+		block := n.Type == html.ElementNode && blockElements[n.Data]
+		if block {
+			b.WriteString("\n")
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+		switch {
+		case block:
+			b.WriteString("\n")
+		case n.Type == html.ElementNode && (n.Data == "td" || n.Data == "th"):
+			b.WriteString(" ")
+		}
+	}
+	for _, n := range sel.Nodes {
+		walk(n)
+	}
+
+	var lines []string
+	for _, line := range strings.Split(b.String(), "\n") {
+		if line = strings.Join(strings.Fields(line), " "); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	neturl "net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// downloadAttempts is how often a media file is requested before giving up on
+// transient failures.
+const downloadAttempts = 3
+
+// mediaDownloader mirrors the media files of scraped products to local disk.
+// It runs its own pool of HTTP workers fed through a buffered channel, so the
+// browser workers only hand products over and move on.
+type mediaDownloader struct {
+	cfg     *Config
+	store   Storage
+	client  *http.Client
+	jobs    chan *Product
+	limiter *time.Ticker
+	wg      sync.WaitGroup
+}
+
+// newMediaDownloader starts cfg.DownloadWorkers download workers that write to
+// cfg.DownloadMedia and record the local files on the products in store.
+// The workers stop once close is called and the queue is drained, or when ctx
+// is cancelled.
+func newMediaDownloader(ctx context.Context, cfg *Config, store Storage) *mediaDownloader {
+	d := &mediaDownloader{
+		cfg:     cfg,
+		store:   store,
+		client:  &http.Client{Timeout: cfg.PageLoadTimeout},
+		jobs:    make(chan *Product, cfg.scrapeWorkers()*8),
+		limiter: time.NewTicker(cfg.DownloadDelay),
+	}
+	for i := 0; i < cfg.DownloadWorkers; i++ {
+		d.wg.Add(1)
+		go func() {
+			defer d.wg.Done()
+			for {
+				product, ok := receive(ctx, d.jobs)
+				if !ok {
+					return
+				}
+				d.downloadProduct(ctx, product)
+			}
+		}()
+	}
+	return d
+}
+
+// enqueue hands product over to the download workers. product must not be
+// modified by the caller afterwards.
+func (d *mediaDownloader) enqueue(ctx context.Context, product *Product) {
+	send(ctx, d.jobs, product)
+}
+
+// close waits for the queued products to be downloaded.
+func (d *mediaDownloader) close() {
+	close(d.jobs)
+	d.wg.Wait()
+	d.limiter.Stop()
+}
+
+// downloadProduct downloads the media and color thumbnails of product into
+// its own directory and stores the local paths and hashes with the product.
+func (d *mediaDownloader) downloadProduct(ctx context.Context, product *Product) {
+	dir := product.ProductNumber
+	downloaded, failed := 0, 0
+	fetch := func(rawURL string, localPath, hash *string) {
+		if rawURL == "" || ctx.Err() != nil {
+			return
+		}
+		relPath := filepath.Join(dir, mediaFileName(rawURL))
+		sum, err := d.download(ctx, rawURL, relPath)
+		if err != nil {
+			slog.Warn("Failed to download media", "product_number", product.ProductNumber, "url", rawURL, "err", err)
+			failed++
+			return
+		}
+		*localPath, *hash = filepath.ToSlash(relPath), sum
+		downloaded++
+	}
+
+	for i := range product.Media {
+		fetch(product.Media[i].Path, &product.Media[i].LocalPath, &product.Media[i].SHA256)
+	}
+	for i := range product.AvailableColors {
+		fetch(product.AvailableColors[i].Path, &product.AvailableColors[i].LocalPath, &product.AvailableColors[i].SHA256)
+	}
+	if downloaded == 0 {
+		return
+	}
+
+	if err := d.store.updateProductMedia(context.Background(), product); err != nil {
+		slog.Error("Failed to record downloaded media", "product_number", product.ProductNumber, "err", err)
+		return
+	}
+	slog.Info("Downloaded media", "product_number", product.ProductNumber, "files", downloaded, "failed", failed)
+}
+
+// download fetches rawURL into relPath below the download directory and
+// returns the SHA-256 of the file. A file downloaded by an earlier run is
+// only requested conditionally, and left untouched when unchanged.
+func (d *mediaDownloader) download(ctx context.Context, rawURL, relPath string) (string, error) {
+	target := filepath.Join(d.cfg.DownloadMedia, relPath)
+	var modified time.Time
+	if info, err := os.Stat(target); err == nil {
+		modified = info.ModTime()
+	}
+
+	var lastErr error
+	for attempt := 1; attempt <= downloadAttempts; attempt++ {
+		if attempt > 1 {
+			select {
+			case <-ctx.Done():
+				return "", ctx.Err()
+			case <-time.After(time.Duration(1<<(attempt-2)) * time.Second):
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-d.limiter.C:
+		}
+
+		body, notModified, err := d.get(ctx, rawURL, modified)
+		if err == nil && notModified {
+			return fileSHA256(target)
+		}
+		if err == nil {
+			return writeIfChanged(target, body)
+		}
+		lastErr = err
+		var permanent *permanentHTTPError
+		if errors.As(err, &permanent) {
+			break
+		}
+	}
+	return "", lastErr
+}
+
+// permanentHTTPError is an HTTP status that retrying will not fix.
+type permanentHTTPError struct {
+	Status string
+}
+
+func (e *permanentHTTPError) Error() string {
+	return "unexpected status " + e.Status
+}
+
+// get requests rawURL, conditionally when ifModifiedSince is set. It reports
+// notModified on a 304 response.
+func (d *mediaDownloader) get(ctx context.Context, rawURL string, ifModifiedSince time.Time) (body []byte, notModified bool, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, false, &permanentHTTPError{Status: err.Error()}
+	}
+	if !ifModifiedSince.IsZero() {
+		req.Header.Set("If-Modified-Since", ifModifiedSince.UTC().Format(http.TimeFormat))
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified:
+		return nil, true, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return nil, false, fmt.Errorf("unexpected status %s", resp.Status)
+	case resp.StatusCode != http.StatusOK:
+		return nil, false, &permanentHTTPError{Status: resp.Status}
+	}
+
+	body, err = io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, false, err
+	}
+	return body, false, nil
+}
+
+// writeIfChanged writes body to target unless target already holds the same
+// content, and returns the SHA-256 of body.
+func writeIfChanged(target string, body []byte) (string, error) {
+	sum := sha256.Sum256(body)
+	hash := hex.EncodeToString(sum[:])
+	if existing, err := fileSHA256(target); err == nil && existing == hash {
+		return hash, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return "", err
+	}
+	tmp := target + ".part"
+	if err := os.WriteFile(tmp, body, 0o644); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp, target); err != nil {
+		return "", err
+	}
+	return hash, nil
+}
+
+// fileSHA256 returns the hex encoded SHA-256 of the file at name.
+func fileSHA256(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// mediaFileName returns the file name a media URL is stored under: the last
+// element of its path, or a hash of the URL when the path has none.
+func mediaFileName(rawURL string) string {
+	if u, err := neturl.Parse(rawURL); err == nil {
+		if name := path.Base(u.Path); name != "." && name != "/" && name != "" {
+			return name
+		}
+	}
+	sum := sha256.Sum256([]byte(rawURL))
+	return hex.EncodeToString(sum[:8])
+}
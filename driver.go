@@ -0,0 +1,527 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// chromeForTestingURL lists the newest ChromeDriver of every Chrome build,
+// i.e. major.minor.build, with its downloads per platform.
+const chromeForTestingURL = "https://googlechromelabs.github.io/chrome-for-testing/latest-patch-versions-per-build-with-downloads.json"
+
+// geckoDriverReleaseURL describes the latest geckodriver release.
+const geckoDriverReleaseURL = "https://api.github.com/repos/mozilla/geckodriver/releases/latest"
+
+// seleniumReleaseURL is where the Selenium 3 server JARs are published; the
+// Selenium service of the tebeka/selenium package launches the Selenium 3 grid.
+const seleniumReleaseURL = "https://selenium-release.storage.googleapis.com"
+
+// chromeBinaries are the names Chrome is looked up by on the PATH when
+// -chrome-binary is not set.
+var chromeBinaries = []string{
+	"google-chrome",
+	"google-chrome-stable",
+	"chromium",
+	"chromium-browser",
+	"chrome",
+	"/Applications/Google Chrome.app/Contents/MacOS/Google Chrome",
+}
+
+var chromeVersionPattern = regexp.MustCompile(`(\d+)\.(\d+)\.(\d+)\.(\d+)`)
+
+// chromeVersion is the version of the local Chrome.
+type chromeVersion struct {
+	Full  string // e.g. 126.0.6478.126
+	Build string // major.minor.build, e.g. 126.0.6478
+	Major int
+}
+
+// detectChromeVersion runs the local Chrome with --version.
+func detectChromeVersion(cfg *Config) (chromeVersion, error) {
+	candidates := chromeBinaries
+	if cfg.ChromeBinary != "" {
+		candidates = []string{cfg.ChromeBinary}
+	}
+	for _, name := range candidates {
+		bin, err := exec.LookPath(name)
+		if err != nil {
+			continue
+		}
+		out, err := exec.Command(bin, "--version").Output()
+		if err != nil {
+			return chromeVersion{}, fmt.Errorf("failed to run %s --version: %v", bin, err)
+		}
+		m := chromeVersionPattern.FindStringSubmatch(string(out))
+		if m == nil {
+			return chromeVersion{}, fmt.Errorf("%s --version printed no version: %q", bin, strings.TrimSpace(string(out)))
+		}
+		major, _ := strconv.Atoi(m[1])
+		return chromeVersion{Full: m[0], Build: strings.Join(m[1:4], "."), Major: major}, nil
+	}
+	if cfg.ChromeBinary != "" {
+		return chromeVersion{}, fmt.Errorf("chrome-binary %s not found", cfg.ChromeBinary)
+	}
+	return chromeVersion{}, errors.New("no Chrome found on the PATH, set -chrome-binary")
+}
+
+// prepareLocalDriver runs before the local Selenium server is started. With
+// -auto-driver it points cfg at a driver for the browser, see
+// prepareChromeDriver and prepareGeckoDriver, and at the Selenium server JAR
+// of -selenium-version, downloading them into the driver cache unless a
+// previous run did. Without a network it keeps the configured paths.
+func prepareLocalDriver(cfg *Config) error {
+	if cfg.AutoDriver && cfg.SeleniumVersion != "" {
+		cacheDir, err := cfg.driverCacheDir()
+		if err != nil {
+			return err
+		}
+		if jar, err := fetchSeleniumServer(cacheDir, cfg.SeleniumVersion); err != nil {
+			slog.Warn("Failed to fetch the Selenium server, using -selenium-path", "selenium_version", cfg.SeleniumVersion, "path", cfg.SeleniumPath, "err", err)
+		} else {
+			cfg.SeleniumPath = jar
+		}
+	}
+	if cfg.Browser == browserFirefox {
+		return prepareGeckoDriver(cfg)
+	}
+	return prepareChromeDriver(cfg)
+}
+
+// prepareChromeDriver fetches the ChromeDriver matching the local Chrome with
+// -auto-driver, and then fails the start with both versions if the driver is
+// still built for another Chrome major version, rather than at the first
+// session. Without -auto-driver a mismatch is only warned about, as the
+// driver may still work and the paths are the user's to choose.
+func prepareChromeDriver(cfg *Config) error {
+	chrome, chromeErr := detectChromeVersion(cfg)
+	if cfg.AutoDriver {
+		if chromeErr != nil {
+			return fmt.Errorf("auto-driver cannot tell the Chrome version: %v", chromeErr)
+		}
+		cacheDir, err := cfg.driverCacheDir()
+		if err != nil {
+			return err
+		}
+		if driver, err := fetchChromeDriver(cacheDir, chrome); err != nil {
+			slog.Warn("Failed to fetch ChromeDriver, using -chromedriver-path", "chrome_version", chrome.Full, "path", cfg.ChromeDriverPath, "err", err)
+		} else {
+			cfg.ChromeDriverPath = driver
+		}
+	}
+	if chromeErr != nil {
+		slog.Debug("Skipping the ChromeDriver version check", "err", chromeErr)
+		return nil
+	}
+	driverMajor, ok := chromeDriverMajorVersion(cfg.ChromeDriverPath)
+	if !ok {
+		return nil
+	}
+	if driverMajor != chrome.Major {
+		if !cfg.AutoDriver {
+			slog.Warn("ChromeDriver is built for another Chrome version, run with -auto-driver or point -chromedriver-path at a matching driver",
+				"chrome_version", chrome.Full, "path", cfg.ChromeDriverPath, "chromedriver_version", driverMajor)
+			return nil
+		}
+		return fmt.Errorf("found Chrome %d (%s), but the ChromeDriver at %s is built for Chrome %d; connect to the internet once or point -chromedriver-path at a matching driver",
+			chrome.Major, chrome.Full, cfg.ChromeDriverPath, driverMajor)
+	}
+	slog.Info("Using ChromeDriver", "path", cfg.ChromeDriverPath, "chrome_version", chrome.Full)
+	return nil
+}
+
+// prepareGeckoDriver fetches the latest geckodriver with -auto-driver, or
+// takes the newest one an earlier run cached when the latest release cannot
+// be looked up. Unlike ChromeDriver, a geckodriver drives a range of Firefox
+// versions, so there is no browser version to match it against.
+func prepareGeckoDriver(cfg *Config) error {
+	if !cfg.AutoDriver {
+		return nil
+	}
+	cacheDir, err := cfg.driverCacheDir()
+	if err != nil {
+		return err
+	}
+	driver, err := fetchGeckoDriver(cacheDir)
+	if err != nil {
+		slog.Warn("Failed to fetch geckodriver, using -geckodriver-path", "path", cfg.GeckoDriverPath, "err", err)
+		return nil
+	}
+	cfg.GeckoDriverPath = driver
+	slog.Info("Using geckodriver", "path", driver)
+	return nil
+}
+
+// driverCacheDir returns -driver-cache-dir or, by default, the crawler's
+// directory in the user cache directory.
+func (c *Config) driverCacheDir() (string, error) {
+	if c.DriverCacheDir != "" {
+		return c.DriverCacheDir, nil
+	}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to find the user cache directory, set -driver-cache-dir: %v", err)
+	}
+	return filepath.Join(dir, "adidas-crawling", "drivers"), nil
+}
+
+// chromeForTestingPlatform returns the Chrome for Testing name of the
+// platform the crawler runs on.
+func chromeForTestingPlatform() (string, error) {
+	switch runtime.GOOS + "/" + runtime.GOARCH {
+	case "linux/amd64":
+		return "linux64", nil
+	case "darwin/amd64":
+		return "mac-x64", nil
+	case "darwin/arm64":
+		return "mac-arm64", nil
+	case "windows/amd64":
+		return "win64", nil
+	case "windows/386":
+		return "win32", nil
+	}
+	return "", fmt.Errorf("no ChromeDriver is published for %s/%s", runtime.GOOS, runtime.GOARCH)
+}
+
+// fetchChromeDriver returns the cached ChromeDriver of chrome's build,
+// downloading the newest one of the build first if none is cached.
+func fetchChromeDriver(cacheDir string, chrome chromeVersion) (string, error) {
+	platform, err := chromeForTestingPlatform()
+	if err != nil {
+		return "", err
+	}
+	name := "chromedriver"
+	if runtime.GOOS == "windows" {
+		name += ".exe"
+	}
+	target := filepath.Join(cacheDir, "chromedriver-"+chrome.Build+"-"+platform, name)
+	if verifyCached(target) {
+		return target, nil
+	}
+
+	var builds struct {
+		Builds map[string]struct {
+			Version   string `json:"version"`
+			Downloads struct {
+				ChromeDriver []struct {
+					Platform string `json:"platform"`
+					URL      string `json:"url"`
+				} `json:"chromedriver"`
+			} `json:"downloads"`
+		} `json:"builds"`
+	}
+	index, err := downloadVerified(chromeForTestingURL, "")
+	if err != nil {
+		return "", err
+	}
+	if err := json.Unmarshal(index, &builds); err != nil {
+		return "", fmt.Errorf("failed to decode %s: %v", chromeForTestingURL, err)
+	}
+	build, ok := builds.Builds[chrome.Build]
+	if !ok {
+		return "", fmt.Errorf("no ChromeDriver is published for Chrome %s", chrome.Full)
+	}
+	var archiveURL string
+	for _, d := range build.Downloads.ChromeDriver {
+		if d.Platform == platform {
+			archiveURL = d.URL
+		}
+	}
+	if archiveURL == "" {
+		return "", fmt.Errorf("no ChromeDriver %s is published for %s", build.Version, platform)
+	}
+
+	slog.Info("Downloading ChromeDriver", "version", build.Version, "url", archiveURL)
+	archive, err := downloadVerified(archiveURL, "")
+	if err != nil {
+		return "", err
+	}
+	data, err := extractFile(archiveURL, archive, name)
+	if err != nil {
+		return "", err
+	}
+	if err := writeCached(target, data, 0o755); err != nil {
+		return "", err
+	}
+	return target, nil
+}
+
+// geckoDriverPlatform returns the name geckodriver releases give the
+// platform the crawler runs on.
+func geckoDriverPlatform() (string, error) {
+	switch runtime.GOOS + "/" + runtime.GOARCH {
+	case "linux/amd64":
+		return "linux64", nil
+	case "linux/arm64":
+		return "linux-aarch64", nil
+	case "darwin/amd64":
+		return "macos", nil
+	case "darwin/arm64":
+		return "macos-aarch64", nil
+	case "windows/amd64":
+		return "win64", nil
+	case "windows/386":
+		return "win32", nil
+	}
+	return "", fmt.Errorf("no geckodriver is published for %s/%s", runtime.GOOS, runtime.GOARCH)
+}
+
+// fetchGeckoDriver returns the cached latest geckodriver release,
+// downloading it first if it is not cached. GitHub publishes the SHA-256 of
+// each release asset, which the download is checked against.
+func fetchGeckoDriver(cacheDir string) (string, error) {
+	platform, err := geckoDriverPlatform()
+	if err != nil {
+		return "", err
+	}
+	name := "geckodriver"
+	if runtime.GOOS == "windows" {
+		name += ".exe"
+	}
+
+	var release struct {
+		TagName string `json:"tag_name"`
+		Assets  []struct {
+			Name   string `json:"name"`
+			URL    string `json:"browser_download_url"`
+			Digest string `json:"digest"`
+		} `json:"assets"`
+	}
+	index, err := downloadVerified(geckoDriverReleaseURL, "")
+	if err == nil {
+		err = json.Unmarshal(index, &release)
+	}
+	if err != nil {
+		// Offline, a driver an earlier run fetched still works.
+		if cached, ok := cachedGeckoDriver(cacheDir, platform, name); ok {
+			slog.Warn("Failed to look up the latest geckodriver, using a cached one", "path", cached, "err", err)
+			return cached, nil
+		}
+		return "", fmt.Errorf("failed to look up the latest geckodriver: %v", err)
+	}
+
+	target := filepath.Join(cacheDir, "geckodriver-"+release.TagName+"-"+platform, name)
+	if verifyCached(target) {
+		return target, nil
+	}
+	for _, asset := range release.Assets {
+		if !strings.HasPrefix(asset.Name, "geckodriver-"+release.TagName+"-"+platform+".") || strings.HasSuffix(asset.Name, ".asc") {
+			continue
+		}
+		slog.Info("Downloading geckodriver", "version", release.TagName, "url", asset.URL)
+		archive, err := downloadVerified(asset.URL, strings.TrimPrefix(asset.Digest, "sha256:"))
+		if err != nil {
+			return "", err
+		}
+		data, err := extractFile(asset.URL, archive, name)
+		if err != nil {
+			return "", err
+		}
+		if err := writeCached(target, data, 0o755); err != nil {
+			return "", err
+		}
+		return target, nil
+	}
+	return "", fmt.Errorf("no geckodriver %s is published for %s", release.TagName, platform)
+}
+
+// cachedGeckoDriver returns the geckodriver of the highest release cached in
+// cacheDir for platform that still matches its checksum.
+func cachedGeckoDriver(cacheDir, platform, name string) (string, bool) {
+	cached, _ := filepath.Glob(filepath.Join(cacheDir, "geckodriver-*-"+platform, name))
+	// Releases are tagged v0.9.0 up to v0.36.0 and later, so the directories
+	// are ordered by the numbers of their tag rather than by name.
+	release := func(path string) []int {
+		tag := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(filepath.Dir(path)), "geckodriver-"), "-"+platform)
+		var numbers []int
+		for _, part := range strings.Split(strings.TrimPrefix(tag, "v"), ".") {
+			n, _ := strconv.Atoi(part)
+			numbers = append(numbers, n)
+		}
+		return numbers
+	}
+	slices.SortFunc(cached, func(a, b string) int { return slices.Compare(release(a), release(b)) })
+	for i := len(cached) - 1; i >= 0; i-- {
+		if verifyCached(cached[i]) {
+			return cached[i], true
+		}
+	}
+	return "", false
+}
+
+// extractFile returns the file called name from a .zip or .tar.gz archive
+// downloaded from url.
+func extractFile(url string, archive []byte, name string) ([]byte, error) {
+	if strings.HasSuffix(url, ".tar.gz") {
+		gz, err := gzip.NewReader(bytes.NewReader(archive))
+		if err != nil {
+			return nil, fmt.Errorf("failed to open %s: %v", url, err)
+		}
+		tr := tar.NewReader(gz)
+		for {
+			header, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("failed to open %s: %v", url, err)
+			}
+			if header.Typeflag == tar.TypeReg && path.Base(header.Name) == name {
+				data, err := io.ReadAll(tr)
+				if err != nil {
+					return nil, fmt.Errorf("failed to extract %s: %v", header.Name, err)
+				}
+				return data, nil
+			}
+		}
+		return nil, fmt.Errorf("%s holds no %s", url, name)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %v", url, err)
+	}
+	for _, f := range zr.File {
+		if path.Base(f.Name) != name {
+			continue
+		}
+		r, err := f.Open()
+		if err != nil {
+			return nil, fmt.Errorf("failed to extract %s: %v", f.Name, err)
+		}
+		data, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to extract %s: %v", f.Name, err)
+		}
+		return data, nil
+	}
+	return nil, fmt.Errorf("%s holds no %s", url, name)
+}
+
+// fetchSeleniumServer returns the cached Selenium server JAR of version,
+// e.g. 3.141.59, downloading it first if it is not cached.
+func fetchSeleniumServer(cacheDir, version string) (string, error) {
+	parts := strings.Split(version, ".")
+	if len(parts) < 2 {
+		return "", fmt.Errorf("selenium-version must look like 3.141.59, got %q", version)
+	}
+	file := "selenium-server-standalone-" + version + ".jar"
+	target := filepath.Join(cacheDir, file)
+	if verifyCached(target) {
+		return target, nil
+	}
+	jarURL := seleniumReleaseURL + "/" + parts[0] + "." + parts[1] + "/" + file
+	slog.Info("Downloading Selenium server", "version", version, "url", jarURL)
+	data, err := downloadVerified(jarURL, "")
+	if err != nil {
+		return "", err
+	}
+	if err := writeCached(target, data, 0o644); err != nil {
+		return "", err
+	}
+	return target, nil
+}
+
+// downloadVerified downloads url and checks the body against wantSHA256,
+// the hex SHA-256 the publisher lists, unless it is empty, and against the
+// MD5 sum Google Cloud Storage sends in the x-goog-hash header. Bodies
+// served without either, like the Chrome for Testing index, are taken as
+// they are.
+func downloadVerified(url, wantSHA256 string) ([]byte, error) {
+	client := &http.Client{Timeout: 5 * time.Minute}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to download %s: %s", url, resp.Status)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download %s: %v", url, err)
+	}
+	if wantSHA256 != "" {
+		sum := sha256.Sum256(data)
+		if got := hex.EncodeToString(sum[:]); got != wantSHA256 {
+			return nil, fmt.Errorf("checksum mismatch for %s: got sha256 %s, want %s", url, got, wantSHA256)
+		}
+	}
+	for _, header := range resp.Header.Values("x-goog-hash") {
+		for _, hash := range strings.Split(header, ",") {
+			want, ok := strings.CutPrefix(strings.TrimSpace(hash), "md5=")
+			if !ok {
+				continue
+			}
+			sum := md5.Sum(data)
+			if got := base64.StdEncoding.EncodeToString(sum[:]); got != want {
+				return nil, fmt.Errorf("checksum mismatch for %s: got md5 %s, want %s", url, got, want)
+			}
+		}
+	}
+	return data, nil
+}
+
+// writeCached writes a downloaded file into the driver cache, next to a
+// .sha256 file verifyCached checks it against on later runs. The file is
+// renamed into place so that an interrupted download is never picked up.
+func writeCached(target string, data []byte, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return fmt.Errorf("failed to create driver cache directory: %v", err)
+	}
+	tmp := target + ".tmp"
+	if err := os.WriteFile(tmp, data, perm); err != nil {
+		return fmt.Errorf("failed to write %s: %v", tmp, err)
+	}
+	sum := sha256.Sum256(data)
+	if err := os.WriteFile(target+".sha256", []byte(hex.EncodeToString(sum[:])+"\n"), 0o644); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write checksum of %s: %v", target, err)
+	}
+	if err := os.Rename(tmp, target); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to move %s into place: %v", target, err)
+	}
+	return nil
+}
+
+// verifyCached reports whether target is cached and still matches the
+// checksum recorded when it was downloaded.
+func verifyCached(target string) bool {
+	want, err := os.ReadFile(target + ".sha256")
+	if err != nil {
+		return false
+	}
+	data, err := os.ReadFile(target)
+	if err != nil {
+		return false
+	}
+	sum := sha256.Sum256(data)
+	if hex.EncodeToString(sum[:]) != strings.TrimSpace(string(want)) {
+		slog.Warn("Cached driver does not match its checksum, downloading it again", "path", target)
+		return false
+	}
+	return true
+}
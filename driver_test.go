@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/tebeka/selenium/chrome"
+)
+
+// fakeExecutable writes a script called name into dir that prints version
+// and records each run in name.runs.
+func fakeExecutable(t *testing.T, dir, name, version string) string {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("fake drivers are shell scripts")
+	}
+	path := filepath.Join(dir, name)
+	script := "#!/bin/sh\necho run >> '" + path + ".runs'\necho '" + version + "'\n"
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// cacheFakeExecutable puts a fake executable into the driver cache at
+// target, as if an earlier run had downloaded it.
+func cacheFakeExecutable(t *testing.T, target, version string) {
+	t.Helper()
+	script, err := os.ReadFile(fakeExecutable(t, t.TempDir(), filepath.Base(target), version))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeCached(target, script, 0o755); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPrepareChromeDriver(t *testing.T) {
+	platform, err := chromeForTestingPlatform()
+	if err != nil {
+		t.Skip(err)
+	}
+	tests := []struct {
+		name       string
+		autoDriver bool
+		cached     string // version of the cached driver of the Chrome build, "" for none
+		wantErr    bool
+		wantCached bool // cfg left pointing at the cached driver
+	}{
+		{name: "mismatch without auto-driver"},
+		{name: "auto-driver fetches a matching driver", autoDriver: true, cached: "ChromeDriver 126.0.6478.126 (d36ace6)", wantCached: true},
+		{name: "auto-driver left with a mismatch", autoDriver: true, cached: "ChromeDriver 125.0.6422.141 (4a4f7a8)", wantErr: true, wantCached: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, cacheDir := t.TempDir(), t.TempDir()
+			args := []string{
+				"-chrome-binary=" + fakeExecutable(t, dir, "google-chrome", "Google Chrome 126.0.6478.126"),
+				"-chromedriver-path=" + fakeExecutable(t, dir, "chromedriver", "ChromeDriver 119.0.6045.105 (38c72552)"),
+				"-driver-cache-dir=" + cacheDir,
+			}
+			if tt.autoDriver {
+				args = append(args, "-auto-driver")
+			}
+			cfg := testConfig(t, args...)
+			configured := cfg.ChromeDriverPath
+			cached := filepath.Join(cacheDir, "chromedriver-126.0.6478-"+platform, "chromedriver")
+			if tt.cached != "" {
+				cacheFakeExecutable(t, cached, tt.cached)
+			}
+
+			err := prepareChromeDriver(cfg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("prepareChromeDriver() = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil && !strings.Contains(err.Error(), "Chrome 126") {
+				t.Errorf("error %q does not name the Chrome version", err)
+			}
+			want := configured
+			if tt.wantCached {
+				want = cached
+			}
+			if cfg.ChromeDriverPath != want {
+				t.Errorf("ChromeDriverPath = %s, want %s", cfg.ChromeDriverPath, want)
+			}
+		})
+	}
+}
+
+// TestChromeCapabilitiesRemote checks that the local ChromeDriver is not run
+// to pick the capabilities of sessions on a remote hub.
+func TestChromeCapabilitiesRemote(t *testing.T) {
+	driver := fakeExecutable(t, t.TempDir(), "chromedriver", "ChromeDriver 2.46.628388")
+	cfg := testConfig(t, "-chromedriver-path="+driver, "-webdriver-url=http://selenium:4444/wd/hub")
+
+	caps := chromeCapabilities(cfg)
+	if _, ok := caps[chrome.CapabilitiesKey]; !ok {
+		t.Errorf("capabilities = %v, want %s for the remote hub", caps, chrome.CapabilitiesKey)
+	}
+	if _, err := os.Stat(driver + ".runs"); err == nil {
+		t.Error("local ChromeDriver run for a remote hub")
+	}
+}
+
+func TestChromeDriverMajorVersion(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		output string
+		want   int
+		ok     bool
+	}{
+		{"ChromeDriver 126.0.6478.126 (d36ace6122e0a59570e258d82441395206d60e41-refs/branch-heads/6478@{#1591})", 126, true},
+		{"ChromeDriver 2.46.628388 (4a34a70827ac54148e092aafb70504c4ea7ae926)", 2, true},
+		{"geckodriver 0.36.0", 0, false},
+	}
+	for i, tt := range tests {
+		driver := fakeExecutable(t, dir, fmt.Sprintf("chromedriver%d", i), tt.output)
+		if got, ok := chromeDriverMajorVersion(driver); got != tt.want || ok != tt.ok {
+			t.Errorf("chromeDriverMajorVersion(%q) = %d, %v, want %d, %v", tt.output, got, ok, tt.want, tt.ok)
+		}
+	}
+	if _, ok := chromeDriverMajorVersion(filepath.Join(dir, "missing")); ok {
+		t.Error("chromeDriverMajorVersion(missing driver) reported a version")
+	}
+}
+
+func TestDetectChromeVersion(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		output  string
+		want    chromeVersion
+		wantErr bool
+	}{
+		{output: "Google Chrome 126.0.6478.126 ", want: chromeVersion{Full: "126.0.6478.126", Build: "126.0.6478", Major: 126}},
+		{output: "Chromium 125.0.6422.141 built on Debian 12.5, running on Debian 12.5", want: chromeVersion{Full: "125.0.6422.141", Build: "125.0.6422", Major: 125}},
+		{output: "Mozilla Firefox 128.0", wantErr: true},
+	}
+	for i, tt := range tests {
+		cfg := testConfig(t, "-chrome-binary="+fakeExecutable(t, dir, fmt.Sprintf("chrome%d", i), tt.output))
+		got, err := detectChromeVersion(cfg)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("detectChromeVersion(%q) = %+v, %v, want %+v", tt.output, got, err, tt.want)
+		}
+	}
+	if _, err := detectChromeVersion(testConfig(t, "-chrome-binary="+filepath.Join(dir, "missing"))); err == nil {
+		t.Error("detectChromeVersion(missing binary) found a version")
+	}
+}
+
+func TestVerifyCached(t *testing.T) {
+	target := filepath.Join(t.TempDir(), "chromedriver-126.0.6478-linux64", "chromedriver")
+	if verifyCached(target) {
+		t.Fatal("verifyCached() = true before anything was cached")
+	}
+	if err := writeCached(target, []byte("driver"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if !verifyCached(target) {
+		t.Fatal("verifyCached() = false for the file just cached")
+	}
+	if err := os.WriteFile(target, []byte("tampered"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if verifyCached(target) {
+		t.Error("verifyCached() = true for a file that no longer matches its checksum")
+	}
+}
+
+func TestCachedGeckoDriver(t *testing.T) {
+	cacheDir := t.TempDir()
+	if _, ok := cachedGeckoDriver(cacheDir, "linux64", "geckodriver"); ok {
+		t.Fatal("cachedGeckoDriver() found a driver in an empty cache")
+	}
+	for _, tag := range []string{"v0.9.0", "v0.34.0", "v0.36.0", "v0.35.0"} {
+		target := filepath.Join(cacheDir, "geckodriver-"+tag+"-linux64", "geckodriver")
+		if err := writeCached(target, []byte("geckodriver "+tag), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The newest cached driver was damaged since it was downloaded.
+	if err := os.WriteFile(filepath.Join(cacheDir, "geckodriver-v0.36.0-linux64", "geckodriver"), nil, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	// Drivers of other platforms are never picked.
+	if err := writeCached(filepath.Join(cacheDir, "geckodriver-v0.37.0-macos", "geckodriver"), []byte("geckodriver"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	got, ok := cachedGeckoDriver(cacheDir, "linux64", "geckodriver")
+	if want := filepath.Join(cacheDir, "geckodriver-v0.35.0-linux64", "geckodriver"); !ok || got != want {
+		t.Errorf("cachedGeckoDriver() = %s, %v, want %s", got, ok, want)
+	}
+}
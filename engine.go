@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/tebeka/selenium"
+)
+
+// Engines of -engine.
+const (
+	engineSelenium = "selenium" // product pages rendered in a browser session
+	engineHTTP     = "http"     // product pages fetched over plain HTTP, the browser only as a fallback
+)
+
+// defaultHTTPUserAgent is the user agent of the HTTP engine when none is
+// configured; the Go default is turned away by the site.
+const defaultHTTPUserAgent = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Safari/537.36"
+
+// Extractor loads product pages for scrapeProduct, which reads them through
+// the DOM it returns. The Selenium engine renders the page in a browser
+// session; the HTTP engine only has the HTML the server sends, so the parts
+// of scrapeProduct that need a browser are skipped with it.
+type Extractor interface {
+	// load loads the page at url. It returns a *pageStateError when the page
+	// is no product page and errChallenge when a bot challenge was served.
+	load(url string) error
+	// dom returns the loaded page.
+	dom() DOM
+	// structuredData returns the JSON-LD blocks of the loaded page and its
+	// embedded state, serialized, or "" when it has none.
+	structuredData() (ld []string, state string, err error)
+	// browser returns the browser session the page is loaded in, nil for the
+	// HTTP engine.
+	browser() selenium.WebDriver
+	// pageSource returns the HTML of the page last loaded, also when it was
+	// no product page, for the snapshots of -artifacts-dir.
+	pageSource() (string, error)
+}
+
+// seleniumExtractor loads product pages in a browser session.
+type seleniumExtractor struct {
+	wd selenium.WebDriver
+}
+
+func (e seleniumExtractor) load(url string) error {
+	if err := e.wd.Get(url); err != nil {
+		return err
+	}
+	return checkPageState(e.wd, url)
+}
+
+func (e seleniumExtractor) dom() DOM {
+	return seleniumDOM{e.wd}
+}
+
+func (e seleniumExtractor) structuredData() ([]string, string, error) {
+	raw, err := e.wd.ExecuteScript(structuredDataScript, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	result, _ := raw.(map[string]any)
+	var ld []string
+	blocks, _ := result["ld"].([]any)
+	for _, block := range blocks {
+		if text, ok := block.(string); ok {
+			ld = append(ld, text)
+		}
+	}
+	state, _ := result["state"].(string)
+	return ld, state, nil
+}
+
+func (e seleniumExtractor) browser() selenium.WebDriver {
+	return e.wd
+}
+
+func (e seleniumExtractor) pageSource() (string, error) {
+	return e.wd.PageSource()
+}
+
+// httpExtractor fetches product pages over plain HTTP and parses their HTML.
+// Each worker has its own, so that the cookies the site sets are kept across
+// its pages like in a browser session.
+type httpExtractor struct {
+	client    *http.Client
+	userAgent string
+	proxy     string // "" for none
+	doc       *goquery.Document
+	source    []byte // body of the last response
+}
+
+// newHTTPExtractor returns an HTTP engine with the user agent and the proxy a
+// browser session opened by sessions would get.
+func newHTTPExtractor(cfg *Config, sessions *sessionFactory) (*httpExtractor, error) {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	proxy := ""
+	if sessions.proxies != nil {
+		proxy = sessions.proxies.take()
+		proxyURL := proxy
+		if !strings.Contains(proxyURL, "://") {
+			proxyURL = "http://" + proxyURL
+		}
+		u, err := url.Parse(proxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy %s: %v", proxy, err)
+		}
+		transport.Proxy = http.ProxyURL(u)
+	}
+	userAgent := sessions.userAgent()
+	if userAgent == "" {
+		userAgent = defaultHTTPUserAgent
+	}
+	return &httpExtractor{
+		client:    &http.Client{Jar: jar, Transport: transport, Timeout: cfg.PageLoadTimeout},
+		userAgent: userAgent,
+		proxy:     proxy,
+	}, nil
+}
+
+func (e *httpExtractor) load(pageURL string) error {
+	e.doc, e.source = nil, nil
+	req, err := http.NewRequest(http.MethodGet, pageURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", e.userAgent)
+	req.Header.Set("Accept", "text/html,application/xhtml+xml")
+	req.Header.Set("Accept-Language", "ja-JP,ja;q=0.9")
+	// The transport asks for and decompresses gzip by itself.
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if e.source, err = io.ReadAll(resp.Body); err != nil {
+		return fmt.Errorf("failed to read page: %v", err)
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		return &pageStateError{State: statusNotFound}
+	case resp.StatusCode == http.StatusForbidden:
+		return &pageStateError{State: statusBlocked}
+	case resp.StatusCode != http.StatusOK:
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	doc, err := goquery.NewDocumentFromReader(bytes.NewReader(e.source))
+	if err != nil {
+		return fmt.Errorf("failed to parse page: %v", err)
+	}
+
+	title := strings.TrimSpace(doc.Find("title").First().Text())
+	text := innerText(doc.Find("body"))
+	if err := pageState(title, text, resp.Request.URL.String(), pageURL); err != nil {
+		return err
+	}
+	if doc.Find(".itemTitle").Length() == 0 &&
+		(doc.Find(challengeSelector).Length() > 0 || containsAny(strings.ToLower(title+"\n"+text), challengeMarkers)) {
+		return errChallenge
+	}
+	e.doc = doc
+	return nil
+}
+
+func (e *httpExtractor) dom() DOM {
+	if e.doc == nil {
+		return htmlElement{&goquery.Selection{}}
+	}
+	return htmlElement{e.doc.Selection}
+}
+
+func (e *httpExtractor) structuredData() ([]string, string, error) {
+	if e.doc == nil {
+		return nil, "", errors.New("no page loaded")
+	}
+	var ld []string
+	e.doc.Find(`script[type="application/ld+json"]`).Each(func(_ int, s *goquery.Selection) {
+		ld = append(ld, s.Text())
+	})
+	// Only a state blob in a script of its own can be read without running
+	// the page's scripts.
+	state := strings.TrimSpace(e.doc.Find("script#__NEXT_DATA__").First().Text())
+	return ld, state, nil
+}
+
+func (e *httpExtractor) browser() selenium.WebDriver {
+	return nil
+}
+
+func (e *httpExtractor) pageSource() (string, error) {
+	if e.source == nil {
+		return "", errors.New("no page loaded")
+	}
+	return string(e.source), nil
+}
+
+// needsBrowser reports whether a product the HTTP engine scraped has to be
+// scraped again in a browser session: its page was blocked, challenged or
+// failed to load, or its title, price or images came back empty. A page that
+// was not found or redirected is taken as it is.
+func needsBrowser(product *Product, sectionErrs []*SectionError) bool {
+	if loadErr := findSectionError(sectionErrs, "page"); loadErr != nil {
+		var stateErr *pageStateError
+		return !errors.As(loadErr, &stateErr) || stateErr.State == statusBlocked
+	}
+	return product.Title == "" || product.PriceText == "" || countMedia(product.Media, "image") == 0
+}
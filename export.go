@@ -0,0 +1,408 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xuri/excelize/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Export formats supported by exportProducts.
+const (
+	formatCSV  = "csv"
+	formatXLSX = "xlsx"
+)
+
+// exportOptions selects what exportProducts writes and where.
+type exportOptions struct {
+	Format string
+	Path   string
+	Filter bson.M // products to export, empty for all
+}
+
+// Sheets of an Excel export. Coordinated products and reviews are written to
+// companion sheets keyed by product number; a CSV export keeps them in JSON
+// columns of the product row instead.
+const (
+	productsSheet    = "Products"
+	coordinatedSheet = "Coordinated"
+	reviewsSheet     = "Reviews"
+)
+
+// listSeparator joins list values, such as the sizes of a product, in one cell.
+const listSeparator = "/"
+
+// productColumns are the fixed columns of the products sheet. They are
+// followed by one column per size chart measurement and, in CSV exports, the
+// JSON columns.
+var productColumns = []string{
+	"product_number", "product_url", "model_code", "color_code", "section", "category", "breadcrumbs",
+	"gender", "product_type", "sport", "title",
+	"price_text", "price_jpy", "original_price_jpy", "sale_price_jpy", "on_sale", "discount_percent",
+	"points_earned", "member_price_jpy", "member_only",
+	"availability", "release_date", "colors", "sizes", "sizes_in_stock",
+	"description_heading", "description_title", "description", "specifications",
+	"materials", "care_instructions", "country_of_origin", "size_remarks", "tags",
+	"rating", "number_of_reviews", "recommended_count", "recommended_rate", "fit", "length", "quality", "comfort",
+	"updated_at", "first_crawled_at", "last_seen_at", "run_id", "crawler_version", "source_worker",
+}
+
+var (
+	coordinatedColumns = []string{"product_number", "relation", "coordinated_product_number", "title", "price_text", "price_jpy", "product_url"}
+	reviewColumns      = []string{"product_number", "review_id", "rating", "title", "description", "date", "submitted_at", "purchased_size", "usual_size", "height", "weight", "age", "gender", "location", "helpful_count", "unhelpful_count"}
+)
+
+// exportProducts streams the products matching opts.Filter to a CSV or Excel
+// file, one row per product. Products are read from a cursor and written as
+// they come, so exports of any size run in constant memory.
+func exportProducts(ctx context.Context, productCollection *mongo.Collection, opts exportOptions) (int, error) {
+	filter := opts.Filter
+	if filter == nil {
+		filter = bson.M{}
+	}
+
+	// Size chart measurements become columns, so they are collected first.
+	measurements, err := sizeChartMeasurements(ctx, productCollection, filter)
+	if err != nil {
+		return 0, err
+	}
+
+	var w exportWriter
+	switch opts.Format {
+	case formatCSV:
+		w, err = newCSVExportWriter(opts.Path)
+	case formatXLSX:
+		w, err = newXLSXExportWriter(opts.Path)
+	default:
+		return 0, fmt.Errorf("unknown export format %q, expected %s or %s", opts.Format, formatCSV, formatXLSX)
+	}
+	if err != nil {
+		return 0, err
+	}
+	companions := w.companionSheets()
+
+	header := append([]string(nil), productColumns...)
+	for _, name := range measurements {
+		header = append(header, "size_chart_"+name)
+	}
+	if !companions {
+		header = append(header, "coordinated_products", "recommended_products", "reviews")
+	}
+	if err := w.writeRow(productsSheet, stringsToRow(header)); err != nil {
+		w.close()
+		return 0, err
+	}
+	if companions {
+		if err := w.writeRow(coordinatedSheet, stringsToRow(coordinatedColumns)); err != nil {
+			w.close()
+			return 0, err
+		}
+		if err := w.writeRow(reviewsSheet, stringsToRow(reviewColumns)); err != nil {
+			w.close()
+			return 0, err
+		}
+	}
+
+	cursor, err := productCollection.Find(ctx, filter)
+	if err != nil {
+		w.close()
+		return 0, fmt.Errorf("failed to find products: %v", err)
+	}
+	defer cursor.Close(context.Background())
+
+	exported := 0
+	for cursor.Next(ctx) {
+		var product Product
+		if err := cursor.Decode(&product); err != nil {
+			slog.Warn("Skipping undecodable product", "id", cursor.Current.Lookup("_id").String(), "err", err)
+			continue
+		}
+		if err := writeProduct(w, &product, measurements, companions); err != nil {
+			w.close()
+			return exported, err
+		}
+		exported++
+	}
+	if err := cursor.Err(); err != nil {
+		w.close()
+		return exported, fmt.Errorf("failed to iterate over products: %v", err)
+	}
+
+	if err := w.close(); err != nil {
+		return exported, err
+	}
+	return exported, nil
+}
+
+// writeProduct writes the row of one product and, with companion sheets, its
+// coordinated products and reviews.
+func writeProduct(w exportWriter, product *Product, measurements []string, companions bool) error {
+	row := productRow(product)
+	for _, name := range measurements {
+		row = append(row, measurementCell(product.SizeCharts, name))
+	}
+	if !companions {
+		row = append(row, jsonCell(product.CoordinatedProducts), jsonCell(product.RecommendedProducts), jsonCell(product.Reviews))
+		return w.writeRow(productsSheet, row)
+	}
+	if err := w.writeRow(productsSheet, row); err != nil {
+		return err
+	}
+
+	for _, rel := range []struct {
+		name     string
+		products []CoordinatedProduct
+	}{{"coordinated", product.CoordinatedProducts}, {"recommended", product.RecommendedProducts}} {
+		for _, p := range rel.products {
+			if err := w.writeRow(coordinatedSheet, []any{product.ProductNumber, rel.name, p.ProductNumber, p.Title, p.PriceText, p.PriceJPY, p.ProductURL}); err != nil {
+				return err
+			}
+		}
+	}
+	for _, r := range product.Reviews {
+		if err := w.writeRow(reviewsSheet, []any{
+			product.ProductNumber, r.ReviewId, r.Rating, r.Title, r.Description, r.DateText, timeCell(r.SubmittedAt),
+			r.PurchasedSize, r.UsualSize, r.Height, r.Weight, r.Age, r.Gender, r.Location, r.HelpfulCount, r.UnhelpfulCount,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// productRow flattens product into the cells of productColumns.
+func productRow(p *Product) []any {
+	colors := make([]string, 0, len(p.AvailableColors))
+	for _, c := range p.AvailableColors {
+		colors = append(colors, c.Color)
+	}
+	sizes := make([]string, 0, len(p.AvailableSizes))
+	inStock := make([]string, 0, len(p.AvailableSizes))
+	for _, s := range p.AvailableSizes {
+		sizes = append(sizes, s.Size)
+		if s.InStock {
+			inStock = append(inStock, s.Size)
+		}
+	}
+	if len(sizes) == 0 {
+		sizes = p.AvailableSizeLabels
+	}
+
+	s := p.ReviewSummary
+	return []any{
+		p.ProductNumber, p.ProductURL, p.ModelCode, p.ColorCode, p.Section, p.Category, strings.Join(p.Breadcrumbs, " > "),
+		p.Gender, p.ProductType, p.Sport, p.Title,
+		p.PriceText, p.PriceJPY, p.OriginalPriceJPY, p.SalePriceJPY, p.OnSale, p.DiscountPercent,
+		p.PointsEarned, jsonCell(p.MemberPrice), p.MemberOnly,
+		p.Availability, timeCell(p.ReleaseDate), strings.Join(colors, listSeparator), strings.Join(sizes, listSeparator), strings.Join(inStock, listSeparator),
+		p.DescriptionHeading, p.DescriptionTitle, p.Description, strings.Join(p.Specifications, "\n"),
+		strings.Join(p.Materials, listSeparator), strings.Join(p.CareInstructions, "\n"), p.CountryOfOrigin, strings.Join(p.SizeRemarks, "\n"), strings.Join(p.Tags, listSeparator),
+		s.Rating, s.NumberOfReviews, s.RecommendedCount, s.RecommendedRate, s.Fit, s.Length, s.Quality, s.Comfort,
+		timeCell(&p.UpdatedAt), timeCell(&p.FirstCrawledAt), timeCell(&p.LastSeenAt), p.RunID, p.CrawlerVersion, p.SourceWorker,
+	}
+}
+
+// sizeChartMeasurements returns the names of every size chart measurement of
+// the products matching filter, sorted.
+func sizeChartMeasurements(ctx context.Context, productCollection *mongo.Collection, filter bson.M) ([]string, error) {
+	values, err := productCollection.Distinct(ctx, "size_charts.measurements.name", filter)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list size chart measurements: %v", err)
+	}
+	var names []string
+	for _, v := range values {
+		if name, ok := v.(string); ok && name != "" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// measurementCell joins the values of the named measurement per size, as in
+// "S:60/M:62", taken from the first size chart that has it.
+func measurementCell(charts []SizeChartTable, name string) string {
+	for _, chart := range charts {
+		for _, m := range chart.Measurements {
+			if m.Name != name {
+				continue
+			}
+			var cells []string
+			for _, size := range chart.Sizes {
+				if v, ok := m.Values[size]; ok && v != "" {
+					cells = append(cells, size+":"+v)
+				}
+			}
+			return strings.Join(cells, listSeparator)
+		}
+	}
+	return ""
+}
+
+func jsonCell(v any) string {
+	b, err := json.Marshal(v)
+	if err != nil || string(b) == "null" {
+		return ""
+	}
+	return string(b)
+}
+
+func timeCell(t *time.Time) string {
+	if t == nil || t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+func stringsToRow(values []string) []any {
+	row := make([]any, len(values))
+	for i, v := range values {
+		row[i] = v
+	}
+	return row
+}
+
+// exportWriter writes the rows of an export, sheet by sheet.
+type exportWriter interface {
+	writeRow(sheet string, row []any) error
+	// companionSheets reports whether coordinated products and reviews get
+	// sheets of their own.
+	companionSheets() bool
+	close() error
+}
+
+// csvExportWriter writes the products sheet as CSV. The file starts with a
+// UTF-8 byte order mark, without which Excel garbles the Japanese text.
+type csvExportWriter struct {
+	file *os.File
+	buf  *bufio.Writer
+	csv  *csv.Writer
+}
+
+func newCSVExportWriter(path string) (*csvExportWriter, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s: %v", path, err)
+	}
+	buf := bufio.NewWriter(f)
+	if _, err := io.WriteString(buf, "\ufeff"); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &csvExportWriter{file: f, buf: buf, csv: csv.NewWriter(buf)}, nil
+}
+
+func (w *csvExportWriter) companionSheets() bool { return false }
+
+func (w *csvExportWriter) writeRow(_ string, row []any) error {
+	record := make([]string, len(row))
+	for i, v := range row {
+		switch v := v.(type) {
+		case string:
+			record[i] = v
+		case float64:
+			record[i] = strconv.FormatFloat(v, 'f', -1, 64)
+		default:
+			record[i] = fmt.Sprint(v)
+		}
+	}
+	return w.csv.Write(record)
+}
+
+func (w *csvExportWriter) close() error {
+	w.csv.Flush()
+	err := w.csv.Error()
+	if flushErr := w.buf.Flush(); err == nil {
+		err = flushErr
+	}
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %v", w.file.Name(), err)
+	}
+	return nil
+}
+
+// xlsxExportWriter writes an Excel workbook through excelize stream writers,
+// which keep only the current row in memory.
+type xlsxExportWriter struct {
+	path    string
+	file    *excelize.File
+	streams map[string]*excelize.StreamWriter
+	rows    map[string]int
+}
+
+func newXLSXExportWriter(path string) (*xlsxExportWriter, error) {
+	f := excelize.NewFile()
+	w := &xlsxExportWriter{path: path, file: f, streams: make(map[string]*excelize.StreamWriter), rows: make(map[string]int)}
+	for _, sheet := range []string{productsSheet, coordinatedSheet, reviewsSheet} {
+		if _, err := f.NewSheet(sheet); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("failed to add sheet %s: %v", sheet, err)
+		}
+		stream, err := f.NewStreamWriter(sheet)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("failed to open sheet %s: %v", sheet, err)
+		}
+		w.streams[sheet] = stream
+	}
+	f.DeleteSheet("Sheet1")
+	if index, err := f.GetSheetIndex(productsSheet); err == nil {
+		f.SetActiveSheet(index)
+	}
+	return w, nil
+}
+
+func (w *xlsxExportWriter) companionSheets() bool { return true }
+
+func (w *xlsxExportWriter) writeRow(sheet string, row []any) error {
+	w.rows[sheet]++
+	cell, err := excelize.CoordinatesToCellName(1, w.rows[sheet])
+	if err != nil {
+		return err
+	}
+	if err := w.streams[sheet].SetRow(cell, row); err != nil {
+		return fmt.Errorf("failed to write row %d of sheet %s: %v", w.rows[sheet], sheet, err)
+	}
+	return nil
+}
+
+func (w *xlsxExportWriter) close() error {
+	defer w.file.Close()
+	for sheet, stream := range w.streams {
+		if err := stream.Flush(); err != nil {
+			return fmt.Errorf("failed to write sheet %s: %v", sheet, err)
+		}
+	}
+	if err := w.file.SaveAs(w.path); err != nil {
+		return fmt.Errorf("failed to save %s: %v", w.path, err)
+	}
+	return nil
+}
+
+// parseExportQuery turns a -query value, a MongoDB filter in extended JSON,
+// into a filter document. Dates are written as {"$date": "2024-05-01T00:00:00Z"}.
+func parseExportQuery(s string) (bson.M, error) {
+	if strings.TrimSpace(s) == "" {
+		return bson.M{}, nil
+	}
+	var filter bson.M
+	if err := bson.UnmarshalExtJSON([]byte(s), false, &filter); err != nil {
+		return nil, fmt.Errorf("invalid query %q: %v", s, err)
+	}
+	return filter, nil
+}
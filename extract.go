@@ -0,0 +1,498 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	neturl "net/url"
+	"path"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/tebeka/selenium"
+)
+
+// The extract functions read one section of a product page each, through
+// the DOM of either engine. They return an error when the elements of their
+// section could not be looked up or read; a section the page does not have is
+// no error, its value is just empty. scrapeProduct reports the errors under
+// the section names of the extraction report.
+
+// firstElement returns the first element of dom matching selector, or nil
+// when there is none.
+func firstElement(dom DOM, selector string) (DOMElement, error) {
+	elems, err := dom.findElements(selector)
+	if err != nil || len(elems) == 0 {
+		return nil, err
+	}
+	return elems[0], nil
+}
+
+// elementText returns the text of the first element of dom matching
+// selector, or "" when there is none.
+func elementText(dom DOM, selector string) (string, error) {
+	elem, err := firstElement(dom, selector)
+	if elem == nil {
+		return "", err
+	}
+	return elem.text()
+}
+
+// elementTexts returns the non-empty texts of the elements of dom matching
+// selector.
+func elementTexts(dom DOM, selector string) ([]string, error) {
+	elems, err := dom.findElements(selector)
+	if err != nil {
+		return nil, err
+	}
+	var texts []string
+	for _, elem := range elems {
+		text, err := elem.text()
+		if err != nil {
+			return texts, err
+		}
+		if text != "" {
+			texts = append(texts, text)
+		}
+	}
+	return texts, nil
+}
+
+// extractBreadcrumbs reads the breadcrumb trail of the page at url, without
+// its root.
+func extractBreadcrumbs(dom DOM, url string) ([]BreadcrumbLink, error) {
+	elems, err := dom.findElements(".breadcrumbListItem a")
+	if err != nil {
+		return nil, err
+	}
+	var links []BreadcrumbLink
+	for _, elem := range elems {
+		text, err := elem.text()
+		if err != nil || text == "" {
+			continue
+		}
+		href, _ := elem.attr("href")
+		link := resolveURL(url, href)
+		if isRootBreadcrumb(link) {
+			continue
+		}
+		links = append(links, BreadcrumbLink{Label: text, URL: link})
+	}
+	return links, nil
+}
+
+// extractCategoryName reads the category name shown above the title.
+func extractCategoryName(dom DOM) (string, error) {
+	return elementText(dom, ".categoryName")
+}
+
+// extractTitle reads the product name.
+func extractTitle(dom DOM) (string, error) {
+	return elementText(dom, ".itemTitle")
+}
+
+// extractPrice reads the current price of the page at url.
+func extractPrice(dom DOM, url string) (PriceInfo, error) {
+	price, err := elementText(dom, ".price-value")
+	if err != nil || price == "" {
+		return PriceInfo{}, err
+	}
+	// The tax marker sits next to the price, inside the price block.
+	priceContext, err := elementText(dom, ".articlePrice")
+	if err != nil {
+		return PriceInfo{}, err
+	}
+	info, ok := parsePrice(price, priceContext)
+	if !ok {
+		slog.Warn("Failed to parse price", "url", url, "price", price)
+	}
+	return info, nil
+}
+
+// memberPricing is the adiClub callouts of the price block.
+type memberPricing struct {
+	PointsEarned int
+	MemberPrice  *int // yen, nil when no member price is shown
+	MemberOnly   bool
+}
+
+// Selectors of the adiClub callouts around the price block.
+const (
+	pointsSelector      = ".articlePrice .point, .adiclubPoint, .test-adiclubPoint"
+	memberPriceSelector = ".articlePrice .memberPrice, .adiclubPrice, .test-adiclubPrice"
+	memberOnlySelector  = ".memberOnly, .adiclubMemberOnly, .test-adiclubMemberOnly"
+)
+
+// extractMemberPricing reads the adiClub points a purchase earns and the
+// price for members, which a login-gated product shows instead of a public
+// price. Their amounts are parsed like the main price.
+func extractMemberPricing(dom DOM) (memberPricing, error) {
+	var pricing memberPricing
+	points, err := firstElement(dom, pointsSelector)
+	if err != nil {
+		return pricing, err
+	}
+	if points != nil {
+		pricing.PointsEarned = parsePoints(calloutText(points))
+	}
+	price, err := firstElement(dom, memberPriceSelector)
+	if err != nil {
+		return pricing, err
+	}
+	if price != nil {
+		if amounts := parseYenAmounts(calloutText(price)); len(amounts) > 0 {
+			pricing.MemberPrice = &amounts[0]
+		}
+	}
+	memberOnly, err := firstElement(dom, memberOnlySelector)
+	if err != nil {
+		return pricing, err
+	}
+	pricing.MemberOnly = memberOnly != nil
+	return pricing, nil
+}
+
+// calloutText returns the text of a callout, which the page shows either
+// inline or in a tooltip: the tooltip text is in an attribute of the element,
+// or in a child that is hidden, and so has no rendered text, until hovered.
+func calloutText(elem DOMElement) string {
+	if text, err := elem.text(); err == nil && strings.TrimSpace(text) != "" {
+		return text
+	}
+	for _, name := range []string{"data-tooltip", "data-tippy-content", "title", "aria-label"} {
+		if text, err := elem.attr(name); err == nil && strings.TrimSpace(text) != "" {
+			return text
+		}
+	}
+	markup, err := elem.html()
+	if err != nil {
+		return ""
+	}
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(markup))
+	if err != nil {
+		return ""
+	}
+	return innerText(doc.Selection)
+}
+
+// extractOriginalPrice reads the crossed-out price of a product on sale, ""
+// for one that is not.
+func extractOriginalPrice(dom DOM) (string, error) {
+	return elementText(dom, ".articlePrice .price-crossed-out, .articlePrice del")
+}
+
+// extractColors reads the color swatches of the page at url, each with the
+// product page of its colorway.
+func extractColors(dom DOM, url string) ([]ColorOption, error) {
+	elems, err := dom.findElements(".selectable-image-group .selectableImageListItem")
+	if err != nil {
+		return nil, err
+	}
+	var colors []ColorOption
+	for _, elem := range elems {
+		img, err := findElement(elem, "img")
+		if err != nil {
+			continue
+		}
+		imageSrc, _ := img.attr("src")
+		color, _ := img.attr("alt")
+
+		// The swatch links to the product page of that colorway.
+		href, _ := elem.attr("href")
+		if href == "" {
+			if link, err := findElement(elem, "a"); err == nil {
+				href, _ = link.attr("href")
+			}
+		}
+		variantURL := resolveURL(url, href)
+
+		imageURL := resolveURL(url, imageSrc)
+		if imageURL != "" && color != "" {
+			colors = append(colors, ColorOption{
+				Path:          imageURL,
+				Color:         color,
+				ProductURL:    variantURL,
+				ProductNumber: extractProductNumber(variantURL),
+			})
+		}
+	}
+	return colors, nil
+}
+
+// extractSizes reads the size selector buttons.
+func extractSizes(dom DOM) ([]SizeOption, error) {
+	elems, err := dom.findElements(".sizeSelectorList .sizeSelectorListItemButton")
+	if err != nil {
+		return nil, err
+	}
+	var sizes []SizeOption
+	for _, elem := range elems {
+		option, err := readSizeOption(elem)
+		if err == nil && option.Size != "" {
+			sizes = append(sizes, option)
+		}
+	}
+	return sizes, nil
+}
+
+// extractImages reads the gallery images of the page at url. In a browser
+// session, wd not nil, each image is scrolled into view first, see imageURL.
+func extractImages(wd selenium.WebDriver, dom DOM, url string) ([]Media, error) {
+	elems, err := dom.findElements(".article_image_wrapper img.test-img")
+	if err != nil {
+		return nil, err
+	}
+	var media []Media
+	for _, elem := range elems {
+		if path := imageURL(wd, elem, url); path != "" {
+			media = append(media, Media{Path: path, Type: "image"})
+		}
+	}
+	return media, nil
+}
+
+// extractVideos reads the product videos of the page at url.
+func extractVideos(dom DOM, url string) ([]Media, error) {
+	elems, err := dom.findElements(".pdp-article-video-wrap video")
+	if err != nil {
+		return nil, err
+	}
+	var media []Media
+	for _, elem := range elems {
+		src, err := elem.attr("src")
+		if err != nil {
+			return media, err
+		}
+		if path := resolveURL(url, src); path != "" {
+			media = append(media, Media{Path: path, Type: "video"})
+		}
+	}
+	return media, nil
+}
+
+// extractCarousel reads the product tiles of the first carousel matching
+// containerSelector, unfolding it first in a browser session, and keeps those
+// that name or show a product.
+func extractCarousel(dom DOM, containerSelector, url string) ([]CoordinatedProduct, error) {
+	container, err := firstElement(dom, containerSelector)
+	if container == nil {
+		return nil, err
+	}
+	if elem, ok := webElement(container); ok {
+		expandCarousel(elem, ".carouselListitem")
+	}
+	elems, err := container.findElements(".carouselListitem")
+	if err != nil {
+		return nil, err
+	}
+	var products []CoordinatedProduct
+	for _, elem := range elems {
+		product := readCarouselItem(elem, url)
+		if product.ProductNumber != "" || product.Path != "" {
+			products = append(products, product)
+		}
+	}
+	return products, nil
+}
+
+// productDescription is the description block of a product page.
+type productDescription struct {
+	Heading string
+	Title   string
+	Text    string
+	HTML    string // markup of Text, unsanitized
+}
+
+// extractDescription reads the heading, subheading and text of the
+// description, the text both as text and as markup.
+func extractDescription(dom DOM) (productDescription, error) {
+	var description productDescription
+	var err error
+	if description.Heading, err = elementText(dom, ".heading.itemName.test-commentItem-topHeading"); err != nil {
+		return description, err
+	}
+	if description.Title, err = elementText(dom, ".heading.itemFeature.test-commentItem-subheading"); err != nil {
+		return description, err
+	}
+	text, err := firstElement(dom, ".description.clearfix.test-descriptionBlock .description_part.details.test-itemComment-descriptionPart .commentItem-mainText.test-commentItem-mainText")
+	if text == nil {
+		return description, err
+	}
+	if description.Text, err = text.text(); err != nil {
+		return description, err
+	}
+	description.HTML, err = text.html()
+	return description, err
+}
+
+// specificationItemsSelector matches footwear's specification bullets.
+const specificationItemsSelector = ".articleFeatures.description_part .articleFeaturesItem"
+
+// extractSpecifications reads the specification lines, footwear's bullets
+// followed by the rows of apparel's table.
+func extractSpecifications(dom DOM) ([]string, error) {
+	lines, err := elementTexts(dom, specificationItemsSelector)
+	if err != nil {
+		return lines, err
+	}
+	return append(lines, scrapeDetailTable(dom)...), nil
+}
+
+// extractSpecificationsHTML returns the sanitized markup of the specification
+// bullets of the page at url that hold more than text, such as a list, a line
+// break or a link, in page order. Bullets of plain text are left out, as
+// their text is all there is.
+func extractSpecificationsHTML(dom DOM, url string) ([]string, error) {
+	items, err := dom.findElements(specificationItemsSelector)
+	if err != nil {
+		return nil, err
+	}
+	var markups []string
+	for _, item := range items {
+		markup, err := item.html()
+		if err != nil {
+			return markups, err
+		}
+		if markup = sanitizeHTML(markup, url); strings.Contains(markup, "<") {
+			markups = append(markups, markup)
+		}
+	}
+	return markups, nil
+}
+
+// extractSpecialDescriptions reads the feature blocks below the description.
+func extractSpecialDescriptions(dom DOM) ([]SpecialDescription, error) {
+	elems, err := dom.findElements(".contents .content")
+	if err != nil {
+		return nil, err
+	}
+	var descriptions []SpecialDescription
+	for _, content := range elems {
+		var special SpecialDescription
+		if title, err := elementText(content, ".tecTextTitle"); err == nil {
+			special.Title = strings.TrimSpace(title)
+		}
+		if text, err := elementText(content, ".tecText, .tecTextBody, .item_part.details p"); err == nil {
+			special.Text = strings.TrimSpace(text)
+		}
+		if img, err := firstElement(content, "div.item_part.illustration img"); img != nil && err == nil {
+			alt, _ := img.attr("alt")
+			special.Description = strings.TrimSpace(alt)
+		}
+		if special.Description == "" {
+			special.Description = special.Text
+		}
+
+		// Blocks without a title are layout filler, not a feature.
+		if special.Title != "" && special.Description != "" {
+			descriptions = append(descriptions, special)
+		}
+	}
+	return descriptions, nil
+}
+
+// extractSizeCharts reads every size chart table of the product page loaded
+// by ex, each with the heading it is shown under in a browser session.
+func extractSizeCharts(ex Extractor) ([]SizeChartTable, error) {
+	tables, err := ex.dom().findElements(".sizeChartTable")
+	if err != nil {
+		return nil, fmt.Errorf("failed to find size chart tables: %v", err)
+	}
+	if len(tables) == 0 {
+		return nil, fmt.Errorf("no size chart table on the page")
+	}
+
+	var charts []SizeChartTable
+	for i, table := range tables {
+		chart, err := readSizeChartTable(table)
+		if err != nil {
+			return charts, fmt.Errorf("size chart table %d: %v", i+1, err)
+		}
+		label := ""
+		if elem, ok := webElement(table); ok {
+			label = sizeChartLabel(ex.browser(), elem)
+		}
+		charts = append(charts, SizeChartTable{Label: label, SizeChart: chart})
+	}
+	return charts, nil
+}
+
+// extractSizeRemarks reads the notes below the size chart.
+func extractSizeRemarks(dom DOM) ([]string, error) {
+	return elementTexts(dom, ".remarkList.test-remarkList .sizeDescriptionRemark")
+}
+
+// extractReviews reads the rating summary and the reviews of the product,
+// from the BazaarVoice API with -reviews-source=api and otherwise, or when
+// the API fails, from the page loaded by ex. Paging through the reviews of a
+// page takes clicks, so fetched HTML only gives the summary.
+func extractReviews(cfg *Config, ex Extractor, productNumber, url string) (ReviewSummary, []Review, error) {
+	if cfg.ReviewsSource == "api" {
+		summary, reviews, err := fetchAPIReviews(context.Background(), cfg, productNumber)
+		if err == nil {
+			return summary, reviews, nil
+		}
+		slog.Warn("Failed to fetch reviews from the API, reading them from the page", "url", url, "err", err)
+	}
+
+	summary := scrapeReviewSummary(ex.dom())
+	if ex.browser() == nil {
+		return summary, nil, nil
+	}
+	reviews, err := scrapeReviews(cfg, ex.browser(), cfg.MaxReviews)
+	return summary, reviews, err
+}
+
+// extractTags reads the tag links of the product page at url, one per slug:
+// the shop lists the same tag again under another casing. A tag without text
+// is labeled with its slug.
+func extractTags(dom DOM, url string) ([]TagLink, error) {
+	elems, err := dom.findElements(".itemTagsPosition a")
+	if err != nil {
+		return nil, err
+	}
+	var tags []TagLink
+	seen := make(map[string]bool)
+	for _, elem := range elems {
+		label, err := elem.text()
+		if err != nil {
+			return tags, err
+		}
+		href, _ := elem.attr("href")
+		tag := TagLink{Label: strings.TrimSpace(label), URL: resolveURL(url, href)}
+		tag.Slug = tagSlug(tag.URL)
+		if tag.Label == "" {
+			tag.Label = tag.Slug
+		}
+		key := tag.Slug
+		if key == "" {
+			key = strings.ToLower(tag.Label)
+		}
+		if key == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+		tags = append(tags, tag)
+	}
+	return tags, nil
+}
+
+// tagSlug returns the tag a tag link searches for, lower-cased: its tag or
+// keyword parameter, or else the last segment of its path.
+func tagSlug(link string) string {
+	u, err := neturl.Parse(link)
+	if err != nil || link == "" {
+		return ""
+	}
+	query := u.Query()
+	for _, name := range []string{"tag", "tags", "keyword", "q"} {
+		if value := strings.TrimSpace(query.Get(name)); value != "" {
+			return strings.ToLower(value)
+		}
+	}
+	slug := path.Base(strings.TrimSuffix(u.Path, "/"))
+	if slug == "." || slug == "/" {
+		return ""
+	}
+	return strings.ToLower(slug)
+}
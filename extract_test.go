@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestExtractSpecialDescriptions checks that a block without a title is
+// skipped without its text ending up in the blocks around it.
+func TestExtractSpecialDescriptions(t *testing.T) {
+	dom := parseDOM(t, `
+<div class="contents">
+  <div class="content">
+    <p class="tecTextTitle">BOOST</p>
+    <div class="item_part details"><p>反発力に優れたクッショニング。</p></div>
+    <div class="item_part illustration"><img src="/boost.png" alt="BOOSTフォーム"></div>
+  </div>
+  <div class="content">
+    <div class="item_part details"><p>レイアウト用のブロック。</p></div>
+  </div>
+  <div class="content">
+    <p class="tecTextTitle">PRIMEKNIT</p>
+    <p class="tecText">足にフィットするニットアッパー。</p>
+  </div>
+</div>`)
+
+	got, err := extractSpecialDescriptions(dom)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []SpecialDescription{
+		{Title: "BOOST", Text: "反発力に優れたクッショニング。", Description: "BOOSTフォーム"},
+		{Title: "PRIMEKNIT", Text: "足にフィットするニットアッパー。", Description: "足にフィットするニットアッパー。"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("extractSpecialDescriptions() = %+v, want %+v", got, want)
+	}
+}
+
+var update = flag.Bool("update", false, "rewrite the golden files of testdata")
+
+// goldenSection is the outcome of an extract function in a golden file.
+type goldenSection struct {
+	Value any    `json:"value"`
+	Error string `json:"error,omitempty"`
+}
+
+// section turns the results of an extract function into a goldenSection.
+func section[T any](value T, err error) goldenSection {
+	s := goldenSection{Value: value}
+	if err != nil {
+		s.Error = err.Error()
+	}
+	return s
+}
+
+// goldenExtractors are the extract functions the golden tests run, by the
+// section of the extraction report they read.
+var goldenExtractors = map[string]func(cfg *Config, ex Extractor, url string) goldenSection{
+	"breadcrumbs": func(_ *Config, ex Extractor, url string) goldenSection {
+		return section(extractBreadcrumbs(ex.dom(), url))
+	},
+	"category":       func(_ *Config, ex Extractor, _ string) goldenSection { return section(extractCategoryName(ex.dom())) },
+	"title":          func(_ *Config, ex Extractor, _ string) goldenSection { return section(extractTitle(ex.dom())) },
+	"price":          func(_ *Config, ex Extractor, url string) goldenSection { return section(extractPrice(ex.dom(), url)) },
+	"original price": func(_ *Config, ex Extractor, _ string) goldenSection { return section(extractOriginalPrice(ex.dom())) },
+	"member pricing": func(_ *Config, ex Extractor, _ string) goldenSection { return section(extractMemberPricing(ex.dom())) },
+	"badges": func(_ *Config, ex Extractor, _ string) goldenSection {
+		return section(extractBadges(ex.dom(), productBadgeSelector))
+	},
+	"colors":        func(_ *Config, ex Extractor, url string) goldenSection { return section(extractColors(ex.dom(), url)) },
+	"sizes":         func(_ *Config, ex Extractor, _ string) goldenSection { return section(extractSizes(ex.dom())) },
+	"purchase info": func(cfg *Config, ex Extractor, _ string) goldenSection { return section(extractPurchaseInfo(cfg, ex)) },
+	"images": func(_ *Config, ex Extractor, url string) goldenSection {
+		return section(extractImages(nil, ex.dom(), url))
+	},
+	"videos": func(_ *Config, ex Extractor, url string) goldenSection { return section(extractVideos(ex.dom(), url)) },
+	"coordinated": func(_ *Config, ex Extractor, url string) goldenSection {
+		return section(extractCarousel(ex.dom(), ".coordinateItems", url))
+	},
+	"description":    func(_ *Config, ex Extractor, _ string) goldenSection { return section(extractDescription(ex.dom())) },
+	"specifications": func(_ *Config, ex Extractor, _ string) goldenSection { return section(extractSpecifications(ex.dom())) },
+	"spec markup": func(_ *Config, ex Extractor, url string) goldenSection {
+		return section(extractSpecificationsHTML(ex.dom(), url))
+	},
+	"special": func(_ *Config, ex Extractor, _ string) goldenSection {
+		return section(extractSpecialDescriptions(ex.dom()))
+	},
+	"size chart":   func(_ *Config, ex Extractor, _ string) goldenSection { return section(extractSizeCharts(ex)) },
+	"size remarks": func(_ *Config, ex Extractor, _ string) goldenSection { return section(extractSizeRemarks(ex.dom())) },
+	"reviews": func(cfg *Config, ex Extractor, url string) goldenSection {
+		return section(extractReviewSummary(cfg, ex, url))
+	},
+	"tags": func(_ *Config, ex Extractor, url string) goldenSection { return section(extractTags(ex.dom(), url)) },
+}
+
+// extractReviewSummary returns the review summary extractReviews reads from
+// the page, without reviews as it is no browser session.
+func extractReviewSummary(cfg *Config, ex Extractor, url string) (ReviewSummary, error) {
+	summary, _, err := extractReviews(cfg, ex, extractProductNumber(url), url)
+	return summary, err
+}
+
+// TestExtractGolden runs every extract function over the saved product pages
+// of testdata through htmlElement and compares what they read with the
+// golden file of the page, <page>.golden.json. Run with -update to rewrite
+// the golden files after a deliberate change.
+func TestExtractGolden(t *testing.T) {
+	pages := []struct {
+		fixture, url string
+	}{
+		{"product_shoe.html", "https://shop.adidas.jp/products/GZ0127/"},
+		{"product_no_size_chart.html", "https://shop.adidas.jp/products/HT3432/"},
+		// A page with none of the optional sections reads them as empty.
+		{"product_sold_out.html", "https://shop.adidas.jp/products/FX5502/"},
+	}
+	cfg := testConfig(t)
+	for _, page := range pages {
+		t.Run(page.fixture, func(t *testing.T) {
+			ex := &fixtureExtractor{path: filepath.Join("testdata", page.fixture)}
+			if err := ex.load(page.url); err != nil {
+				t.Fatal(err)
+			}
+			sections := make(map[string]goldenSection, len(goldenExtractors))
+			for name, extract := range goldenExtractors {
+				sections[name] = extract(cfg, ex, page.url)
+			}
+
+			var b bytes.Buffer
+			enc := json.NewEncoder(&b)
+			enc.SetEscapeHTML(false)
+			enc.SetIndent("", "  ")
+			if err := enc.Encode(sections); err != nil {
+				t.Fatal(err)
+			}
+			golden := filepath.Join("testdata", strings.TrimSuffix(page.fixture, ".html")+".golden.json")
+			if *update {
+				if err := os.WriteFile(golden, b.Bytes(), 0o644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(b.Bytes(), want) {
+				t.Errorf("extracted sections differ from %s, got:\n%s", golden, b.Bytes())
+			}
+		})
+	}
+}
+
+func TestExtractMemberPricing(t *testing.T) {
+	yen := func(amount int) *int { return &amount }
+	tests := []struct {
+		name, markup string
+		want         memberPricing
+	}{
+		{"inline callouts",
+			`<div class="articlePrice"><span class="price-value">¥12,100</span><span class="point">1,210ポイント獲得</span><span class="memberPrice">メンバー価格 ¥10,890</span></div>`,
+			memberPricing{PointsEarned: 1210, MemberPrice: yen(10890)}},
+		{"points in a tooltip attribute",
+			`<div class="articlePrice"><span class="point" data-tooltip="1,210pt"></span></div>`,
+			memberPricing{PointsEarned: 1210}},
+		{"points in a hidden child",
+			`<div class="adiclubPoint"><i class="icon"></i><div class="tooltip" hidden><p>購入で</p><p>605ポイント</p></div></div>`,
+			memberPricing{PointsEarned: 605}},
+		{"member only",
+			`<div class="adiclubMemberOnly">adiClubメンバー限定</div><div class="adiclubPrice">10,890円</div>`,
+			memberPricing{MemberPrice: yen(10890), MemberOnly: true}},
+		{"member price without an amount",
+			`<div class="articlePrice"><span class="memberPrice">ログインして価格を確認</span></div>`,
+			memberPricing{}},
+		{"no callouts",
+			`<div class="articlePrice"><span class="price-value">¥12,100</span></div>`,
+			memberPricing{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := extractMemberPricing(parseDOM(t, tt.markup))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.PointsEarned != tt.want.PointsEarned || got.MemberOnly != tt.want.MemberOnly {
+				t.Errorf("extractMemberPricing() = %+v, want %+v", got, tt.want)
+			}
+			if (got.MemberPrice == nil) != (tt.want.MemberPrice == nil) || got.MemberPrice != nil && *got.MemberPrice != *tt.want.MemberPrice {
+				t.Errorf("MemberPrice = %v, want %v", got.MemberPrice, tt.want.MemberPrice)
+			}
+		})
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+)
+
+// sectionResult is one line of the extraction report of scrape-one: how many
+// elements a section of the product page gave, and why it failed if it did.
+type sectionResult struct {
+	Section string `json:"section"`
+	Found   int    `json:"found"`
+	Error   string `json:"error,omitempty"`
+}
+
+// reportedSections are the sections of a product in the extraction report,
+// each with the number of values scraped for it. Their names match the
+// sections of SectionError where there is one.
+var reportedSections = []struct {
+	Name  string
+	Count func(p *Product) int
+}{
+	{"title", func(p *Product) int { return countString(p.Title) }},
+	{"price", func(p *Product) int { return countString(p.PriceText) }},
+	{"breadcrumbs", func(p *Product) int { return len(p.Breadcrumbs) }},
+	{"category", func(p *Product) int { return countString(p.Category) }},
+	{"colors", func(p *Product) int { return len(p.AvailableColors) }},
+	{"sizes", func(p *Product) int { return len(p.AvailableSizes) }},
+	{"availability", func(p *Product) int { return countString(p.Availability) }},
+	{"badges", func(p *Product) int { return len(p.Badges) }},
+	{"purchase info", func(p *Product) int {
+		if p.PurchaseInfo == nil {
+			return 0
+		}
+		return countString(p.PurchaseInfo.DeliveryNote) + countString(p.PurchaseInfo.ReturnPolicy) + countString(p.PurchaseInfo.ShippingNote)
+	}},
+	{"images", func(p *Product) int { return countMedia(p.Media, "image") }},
+	{"videos", func(p *Product) int { return countMedia(p.Media, "video") }},
+	{"coordinated", func(p *Product) int { return len(p.CoordinatedProducts) }},
+	{"recommended", func(p *Product) int { return len(p.RecommendedProducts) }},
+	{"description", func(p *Product) int { return countString(p.Description) }},
+	{"specifications", func(p *Product) int {
+		return len(p.Specifications) + len(p.Materials) + len(p.CareInstructions) + countString(p.CountryOfOrigin)
+	}},
+	{"special description", func(p *Product) int { return len(p.SpecialDescription) }},
+	{"technology badges", func(p *Product) int { return len(p.TechnologyBadges) }},
+	{"size chart", func(p *Product) int { return len(p.SizeCharts) }},
+	{"size remarks", func(p *Product) int { return len(p.SizeRemarks) }},
+	{"reviews", func(p *Product) int { return len(p.Reviews) }},
+	{"tags", func(p *Product) int { return len(p.Tags) }},
+}
+
+// countString counts s as one value unless it is empty.
+func countString(s string) int {
+	if s == "" {
+		return 0
+	}
+	return 1
+}
+
+// countMedia counts the media of mediaType.
+func countMedia(media []Media, mediaType string) int {
+	n := 0
+	for _, m := range media {
+		if m.Type == mediaType {
+			n++
+		}
+	}
+	return n
+}
+
+// extractionReport lists every section of product with what was found for
+// it, followed by the failed sections that have no count, such as the page
+// load or the scroll.
+func extractionReport(product *Product, sectionErrs []*SectionError) []sectionResult {
+	errs := make(map[string]string)
+	var unreported []string
+	for _, err := range sectionErrs {
+		if _, ok := errs[err.Section]; !ok {
+			errs[err.Section] = err.Err.Error()
+			unreported = append(unreported, err.Section)
+		}
+	}
+
+	var report []sectionResult
+	for _, section := range reportedSections {
+		report = append(report, sectionResult{Section: section.Name, Found: section.Count(product), Error: errs[section.Name]})
+		delete(errs, section.Name)
+	}
+	for _, section := range unreported {
+		if msg, ok := errs[section]; ok {
+			report = append(report, sectionResult{Section: section, Error: msg})
+		}
+	}
+	return report
+}
+
+// writeExtractionReport prints report as a table, with the empty and failed
+// sections marked.
+func writeExtractionReport(out io.Writer, report []sectionResult) error {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SECTION\tRESULT\tFOUND\tERROR")
+	for _, r := range report {
+		result := "ok"
+		switch {
+		case r.Error != "":
+			result = "FAILED"
+		case r.Found == 0:
+			result = "EMPTY"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\n", r.Section, result, r.Found, r.Error)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// failedURL is a product URL in the failed_urls collection: a URL whose
+// last scrape failed, kept so that it can be retried with retry-failed
+// instead of being lost in the logs.
+type failedURL struct {
+	URL           string    `json:"url" bson:"url"`
+	Section       string    `json:"section" bson:"section"`
+	Category      string    `json:"category" bson:"category"`
+	PageNo        int       `json:"pageno" bson:"pageno"`
+	ErrorClass    string    `json:"error_class" bson:"error_class"`
+	Error         string    `json:"error" bson:"error"`
+	Attempts      int       `json:"attempts" bson:"attempts"`
+	FirstFailedAt time.Time `json:"first_failed_at" bson:"first_failed_at"`
+	LastFailedAt  time.Time `json:"last_failed_at" bson:"last_failed_at"`
+	// Permanent is set once Attempts reaches -max-failed-attempts;
+	// retry-failed leaves such URLs alone.
+	Permanent bool `json:"permanent" bson:"permanent"`
+	// Artifacts are the page snapshots of the last failure, see
+	// -artifacts-dir, and MissingFields the required fields an incomplete
+	// product lacked.
+	Artifacts     []string `json:"artifacts,omitempty" bson:"artifacts,omitempty"`
+	MissingFields []string `json:"missing_fields,omitempty" bson:"missing_fields,omitempty"`
+}
+
+// Error classes of a failedURL.
+const (
+	failureTimeout    = "timeout"     // the page did not load in time
+	failureLoad       = "load_error"  // the page failed to load otherwise
+	failureNotFound   = "not_found"   // there is no product page at the URL
+	failureBlocked    = "blocked"     // the site refused to serve the page
+	failureParse      = "parse_error" // the page loaded but gave no product that could be saved
+	failurePanic      = "panic"       // scraping the page panicked, a bug of the crawler
+	failureIncomplete = "incomplete"  // the product lacked one of the -required-fields and was not stored
+)
+
+// failureClasses lists the error classes retry-failed can select.
+var failureClasses = []string{failureTimeout, failureLoad, failureNotFound, failureBlocked, failureParse, failurePanic, failureIncomplete}
+
+// loadFailureClass returns the error class of a page that failed to load.
+func loadFailureClass(err error) string {
+	var stateErr *pageStateError
+	var panicErr *panicError
+	switch {
+	case errors.As(err, &stateErr) && stateErr.State == statusNotFound:
+		return failureNotFound
+	case errors.As(err, &stateErr) && stateErr.State == statusBlocked:
+		return failureBlocked
+	case errors.As(err, &panicErr):
+		return failurePanic
+	case isTimeoutError(err):
+		return failureTimeout
+	}
+	return failureLoad
+}
+
+// trackFailure records the outcome of scraping productURL in the failed
+// URLs: a failure of class is added to them, with the paths of the page
+// snapshots taken of it, and a success, with class "", removes the URL from
+// them.
+func trackFailure(ctx context.Context, cfg *Config, store Storage, productURL ProductURL, class string, scrapeErr error, artifacts []string) {
+	ctx = context.WithoutCancel(ctx)
+	if class == "" {
+		if err := store.clearFailure(ctx, productURL.URL); err != nil {
+			slog.ErrorContext(ctx, "Failed to remove product URL from the failed URLs", "err", err)
+		}
+		return
+	}
+	failure := failedURL{
+		URL:          productURL.URL,
+		Section:      productURL.Section,
+		Category:     productURL.Category,
+		PageNo:       productURL.PageNo,
+		ErrorClass:   class,
+		Error:        fmt.Sprint(scrapeErr),
+		LastFailedAt: time.Now().UTC(),
+		Artifacts:    artifacts,
+	}
+	var incomplete *incompleteError
+	if errors.As(scrapeErr, &incomplete) {
+		failure.MissingFields = incomplete.Fields
+	}
+	if err := store.recordFailure(ctx, failure, cfg.MaxFailedAttempts); err != nil {
+		slog.ErrorContext(ctx, "Failed to record failed product URL", "err", err)
+	}
+}
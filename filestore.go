@@ -0,0 +1,791 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// outputDirPrefix selects file storage in -output, as in dir:///data/adidas.
+const outputDirPrefix = "dir://"
+
+// Files of a file storage directory.
+const (
+	productURLsFile = "product_urls.ndjson"    // product URLs in discovery order
+	indexFile       = "index.ndjson"           // scrape status changes, the last one per URL wins
+	productsDir     = "products"               // one <product number>.json per product
+	runsFile        = "runs.ndjson"            // crawl runs as they start and finish, the last one per run wins
+	failedFile      = "failed_urls.ndjson"     // failed URLs, rewritten whole on every change
+	historyFile     = "product_history.ndjson" // price and stock changes of products
+)
+
+// fileProductURL is a product URL with the scrape state kept in the index.
+type fileProductURL struct {
+	ProductURL
+	NotFoundCount int            `json:"not_found_count,omitempty"`
+	Fields        map[string]any `json:"fields,omitempty"` // as passed to markProductURL, e.g. final_url
+	Deleted       bool           `json:"deleted,omitempty"`
+}
+
+// fileStorage is the Storage used without a database. Discovery appends to
+// product_urls.ndjson, every change of a scrape status is appended to
+// index.ndjson and every product is written to products/<number>.json. The
+// state of all URLs is held in memory and rebuilt from the two files on open,
+// so an interrupted run resumes like it does with MongoDB. Only one crawler
+// process may use a directory at a time.
+type fileStorage struct {
+	dir string
+
+	mu       sync.Mutex
+	urls     map[string]*fileProductURL
+	order    []string // URLs in discovery order
+	products map[string]bool
+	failures map[string]*failedURL
+	urlLog   *os.File
+	index    *os.File
+}
+
+func openFileStorage(dir string) (*fileStorage, error) {
+	if err := os.MkdirAll(filepath.Join(dir, productsDir), 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create output directory: %v", err)
+	}
+	s := &fileStorage{dir: dir, urls: make(map[string]*fileProductURL), products: make(map[string]bool), failures: make(map[string]*failedURL)}
+
+	err := readNDJSONFile(filepath.Join(dir, productURLsFile), func(line []byte) error {
+		var u fileProductURL
+		if err := json.Unmarshal(line, &u.ProductURL); err != nil {
+			return err
+		}
+		if _, ok := s.urls[u.URL]; !ok {
+			s.urls[u.URL] = &u
+			s.order = append(s.order, u.URL)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = readNDJSONFile(filepath.Join(dir, indexFile), func(line []byte) error {
+		var u fileProductURL
+		if err := json.Unmarshal(line, &u); err != nil {
+			return err
+		}
+		if _, ok := s.urls[u.URL]; ok {
+			s.urls[u.URL] = &u
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := s.compactIndex(); err != nil {
+		return nil, err
+	}
+	err = readNDJSONFile(filepath.Join(dir, failedFile), func(line []byte) error {
+		var f failedURL
+		if err := json.Unmarshal(line, &f); err != nil {
+			return err
+		}
+		s.failures[f.URL] = &f
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(filepath.Join(dir, productsDir))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list products: %v", err)
+	}
+	for _, entry := range entries {
+		if number, ok := strings.CutSuffix(entry.Name(), ".json"); ok {
+			s.products[number] = true
+		}
+	}
+
+	if s.urlLog, err = os.OpenFile(filepath.Join(dir, productURLsFile), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644); err != nil {
+		return nil, fmt.Errorf("failed to open %s: %v", productURLsFile, err)
+	}
+	if s.index, err = os.OpenFile(filepath.Join(dir, indexFile), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644); err != nil {
+		s.urlLog.Close()
+		return nil, fmt.Errorf("failed to open %s: %v", indexFile, err)
+	}
+	slog.Info("Using output directory", "dir", dir, "product_urls", len(s.order), "products", len(s.products))
+	return s, nil
+}
+
+// readNDJSONFile calls fn with every line of path. A missing file has no lines.
+func readNDJSONFile(path string, fn func(line []byte) error) error {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %v", path, err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		if err := fn(scanner.Bytes()); err != nil {
+			// A line cut short by a crash is dropped rather than failing the run.
+			slog.Warn("Skipping unreadable line", "file", path, "line", lineNo, "err", err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read %s: %v", path, err)
+	}
+	return nil
+}
+
+// compactIndex rewrites the index with one line per URL that has a scrape
+// state, so it does not grow without bound over many runs.
+func (s *fileStorage) compactIndex() error {
+	path := filepath.Join(s.dir, indexFile)
+	return writeFileAtomic(path, func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		for _, url := range s.order {
+			u := s.urls[url]
+			if !u.Deleted && (u.Status == "" || u.Status == statusPending && u.Error == "") {
+				continue
+			}
+			if err := enc.Encode(u); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// writeFileAtomic writes path through a temporary file renamed into place, so
+// readers never see a partly written file.
+func writeFileAtomic(path string, write func(w io.Writer) error) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	buf := bufio.NewWriter(tmp)
+	if err := write(buf); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	if err := buf.Flush(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	return nil
+}
+
+func (s *fileStorage) prepare(ctx context.Context) error {
+	return nil
+}
+
+func (s *fileStorage) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.urlLog.Close()
+	if indexErr := s.index.Close(); err == nil {
+		err = indexErr
+	}
+	return err
+}
+
+func (s *fileStorage) countProductURLs(ctx context.Context) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := int64(0)
+	for _, u := range s.urls {
+		if !u.Deleted {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (s *fileStorage) saveProductURL(ctx context.Context, productURL ProductURL) (bool, error) {
+	stampProductURL(ctx, &productURL, time.Now().UTC())
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if u, ok := s.urls[productURL.URL]; ok {
+		if !u.Deleted {
+			return false, nil
+		}
+		// Found again after -prune-dead deleted it.
+		return true, s.update(&fileProductURL{ProductURL: productURL})
+	}
+	if err := appendJSONLine(s.urlLog, productURL); err != nil {
+		return false, err
+	}
+	s.order = append(s.order, productURL.URL)
+	s.urls[productURL.URL] = &fileProductURL{ProductURL: productURL}
+	return true, nil
+}
+
+func (s *fileStorage) countPendingProductURLs(ctx context.Context, categories *regexp.Regexp) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := int64(0)
+	for _, u := range s.urls {
+		if !u.Deleted && (u.Status == statusPending || u.Status == "") && (categories == nil || categories.MatchString(u.Category)) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (s *fileStorage) eachPendingProductURL(ctx context.Context, categories *regexp.Regexp, limit int, fn func(ProductURL) bool) error {
+	// fn hands the URLs to workers that call back into the storage, so the
+	// pending URLs are collected before the lock is released.
+	s.mu.Lock()
+	var pending []ProductURL
+	for _, url := range s.order {
+		u := s.urls[url]
+		if u.Deleted || (u.Status != statusPending && u.Status != "") {
+			continue
+		}
+		if categories != nil && !categories.MatchString(u.Category) {
+			continue
+		}
+		pending = append(pending, u.ProductURL)
+		if limit > 0 && len(pending) == limit {
+			break
+		}
+	}
+	s.mu.Unlock()
+
+	for _, productURL := range pending {
+		if ctx.Err() != nil || !fn(productURL) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// eachStaleProductURL reads every product file to learn when its product
+// was last seen, so it is slow for a large catalog.
+func (s *fileStorage) eachStaleProductURL(ctx context.Context, categories *regexp.Regexp, before time.Time, limit int, fn func(ProductURL) bool) error {
+	type candidate struct {
+		ProductURL
+		seenAt time.Time // zero when the URL has no product
+	}
+	s.mu.Lock()
+	seen := make(map[string]time.Time, len(s.products))
+	for number := range s.products {
+		path, err := s.productPath(number)
+		if err != nil {
+			continue
+		}
+		product, err := s.readProduct(path)
+		if err != nil {
+			s.mu.Unlock()
+			return err
+		}
+		seenAt := product.LastSeenAt
+		if seenAt.IsZero() {
+			seenAt = product.UpdatedAt
+		}
+		seen[product.ProductURL] = seenAt
+	}
+	var stale []candidate
+	for _, url := range s.order {
+		u := s.urls[url]
+		if u.Deleted || !slices.Contains([]string{"", statusPending, statusDone, statusFailed, statusComingSoon}, u.Status) {
+			continue
+		}
+		if categories != nil && !categories.MatchString(u.Category) {
+			continue
+		}
+		if seenAt := seen[url]; seenAt.Before(before) {
+			stale = append(stale, candidate{u.ProductURL, seenAt})
+		}
+	}
+	s.mu.Unlock()
+
+	slices.SortStableFunc(stale, func(a, b candidate) int { return a.seenAt.Compare(b.seenAt) })
+	if limit > 0 && len(stale) > limit {
+		stale = stale[:limit]
+	}
+	for _, c := range stale {
+		if ctx.Err() != nil || !fn(c.ProductURL) {
+			return nil
+		}
+	}
+	return nil
+}
+
+func (s *fileStorage) claimProductURL(ctx context.Context, url string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.urls[url]
+	if !ok || u.Deleted || (u.Status != statusPending && u.Status != "") {
+		return false, nil
+	}
+	next := *u
+	next.Status = statusInProgress
+	next.ClaimedAt = time.Now().UTC()
+	stampProductURL(ctx, &next.ProductURL, next.ClaimedAt)
+	return true, s.update(&next)
+}
+
+func (s *fileStorage) markProductURL(ctx context.Context, url, status string, scrapeErr error, fields map[string]any) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.urls[url]
+	if !ok {
+		return nil
+	}
+	next := *u
+	next.Status = status
+	next.ClaimedAt = time.Time{}
+	next.Error = ""
+	stampProductURL(ctx, &next.ProductURL, time.Now().UTC())
+	if urlScraped(status) {
+		next.CrawledAt = next.UpdatedAt
+	}
+	if scrapeErr != nil {
+		next.Error = scrapeErr.Error()
+	}
+	if status != statusNotFound {
+		next.NotFoundCount = 0
+	}
+	if runID, ok := fields["run_id"].(string); ok {
+		next.RunID = runID
+	}
+	if len(fields) > 0 {
+		next.Fields = make(map[string]any, len(u.Fields)+len(fields))
+		for k, v := range u.Fields {
+			next.Fields[k] = v
+		}
+		for k, v := range fields {
+			if k != "run_id" {
+				next.Fields[k] = v
+			}
+		}
+		if availability, ok := fields["availability"].(string); ok {
+			next.Availability = availability
+		}
+	}
+	return s.update(&next)
+}
+
+func (s *fileStorage) releaseStaleClaims(ctx context.Context, timeout time.Duration) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cutoff := time.Now().UTC().Add(-timeout)
+	released := int64(0)
+	for _, url := range s.order {
+		u := s.urls[url]
+		if u.Deleted || u.Status != statusInProgress || !u.ClaimedAt.Before(cutoff) {
+			continue
+		}
+		next := *u
+		next.Status = statusPending
+		next.ClaimedAt = time.Time{}
+		next.UpdatedAt = time.Now().UTC()
+		if err := s.update(&next); err != nil {
+			return released, err
+		}
+		released++
+	}
+	return released, nil
+}
+
+func (s *fileStorage) countNotFound(ctx context.Context, url string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.urls[url]
+	if !ok {
+		return 0, fmt.Errorf("unknown product URL %s", url)
+	}
+	next := *u
+	next.NotFoundCount++
+	return next.NotFoundCount, s.update(&next)
+}
+
+func (s *fileStorage) deleteProductURL(ctx context.Context, url string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.urls[url]
+	if !ok {
+		return nil
+	}
+	next := *u
+	next.Deleted = true
+	return s.update(&next)
+}
+
+// update appends the new state of a URL to the index and then takes it over.
+// The caller holds s.mu.
+func (s *fileStorage) update(u *fileProductURL) error {
+	if err := appendJSONLine(s.index, u); err != nil {
+		return err
+	}
+	s.urls[u.URL] = u
+	return nil
+}
+
+func appendJSONLine(f *os.File, v any) error {
+	line, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write %s: %v", f.Name(), err)
+	}
+	return nil
+}
+
+// productPath returns the file of a product, rejecting product numbers that
+// would point outside the products directory.
+func (s *fileStorage) productPath(productNumber string) (string, error) {
+	if productNumber == "" || productNumber != filepath.Base(productNumber) || strings.HasPrefix(productNumber, ".") {
+		return "", fmt.Errorf("product number %q cannot be used as a file name", productNumber)
+	}
+	return filepath.Join(s.dir, productsDir, productNumber+".json"), nil
+}
+
+func (s *fileStorage) readProduct(path string) (*Product, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var product Product
+	if err := json.Unmarshal(data, &product); err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %v", path, err)
+	}
+	return &product, nil
+}
+
+func (s *fileStorage) writeProduct(path string, product *Product) error {
+	return writeFileAtomic(path, func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(product)
+	})
+}
+
+func (s *fileStorage) saveProductURLs(ctx context.Context, productURLs []ProductURL) (int, error) {
+	inserted := 0
+	for _, productURL := range productURLs {
+		ok, err := s.saveProductURL(ctx, productURL)
+		if err != nil {
+			return inserted, err
+		}
+		if ok {
+			inserted++
+		}
+	}
+	return inserted, nil
+}
+
+func (s *fileStorage) saveProducts(ctx context.Context, products []*Product) ([]string, []error) {
+	return saveEachProduct(ctx, s, products)
+}
+
+func (s *fileStorage) saveProduct(ctx context.Context, product *Product) (string, error) {
+	path, err := s.productPath(product.ProductNumber)
+	if err != nil {
+		return "", fmt.Errorf("product %s has no usable product number: %v", product.ProductURL, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now().UTC()
+	product.FirstCrawledAt = now
+	product.LastSeenAt = now
+	stampProduct(ctx, product)
+	stored, err := s.readProduct(path)
+	if err == nil && product.ContentHash != "" && stored.ContentHash == product.ContentHash {
+		stored.LastSeenAt = now
+		stored.ScrapedSections = product.ScrapedSections
+		product.FirstCrawledAt, product.UpdatedAt = stored.FirstCrawledAt, stored.UpdatedAt
+		return productUnchanged, s.writeProduct(path, stored)
+	}
+	if err == nil {
+		keepSkippedFields(product, stored)
+		if !stored.FirstCrawledAt.IsZero() {
+			product.FirstCrawledAt = stored.FirstCrawledAt
+		}
+	}
+	product.UpdatedAt = now
+	if err := s.writeProduct(path, product); err != nil {
+		return "", err
+	}
+	s.products[product.ProductNumber] = true
+	if err := s.appendHistory(productChanges(stored, product)); err != nil {
+		// The product itself is saved; only this scrape's changes are lost.
+		slog.ErrorContext(ctx, "Failed to record product history", "product_number", product.ProductNumber, "err", err)
+	}
+	if stored == nil {
+		return productNew, nil
+	}
+	return productChanged, nil
+}
+
+// appendHistory appends changes to the product history. The caller holds
+// s.mu.
+func (s *fileStorage) appendHistory(changes []historyEntry) error {
+	if len(changes) == 0 {
+		return nil
+	}
+	f, err := os.OpenFile(filepath.Join(s.dir, historyFile), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %v", historyFile, err)
+	}
+	defer f.Close()
+	for _, change := range changes {
+		if err := appendJSONLine(f, change); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *fileStorage) productHistory(ctx context.Context, productNumber string) ([]historyEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var entries []historyEntry
+	err := readNDJSONFile(filepath.Join(s.dir, historyFile), func(line []byte) error {
+		var e historyEntry
+		if err := json.Unmarshal(line, &e); err != nil {
+			return err
+		}
+		if e.ProductNumber == productNumber {
+			entries = append(entries, e)
+		}
+		return nil
+	})
+	return entries, err
+}
+
+func (s *fileStorage) eachHistory(ctx context.Context, afterRunID, untilRunID string, fn func(historyEntry) bool) error {
+	s.mu.Lock()
+	var entries []historyEntry
+	err := readNDJSONFile(filepath.Join(s.dir, historyFile), func(line []byte) error {
+		var e historyEntry
+		if err := json.Unmarshal(line, &e); err != nil {
+			return err
+		}
+		if e.RunID > afterRunID && e.RunID <= untilRunID {
+			entries = append(entries, e)
+		}
+		return nil
+	})
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if !fn(e) {
+			return nil
+		}
+	}
+	return nil
+}
+
+func (s *fileStorage) hasProduct(ctx context.Context, productNumber string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.products[productNumber], nil
+}
+
+func (s *fileStorage) eachProduct(ctx context.Context, fn func(*Product) bool) error {
+	s.mu.Lock()
+	numbers := make([]string, 0, len(s.products))
+	for number := range s.products {
+		numbers = append(numbers, number)
+	}
+	s.mu.Unlock()
+	slices.Sort(numbers)
+
+	for _, number := range numbers {
+		path, err := s.productPath(number)
+		if err != nil {
+			return err
+		}
+		s.mu.Lock()
+		product, err := s.readProduct(path)
+		s.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		if !fn(product) {
+			return nil
+		}
+	}
+	return nil
+}
+
+func (s *fileStorage) updateProductMedia(ctx context.Context, product *Product) error {
+	path, err := s.productPath(product.ProductNumber)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, err := s.readProduct(path)
+	if err != nil {
+		return err
+	}
+	stored.Media = product.Media
+	stored.AvailableColors = product.AvailableColors
+	return s.writeProduct(path, stored)
+}
+
+func (s *fileStorage) startRun(ctx context.Context, run *crawlRun) error {
+	return s.appendRun(run)
+}
+
+func (s *fileStorage) finishRun(ctx context.Context, run *crawlRun) error {
+	return s.appendRun(run)
+}
+
+func (s *fileStorage) appendRun(run *crawlRun) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, err := os.OpenFile(filepath.Join(s.dir, runsFile), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %v", runsFile, err)
+	}
+	defer f.Close()
+	return appendJSONLine(f, run)
+}
+
+func (s *fileStorage) recentRuns(ctx context.Context, limit int) ([]crawlRun, error) {
+	byID, err := s.readRuns()
+	if err != nil {
+		return nil, err
+	}
+
+	runs := make([]crawlRun, 0, len(byID))
+	for _, run := range byID {
+		runs = append(runs, run)
+	}
+	slices.SortFunc(runs, func(a, b crawlRun) int { return b.StartedAt.Compare(a.StartedAt) })
+	return runs[:min(limit, len(runs))], nil
+}
+
+func (s *fileStorage) findRun(ctx context.Context, id string) (*crawlRun, error) {
+	byID, err := s.readRuns()
+	if err != nil {
+		return nil, err
+	}
+	if run, ok := byID[id]; ok {
+		return &run, nil
+	}
+	return nil, nil
+}
+
+func (s *fileStorage) lastScrapeRun(ctx context.Context, before time.Time) (*crawlRun, error) {
+	byID, err := s.readRuns()
+	if err != nil {
+		return nil, err
+	}
+	var last *crawlRun
+	for _, run := range byID {
+		if run.StartedAt.Before(before) && run.Status != runRunning && run.Stats["completed"] > 0 &&
+			(last == nil || run.StartedAt.After(last.StartedAt)) {
+			last = &run
+		}
+	}
+	return last, nil
+}
+
+// readRuns returns the last record of every run by run ID.
+func (s *fileStorage) readRuns() (map[string]crawlRun, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	byID := make(map[string]crawlRun)
+	err := readNDJSONFile(filepath.Join(s.dir, runsFile), func(line []byte) error {
+		var run crawlRun
+		if err := json.Unmarshal(line, &run); err != nil {
+			return err
+		}
+		byID[run.ID] = run
+		return nil
+	})
+	return byID, err
+}
+
+func (s *fileStorage) recordFailure(ctx context.Context, failure failedURL, maxAttempts int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if known, ok := s.failures[failure.URL]; ok {
+		failure.Attempts = known.Attempts
+		failure.FirstFailedAt = known.FirstFailedAt
+	} else {
+		failure.FirstFailedAt = failure.LastFailedAt
+	}
+	failure.Attempts++
+	failure.Permanent = failure.Attempts >= maxAttempts
+	s.failures[failure.URL] = &failure
+	return s.writeFailures()
+}
+
+func (s *fileStorage) clearFailure(ctx context.Context, url string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.failures[url]; !ok {
+		return nil
+	}
+	delete(s.failures, url)
+	return s.writeFailures()
+}
+
+func (s *fileStorage) eachFailure(ctx context.Context, classes []string, fn func(failedURL) bool) error {
+	s.mu.Lock()
+	var failures []failedURL
+	for _, f := range s.failures {
+		if !f.Permanent && (classes == nil || slices.Contains(classes, f.ErrorClass)) {
+			failures = append(failures, *f)
+		}
+	}
+	s.mu.Unlock()
+
+	slices.SortFunc(failures, func(a, b failedURL) int { return a.LastFailedAt.Compare(b.LastFailedAt) })
+	for _, f := range failures {
+		if ctx.Err() != nil || !fn(f) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// writeFailures rewrites the failed URLs file. The caller holds s.mu.
+func (s *fileStorage) writeFailures() error {
+	return writeFileAtomic(filepath.Join(s.dir, failedFile), func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		for _, f := range s.failures {
+			if err := enc.Encode(f); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/tebeka/selenium"
+)
+
+// fixtureExtractor serves the saved product page at path in place of the
+// page of whatever URL it is asked to load, like the HTTP engine would
+// serve it.
+type fixtureExtractor struct {
+	path   string
+	doc    *goquery.Document
+	source []byte
+}
+
+func (e *fixtureExtractor) load(string) error {
+	source, err := os.ReadFile(e.path)
+	if err != nil {
+		return err
+	}
+	doc, err := goquery.NewDocumentFromReader(bytes.NewReader(source))
+	if err != nil {
+		return err
+	}
+	e.doc, e.source = doc, source
+	return nil
+}
+
+func (e *fixtureExtractor) dom() DOM {
+	return htmlElement{e.doc.Selection}
+}
+
+func (e *fixtureExtractor) structuredData() ([]string, string, error) {
+	return nil, "", nil
+}
+
+func (e *fixtureExtractor) browser() selenium.WebDriver {
+	return nil
+}
+
+func (e *fixtureExtractor) pageSource() (string, error) {
+	return string(e.source), nil
+}
+
+// loadFixture parses testdata/name.
+func loadFixture(t *testing.T, name string) DOM {
+	t.Helper()
+	ex := &fixtureExtractor{path: filepath.Join("testdata", name)}
+	if err := ex.load(""); err != nil {
+		t.Fatal(err)
+	}
+	return ex.dom()
+}
+
+// parseDOM parses markup, a page or a fragment of one.
+func parseDOM(t *testing.T, markup string) DOM {
+	t.Helper()
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(markup))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return htmlElement{doc.Selection}
+}
+
+// sectionErrorNames returns the sections of errs.
+func sectionErrorNames(errs []*SectionError) []string {
+	var names []string
+	for _, err := range errs {
+		names = append(names, err.Section)
+	}
+	return names
+}
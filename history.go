@@ -0,0 +1,77 @@
+package main
+
+import "time"
+
+// historyEntry records one change of a tracked field of a product between two
+// scrapes, in the product_history collection. Unchanged products add none.
+type historyEntry struct {
+	ProductNumber string    `json:"product_number" bson:"product_number"`
+	Field         string    `json:"field" bson:"field"` // price_jpy, on_sale, availability, title, description or size:<label>
+	Old           any       `json:"old" bson:"old"`     // nil for a size that was not offered
+	New           any       `json:"new" bson:"new"`     // nil for a size that is no longer offered
+	RunID         string    `json:"run_id,omitempty" bson:"run_id,omitempty"`
+	ChangedAt     time.Time `json:"changed_at" bson:"changed_at"`
+}
+
+// Stock values of a size in the product history.
+const (
+	stockInStock  = "in_stock"
+	stockLowStock = "low_stock"
+	stockSoldOut  = "sold_out"
+)
+
+// productChanges returns the history entries of product against the stored
+// version of it, none when stored is nil because the product is new.
+func productChanges(stored, product *Product) []historyEntry {
+	if stored == nil {
+		return nil
+	}
+	var changes []historyEntry
+	add := func(field string, oldValue, newValue any) {
+		if oldValue != newValue {
+			changes = append(changes, historyEntry{
+				ProductNumber: product.ProductNumber,
+				Field:         field,
+				Old:           oldValue,
+				New:           newValue,
+				RunID:         product.RunID,
+				ChangedAt:     product.UpdatedAt,
+			})
+		}
+	}
+	add("price_jpy", stored.PriceJPY, product.PriceJPY)
+	add("on_sale", stored.OnSale, product.OnSale)
+	add("availability", stored.Availability, product.Availability)
+	add("title", stored.Title, product.Title)
+	add("description", stored.Description, product.Description)
+
+	if !hasSection(product, sectionSizes) {
+		return changes
+	}
+	before, after := sizeStocks(stored.AvailableSizes), sizeStocks(product.AvailableSizes)
+	for _, size := range product.AvailableSizes {
+		add("size:"+size.Size, before[size.Size], after[size.Size])
+	}
+	for _, size := range stored.AvailableSizes {
+		if _, ok := after[size.Size]; !ok {
+			add("size:"+size.Size, before[size.Size], nil)
+		}
+	}
+	return changes
+}
+
+// sizeStocks maps the label of every size to its stock value.
+func sizeStocks(sizes []SizeOption) map[string]any {
+	stocks := make(map[string]any, len(sizes))
+	for _, size := range sizes {
+		switch {
+		case !size.InStock:
+			stocks[size.Size] = stockSoldOut
+		case size.LowStock:
+			stocks[size.Size] = stockLowStock
+		default:
+			stocks[size.Size] = stockInStock
+		}
+	}
+	return stocks
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// identifierLinePattern matches a "label: value" line of the specifications
+// block that carries one of the product identifiers.
+var identifierLinePattern = regexp.MustCompile(`^\s*(品番|商品番号|モデル番号|モデルコード|型番|カラーコード)\s*[:：]?\s*(\S.*?)\s*$`)
+
+// productIdentifiers are the codes printed in the specifications block of a
+// product page.
+type productIdentifiers struct {
+	ProductNumber string // article number, e.g. IP0418
+	ModelCode     string
+	ColorCode     string
+}
+
+// parseIdentifiers reads the product identifiers from the specification
+// lines. A line may hold several entries separated by line breaks.
+func parseIdentifiers(specifications []string) productIdentifiers {
+	var ids productIdentifiers
+	for _, specification := range specifications {
+		for _, line := range strings.Split(specification, "\n") {
+			m := identifierLinePattern.FindStringSubmatch(line)
+			if m == nil {
+				continue
+			}
+			switch m[1] {
+			case "品番", "商品番号":
+				ids.ProductNumber = strings.ToUpper(m[2])
+			case "モデル番号", "モデルコード", "型番":
+				ids.ModelCode = m[2]
+			case "カラーコード":
+				ids.ColorCode = m[2]
+			}
+		}
+	}
+	return ids
+}
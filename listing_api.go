@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	neturl "net/url"
+	"sync/atomic"
+
+	"github.com/tebeka/selenium"
+)
+
+// Modes of -listing-mode.
+const (
+	listingModeAPI  = "api"  // only the listing API
+	listingModeDOM  = "dom"  // only the rendered listing page
+	listingModeAuto = "auto" // the listing API, falling back to the rendered page
+)
+
+// listingAPIURL is the endpoint the listing pages load their product cards
+// from. It takes the query of the listing page URL: category, gender, page
+// and the filters.
+const listingAPIURL = siteURL + "/f/v1/pub/product/list"
+
+// maxListingShapeErrors is the number of unexpected listing API responses in
+// a row after which -listing-mode=auto stops calling the API for the run.
+const maxListingShapeErrors = 3
+
+// errListingShape is returned for a listing API response the crawler cannot
+// read, typically because the endpoint changed.
+var errListingShape = errors.New("unexpected listing API response")
+
+// listingAPIResponse is the part of a listing API response the crawler uses.
+type listingAPIResponse struct {
+	// ArticlesSortList lists the article numbers of the page in listing
+	// order. A pointer, so that a response without it is told apart from an
+	// empty page.
+	ArticlesSortList *[]string `json:"articles_sort_list"`
+}
+
+// listingClient fetches the product URLs of listing pages from the listing
+// API over plain HTTP, with the cookies and user agent of a browser session
+// so that the requests look like those of the page itself.
+type listingClient struct {
+	client      *http.Client
+	userAgent   string
+	cookies     []*http.Cookie
+	shapeErrors atomic.Int32 // unexpected responses in a row
+}
+
+// newListingClient loads the shop's top page in wd and returns a client with
+// the cookies and user agent of the session.
+func newListingClient(ctx context.Context, cfg *Config, wd selenium.WebDriver, pace *throttle) (*listingClient, error) {
+	if !pace.wait(ctx) {
+		return nil, ctx.Err()
+	}
+	if err := wd.Get(siteURL + "/"); err != nil {
+		return nil, fmt.Errorf("failed to load %s: %v", siteURL, err)
+	}
+	browserCookies, err := wd.GetCookies()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the browser cookies: %v", err)
+	}
+	userAgent, err := wd.ExecuteScript("return navigator.userAgent", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the browser user agent: %v", err)
+	}
+
+	c := &listingClient{client: &http.Client{Timeout: cfg.PageLoadTimeout}}
+	c.userAgent, _ = userAgent.(string)
+	for _, cookie := range browserCookies {
+		c.cookies = append(c.cookies, &http.Cookie{Name: cookie.Name, Value: cookie.Value})
+	}
+	slog.InfoContext(ctx, "Using the listing API", "cookies", len(c.cookies))
+	return c, nil
+}
+
+// usable reports whether the API is still worth calling, that is it has not
+// answered with unexpected responses too often in a row.
+func (c *listingClient) usable() bool {
+	return c.shapeErrors.Load() < maxListingShapeErrors
+}
+
+// fetch returns the product URLs of the listing page at pageURL.
+func (c *listingClient) fetch(ctx context.Context, pageURL string) ([]string, error) {
+	u, err := neturl.Parse(pageURL)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, listingAPIURL+"?"+u.RawQuery, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Referer", pageURL)
+	if c.userAgent != "" {
+		req.Header.Set("User-Agent", c.userAgent)
+	}
+	for _, cookie := range c.cookies {
+		req.AddCookie(cookie)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("listing API request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("listing API returned %s", resp.Status)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read listing API response: %v", err)
+	}
+
+	urls, err := parseListingResponse(body)
+	if errors.Is(err, errListingShape) {
+		c.shapeErrors.Add(1)
+		return nil, err
+	}
+	c.shapeErrors.Store(0)
+	return urls, err
+}
+
+// parseListingResponse returns the product URLs of a listing API response,
+// in listing order.
+func parseListingResponse(body []byte) ([]string, error) {
+	var page listingAPIResponse
+	if err := json.Unmarshal(body, &page); err != nil {
+		return nil, fmt.Errorf("%w: %v", errListingShape, err)
+	}
+	if page.ArticlesSortList == nil {
+		return nil, fmt.Errorf("%w: no articles_sort_list", errListingShape)
+	}
+	urls := make([]string, 0, len(*page.ArticlesSortList))
+	for _, articleNumber := range *page.ArticlesSortList {
+		if articleNumber == "" {
+			return nil, fmt.Errorf("%w: empty article number", errListingShape)
+		}
+		urls = append(urls, siteURL+"/products/"+neturl.PathEscape(articleNumber)+"/")
+	}
+	return urls, nil
+}
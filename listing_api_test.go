@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"slices"
+	"testing"
+)
+
+func TestParseListingResponse(t *testing.T) {
+	body, err := os.ReadFile("testdata/listing_api_response.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := parseListingResponse(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"https://shop.adidas.jp/products/GZ0127/",
+		"https://shop.adidas.jp/products/IE1631/",
+		"https://shop.adidas.jp/products/HQ4199/",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("parseListingResponse() = %q, want %q", got, want)
+	}
+}
+
+func TestParseListingResponseShape(t *testing.T) {
+	tests := []struct {
+		name, body string
+		shapeErr   bool
+	}{
+		{"empty page", `{"count": 0, "articles_sort_list": []}`, false},
+		{"no sort list", `{"count": 12, "items": []}`, true},
+		{"empty article number", `{"articles_sort_list": ["GZ0127", ""]}`, true},
+		{"not JSON", `<html><body>Access Denied</body></html>`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			urls, err := parseListingResponse([]byte(tt.body))
+			if got := errors.Is(err, errListingShape); got != tt.shapeErr {
+				t.Errorf("parseListingResponse() error = %v, want a shape error: %v", err, tt.shapeErr)
+			}
+			if !tt.shapeErr && (urls == nil || len(urls) != 0) {
+				t.Errorf("parseListingResponse() = %#v, want an empty page", urls)
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// Formats selectable with -log-format.
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// parseLogLevel parses a -log-level value.
+func parseLogLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(s)); err != nil {
+		return 0, fmt.Errorf("log-level must be debug, info, warn or error, got %q", s)
+	}
+	return level, nil
+}
+
+// setupLogging makes the logger configured by cfg the default one, so the
+// log package and slog both write through it. With -log-file the file is
+// rotated once it reaches -log-max-size megabytes. Logs to stderr share it
+// with the progress display, if there is one.
+func setupLogging(cfg *Config) {
+	level, _ := parseLogLevel(cfg.LogLevel)
+	var out io.Writer = os.Stderr
+	if progress != nil {
+		out = progress
+	}
+	if cfg.LogFile != "" {
+		out = &lumberjack.Logger{
+			Filename:   cfg.LogFile,
+			MaxSize:    cfg.LogMaxSize,
+			MaxBackups: cfg.LogMaxBackups,
+			Compress:   true,
+		}
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler = slog.NewTextHandler(out, opts)
+	if cfg.LogFormat == logFormatJSON {
+		handler = slog.NewJSONHandler(out, opts)
+	}
+	slog.SetDefault(slog.New(contextHandler{handler}))
+}
+
+type logAttrsKey struct{}
+
+// withLogAttrs returns a context whose log records carry args, given as
+// alternating keys and values like slog.Logger.With takes them. Workers use
+// it to tag their records with the phase, their worker ID and the URL at
+// hand.
+func withLogAttrs(ctx context.Context, args ...any) context.Context {
+	attrs, _ := ctx.Value(logAttrsKey{}).([]slog.Attr)
+	record := slog.Record{}
+	record.Add(args...)
+	record.Attrs(func(a slog.Attr) bool {
+		attrs = append(attrs, a)
+		return true
+	})
+	return context.WithValue(ctx, logAttrsKey{}, attrs[:len(attrs):len(attrs)])
+}
+
+// contextHandler adds the attributes stored by withLogAttrs to the records
+// logged with a context.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if attrs, ok := ctx.Value(logAttrsKey{}).([]slog.Attr); ok {
+		r.AddAttrs(attrs...)
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
@@ -2,53 +2,141 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	"log"
+	"log/slog"
+	neturl "net/url"
+	"os"
+	"os/signal"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/tebeka/selenium"
-	"github.com/xuri/excelize/v2"
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
 )
 
 type ProductURL struct {
-	Category string `json:"category"`
-	PageNo   int    `json:"pageno"`
-	URL      string `json:"url"`
+	Section   string    `json:"section"`
+	Category  string    `json:"category"`
+	PageNo    int       `json:"pageno"`
+	URL       string    `json:"url"`                                        // canonical, without tracking parameters
+	RawURL    string    `json:"raw_url,omitempty" bson:"raw_url,omitempty"` // href as found, when it differs from URL
+	Status    string    `json:"status"`
+	Error     string    `json:"error,omitempty" bson:"error,omitempty"`
+	ClaimedAt time.Time `json:"claimed_at,omitempty" bson:"claimed_at,omitempty"`
+	RunID     string    `json:"run_id,omitempty" bson:"run_id,omitempty"` // run that last wrote the URL
+
+	// When the page was last scraped, zero until it is, and when the
+	// document was last written, zero for documents written before it was
+	// recorded. CrawlerVersion and SourceWorker are those of the last write.
+	CrawledAt      time.Time `json:"crawled_at,omitempty" bson:"crawled_at,omitempty"`
+	UpdatedAt      time.Time `json:"updated_at,omitempty" bson:"updated_at,omitempty"`
+	CrawlerVersion string    `json:"crawler_version,omitempty" bson:"crawler_version,omitempty"`
+	SourceWorker   string    `json:"source_worker,omitempty" bson:"source_worker,omitempty"`
+
+	// Availability of the product when it was last scraped.
+	Availability string `json:"availability,omitempty" bson:"availability,omitempty"`
+
+	// Badges of the listing card the URL was found on, such as new or
+	// sale, see normalizeBadges.
+	Badges []string `json:"badges,omitempty" bson:"badges,omitempty"`
+
+	// Category is the slug the listing URL names, or the name of the
+	// category when it names none. CategoryName is the anchor text of the
+	// navigation link the listing page was found under.
+	CategoryName string `json:"category_name,omitempty" bson:"category_name,omitempty"`
+}
+
+// listingPage is one page of a category listing queued for discovery.
+type listingPage struct {
+	Section      string
+	URL          string
+	CategoryName string // anchor text of the navigation link to the category
+}
+
+// categoryLink is a category linked from the local navigation of a section.
+type categoryLink struct {
+	URL  string
+	Name string // anchor text, "" when the link has none
 }
 
 type ColorOption struct {
-	Path  string `json:"path"`
-	Color string `json:"color"`
+	Path          string `json:"path"`
+	Color         string `json:"color"`
+	ProductURL    string `json:"product_url,omitempty" bson:"product_url,omitempty"`
+	ProductNumber string `json:"product_number,omitempty" bson:"product_number,omitempty"`
+	LocalPath     string `json:"local_path,omitempty" bson:"local_path,omitempty"`
+	SHA256        string `json:"sha256,omitempty" bson:"sha256,omitempty"`
+}
+
+// BreadcrumbLink is one entry of the breadcrumb trail of a product page.
+type BreadcrumbLink struct {
+	Label string `json:"label" bson:"label"`
+	URL   string `json:"url" bson:"url"`
+}
+
+// TagLink is a tag of a product page, linking to the search for it. Slug is
+// the tag the link searches for, lower-cased.
+type TagLink struct {
+	Label string `json:"label" bson:"label"`
+	Slug  string `json:"slug" bson:"slug"`
+	URL   string `json:"url" bson:"url"`
 }
 
 type ReviewSummary struct {
-	Rating          float64 `json:"rating"`
-	NumberOfReviews int     `json:"number_of_reviews"`
-	RecommendedRate string  `json:"recommended_rate"`
-	Fit             string  `json:"fit"`
-	Length          string  `json:"length"`
-	Quality         string  `json:"quality"`
-	Comfort         string  `json:"comfort"`
+	Rating              float64 `json:"rating"`
+	NumberOfReviews     int     `json:"number_of_reviews"`
+	RecommendedCount    int     `json:"recommended_count" bson:"recommended_count"`   // reviewers who answered the "buy again" question
+	RecommendedRate     float64 `json:"recommended_rate" bson:"recommended_rate"`     // 0-100
+	RecommendedRateText string  `json:"recommended_rate_text" bson:"recommendedrate"` // as shown, e.g. "85%"
+	Fit                 string  `json:"fit"`
+	Length              string  `json:"length"`
+	Quality             string  `json:"quality"`
+	Comfort             string  `json:"comfort"`
+
+	// Number of reviews per star level, 1 to 5.
+	RatingHistogram map[int]int `json:"rating_histogram" bson:"rating_histogram"`
+
+	// Every secondary rating by its label, as shown and as a number.
+	SecondaryRatings      map[string]string  `json:"secondary_ratings,omitempty" bson:"secondary_ratings,omitempty"`
+	SecondaryRatingValues map[string]float64 `json:"secondary_rating_values,omitempty" bson:"secondary_rating_values,omitempty"`
 }
 
 type Review struct {
-	Rating      float64 `json:"rating"`
-	Title       string  `json:"title"`
-	Description string  `json:"description"`
-	Date        string  `json:"date"`
-	ReviewId    string  `json:"reviewId"`
+	Rating      float64    `json:"rating"`
+	Title       string     `json:"title"`
+	Description string     `json:"description"`
+	DateText    string     `json:"date" bson:"date"` // as published by the widget or API
+	SubmittedAt *time.Time `json:"submitted_at,omitempty" bson:"submitted_at,omitempty"`
+	ReviewId    string     `json:"reviewId"`
+
+	// Reviewer attributes and votes are only set when the review shows them.
+	PurchasedSize  string   `json:"purchased_size,omitempty" bson:"purchased_size,omitempty"`
+	UsualSize      string   `json:"usual_size,omitempty" bson:"usual_size,omitempty"`
+	Height         string   `json:"height,omitempty" bson:"height,omitempty"`
+	Weight         string   `json:"weight,omitempty" bson:"weight,omitempty"`
+	Age            string   `json:"age,omitempty" bson:"age,omitempty"`
+	Gender         string   `json:"gender,omitempty" bson:"gender,omitempty"`
+	Location       string   `json:"location,omitempty" bson:"location,omitempty"`
+	HelpfulCount   int      `json:"helpful_count,omitempty" bson:"helpful_count,omitempty"`
+	UnhelpfulCount int      `json:"unhelpful_count,omitempty" bson:"unhelpful_count,omitempty"`
+	Photos         []string `json:"photos,omitempty" bson:"photos,omitempty"`
 }
 
 type CoordinatedProduct struct {
 	Title         string `json:"title"`
-	Price         string `json:"price"`
+	PriceInfo     `bson:",inline"`
 	Path          string `json:"path"`
 	ProductNumber string `json:"product_number"`
 	ProductURL    string `json:"product_page_url"`
@@ -57,209 +145,896 @@ type CoordinatedProduct struct {
 type SpecialDescription struct {
 	Title       string `json:"title"`
 	Description string `json:"description"`
+	Text        string `json:"text,omitempty" bson:"text,omitempty"`
 }
 
 type Media struct {
-	Type string `json:"type"`
-	Path string `json:"path"`
+	Type      string `json:"type"`
+	Path      string `json:"path"`
+	LocalPath string `json:"local_path,omitempty" bson:"local_path,omitempty"` // relative to the -download-media directory
+	SHA256    string `json:"sha256,omitempty" bson:"sha256,omitempty"`
 }
 
 type Product struct {
-	ProductURL          string                         `json:"product_url"`
-	Breadcrumbs         []string                       `json:"breadcrumbs"`
-	Category            string                         `json:"category"`
-	Title               string                         `json:"title"`
-	Price               string                         `json:"price"`
-	AvailableColors     []ColorOption                  `json:"available_colors"`
-	AvailableSizes      []string                       `json:"available_sizes"`
-	Media               []Media                        `json:"media"`
-	CoordinatedProducts []CoordinatedProduct           `json:"coordinated_products"`
-	DescriptionHeading  string                         `json:"description_heading"`
-	DescriptionTitle    string                         `json:"description_title"`
-	Description         string                         `json:"description"`
-	Specifications      []string                       `json:"specifications"`
-	SpecialDescription  []SpecialDescription           `json:"special_description"`
-	SizeChart           map[string][]map[string]string `json:"size_chart"`
-	SizeRemarks         []string                       `json:"size_remarks"`
-	ReviewSummary       ReviewSummary                  `json:"review_summary"`
-	Reviews             []Review                       `json:"reviews"`
-	Tags                []string                       `json:"tags"`
+	ProductURL          string           `json:"product_url"`
+	ProductNumber       string           `json:"product_number" bson:"product_number"`
+	ModelCode           string           `json:"model_code,omitempty" bson:"model_code,omitempty"`
+	ColorCode           string           `json:"color_code,omitempty" bson:"color_code,omitempty"`
+	Section             string           `json:"section"`
+	Breadcrumbs         []string         `json:"breadcrumbs"`
+	BreadcrumbLinks     []BreadcrumbLink `json:"breadcrumb_links" bson:"breadcrumb_links"`
+	Category            string           `json:"category"`
+	Gender              string           `json:"gender,omitempty" bson:"gender,omitempty"`             // men, women or kids
+	ProductType         string           `json:"product_type,omitempty" bson:"product_type,omitempty"` // shoes, wear or accessories
+	Sport               string           `json:"sport,omitempty" bson:"sport,omitempty"`
+	Title               string           `json:"title"`
+	PriceInfo           `bson:",inline"`
+	OriginalPriceJPY    int                  `json:"original_price_jpy" bson:"original_price_jpy"`
+	SalePriceJPY        int                  `json:"sale_price_jpy" bson:"sale_price_jpy"`
+	OnSale              bool                 `json:"on_sale" bson:"on_sale"`
+	DiscountPercent     float64              `json:"discount_percent" bson:"discount_percent"`
+	AvailableColors     []ColorOption        `json:"available_colors"`
+	AvailableSizes      []SizeOption         `json:"available_sizes" bson:"size_options"`
+	AvailableSizeLabels []string             `json:"available_size_labels" bson:"availablesizes"` // every size label, kept for older consumers
+	Availability        string               `json:"availability" bson:"availability"`            // in_stock, out_of_stock, coming_soon or discontinued
+	ReleaseDate         *time.Time           `json:"release_date,omitempty" bson:"release_date,omitempty"`
+	Media               []Media              `json:"media"`
+	CoordinatedProducts []CoordinatedProduct `json:"coordinated_products"`
+	RecommendedProducts []CoordinatedProduct `json:"recommended_products" bson:"recommended_products"`
+	DescriptionHeading  string               `json:"description_heading"`
+	DescriptionTitle    string               `json:"description_title"`
+	Description         string               `json:"description"`
+	Specifications      []string             `json:"specifications"`
+	Materials           []string             `json:"materials,omitempty" bson:"materials,omitempty"`
+	CareInstructions    []string             `json:"care_instructions,omitempty" bson:"care_instructions,omitempty"`
+	CountryOfOrigin     string               `json:"country_of_origin,omitempty" bson:"country_of_origin,omitempty"`
+	SpecialDescription  []SpecialDescription `json:"special_description"`
+	TechnologyBadges    []TechnologyBadge    `json:"technology_badges" bson:"technology_badges"`
+	SizeCharts          []SizeChartTable     `json:"size_charts" bson:"size_charts"`
+	SizeRemarks         []string             `json:"size_remarks"`
+	ReviewSummary       ReviewSummary        `json:"review_summary"`
+	Reviews             []Review             `json:"reviews"`
+	Tags                []string             `json:"tags"` // label of every tag, kept for older consumers
+	FirstCrawledAt      time.Time            `json:"first_crawled_at" bson:"first_crawled_at,omitempty"`
+	UpdatedAt           time.Time            `json:"updated_at" bson:"updated_at"`                         // last time the content changed
+	LastSeenAt          time.Time            `json:"last_seen_at" bson:"last_seen_at"`                     // last time the product was scraped, changed or not
+	ContentHash         string               `json:"content_hash,omitempty" bson:"content_hash,omitempty"` // see contentHash
+	CompletenessScore   float64              `json:"completeness_score" bson:"completeness_score"`         // fraction of the expected sections scraped, 0 to 1
+	Proxy               string               `json:"proxy,omitempty" bson:"proxy,omitempty"`               // proxy the product was scraped through, for tracing bad data
+	Provenance          map[string]string    `json:"provenance,omitempty" bson:"provenance,omitempty"`     // source of the title, price, availability, images and description, see -pdp-mode
+	RunID               string               `json:"run_id,omitempty" bson:"run_id,omitempty"`             // run that last scraped the product, see crawlRun
+
+	// Version of the crawler and host/pid/phase/worker that wrote the
+	// content. FirstCrawledAt, UpdatedAt and LastSeenAt are its timestamps.
+	CrawlerVersion string `json:"crawler_version,omitempty" bson:"crawler_version,omitempty"`
+	SourceWorker   string `json:"source_worker,omitempty" bson:"source_worker,omitempty"`
+
+	// Markup of Description and of the Specifications bullets that hold more
+	// than text, sanitized for re-rendering, see sanitizeHTML.
+	DescriptionHTML    string   `json:"description_html,omitempty" bson:"description_html,omitempty"`
+	SpecificationsHTML []string `json:"specifications_html,omitempty" bson:"specifications_html,omitempty"`
+
+	// adiClub callouts of the price block: the points a purchase earns, the
+	// price for members and whether only members can buy the product. Zero
+	// when the page does not show them. MemberOnly is always stored, so that
+	// a product open to everyone again reads false.
+	PointsEarned int  `json:"points_earned,omitempty" bson:"points_earned,omitempty"`
+	MemberPrice  *int `json:"member_price_jpy,omitempty" bson:"member_price_jpy,omitempty"`
+	MemberOnly   bool `json:"member_only,omitempty" bson:"member_only"`
+
+	// Badges of the page, such as new or sale, see normalizeBadges.
+	Badges []string `json:"badges,omitempty" bson:"badges,omitempty"`
+
+	// Delivery, return and shipping notes of the purchase panel, nil for a
+	// page without them.
+	PurchaseInfo *PurchaseInfo `json:"purchase_info,omitempty" bson:"purchase_info,omitempty"`
+
+	// Tag links of the product page, one per slug.
+	TagLinks []TagLink `json:"tag_links,omitempty" bson:"tag_links,omitempty"`
+
+	// When each section of the page was last scraped, see -scrape-sections.
+	ScrapedSections map[string]time.Time `json:"scraped_sections,omitempty" bson:"scraped_sections,omitempty"`
+
+	// Time the scrape spent per section of the page, only stored with
+	// -debug-timings.
+	Timings ScrapeTiming `json:"timings,omitempty" bson:"timings,omitempty"`
 }
 
-// Other types omitted for brevity
+// SectionError records a section of a product page that could not be scraped.
+type SectionError struct {
+	Section string
+	Err     error
+}
 
-const (
-	seleniumPath         = "/path/to/selenium-server.jar"
-	chromeDriverPath     = "/path/to/chromedriver"
-	port                 = 4444
-	numWorkers           = 10
-	mongoURI             = "mongodb://127.0.0.1:27017"
-	dbName               = "adidas"
-	productURLCollection = "product_urls"
-	productCollection    = "products"
-)
+func (e *SectionError) Error() string {
+	return e.Section + ": " + e.Err.Error()
+}
+
+func (e *SectionError) Unwrap() error {
+	return e.Err
+}
+
+// findSectionError returns the error recorded for section, or nil.
+func findSectionError(errs []*SectionError, section string) error {
+	for _, err := range errs {
+		if err.Section == section {
+			return err
+		}
+	}
+	return nil
+}
+
+// Other types omitted for brevity
 
 func main() {
-	log.Println("Crawling starting...")
+	ctx, cancel := shutdownContext()
+	defer cancel()
+	defer func() {
+		if r := recover(); r != nil {
+			sendFatalAlert(fmt.Sprintf("panic: %v", r))
+			panic(r)
+		}
+	}()
+
+	if err := runCommand(ctx, os.Args[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(0)
+		}
+		sendFatalAlert(err.Error())
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+}
+
+// shutdownContext returns a context that is cancelled on the first SIGINT or
+// SIGTERM, letting workers finish what they are doing. The default signal
+// handling is restored afterwards, so a second signal terminates the process.
+func shutdownContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		select {
+		case sig := <-signals:
+			slog.Info("Finishing in-flight work, send the signal again to force exit", "signal", sig)
+			cancel()
+		case <-ctx.Done():
+		}
+		signal.Stop(signals)
+	}()
+
+	return ctx, cancel
+}
 
+func startSelenium(cfg *Config) (*selenium.Service, error) {
 	opts := []selenium.ServiceOption{
-		selenium.ChromeDriver(chromeDriverPath),
+		selenium.ChromeDriver(cfg.ChromeDriverPath),
 		selenium.Output(nil), // Output debug info to stderr
 	}
-	service, err := selenium.NewSeleniumService(seleniumPath, port, opts...)
+	if cfg.Browser == browserFirefox {
+		opts[0] = selenium.GeckoDriver(cfg.GeckoDriverPath)
+	}
+	service, err := selenium.NewSeleniumService(cfg.SeleniumPath, cfg.Port, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("error starting the Selenium server: %v", err)
+	}
+	return service, nil
+}
+
+// connectMongo connects to MongoDB with the -mongo-* options and pings it,
+// so that a server that cannot be reached fails the start within
+// -mongo-connect-timeout rather than hanging until the first write.
+func connectMongo(cfg *Config) (*mongo.Client, error) {
+	opts := options.Client().ApplyURI(cfg.MongoURI).
+		SetConnectTimeout(cfg.MongoConnectTimeout).
+		SetServerSelectionTimeout(cfg.MongoSelectTimeout)
+	if cfg.MongoMajority {
+		opts.SetWriteConcern(writeconcern.Majority())
+	}
+	if !cfg.MongoRetryWrites {
+		opts.SetRetryWrites(false)
+	}
+	if cfg.MongoUsername != "" {
+		opts.SetAuth(options.Credential{Username: cfg.MongoUsername, Password: cfg.MongoPassword, AuthSource: cfg.MongoAuthSource})
+	}
+	if cfg.MongoTLS || cfg.MongoTLSCAFile != "" {
+		tlsConfig := &tls.Config{}
+		if cfg.MongoTLSCAFile != "" {
+			pem, err := os.ReadFile(cfg.MongoTLSCAFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read mongo-tls-ca-file: %v", err)
+			}
+			tlsConfig.RootCAs = x509.NewCertPool()
+			if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("mongo-tls-ca-file %s holds no PEM certificate", cfg.MongoTLSCAFile)
+			}
+		}
+		opts.SetTLSConfig(tlsConfig)
+	}
+
+	client, err := mongo.Connect(context.Background(), opts)
 	if err != nil {
-		log.Fatalf("Error starting the Selenium server: %v", err)
+		return nil, fmt.Errorf("failed to connect to MongoDB: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.MongoConnectTimeout)
+	defer cancel()
+	if err := client.Ping(ctx, nil); err != nil {
+		disconnectMongo(client)
+		return nil, fmt.Errorf("MongoDB did not answer within %v, check -mongo-uri and that the server is up: %v", cfg.MongoConnectTimeout, err)
 	}
-	defer service.Stop()
+	return client, nil
+}
+
+func disconnectMongo(client *mongo.Client) {
+	if err := client.Disconnect(context.TODO()); err != nil {
+		slog.Warn("Failed to disconnect from MongoDB", "err", err)
+	}
+}
 
-	client, err := mongo.Connect(context.TODO(), options.Client().ApplyURI(mongoURI))
+// discoverOptions restricts which listing pages the discover phase walks.
+type discoverOptions struct {
+	Source     string // sourceListing or sourceSitemap
+	Sections   []string
+	Categories *regexp.Regexp // nil means every category
+	MaxPages   int            // 0 means every page
+}
+
+// sections lists the shop sections discovery can start from.
+var sections = []string{"men", "women", "kids"}
+
+// defaultSections is the -sections default.
+const defaultSections = "men"
+
+// discover walks the listing pages of every category linked from the
+// navigation of each requested section and stores the product URLs found on
+// them in the product_urls collection.
+func discover(ctx context.Context, cfg *Config, opts discoverOptions, sessions *sessionFactory, store Storage, stats *crawlStats) error {
+	ctx = withLogAttrs(ctx, "phase", "discover")
+	if err := store.prepare(ctx); err != nil {
+		return err
+	}
+	robots, err := loadRobots(cfg)
 	if err != nil {
-		log.Fatalf("Failed to connect to MongoDB: %v", err)
+		return err
 	}
-	defer func() {
-		if err := client.Disconnect(context.TODO()); err != nil {
-			log.Fatalf("Failed to disconnect from MongoDB: %v", err)
+	pace := newThrottle(cfg, stats, robots)
+	sessions = sessions.paced(ctx, pace)
+	if cfg.DiscoveryLite {
+		sessions = sessions.lite()
+	}
+
+	session, err := sessions.checkout()
+	if err != nil {
+		return fmt.Errorf("error connecting to the WebDriver server: %v", err)
+	}
+	defer sessions.release(session, false)
+	wd := session.wd
+
+	var listing *listingClient
+	if cfg.ListingMode != listingModeDOM {
+		listing, err = newListingClient(ctx, cfg, wd, pace)
+		if err != nil && cfg.ListingMode == listingModeAPI {
+			return err
+		}
+		if err != nil {
+			slog.WarnContext(ctx, "Listing API unavailable, reading the listing pages in the browser", "err", err)
 		}
+	}
+
+	workers := cfg.discoverWorkers()
+	productUrlChan := make(chan listingPage, cfg.ChannelBuffer)
+	workerErrs := make(chan error, workers)
+	var wg sync.WaitGroup
+
+	// Stop queueing listing pages if every worker has given up, instead of
+	// blocking on a channel nobody reads any more.
+	dispatchCtx, stopDispatch := context.WithCancel(ctx)
+	defer stopDispatch()
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer recoverWorker(workerErrs, stats)
+			processURLs(withLogAttrs(ctx, "worker", i+1), cfg, productUrlChan, sessions, listing, store, pace, stats, workerErrs)
+		}()
+	}
+	go func() {
+		wg.Wait()
+		stopDispatch()
 	}()
 
-	productUrlCollection := client.Database(dbName).Collection(productURLCollection)
-	productCollection := client.Database(dbName).Collection(productCollection)
+	for _, section := range opts.Sections {
+		if dispatchCtx.Err() != nil {
+			break
+		}
 
-	// Check if product_urls collection is empty
-	productURLCount, err := productUrlCollection.CountDocuments(context.Background(), bson.M{})
-	if err != nil {
-		log.Fatalf("Failed to count documents in product_urls collection: %v", err)
+		categories, err := discoverCategories(dispatchCtx, cfg, wd, pace, section)
+		if err != nil {
+			slog.ErrorContext(ctx, "Skipping section", "section", section, "err", err)
+			continue
+		}
+
+		discoverSection(dispatchCtx, cfg, wd, pace, opts, section, categories, productUrlChan)
 	}
 
-	caps := selenium.Capabilities{
-		"browserName": "chrome",
-		"chromeOptions": map[string]interface{}{
-			"args": []string{"--start-fullscreen"},
-		},
+	close(productUrlChan)
+	wg.Wait()
+	close(workerErrs)
+
+	failedWorkers := 0
+	for err := range workerErrs {
+		slog.ErrorContext(ctx, "Discovery worker stopped", "err", err)
+		failedWorkers++
 	}
+	if failedWorkers == workers {
+		return fmt.Errorf("all %d discovery workers stopped, leaving the remaining listing pages unread", failedWorkers)
+	}
+	return nil
+}
 
-	if productURLCount == 0 {
+// discoverSection queues the listing pages of every category of one section.
+func discoverSection(ctx context.Context, cfg *Config, wd selenium.WebDriver, pace *throttle, opts discoverOptions, section string, categories []categoryLink, productUrlChan chan<- listingPage) {
+	for _, link := range categories {
+		if ctx.Err() != nil {
+			return
+		}
 
-		productUrlChan := make(chan string)
-		var wg sync.WaitGroup
+		category := link.URL
+		name := extractCategory(category)
+		if name == "" {
+			name = category
+		}
+		if opts.Categories != nil && !opts.Categories.MatchString(name) {
+			continue
+		}
+		if !pace.allowed(category) {
+			continue
+		}
 
-		for i := 0; i < numWorkers; i++ {
-			wg.Add(1)
-			go func() {
-				defer wg.Done()
-				processURLs(productUrlChan, caps, productUrlCollection)
-			}()
+		if !pace.wait(ctx) {
+			return
 		}
+		if err := wd.Get(category); err != nil {
+			slog.ErrorContext(ctx, "Failed to load category page", "url", category, "err", err)
+			continue
+		}
+
+		if err := waitForElement(wd, ".articleDisplayCard-children", cfg.WaitTimeout); err != nil {
+			slog.WarnContext(ctx, "Category page did not render", "url", category, "err", err)
+		}
+		closeModals(cfg, wd)
 
-		wd, err := selenium.NewRemote(caps, fmt.Sprintf("http://localhost:%d/wd/hub", port))
+		pageCount, strategy, err := getPageCount(ctx, cfg, wd, pace, category, opts.MaxPages)
 		if err != nil {
-			log.Fatalf("Error connecting to the WebDriver server: %v", err)
+			slog.WarnContext(ctx, "Failed to find the page count of category, queueing its first page only", "url", category, "err", err)
+			pageCount, strategy = 1, ""
+		}
+		if opts.MaxPages > 0 && pageCount > opts.MaxPages {
+			pageCount = opts.MaxPages
 		}
-		defer wd.Quit()
 
-		if err := wd.Get("https://shop.adidas.jp/item/?gender=mens&category=wear&order=1&page=1"); err != nil {
-			log.Fatalf("Failed to load page: %v", err)
+		queued := 0
+		for i := 1; i <= pageCount; i++ {
+			pageURL := listingPageURL(category, i)
+			if !pace.allowed(pageURL) {
+				continue
+			}
+			if !send(ctx, productUrlChan, listingPage{Section: section, URL: pageURL, CategoryName: link.Name}) {
+				break
+			}
+			queued++
 		}
+		slog.InfoContext(ctx, "Queued listing pages", "section", section, "category", name, "queued", queued, "pages", pageCount, "page_count_from", strategy)
+	}
+}
 
-		time.Sleep(5 * time.Second)
+// discoverCategories returns the categories linked from the local navigation
+// of a section, without duplicates and in navigation order.
+func discoverCategories(ctx context.Context, cfg *Config, wd selenium.WebDriver, pace *throttle, section string) ([]categoryLink, error) {
+	sectionURL := siteURL + "/" + section + "/"
+	if !pace.wait(ctx) {
+		return nil, ctx.Err()
+	}
+	if err := wd.Get(sectionURL); err != nil {
+		return nil, fmt.Errorf("failed to load %s top page: %v", section, err)
+	}
 
-		pageCount := getPageCount(wd)
+	if err := waitForElement(wd, ".lpc-ukLocalNavigation_itemList", cfg.WaitTimeout); err != nil {
+		return nil, err
+	}
 
-		for i := 1; i <= pageCount; i++ {
-			pageURL := fmt.Sprintf("https://shop.adidas.jp/item/?gender=mens&category=wear&order=1&page=%d", i)
-			productUrlChan <- pageURL
+	categoryElems, err := wd.FindElements(selenium.ByCSSSelector, ".lpc-ukLocalNavigation_itemList li a")
+	if err != nil {
+		return nil, fmt.Errorf("failed to find category elements: %v", err)
+	}
+
+	var categories []categoryLink
+	seen := make(map[string]bool)
+	for _, elem := range categoryElems {
+		href, err := elem.GetAttribute("href")
+		if err != nil {
+			slog.DebugContext(ctx, "Failed to get href attribute", "err", err)
+			continue
+		}
+		if href == "" {
+			continue
 		}
 
-		close(productUrlChan)
-		wg.Wait()
+		fullURL := resolveURL(sectionURL, href)
+		if fullURL == "" || seen[fullURL] {
+			continue
+		}
+		seen[fullURL] = true
+		name, err := elem.Text()
+		if err != nil {
+			slog.DebugContext(ctx, "Failed to get category name", "url", fullURL, "err", err)
+		}
+		categories = append(categories, categoryLink{URL: fullURL, Name: strings.TrimSpace(name)})
 	}
 
-	filter := bson.M{}
-	findOptions := options.Find()
-	findOptions.SetLimit(300)
+	return categories, nil
+}
+
+// scrapeOptions restricts which stored product URLs the scrape phase visits.
+type scrapeOptions struct {
+	Categories *regexp.Regexp      // nil means every category
+	Limit      int                 // 0 means every pending URL
+	URLs       map[string]struct{} // nil means every pending URL, otherwise only these
+	// Feed, when set, is scraped in its order instead of the pending product
+	// URLs. Unless Stored is set they are not stored ones, see feedStorage.
+	Feed   []ProductURL
+	Stored bool // Feed holds stored product URLs, claimed and marked as usual
+}
+
+// scrape visits the stored product URLs and saves the scraped products,
+// handing each to sinks.
+func scrape(ctx context.Context, cfg *Config, opts scrapeOptions, sessions *sessionFactory, store Storage, sinks []productSink, stats *crawlStats) error {
+	ctx = withLogAttrs(ctx, "phase", "scrape")
+	if err := store.prepare(ctx); err != nil {
+		return err
+	}
+	released, err := store.releaseStaleClaims(ctx, cfg.StaleClaimTimeout)
+	if err != nil {
+		return fmt.Errorf("failed to release stale claims: %v", err)
+	}
+	if released > 0 {
+		slog.InfoContext(ctx, "Released product URLs left in progress", "released", released, "older_than", cfg.StaleClaimTimeout)
+	}
 
-	cursor, err := productUrlCollection.Find(context.Background(), filter, findOptions)
+	robots, err := loadRobots(cfg)
+	if err != nil {
+		return err
+	}
+	pace := newThrottle(cfg, stats, robots)
+	sessions = sessions.paced(ctx, pace)
+	artifacts, err := newArtifactStore(cfg)
 	if err != nil {
-		log.Fatalf("Failed to find documents: %v", err)
+		return err
 	}
-	defer cursor.Close(context.Background())
 
-	var results []ProductURL
-	if err = cursor.All(context.Background(), &results); err != nil {
-		log.Fatalf("Failed to iterate over cursor: %v", err)
+	stats.Pending.Store(countPending(ctx, store, opts))
+
+	batched := newBatchStorage(store, cfg.ProductBatchSize, cfg.ProductBatchInterval, stats)
+	defer batched.stop()
+	store = batched
+
+	// With -expand-colors, scraping a product queues its other colorways as
+	// pending product URLs. They are picked up by further passes until a pass
+	// queues nothing new.
+	seen := make(map[string]struct{})
+	limit := opts.Limit
+	for pass := 1; ; pass++ {
+		queued := stats.Variants.Load()
+		dispatched, err := scrapePass(ctx, cfg, sessions, store, opts, limit, seen, pace, artifacts, sinks, stats)
+		if err != nil {
+			return err
+		}
+		if dispatched == 0 && pass == 1 {
+			slog.InfoContext(ctx, "No pending product URLs to scrape")
+		}
+		if !cfg.ExpandColors || ctx.Err() != nil || stats.Variants.Load() == queued {
+			return nil
+		}
+		if opts.Limit > 0 {
+			remaining := int64(opts.Limit) - stats.Dispatched.Load()
+			if remaining <= 0 {
+				return nil
+			}
+			limit = int(remaining)
+		}
+		slog.InfoContext(ctx, "Scraping queued color variants", "variants", stats.Variants.Load()-queued, "pass", pass)
 	}
+}
 
-	if len(results) != 0 {
-		productChan := make(chan string)
-		var wg sync.WaitGroup
+// countPending returns how many product URLs scrape is about to dispatch, or
+// an upper bound of it, for the progress display. It returns 0 when they
+// cannot be counted.
+func countPending(ctx context.Context, store Storage, opts scrapeOptions) int64 {
+	var n int64
+	switch {
+	case opts.Feed != nil:
+		n = int64(len(opts.Feed))
+	case opts.URLs != nil:
+		n = int64(len(opts.URLs))
+	default:
+		var err error
+		if n, err = store.countPendingProductURLs(ctx, opts.Categories); err != nil {
+			slog.WarnContext(ctx, "Failed to count pending product URLs", "err", err)
+			return 0
+		}
+	}
+	if opts.Limit > 0 {
+		n = min(n, int64(opts.Limit))
+	}
+	return n
+}
 
-		for i := 0; i < numWorkers; i++ {
+// scrapePass feeds the pending product URLs selected by opts, up to limit, to
+// a fresh pool of scrape workers and waits for them to finish. URLs in seen
+// are skipped and the dispatched ones are added to it. It returns the number
+// of URLs dispatched.
+func scrapePass(ctx context.Context, cfg *Config, sessions *sessionFactory, store Storage, opts scrapeOptions, limit int, seen map[string]struct{}, pace *throttle, artifacts *artifactStore, sinks []productSink, stats *crawlStats) (int, error) {
+	workers := cfg.scrapeWorkers()
+	productChan := make(chan ProductURL, cfg.ChannelBuffer)
+	workerErrs := make(chan error, workers)
+	var wg sync.WaitGroup
+
+	// Stop dispatching if every worker has given up, instead of blocking on a
+	// channel nobody reads any more.
+	dispatchCtx, stopDispatch := context.WithCancel(ctx)
+	defer stopDispatch()
+
+	// Workers are started with the first pending URL, so that a pass with
+	// nothing to do opens no browser sessions.
+	started := false
+	start := func() {
+		started = true
+		for i := 0; i < workers; i++ {
 			wg.Add(1)
 			go func() {
 				defer wg.Done()
-				processProduct(productChan, caps, productCollection)
+				defer recoverWorker(workerErrs, stats)
+				processProduct(withLogAttrs(ctx, "worker", i+1), cfg, productChan, sessions, store, pace, artifacts, sinks, stats, workerErrs)
 			}()
 		}
+		go func() {
+			wg.Wait()
+			stopDispatch()
+		}()
+	}
 
-		for _, result := range results {
-			productChan <- result.URL
+	each := func(fn func(ProductURL) bool) error {
+		return store.eachPendingProductURL(ctx, opts.Categories, limit, fn)
+	}
+	if opts.Feed != nil {
+		if !opts.Stored {
+			store = &feedStorage{Storage: store}
 		}
+		each = func(fn func(ProductURL) bool) error {
+			for i, productURL := range opts.Feed {
+				if limit > 0 && i >= limit || !fn(productURL) {
+					break
+				}
+			}
+			return nil
+		}
+	}
 
-		close(productChan)
-		wg.Wait()
+	// The same product is often listed under several sections; only the
+	// first listing is scraped.
+	dispatched := 0
+	err := each(func(result ProductURL) bool {
+		if opts.URLs != nil && !contains(opts.URLs, result.URL) {
+			return true
+		}
+		canonical := canonicalProductURL(result.URL)
+		if contains(seen, canonical) {
+			return true
+		}
+		if !started {
+			start()
+		}
+		seen[canonical] = struct{}{}
+		if !send(dispatchCtx, productChan, result) {
+			return false
+		}
+		dispatched++
+		stats.Dispatched.Add(1)
+		return true
+	})
+	if !started {
+		return 0, err
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Stopped dispatching product URLs", "err", err)
 	}
 
-	exportToExcel(productCollection)
+	close(productChan)
+	wg.Wait()
+	close(workerErrs)
+
+	failedWorkers := 0
+	for err := range workerErrs {
+		slog.ErrorContext(ctx, "Scrape worker stopped", "err", err)
+		failedWorkers++
+	}
+	if failedWorkers == workers {
+		return dispatched, fmt.Errorf("all %d scrape workers stopped, leaving the remaining product URLs pending", failedWorkers)
+	}
+	return dispatched, nil
+}
 
-	log.Println("Crawling finished!")
+// contains reports whether key is in set.
+func contains(set map[string]struct{}, key string) bool {
+	_, ok := set[key]
+	return ok
 }
 
-func processURLs(productUrlChan chan string, caps selenium.Capabilities, collection *mongo.Collection) {
-	wd, err := selenium.NewRemote(caps, fmt.Sprintf("http://localhost:%d/wd/hub", port))
-	if err != nil {
-		log.Fatalf("Error connecting to the WebDriver server: %v", err)
+// receive returns the next value from ch. It reports false once ch is closed
+// or ctx is cancelled, so workers stop pulling new work on shutdown.
+func receive[T any](ctx context.Context, ch <-chan T) (T, bool) {
+	var zero T
+	if ctx.Err() != nil {
+		return zero, false
 	}
-	defer wd.Quit()
+	select {
+	case <-ctx.Done():
+		return zero, false
+	case v, ok := <-ch:
+		return v, ok
+	}
+}
 
-	for url := range productUrlChan {
-		if err := wd.Get(url); err != nil {
-			log.Printf("Failed to load page URL: %v", err)
-			continue
-		}
+// send delivers v on ch unless ctx is cancelled first.
+func send[T any](ctx context.Context, ch chan<- T, v T) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case ch <- v:
+		return true
+	}
+}
 
-		closeModals(wd)
-		scrollToBottom(wd)
-		time.Sleep(5 * time.Second)
+// processURLs stores the product URLs of the listing pages received on
+// productUrlChan. With a listing client they are fetched from the listing
+// API, otherwise, and with -listing-mode=auto when the API fails, read from
+// the rendered page. If no browser session can be opened for a page, the
+// worker reports why on errs and exits.
+func processURLs(ctx context.Context, cfg *Config, productUrlChan <-chan listingPage, sessions *sessionFactory, listing *listingClient, store Storage, pace *throttle, stats *crawlStats, errs chan<- error) {
+	// A browser session is only borrowed once a page needs it, and handed
+	// back before the worker waits for the next page.
+	var session *pooledSession
+	var wd selenium.WebDriver
+	releaseSession := func() {
+		if session != nil {
+			sessions.release(session, false)
+			session, wd = nil, nil
+		}
+	}
+	defer releaseSession()
 
-		productElems, err := wd.FindElements(selenium.ByCSSSelector, ".articleDisplayCard-children a.image_link")
-		if err != nil {
-			log.Printf("Failed to find product elements: %v", err)
-			continue
+	for {
+		releaseSession()
+		page, ok := receive(ctx, productUrlChan)
+		if !ok {
+			return
 		}
+		url := page.URL
+		pageCtx := withLogAttrs(ctx, "url", url)
 
 		pageNo := extractPageNumber(url)
+		if pageNo == -1 {
+			slog.ErrorContext(pageCtx, "Failed to extract the page number from the URL")
+			continue
+		}
+		// A category the URL does not name goes by the name of its
+		// navigation link.
 		category := extractCategory(url)
-		if pageNo == -1 || category == "" {
-			log.Printf("Failed to extract page number from URL: %s", url)
+		if category == "" {
+			category = page.CategoryName
+		}
+		if category == "" {
+			slog.ErrorContext(pageCtx, "Failed to extract the category from the URL or its navigation link")
 			continue
 		}
 
-		for _, elem := range productElems {
-			href, err := elem.GetAttribute("href")
-			if err != nil || href == "" {
+		if listing != nil && listing.usable() {
+			if !pace.wait(ctx) {
+				return
+			}
+			productURLs, err := listing.fetch(ctx, url)
+			if err == nil {
+				pace.passed()
+				storeListingURLs(pageCtx, store, pace, stats, page, category, pageNo, productURLs, nil)
+				continue
+			}
+			if cfg.ListingMode == listingModeAPI {
+				slog.ErrorContext(pageCtx, "Failed to fetch listing page from the listing API", "err", err)
 				continue
 			}
+			slog.WarnContext(pageCtx, "Failed to fetch listing page from the listing API, reading it in the browser", "err", err)
+		}
 
-			fullURL := "https://shop.adidas.jp" + href
+		if wd == nil {
+			var err error
+			if session, err = sessions.checkout(); err != nil {
+				errs <- fmt.Errorf("error connecting to the WebDriver server, listing page %s left unread: %v", url, err)
+				return
+			}
+			wd = session.wd
+		}
 
-			_, err = collection.InsertOne(context.TODO(), ProductURL{Category: category, PageNo: pageNo, URL: fullURL})
+		// A challenge page is retried once the shared backoff has passed.
+		loaded := false
+		var start time.Time
+		for pace.wait(ctx) {
+			start = time.Now()
+			if err := wd.Get(url); err != nil {
+				slog.ErrorContext(pageCtx, "Failed to load listing page", "err", err)
+				if isTimeoutError(err) {
+					stats.Timeouts.Add(1)
+				}
+				break
+			}
+
+			closeModals(cfg, wd)
+			if err := scrollToBottom(cfg, wd); err != nil {
+				slog.WarnContext(pageCtx, "Failed to scroll listing page", "err", err)
+			}
+			if err := waitForElement(wd, ".articleDisplayCard-children", cfg.WaitTimeout); err != nil {
+				if isChallengePage(wd) {
+					pace.challenged(url)
+					continue
+				}
+				slog.WarnContext(pageCtx, "Listing page did not render", "err", err)
+			}
+			pace.passed()
+			loaded = true
+			break
+		}
+		if !loaded {
+			continue
+		}
+
+		cards, err := wd.FindElements(selenium.ByCSSSelector, ".articleDisplayCard-children")
+		if err != nil {
+			slog.ErrorContext(pageCtx, "Failed to find product elements", "err", err)
+			continue
+		}
+
+		var productURLs []string
+		badges := make(map[string][]string)
+		for _, card := range seleniumElements(wd, cards) {
+			links, err := card.findElements("a.image_link")
 			if err != nil {
-				log.Printf("Failed to insert document: %v", err)
+				continue
+			}
+			labels, _ := extractBadges(card, listingBadgeSelector)
+			for _, link := range links {
+				href, err := link.attr("href")
+				if err != nil || href == "" {
+					continue
+				}
+				productURL := resolveURL(url, href)
+				productURLs = append(productURLs, productURL)
+				badges[productURL] = normalizeBadges(labels)
 			}
 		}
+		stats.addListingTime(time.Since(start))
+		storeListingURLs(pageCtx, store, pace, stats, page, category, pageNo, productURLs, badges)
 	}
 }
 
+// storeListingURLs stores the product URLs found on one listing page, in one
+// write, each with the badges of its card by URL, which the listing API does
+// not give. They are stored by their canonical URL, see canonicalProductURL,
+// so that a page linked twice with different tracking parameters is queued
+// once.
+func storeListingURLs(ctx context.Context, store Storage, pace *throttle, stats *crawlStats, page listingPage, category string, pageNo int, productURLs []string, badges map[string][]string) {
+	var batch []ProductURL
+	seen := make(map[string]struct{}, len(productURLs))
+	for _, fullURL := range productURLs {
+		if fullURL == "" {
+			continue
+		}
+		canonical := canonicalProductURL(fullURL)
+		if contains(seen, canonical) || !pace.allowed(canonical) {
+			continue
+		}
+		seen[canonical] = struct{}{}
+		productURL := ProductURL{Section: page.Section, Category: category, CategoryName: page.CategoryName, PageNo: pageNo, URL: canonical, Status: statusPending}
+		productURL.Badges = badges[fullURL]
+		if canonical != fullURL {
+			productURL.RawURL = fullURL
+		}
+		batch = append(batch, productURL)
+	}
+	stats.ListingPages.Add(1)
+	if len(batch) == 0 {
+		slog.InfoContext(ctx, "Stored product URLs of listing page", "new", 0, "known", 0)
+		return
+	}
+
+	newURLs, err := store.saveProductURLs(context.WithoutCancel(ctx), batch)
+	stats.URLWrites.Add(1)
+	stats.ProductURLs.Add(int64(newURLs))
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to store product URLs of listing page", "urls", len(batch), "new", newURLs, "err", err)
+		return
+	}
+	slog.InfoContext(ctx, "Stored product URLs of listing page", "new", newURLs, "known", len(batch)-newURLs)
+}
+
+// siteURL is the origin of the shop. Relative links found on its pages are
+// resolved against the page they appear on, see resolveURL.
+const siteURL = "https://shop.adidas.jp"
+
+// resolveURL resolves ref, as found in an href or src attribute, against the
+// URL of the page it appears on. Absolute and protocol-relative references are
+// kept as they are. It returns "" for empty references, data: URIs used as
+// lazy-load placeholders and anything that does not parse.
+func resolveURL(base, ref string) string {
+	ref = strings.TrimSpace(ref)
+	if ref == "" || strings.HasPrefix(strings.ToLower(ref), "data:") {
+		return ""
+	}
+	refURL, err := neturl.Parse(ref)
+	if err != nil {
+		return ""
+	}
+	baseURL, err := neturl.Parse(base)
+	if err != nil || !baseURL.IsAbs() {
+		baseURL, _ = neturl.Parse(siteURL)
+	}
+	return baseURL.ResolveReference(refURL).String()
+}
+
+// isRootBreadcrumb reports whether a breadcrumb link points at the shop's
+// home page or the top page of a section, which say nothing about the
+// product's category.
+func isRootBreadcrumb(link string) bool {
+	u, err := neturl.Parse(link)
+	if err != nil || link == "" {
+		return false
+	}
+	p := strings.Trim(u.Path, "/")
+	return p == "" || slices.Contains(sections, p)
+}
+
+// canonicalProductURL returns url without its query string, which carries
+// nothing but tracking parameters such as utm_source, and fragment, with a
+// lower-case host and, on the shop, the path of a product page cut to
+// /products/<code>/, so links to the same product page from different
+// listings compare equal.
+func canonicalProductURL(rawURL string) string {
+	u, err := neturl.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	u.Host = strings.ToLower(u.Host)
+	u.RawQuery = ""
+	u.Fragment = ""
+	if productNumber := extractProductNumber(u.Path); productNumber != "" && u.Host == strings.TrimPrefix(siteURL, "https://") {
+		u.Path, u.RawPath = "/products/"+productNumber+"/", ""
+	}
+	return u.String()
+}
+
+// listingPageURL returns the URL of page page of the listing at categoryURL:
+// categoryURL with its page query parameter set, keeping the others.
+func listingPageURL(categoryURL string, page int) string {
+	u, err := neturl.Parse(categoryURL)
+	if err != nil {
+		return categoryURL
+	}
+	query := u.Query()
+	query.Set("page", strconv.Itoa(page))
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
 func extractPageNumber(url string) int {
 	re := regexp.MustCompile(`page=(\d+)`)
 	matches := re.FindStringSubmatch(url)
@@ -269,15 +1044,17 @@ func extractPageNumber(url string) int {
 
 	pageNo, err := strconv.Atoi(matches[1])
 	if err != nil {
-		log.Printf("Failed to convert page number to integer: %v", err)
+		slog.Debug("Failed to convert page number to integer", "url", url, "err", err)
 		return -1
 	}
 
 	return pageNo
 }
 
-func extractCategory(url string) string {
-	re := regexp.MustCompile(`category=([^&]+)`)
+// extractProductNumber returns the article number from the products/XXXXXX
+// segment of a product page URL, or "" if there is none.
+func extractProductNumber(url string) string {
+	re := regexp.MustCompile(`/products/([^/?#]+)`)
 	matches := re.FindStringSubmatch(url)
 	if len(matches) < 2 {
 		return ""
@@ -286,607 +1063,879 @@ func extractCategory(url string) string {
 	return matches[1]
 }
 
-func getPageCount(wd selenium.WebDriver) int {
-	pageCount := 1
-	pageTotalElem, err := wd.FindElement(selenium.ByCSSSelector, ".pageTotal")
-	if err == nil && pageTotalElem != nil {
-		pageTotalText, err := pageTotalElem.Text()
-		if err == nil {
-			pageTotal, err := strconv.Atoi(strings.TrimSpace(pageTotalText))
-			if err == nil {
-				pageCount = pageTotal
-			}
-		}
+// extractCategory returns the category slug of a listing URL: its category
+// query parameter or, for a path-based URL such as /men/shoes/running/, the
+// path segments after the section, "shoes/running". It returns "" when the
+// URL names no category.
+func extractCategory(rawURL string) string {
+	u, err := neturl.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	if category := u.Query().Get("category"); category != "" {
+		return category
+	}
+	segments := strings.FieldsFunc(u.Path, func(r rune) bool { return r == '/' })
+	if len(segments) > 0 && slices.Contains(sections, segments[0]) {
+		segments = segments[1:]
 	}
-	return pageCount
+	if len(segments) == 0 || segments[0] == "item" || segments[0] == "products" {
+		return ""
+	}
+	return strings.Join(segments, "/")
 }
 
-func scrollToBottom(wd selenium.WebDriver) {
-	for {
-		_, err := wd.ExecuteScript("window.scrollBy(0, 1000);", nil)
-		if err != nil {
-			log.Fatalf("Failed to scroll: %v", err)
-		}
-
-		time.Sleep(5 * time.Second)
-
-		scrollHeight, err := wd.ExecuteScript("return document.documentElement.scrollHeight;", nil)
-		if err != nil {
-			log.Fatalf("Failed to get scroll height: %v", err)
-		}
+// Strategies getPageCount found the page count of a category with.
+const (
+	pageCountTotal = "page_total"       // the .pageTotal element
+	pageCountLinks = "pagination_links" // the highest page=N link
+	pageCountProbe = "probe"            // loading pages until one is empty
+)
 
-		clientHeight, err := wd.ExecuteScript("return document.documentElement.clientHeight;", nil)
-		if err != nil {
-			log.Fatalf("Failed to get client height: %v", err)
+// pageProbeLimit is the highest page number getPageCount probes without
+// -max-pages.
+const pageProbeLimit = 512
+
+// getPageCount returns the number of listing pages of the category page wd
+// has loaded and the strategy it was found with. It reads the .pageTotal
+// element, as "42" or "1 / 42", then falls back to the highest page linked
+// from the page and, when a page links to none, such as a single page
+// category, probes pages of categoryURL, up to maxPages, 0 for
+// pageProbeLimit, until one has no product cards. It returns an error when
+// no strategy gave a count.
+func getPageCount(ctx context.Context, cfg *Config, wd selenium.WebDriver, pace *throttle, categoryURL string, maxPages int) (int, string, error) {
+	if elem, err := wd.FindElement(selenium.ByCSSSelector, ".pageTotal"); err == nil {
+		if text, err := elem.Text(); err == nil {
+			if total, ok := parsePageTotal(text); ok {
+				return total, pageCountTotal, nil
+			}
+			slog.DebugContext(ctx, "Failed to parse the page total", "url", categoryURL, "text", text)
 		}
+	}
 
-		scrollTop, err := wd.ExecuteScript("return document.documentElement.scrollTop;", nil)
-		if err != nil {
-			log.Fatalf("Failed to get scroll top: %v", err)
+	if links, err := wd.FindElements(selenium.ByCSSSelector, `a[href*="page="]`); err == nil {
+		highest := 0
+		for _, link := range links {
+			if href, err := link.GetAttribute("href"); err == nil {
+				highest = max(highest, extractPageNumber(href))
+			}
 		}
-
-		if scrollTop.(float64)+clientHeight.(float64) >= scrollHeight.(float64) {
-			break
+		if highest > 0 {
+			return highest, pageCountLinks, nil
 		}
 	}
-}
 
-func closeModals(wd selenium.WebDriver) {
-	closeButtons, err := wd.FindElements(selenium.ByCSSSelector, ".modal .boxClose")
-	if err != nil {
-		log.Printf("Failed to find modal close buttons: %v", err)
+	if maxPages <= 0 {
+		maxPages = pageProbeLimit
 	}
-
-	for _, closeButton := range closeButtons {
-		if err := closeButton.Click(); err == nil {
-			log.Println("Modal closed")
-		}
+	count, err := probePageCount(ctx, cfg, wd, pace, categoryURL, maxPages)
+	if err != nil {
+		return 0, "", fmt.Errorf("no page total, no pagination links and probing failed: %v", err)
 	}
+	return count, pageCountProbe, nil
 }
 
-func processProduct(urlChan <-chan string, caps selenium.Capabilities, productsCollection *mongo.Collection) {
-	wd, err := selenium.NewRemote(caps, fmt.Sprintf("http://localhost:%d/wd/hub", port))
-	if err != nil {
-		log.Printf("Error connecting to the WebDriver server: %v", err)
-		return
-	}
-	defer wd.Quit()
+// pageTotalNumber matches the last number of a page total.
+var pageTotalNumber = regexp.MustCompile(`(\d+)\D*$`)
 
-	for url := range urlChan {
-		product := scrapeProduct(wd, url)
-		if product != nil {
-			// Insert product into MongoDB
-			_, err := productsCollection.InsertOne(context.Background(), product)
-			if err == nil {
-				log.Printf("Inserted product: %s", product.ProductURL)
-			}
-		}
+// parsePageTotal parses the text of the .pageTotal element, a bare total
+// such as "42" or the current page and the total such as "1 / 42".
+func parsePageTotal(text string) (int, bool) {
+	if _, after, ok := strings.Cut(text, "/"); ok {
+		text = after
 	}
+	matches := pageTotalNumber.FindStringSubmatch(strings.TrimSpace(text))
+	if matches == nil {
+		return 0, false
+	}
+	total, err := strconv.Atoi(matches[1])
+	return total, err == nil && total > 0
 }
 
-func scrapeProduct(wd selenium.WebDriver, url string) *Product {
-	product := &Product{ProductURL: url}
-
-	baseURL := "https://shop.adidas.jp"
-
-	if err := wd.Get(url); err != nil {
-		log.Printf("Failed to load page: %v", err)
+// probePageCount finds the last page of categoryURL with product cards, up to
+// limit, by doubling the page number until a page is empty and bisecting
+// between the last full and the first empty page. Page 1 is taken to have
+// cards, as the category page rendered.
+func probePageCount(ctx context.Context, cfg *Config, wd selenium.WebDriver, pace *throttle, categoryURL string, limit int) (int, error) {
+	hasCards := func(page int) (bool, error) {
+		if !pace.wait(ctx) {
+			return false, ctx.Err()
+		}
+		pageURL := listingPageURL(categoryURL, page)
+		if err := wd.Get(pageURL); err != nil {
+			return false, fmt.Errorf("failed to load %s: %v", pageURL, err)
+		}
+		// An empty page never renders a card, so it costs a full
+		// -wait-timeout.
+		waitForElement(wd, ".articleDisplayCard-children", cfg.WaitTimeout)
+		cards, err := wd.FindElements(selenium.ByCSSSelector, ".articleDisplayCard-children")
+		return err == nil && len(cards) > 0, nil
 	}
 
-	time.Sleep(5 * time.Second)
-
-	_, err := wd.FindElement(selenium.ByCSSSelector, ".article_image_wrapper")
-
-	if err == nil {
-		script := `
-		var element = document.querySelector('.article_image_wrapper');
-		if (element) {
-			element.classList.add('isExpand');
+	full, empty := 1, 0
+	for page := 2; ; page *= 2 {
+		page = min(page, limit)
+		if page <= full {
+			return full, nil
 		}
-	`
-		_, scriptErr := wd.ExecuteScript(script, nil)
-		if scriptErr != nil {
-			log.Printf("Failed to add 'isExpand' class to 'article_image_wrapper' element: %v", scriptErr)
+		ok, err := hasCards(page)
+		if err != nil {
+			return 0, err
+		}
+		if !ok {
+			empty = page
+			break
+		}
+		full = page
+		if page == limit {
+			return full, nil
+		}
+	}
+	for empty-full > 1 {
+		page := (full + empty) / 2
+		ok, err := hasCards(page)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			full = page
+		} else {
+			empty = page
 		}
 	}
+	return full, nil
+}
 
-	closeModals(wd)
-	scrollToBottom(wd)
+// waitForElement polls until an element matching selector is present on the
+// page, giving up after timeout.
+func waitForElement(wd selenium.WebDriver, selector string, timeout time.Duration) error {
+	err := wd.WaitWithTimeout(func(wd selenium.WebDriver) (bool, error) {
+		elems, err := wd.FindElements(selenium.ByCSSSelector, selector)
+		return err == nil && len(elems) > 0, nil
+	}, timeout)
+	if err != nil {
+		return fmt.Errorf("%s did not appear within %v", selector, timeout)
+	}
+	return nil
+}
 
-	// Wait for the page to load completely
-	time.Sleep(5 * time.Second)
+// Scrolling waits for the page height to settle between steps, polling it at
+// scrollPollInterval for at most scrollSettleTimeout.
+const (
+	scrollPollInterval  = 250 * time.Millisecond
+	scrollSettleTimeout = 3 * time.Second
+)
 
-	// Product URL
-	product.ProductURL = url
+// scrollToBottom scrolls down until the bottom of the page is reached, so that
+// lazy-loaded content renders. Pages whose height keeps growing, such as
+// those with endless recommendation carousels, are given up on after
+// cfg.ScrollMaxSteps steps or cfg.ScrollMaxDuration.
+func scrollToBottom(cfg *Config, wd selenium.WebDriver) error {
+	deadline := time.Now().Add(cfg.ScrollMaxDuration)
+
+	for step := 0; step < cfg.ScrollMaxSteps; step++ {
+		if time.Now().After(deadline) {
+			slog.Debug("Stopped scrolling without reaching the bottom", "after", cfg.ScrollMaxDuration)
+			return nil
+		}
 
-	// =============================== Breadcrumb Start =========================
-	breadcrumbElements, err := wd.FindElements(selenium.ByCSSSelector, ".breadcrumbListItem a")
-	if err == nil {
+		_, err := wd.ExecuteScript("window.scrollBy(0, 1000);", nil)
+		if err != nil {
+			return fmt.Errorf("failed to scroll: %v", err)
+		}
+		// Some widgets only open once the page was scrolled.
+		closeModals(cfg, wd)
 
-		for key, breadcrumbElement := range breadcrumbElements {
-			text, err := breadcrumbElement.Text()
-			if err == nil && text != "" {
-				if key != 0 && key != 1 {
-					product.Breadcrumbs = append(product.Breadcrumbs, text)
-				}
-			}
+		scrollHeight, err := waitForStableHeight(wd)
+		if err != nil {
+			return err
 		}
-	}
-	// =============================== Breadcrumb End =========================
 
-	// =============================== Category Start =========================
-	categoryNameElement, err := wd.FindElement(selenium.ByCSSSelector, ".categoryName")
-	if err == nil {
-		categoryName, err := categoryNameElement.Text()
-		if err == nil {
-			product.Category = categoryName
+		// Headless windows may report a zero clientHeight, fall back to the
+		// viewport height.
+		clientHeight, err := scriptNumber(wd, "return document.documentElement.clientHeight || window.innerHeight;")
+		if err != nil {
+			return fmt.Errorf("failed to get client height: %v", err)
 		}
-	}
-	// =============================== Category End =========================
 
-	// =============================== Item Title Start =========================
-	itemTitleElement, err := wd.FindElement(selenium.ByCSSSelector, ".itemTitle")
-	if err == nil {
-		itemTitle, err := itemTitleElement.Text()
-		if err == nil {
-			product.Title = itemTitle
+		scrollTop, err := scriptNumber(wd, "return document.documentElement.scrollTop || window.pageYOffset;")
+		if err != nil {
+			return fmt.Errorf("failed to get scroll top: %v", err)
 		}
-	}
-	// =============================== Item Title End =========================
 
-	// =============================== Item Price Start =========================
-	priceElement, err := wd.FindElement(selenium.ByCSSSelector, ".price-value")
-	if err == nil {
-		price, err := priceElement.Text()
-		if err == nil {
-			product.Price = price
+		if scrollTop+clientHeight >= scrollHeight {
+			return nil
 		}
 	}
-	// =============================== Item Price End =========================
 
-	// ============================== Color Start =============================
-	colorOptionElements, err := wd.FindElements(selenium.ByCSSSelector, ".selectable-image-group .selectableImageListItem")
-	if err != nil {
-		log.Fatalf("Failed to find color option elements: %v", err)
-	}
+	slog.Debug("Stopped scrolling without reaching the bottom", "steps", cfg.ScrollMaxSteps)
+	return nil
+}
 
-	for _, element := range colorOptionElements {
-		imgElement, err := element.FindElement(selenium.ByTagName, "img")
+// waitForStableHeight polls the document height until two consecutive reads
+// agree, meaning whatever the last scroll triggered has finished rendering.
+func waitForStableHeight(wd selenium.WebDriver) (float64, error) {
+	last := -1.0
+	deadline := time.Now().Add(scrollSettleTimeout)
+	for {
+		height, err := scriptNumber(wd, "return document.documentElement.scrollHeight;")
 		if err != nil {
-			continue
+			return 0, fmt.Errorf("failed to get scroll height: %v", err)
 		}
-		imageSrc, _ := imgElement.GetAttribute("src")
-		color, _ := imgElement.GetAttribute("alt")
-
-		if imageSrc != "" && color != "" {
-			imageURL := baseURL + imageSrc
-			product.AvailableColors = append(product.AvailableColors, ColorOption{
-				Path:  imageURL,
-				Color: color,
-			})
+		if height == last || time.Now().After(deadline) {
+			return height, nil
 		}
+		last = height
+		time.Sleep(scrollPollInterval)
 	}
-	// ============================== Color End =============================
+}
 
-	// ============================== Available Size Start =============================
-	sizeElements, err := wd.FindElements(selenium.ByCSSSelector, ".sizeSelectorList .sizeSelectorListItemButton")
+// scriptNumber runs script and converts its result to a float64. Drivers
+// return JavaScript numbers as float64, integer types or json.Number.
+func scriptNumber(wd selenium.WebDriver, script string) (float64, error) {
+	v, err := wd.ExecuteScript(script, nil)
 	if err != nil {
-		log.Fatalf("Failed to find size elements: %v", err)
+		return 0, err
 	}
-
-	for _, sizeElement := range sizeElements {
-		sizeText, err := sizeElement.Text()
-		if err == nil && sizeText != "" {
-			product.AvailableSizes = append(product.AvailableSizes, sizeText)
-		}
+	switch n := v.(type) {
+	case float64:
+		return n, nil
+	case float32:
+		return float64(n), nil
+	case int:
+		return float64(n), nil
+	case int64:
+		return float64(n), nil
+	case json.Number:
+		return n.Float64()
+	default:
+		return 0, fmt.Errorf("unexpected script result %v (%T)", v, v)
 	}
-	// ============================== Available Size End =============================
+}
 
-	// ============================== Image URL Start =============================
-	imageElements, err := wd.FindElements(selenium.ByCSSSelector, ".article_image_wrapper img.test-img")
-	if err != nil {
-		log.Fatalf("Failed to find image elements: %v", err)
+// overlayRecheckDelay is how long closeModals waits after dismissing an
+// overlay before looking again, as dismissing one often brings up the next,
+// such as the country prompt after the cookie consent.
+const overlayRecheckDelay = 300 * time.Millisecond
+
+// overlayRechecks is how many times closeModals looks again.
+const overlayRechecks = 3
+
+// dismissOverlaysScript clicks every displayed element matching one of the
+// selectors in arguments[0] and returns the selectors it clicked.
+const dismissOverlaysScript = `
+	var dismissed = [];
+	arguments[0].forEach(function(selector) {
+		var elements;
+		try {
+			elements = document.querySelectorAll(selector);
+		} catch (e) {
+			return;
+		}
+		for (var i = 0; i < elements.length; i++) {
+			if (elements[i].getClientRects().length > 0) {
+				elements[i].click();
+				dismissed.push(selector);
+				break;
+			}
+		}
+	});
+	return dismissed;
+`
+
+// closeModals dismisses the overlays of -overlay-selectors the page shows,
+// such as the cookie consent bar, which sit over the size selector and block
+// clicks. Overlays come back as the page is scrolled, so it runs after every
+// page load and scroll step. Every overlay dismissed is logged, to spot
+// widgets that show up newly.
+func closeModals(cfg *Config, wd selenium.WebDriver) {
+	selectors := overlaySelectors(cfg)
+	if len(selectors) == 0 {
+		return
 	}
-
-	for _, imgElem := range imageElements {
-		imgSrc, err := imgElem.GetAttribute("src")
+	for i := 0; i < overlayRechecks; i++ {
+		if i > 0 {
+			time.Sleep(overlayRecheckDelay)
+		}
+		result, err := wd.ExecuteScript(dismissOverlaysScript, []any{selectors})
 		if err != nil {
-			log.Fatalf("Failed to get image src: %v", err)
+			slog.Debug("Failed to dismiss overlays", "err", err)
+			return
+		}
+		dismissed, _ := result.([]any)
+		if len(dismissed) == 0 {
+			return
+		}
+		url, _ := wd.CurrentURL()
+		for _, selector := range dismissed {
+			slog.Info("Dismissed overlay", "selector", selector, "url", url)
 		}
-		product.Media = append(product.Media, Media{
-			Path: baseURL + imgSrc,
-			Type: "image",
-		})
 	}
+}
 
-	videoElements, err := wd.FindElements(selenium.ByCSSSelector, ".pdp-article-video-wrap video")
-	if err != nil {
-		log.Fatalf("Failed to find video elements: %v", err)
+// overlaySelectors returns the selectors of -overlay-selectors.
+func overlaySelectors(cfg *Config) []string {
+	var selectors []string
+	for _, selector := range strings.Split(cfg.OverlaySelectors, ";") {
+		if selector = strings.TrimSpace(selector); selector != "" {
+			selectors = append(selectors, selector)
+		}
 	}
+	return selectors
+}
 
-	for _, videoElem := range videoElements {
-		videoSrc, err := videoElem.GetAttribute("src")
-		if err != nil {
-			log.Fatalf("Failed to get video src: %v", err)
+// processProduct scrapes the product URLs it receives on urlChan. When the
+// browser session dies mid-crawl it is replaced and the URL retried, up to
+// cfg.MaxSessionRestarts times; after that, or if no session can be opened,
+// the worker reports why on errs and exits. Saved products are handed to
+// every sink, see openSinks.
+//
+// With -engine=http product pages are fetched over plain HTTP and only loaded
+// in the browser when needsBrowser says so; the browser session is opened for
+// the first product that needs it.
+//
+// Failed pages, and with -snapshot-all every page, are snapshotted into
+// artifacts, nil without -artifacts-dir; see snapshotPage.
+func processProduct(ctx context.Context, cfg *Config, urlChan <-chan ProductURL, sessions *sessionFactory, store Storage, pace *throttle, artifacts *artifactStore, sinks []productSink, stats *crawlStats, errs chan<- error) {
+	// The browser session is borrowed from the pool for a product URL and
+	// handed back before the worker waits for the next one.
+	var session *pooledSession
+	var wd selenium.WebDriver
+	var proxy string
+	releaseSession := func(broken bool) {
+		if session != nil {
+			sessions.release(session, broken)
+			session, wd, proxy = nil, nil, ""
 		}
-		product.Media = append(product.Media, Media{
-			Path: baseURL + videoSrc,
-			Type: "video",
-		})
 	}
-	// ============================== Image URL End ====================================
-
-	// ============================== Coordinated Start =============================
-	productElements, err := wd.FindElements(selenium.ByCSSSelector, ".coordinateItems .carouselListitem")
-	if err == nil {
-		for _, productElement := range productElements {
-			var coorProduct CoordinatedProduct
+	defer releaseSession(false)
+	// openSession borrows a browser session, in place of the one that died
+	// if there is one.
+	openSession := func() error {
+		releaseSession(true)
+		var err error
+		if session, err = sessions.checkout(); err != nil {
+			return err
+		}
+		wd, proxy = session.wd, session.proxy
+		return nil
+	}
 
-			// Get product name
-			productNameElement, err := productElement.FindElement(selenium.ByCSSSelector, ".coordinate_image img")
-			if err == nil {
-				productName, err := productNameElement.GetAttribute("alt")
-				if err == nil {
-					coorProduct.Title = productName
-				}
+	var fetcher *httpExtractor
+	if cfg.Engine == engineHTTP {
+		var err error
+		if fetcher, err = newHTTPExtractor(cfg, sessions); err != nil {
+			errs <- err
+			return
+		}
+	} else if err := openSession(); err != nil {
+		errs <- fmt.Errorf("error connecting to the WebDriver server: %v", err)
+		return
+	}
+	restarts := 0
+
+	// scrapeURL waits for the shared throttle before every page load and
+	// loads the page again when a bot challenge was served instead. The error
+	// is that of a browser session that could not be opened. loaded is the
+	// extractor the page was last loaded with.
+	var loaded Extractor
+	scrapeURL := func(url string) (*Product, []*SectionError, error) {
+		for {
+			if !pace.wait(ctx) {
+				return nil, []*SectionError{{Section: "page", Err: ctx.Err()}}, nil
 			}
-
-			// Get price
-			priceElement, err := productElement.FindElement(selenium.ByCSSSelector, ".price-value.test-price-value")
-			if err == nil {
-				price, err := priceElement.Text()
-				if err == nil {
-					coorProduct.Price = price
+			if fetcher != nil {
+				loaded = fetcher
+				product, sectionErrs := scrapeSafely(cfg, fetcher, url)
+				if !needsBrowser(product, sectionErrs) {
+					pace.passed()
+					product.Proxy = fetcher.proxy
+					return product, sectionErrs, nil
+				}
+				slog.DebugContext(ctx, "Loading product page in the browser, plain HTTP fell short", "page_error", findSectionError(sectionErrs, "page"))
+				stats.BrowserFallbacks.Add(1)
+				if !pace.wait(ctx) {
+					return nil, []*SectionError{{Section: "page", Err: ctx.Err()}}, nil
+				}
+				if wd == nil {
+					if err := openSession(); err != nil {
+						return nil, nil, fmt.Errorf("error connecting to the WebDriver server: %v", err)
+					}
 				}
 			}
-
-			// Get image URL
-			imageURL, err := productNameElement.GetAttribute("src")
-			if err == nil {
-				coorProduct.Path = baseURL + imageURL
+			if wd == nil {
+				if err := openSession(); err != nil {
+					return nil, nil, fmt.Errorf("error connecting to the WebDriver server: %v", err)
+				}
 			}
-
-			// // Extract product number from image URL
-			urlParts := strings.Split(imageURL, "/")
-			if len(urlParts) > 3 {
-				productNumber := urlParts[3]
-				coorProduct.ProductNumber = productNumber
+			loaded = seleniumExtractor{wd}
+			product, sectionErrs := scrapeSafely(cfg, loaded, url)
+			if !errors.Is(findSectionError(sectionErrs, "page"), errChallenge) {
+				pace.passed()
+				product.Proxy = proxy
+				return product, sectionErrs, nil
 			}
-
-			// // // Get product page URL
-			productURL := "https://shop.adidas.jp/products/" + coorProduct.ProductNumber
-			coorProduct.ProductURL = productURL
-
-			product.CoordinatedProducts = append(product.CoordinatedProducts, coorProduct)
+			pace.challenged(url)
 		}
 	}
-	// ============================== Coordinated End =============================
 
-	// ============================== Description Start =============================
-	DescriptionHeadingElement, err := wd.FindElement(selenium.ByCSSSelector, ".heading.itemName.test-commentItem-topHeading")
-	if err == nil {
-		descriptionHeading, err := DescriptionHeadingElement.Text()
-		if err == nil {
-			product.DescriptionHeading = descriptionHeading
+	for {
+		releaseSession(false)
+		productURL, ok := receive(ctx, urlChan)
+		if !ok {
+			return
 		}
-	}
+		urlCtx := withLogAttrs(ctx, "url", productURL.URL)
 
-	descriptionTitleElement, err := wd.FindElement(selenium.ByCSSSelector, ".heading.itemFeature.test-commentItem-subheading")
-	if err == nil {
-		descriptionTitle, err := descriptionTitleElement.Text()
-		if err == nil {
-			product.DescriptionTitle = descriptionTitle
+		claimed, err := store.claimProductURL(context.WithoutCancel(urlCtx), productURL.URL)
+		if err != nil {
+			slog.ErrorContext(urlCtx, "Failed to claim product URL", "err", err)
+			continue
 		}
-	}
-
-	description, err := wd.FindElement(selenium.ByCSSSelector, ".description.clearfix.test-descriptionBlock .description_part.details.test-itemComment-descriptionPart .commentItem-mainText.test-commentItem-mainText")
-	if err == nil {
-		descriptionText, err := description.Text()
-		if err == nil {
-			product.Description = descriptionText
+		if !claimed {
+			// Another worker or process got to it first.
+			continue
 		}
-	}
 
-	specificationItems, err := wd.FindElements(selenium.ByCSSSelector, ".articleFeatures.description_part .articleFeaturesItem")
-	if err == nil {
-		for _, item := range specificationItems {
-			itemText, err := item.Text()
-			if err == nil {
-				product.Specifications = append(product.Specifications, itemText)
+		status, scrapeErr := statusDone, error(nil)
+		product, sectionErrs, err := scrapeURL(productURL.URL)
+		for sessionErr := findSessionError(sectionErrs); err == nil && sessionErr != nil; sessionErr = findSessionError(sectionErrs) {
+			if restarts >= cfg.MaxSessionRestarts {
+				releaseProductURL(urlCtx, store, productURL.URL)
+				errs <- fmt.Errorf("browser session died %d times, last error: %v", restarts+1, sessionErr)
+				return
 			}
-		}
-	}
-	// ============================== Description End =================================
+			restarts++
+			slog.WarnContext(urlCtx, "Browser session died, starting a new one", "err", sessionErr, "restart", restarts, "max_restarts", cfg.MaxSessionRestarts)
 
-	// ============================== Specific Description Start =============================
-	contentElements, err := wd.FindElements(selenium.ByCSSSelector, ".contents .content")
-	if err == nil {
-		var specialDescription SpecialDescription
-
-		for _, content := range contentElements {
-			titleElement, titleErr := content.FindElement(selenium.ByCSSSelector, ".tecTextTitle")
-			imgAltElement, imgAltErr := content.FindElement(selenium.ByCSSSelector, "div.item_part.illustration img")
-
-			if titleErr == nil && imgAltErr == nil {
-				title, _ := titleElement.Text()
-				imgAlt, _ := imgAltElement.GetAttribute("alt")
+			if err := openSession(); err != nil {
+				releaseProductURL(urlCtx, store, productURL.URL)
+				errs <- fmt.Errorf("error reconnecting to the WebDriver server: %v", err)
+				return
+			}
+			product, sectionErrs, err = scrapeURL(productURL.URL)
+		}
+		if err != nil {
+			releaseProductURL(urlCtx, store, productURL.URL)
+			errs <- err
+			return
+		}
+		var fields map[string]any
+		var stateErr *pageStateError
+		// failure is the error class the URL is recorded with in the failed
+		// URLs, empty when the scrape succeeded.
+		var failure string
+		if ctx.Err() != nil && product == nil {
+			// Shut down while waiting out a backoff; leave the URL for the next run.
+			releaseProductURL(urlCtx, store, productURL.URL)
+			return
+		}
+		if loadErr := findSectionError(sectionErrs, "page"); errors.As(loadErr, &stateErr) {
+			slog.InfoContext(urlCtx, "Skipping product URL", "reason", stateErr)
+			stats.Dead.Add(1)
+			status, scrapeErr = stateErr.State, stateErr
+			if stateErr.State != statusRedirected {
+				failure = loadFailureClass(stateErr)
+			}
+			if stateErr.FinalURL != "" {
+				fields = map[string]any{"final_url": stateErr.FinalURL}
+			}
+		} else if loadErr != nil {
+			var panicErr *panicError
+			switch {
+			case isTimeoutError(loadErr):
+				stats.Timeouts.Add(1)
+			case errors.As(loadErr, &panicErr):
+				stats.Panics.Add(1)
+			}
+			slog.ErrorContext(urlCtx, "Failed to load product page", "err", loadErr)
+			status, scrapeErr = statusFailed, loadErr
+			failure = loadFailureClass(loadErr)
+		} else if product != nil {
+			stats.addTimings(product.Timings)
+			if !cfg.DebugTimings {
+				product.Timings = nil
+			}
+			product.Section = productURL.Section
+			classifyProduct(product)
+			if product.Section == "" {
+				// URLs from -urls-file were not listed in a section.
+				product.Section = product.Gender
+			}
+			// The score and hash describe the whole page, so a product
+			// scraped without some sections keeps the stored ones.
+			if !partialScrape(product) {
+				product.CompletenessScore = completenessScore(product)
+				product.ContentHash = contentHash(product, splitList(cfg.HashExclude))
+			}
 
-				if title != "" && imgAlt != "" {
-					specialDescription.Title = title
-					specialDescription.Description = imgAlt
+			// A half-loaded page is not stored over a good product; it is
+			// recorded as a failure and retried instead.
+			if missing := missingFields(product, splitList(cfg.RequiredFields)); len(missing) > 0 {
+				slog.WarnContext(urlCtx, "Not saving incomplete product", "missing_fields", missing)
+				status, scrapeErr, failure = statusFailed, &incompleteError{Fields: missing}, failureIncomplete
+			} else if outcome, err := store.saveProduct(context.WithoutCancel(urlCtx), product); err != nil {
+				slog.ErrorContext(urlCtx, "Failed to save product", "err", err)
+				status, scrapeErr, failure = statusFailed, err, failureParse
+			} else {
+				logSavedProduct(urlCtx, product, outcome, sectionErrs)
+				stats.Products.Add(1)
+				stats.countCategory(product.Category)
+				switch outcome {
+				case productNew:
+					stats.NewProducts.Add(1)
+				case productChanged:
+					stats.ChangedProducts.Add(1)
+				case productUnchanged:
+					stats.UnchangedProducts.Add(1)
+				}
+				if cfg.ExpandColors {
+					queueColorVariants(urlCtx, store, productURL, product, pace, stats)
+				}
+				for _, sink := range sinks {
+					sink.enqueue(ctx, product)
 				}
 			}
-			product.SpecialDescription = append(product.SpecialDescription, specialDescription)
 		}
-	}
-	// ============================== Specific Description End =============================
+		if status == statusFailed {
+			stats.Failed.Add(1)
+			emitEvent(ctx, sinks, runEvent{Type: eventURLFailed, URL: productURL.URL, Error: fmt.Sprint(scrapeErr)})
+		}
 
-	// ==================== Size Chart Start ==========================
-	headerElems, err := wd.FindElements(selenium.ByCSSSelector, ".sizeChartTable thead .sizeChartTHeaderCell")
-	if err != nil {
-		log.Fatalf("Failed to find header elements: %v", err)
-	}
-	var headers []string
-	for _, elem := range headerElems {
-		text, err := elem.Text()
-		if err != nil {
-			log.Fatalf("Failed to get header text: %v", err)
+		if product != nil && product.Availability != "" && status == statusDone {
+			fields = map[string]any{"availability": product.Availability}
+			if product.Availability == availabilityComingSoon {
+				status = statusComingSoon
+			}
 		}
-		if text != "" {
-			headers = append(headers, text)
+		if err := store.markProductURL(context.WithoutCancel(urlCtx), productURL.URL, status, scrapeErr, fields); err != nil {
+			slog.ErrorContext(urlCtx, "Failed to record scrape status", "status", status, "err", err)
 		}
+		var snapshot []string
+		if artifacts != nil && loaded != nil {
+			snapshot = snapshotPage(urlCtx, cfg, artifacts, loaded, productURL, product, sectionErrs, failure)
+		}
+		trackFailure(urlCtx, cfg, store, productURL, failure, scrapeErr, snapshot)
+		if failure != "" {
+			stats.countFailure(failure)
+		}
+		if status == statusNotFound {
+			pruneDeadProductURL(urlCtx, cfg, store, productURL.URL)
+		}
+		stats.Completed.Add(1)
 	}
+}
 
-	// Extract size keys
-	sizeKeysElems, err := wd.FindElements(selenium.ByCSSSelector, ".sizeChartTable tbody .sizeChartTRow:nth-of-type(1) .sizeChartTCell span")
+// pruneDeadProductURL counts another miss of a URL whose page was not found
+// and, with -prune-dead, deletes it once it was not found twice in a row.
+func pruneDeadProductURL(ctx context.Context, cfg *Config, store Storage, url string) {
+	ctx = context.WithoutCancel(ctx)
+	misses, err := store.countNotFound(ctx, url)
 	if err != nil {
-		log.Fatalf("Failed to find size key elements: %v", err)
+		slog.ErrorContext(ctx, "Failed to count misses of product URL", "err", err)
+		return
 	}
-	var sizeKeys []string
-	for _, elem := range sizeKeysElems {
-		text, err := elem.Text()
-		if err != nil {
-			log.Fatalf("Failed to get size key text: %v", err)
-		}
-		sizeKeys = append(sizeKeys, text)
+	if !cfg.PruneDead || misses < 2 {
+		return
+	}
+	if err := store.deleteProductURL(ctx, url); err != nil {
+		slog.ErrorContext(ctx, "Failed to prune product URL", "err", err)
+		return
+	}
+	slog.InfoContext(ctx, "Pruned product URL", "misses", misses)
+}
+
+// releaseProductURL puts a claimed URL back to pending so that a later run
+// picks it up again, also after ctx was cancelled by a shutdown.
+func releaseProductURL(ctx context.Context, store Storage, url string) {
+	if err := store.markProductURL(context.WithoutCancel(ctx), url, statusPending, nil, nil); err != nil {
+		slog.ErrorContext(ctx, "Failed to release product URL", "err", err)
+	}
+}
+
+// logSavedProduct logs a saved product once, together with the sections of
+// it that could not be scraped.
+func logSavedProduct(ctx context.Context, product *Product, outcome string, sectionErrs []*SectionError) {
+	if len(sectionErrs) == 0 {
+		slog.InfoContext(ctx, "Saved product", "product_number", product.ProductNumber, "outcome", outcome)
+		return
 	}
+	failed := make([]string, len(sectionErrs))
+	for i, e := range sectionErrs {
+		failed[i] = e.Error()
+	}
+	slog.WarnContext(ctx, "Saved product with missing sections", "product_number", product.ProductNumber, "outcome", outcome, "failed_sections", failed)
+}
 
-	// Extract size chart data dynamically
-	sizeChart := make(map[string][]map[string]string)
-	for i, header := range headers {
-		sizeChart[header] = make([]map[string]string, len(sizeKeys))
-		rows, err := wd.FindElements(selenium.ByCSSSelector, fmt.Sprintf(".sizeChartTable tbody .sizeChartTRow:nth-of-type(%d) .sizeChartTCell span", i+2))
+// scrapeProduct scrapes the product page at url, loaded by ex, one section at
+// a time through the extract functions. Sections that cannot be scraped are
+// left empty on the returned Product and reported in the returned errors, so
+// one missing element never aborts the crawl. The time each section took is
+// recorded in the Timings of the product.
+func scrapeProduct(cfg *Config, ex Extractor, url string) (*Product, []*SectionError) {
+	product := &Product{ProductURL: url}
+	timer := newSectionTimer()
+	defer func() { product.Timings = timer.done() }()
+
+	var sectionErrs []*SectionError
+	fail := func(section string, err error) {
 		if err != nil {
-			log.Fatalf("Failed to find row elements: %v", err)
-		}
-		for j, row := range rows {
-			text, err := row.Text()
-			if err != nil {
-				log.Fatalf("Failed to get row text: %v", err)
-			}
-			sizeChart[header][j] = map[string]string{sizeKeys[j]: text}
+			sectionErrs = append(sectionErrs, &SectionError{Section: section, Err: err})
 		}
 	}
+	scraping := cfg.scrapedSections()
+	stampScrapedSections(product, scraping)
 
-	product.SizeChart = sizeChart
+	err := ex.load(url)
+	timer.lap(timingNavigation)
+	if err != nil {
+		fail("page", err)
+		return product, sectionErrs
+	}
 
-	remarkElements, err := wd.FindElements(selenium.ByCSSSelector, ".remarkList.test-remarkList .sizeDescriptionRemark")
-	if err == nil {
-		for _, remarkElement := range remarkElements {
-			remarkText, err := remarkElement.Text()
-			if err == nil && remarkText != "" {
-				product.SizeRemarks = append(product.SizeRemarks, remarkText)
+	// Fetched HTML is complete as it is; a rendered page is waited for and
+	// scrolled through so that its lazily loaded sections render.
+	wd := ex.browser()
+	if wd != nil {
+		if err := waitForElement(wd, ".itemTitle", cfg.WaitTimeout); err != nil {
+			if isChallengePage(wd) {
+				fail("page", errChallenge)
+				return product, sectionErrs
 			}
+			fail("title", err)
 		}
-	}
-	// ==================== Size Chart End ==========================
 
-	// ==================== Review Summary Start =======================
-	var reviewSummary ReviewSummary
+		_, err := wd.FindElement(selenium.ByCSSSelector, ".article_image_wrapper")
 
-	ratingElement, err := wd.FindElement(selenium.ByCSSSelector, ".BVRRRating.BVRRRatingNormal.BVRRRatingOverall .BVRRRatingNormalOutOf .BVRRRatingNumber")
-	if err == nil {
-		totalRating, err := ratingElement.Text()
 		if err == nil {
-			convertedRating, err := strconv.ParseFloat(totalRating, 64)
-			if err == nil {
-				reviewSummary.Rating = convertedRating
-			} else {
-				reviewSummary.Rating = 0.0
+			script := `
+		var element = document.querySelector('.article_image_wrapper');
+		if (element) {
+			element.classList.add('isExpand');
+		}
+	`
+			_, scriptErr := wd.ExecuteScript(script, nil)
+			if scriptErr != nil {
+				slog.Debug("Failed to expand the article images", "url", url, "err", scriptErr)
 			}
-		} else {
-			reviewSummary.Rating = 0.0
 		}
-	}
 
-	numberOfRatingElement, err := wd.FindElement(selenium.ByCSSSelector, ".BVRRQuickTakeCustomWrapper .BVRRBuyAgainTotal")
-	if err == nil {
-		numberOfRating, err := numberOfRatingElement.Text()
-		if err == nil {
-			convert, err := strconv.Atoi(numberOfRating)
-			if err == nil {
-				reviewSummary.NumberOfReviews = convert
+		closeModals(cfg, wd)
+		timer.lap(timingWait)
+		// Only the media, carousels, size chart, reviews and tags load
+		// lazily; the basic section and the sizes are rendered right away.
+		if len(scraping) > 2 || (len(scraping) == 2 && !scraping[sectionSizes]) {
+			if err := scrollToBottom(cfg, wd); err != nil {
+				fail("scroll", err)
 			}
-		} else {
-			reviewSummary.NumberOfReviews = 0
+			timer.lap(timingScroll)
 		}
 	}
+	dom := ex.dom()
 
-	recommededElement, err := wd.FindElement(selenium.ByCSSSelector, ".BVRRQuickTakeCustomWrapper .BVRRBuyAgainPercentage")
-	if err == nil {
-		recommeded_percentage, err := recommededElement.Text()
-		if err == nil {
-			reviewSummary.RecommendedRate = recommeded_percentage
-		} else {
-			reviewSummary.RecommendedRate = "0.00%"
+	// Product URL
+	product.ProductURL = url
+	product.ProductNumber = extractProductNumber(url)
+
+	// With -pdp-mode=hybrid the fields the structured data of the page
+	// carries are taken from it, and the selectors below only read the rest.
+	var structured *structuredProduct
+	if cfg.PDPMode == pdpModeHybrid {
+		if structured, err = readStructuredData(ex, product.ProductNumber); err != nil {
+			slog.Debug("Reading the product page through selectors only", "url", url, "err", err)
 		}
+		timer.lap(timingStructuredData)
 	}
-
-	summaryElements, err := wd.FindElements(selenium.ByCSSSelector, ".BVRRSecondaryRatingsContainer .BVRRRatingRadioImage img")
-	if err == nil {
-		for key, overAll := range summaryElements {
-			overAllText, err := overAll.GetAttribute("title")
-			if err == nil {
-				switch key {
-				case 0:
-					reviewSummary.Fit = overAllText
-				case 1:
-					reviewSummary.Length = overAllText
-				case 2:
-					reviewSummary.Quality = overAllText
-				case 3:
-					reviewSummary.Comfort = overAllText
-				}
-			}
+	product.Provenance = make(map[string]string)
+	useStructured := func(key string) bool {
+		if structured == nil || structured.Sources[key] == "" {
+			return false
 		}
+		product.Provenance[key] = structured.Sources[key]
+		return true
 	}
 
-	product.ReviewSummary = reviewSummary
-	// ==================== Review Summary End =================
+	product.BreadcrumbLinks, err = extractBreadcrumbs(dom, url)
+	fail("breadcrumbs", err)
+	for _, link := range product.BreadcrumbLinks {
+		product.Breadcrumbs = append(product.Breadcrumbs, link.Label)
+	}
 
-	// ==================== Review Start =======================
-	reviewDiv, err := wd.FindElements(selenium.ByCSSSelector, ".BVRRDisplayContent .BVRRDisplayContentBody .BVRRContentReview") // BVRRReviewDisplayStyle5
-	if err == nil {
-		for _, review := range reviewDiv {
-			var reviewInfo Review
+	product.Category, err = extractCategoryName(dom)
+	fail("category", err)
 
-			// Get Rating Value
-			review_rating := 0.0
-			ratingValueElement, err := review.FindElement(selenium.ByCSSSelector, ".BVRRReviewDisplayStyle5Header .BVRRRatingNormalImage img")
-			if err == nil {
-				ratingValueText, err := ratingValueElement.GetAttribute("title")
-				ratingText := strings.Split(ratingValueText, "/")
-				if err == nil && ratingValueText != "" {
-					convertedRating, err := strconv.ParseFloat(strings.Trim(ratingText[1], " "), 64)
-					if err == nil {
-						review_rating = convertedRating
-					}
-				}
-			}
-			reviewInfo.Rating = review_rating
+	if useStructured("title") {
+		product.Title = structured.Title
+	} else {
+		product.Title, err = extractTitle(dom)
+		fail("title", err)
+	}
 
-			// Get Review Date
-			review_date := ""
-			reviewDateElement, err := review.FindElement(selenium.ByCSSSelector, ".BVRRReviewDateContainer meta")
-			if err == nil {
-				reviewDateText, err := reviewDateElement.GetAttribute("content")
-				if err == nil && reviewDateText != "" {
-					review_date = reviewDateText
-				}
-			}
-			reviewInfo.Date = review_date
+	if useStructured("price") {
+		product.PriceInfo = structured.priceInfo()
+	} else {
+		product.PriceInfo, err = extractPrice(dom, url)
+		fail("price", err)
+	}
+	if product.PriceText == "" {
+		slog.Warn("No price found", "url", url)
+	}
+	originalPrice, err := extractOriginalPrice(dom)
+	fail("price", err)
+	applySalePrice(product, originalPrice)
+	shownBadges, err := extractBadges(dom, productBadgeSelector)
+	fail("badges", err)
+	product.Badges = normalizeBadges(shownBadges)
+	applySaleBadge(product, shownBadges)
+	pricing, err := extractMemberPricing(dom)
+	fail("price", err)
+	product.PointsEarned, product.MemberPrice, product.MemberOnly = pricing.PointsEarned, pricing.MemberPrice, pricing.MemberOnly
+
+	product.AvailableColors, err = extractColors(dom, url)
+	fail("colors", err)
+
+	// The availability is read from the sizes, which are kept only with
+	// the sizes section.
+	sizes, err := extractSizes(dom)
+	if scraping[sectionSizes] {
+		fail("sizes", err)
+		product.AvailableSizes = sizes
+		for _, size := range product.AvailableSizes {
+			product.AvailableSizeLabels = append(product.AvailableSizeLabels, size.Size)
+		}
+	}
 
-			// Get Review Title
-			review_title := ""
-			titleText, err := review.FindElement(selenium.ByCSSSelector, ".BVRRReviewTitleContainer .BVRRReviewTitle")
-			if err == nil {
-				reviewTitle, err := titleText.Text()
-				if err == nil && reviewTitle != "" {
-					review_title = reviewTitle
+	if useStructured("availability") {
+		product.Availability = structured.Availability
+		if product.Availability == availabilityComingSoon {
+			// The release date is only announced on the page.
+			_, product.ReleaseDate = scrapeAvailability(dom, sizes)
+		}
+	} else {
+		product.Availability, product.ReleaseDate = scrapeAvailability(dom, sizes)
+	}
+	product.PurchaseInfo, err = extractPurchaseInfo(cfg, ex)
+	fail("purchase info", err)
+	timer.lap(timingDetails)
+
+	if scraping[sectionMedia] {
+		if useStructured("images") {
+			for _, image := range structured.Images {
+				if path := resolveURL(url, image); path != "" {
+					product.Media = append(product.Media, Media{Path: path, Type: "image"})
 				}
 			}
-			reviewInfo.Title = review_title
+		} else {
+			product.Media, err = extractImages(wd, dom, url)
+			fail("images", err)
+		}
+		videos, err := extractVideos(dom, url)
+		fail("videos", err)
+		product.Media = dedupeMedia(append(product.Media, videos...))
+		timer.lap(timingMedia)
+	}
 
-			// Get Review Comment
-			review_description := ""
-			reviewComment, err := review.FindElement(selenium.ByCSSSelector, ".BVRRReviewTextContainer .BVRRReviewText")
-			if err == nil {
-				commentText, err := reviewComment.Text()
-				if err == nil && commentText != "" {
-					review_description = commentText
-				}
+	if scraping[sectionCoordinated] {
+		product.CoordinatedProducts, err = extractCarousel(dom, ".coordinateItems", url)
+		fail("coordinated", err)
+
+		// Recommendations repeat neither the coordinated products nor each other.
+		recommended, err := extractCarousel(dom, ".recommendItems, .recommendation-carousel, .pdp-recommendations", url)
+		fail("recommended", err)
+		product.RecommendedProducts = []CoordinatedProduct{}
+		seen := make(map[string]bool)
+		for _, coorProduct := range product.CoordinatedProducts {
+			seen[coorProduct.ProductNumber] = true
+		}
+		for _, item := range recommended {
+			if item.ProductNumber == "" || seen[item.ProductNumber] {
+				continue
 			}
-			reviewInfo.Description = review_description
+			seen[item.ProductNumber] = true
+			product.RecommendedProducts = append(product.RecommendedProducts, item)
+		}
+		timer.lap(timingCarousels)
+	}
 
-			// Get Review Author
-			review_id := ""
-			reviewId, err := review.FindElement(selenium.ByCSSSelector, ".BVRRUserNicknameContainer .BVRRUserNickname .BVRRNickname")
-			if err == nil {
-				authorText, err := reviewId.Text()
-				if err == nil && authorText != "" {
-					review_id = authorText
-				}
-			}
-			reviewInfo.ReviewId = review_id
+	description, err := extractDescription(dom)
+	fail("description", err)
+	product.DescriptionHeading = description.Heading
+	product.DescriptionTitle = description.Title
+	product.DescriptionHTML = sanitizeHTML(description.HTML, url)
+	if useStructured("description") {
+		product.Description = structured.Description
+	} else {
+		product.Description = description.Text
+	}
 
-			product.Reviews = append(product.Reviews, reviewInfo)
+	product.Specifications, err = extractSpecifications(dom)
+	fail("specifications", err)
+	product.SpecificationsHTML, err = extractSpecificationsHTML(dom, url)
+	fail("specifications", err)
+
+	// The article number on the page is authoritative; the one in the URL is
+	// only used when the page does not show it.
+	ids := parseIdentifiers(product.Specifications)
+	if ids.ProductNumber != "" {
+		if product.ProductNumber != "" && !strings.EqualFold(ids.ProductNumber, product.ProductNumber) {
+			slog.Warn("Product number on the page differs from the one in its URL", "url", url, "page_product_number", ids.ProductNumber)
 		}
+		product.ProductNumber = ids.ProductNumber
+	}
+	product.ModelCode = ids.ModelCode
+	product.ColorCode = ids.ColorCode
+
+	details := parseProductDetails(product.Specifications)
+	product.Specifications = details.Unmatched
+	product.Materials = details.Materials
+	product.CareInstructions = details.CareInstructions
+	product.CountryOfOrigin = details.CountryOfOrigin
+
+	product.SpecialDescription, err = extractSpecialDescriptions(dom)
+	fail("special description", err)
+
+	product.TechnologyBadges = scrapeTechnologyBadges(dom, url)
+	timer.lap(timingDescription)
+
+	if scraping[sectionSizeChart] {
+		product.SizeCharts, err = extractSizeCharts(ex)
+		fail("size chart", err)
+		product.SizeRemarks, err = extractSizeRemarks(dom)
+		fail("size remarks", err)
+		timer.lap(timingSizeChart)
 	}
-	// ==================== Review End =========================
 
-	// ==================== Tags Start ==========================
-	tagElements, err := wd.FindElements(selenium.ByCSSSelector, ".itemTagsPosition a")
-	if err == nil {
-		for _, tagElement := range tagElements {
-			tag, err := tagElement.Text()
-			if err == nil && tag != "" {
-				product.Tags = append(product.Tags, tag)
-			}
+	if scraping[sectionReviews] {
+		product.ReviewSummary, product.Reviews, err = extractReviews(cfg, ex, product.ProductNumber, url)
+		fail("reviews", err)
+		if total := histogramTotal(product.ReviewSummary.RatingHistogram); total != product.ReviewSummary.NumberOfReviews {
+			slog.Debug("Rating histogram does not add up to the number of reviews", "url", url, "histogram_total", total, "reviews", product.ReviewSummary.NumberOfReviews)
 		}
+		timer.lap(timingReviews)
 	}
-	// ==================== Tags End ==========================
 
-	return product
-}
+	if scraping[sectionTags] {
+		product.TagLinks, err = extractTags(dom, url)
+		fail("tags", err)
+		for _, tag := range product.TagLinks {
+			product.Tags = append(product.Tags, tag.Label)
+		}
+		timer.lap(timingTags)
+	}
 
-func exportToExcel(productCollection *mongo.Collection) {
-	cursor, err := productCollection.Find(context.Background(), bson.M{})
-	if err != nil {
-		log.Fatalf("Failed to find products: %v", err)
-	}
-	defer cursor.Close(context.Background())
-
-	var products []Product
-	if err = cursor.All(context.Background(), &products); err != nil {
-		log.Fatalf("Failed to iterate over cursor: %v", err)
-	}
-
-	f := excelize.NewFile()
-	sheetName := "Products"
-	index, _ := f.NewSheet(sheetName)
-
-	// Set the headers
-	headers := []string{
-		"SerialNo", "producturl", "breadcrumbs", "category", "title", "price", "availablecolors",
-		"availablesizes", "media", "coordinatedproducts", "descriptionheading",
-		"descriptiontitle", "description", "specifications", "specialdescription",
-		"sizechart", "sizeremarks", "reviewsummary", "reviews", "tags",
-	}
-	for i, header := range headers {
-		cell, _ := excelize.CoordinatesToCellName(i+1, 1)
-		f.SetCellValue(sheetName, cell, header)
-	}
-
-	// Set the product data
-	for i, product := range products {
-		rowNum := i + 2
-		f.SetCellValue(sheetName, fmt.Sprintf("A%d", rowNum), i+1)
-		f.SetCellValue(sheetName, fmt.Sprintf("A%d", rowNum), fmt.Sprintf("%v", product.ProductURL))
-		f.SetCellValue(sheetName, fmt.Sprintf("B%d", rowNum), fmt.Sprintf("%v", product.Breadcrumbs))
-		f.SetCellValue(sheetName, fmt.Sprintf("C%d", rowNum), fmt.Sprintf("%v", product.Category))
-		f.SetCellValue(sheetName, fmt.Sprintf("D%d", rowNum), fmt.Sprintf("%v", product.Title))
-		f.SetCellValue(sheetName, fmt.Sprintf("E%d", rowNum), fmt.Sprintf("%v", product.Price))
-		f.SetCellValue(sheetName, fmt.Sprintf("F%d", rowNum), fmt.Sprintf("%v", product.AvailableColors))
-		f.SetCellValue(sheetName, fmt.Sprintf("G%d", rowNum), fmt.Sprintf("%v", product.AvailableSizes))
-		f.SetCellValue(sheetName, fmt.Sprintf("H%d", rowNum), fmt.Sprintf("%v", product.Media))
-		f.SetCellValue(sheetName, fmt.Sprintf("I%d", rowNum), fmt.Sprintf("%v", product.CoordinatedProducts))
-		f.SetCellValue(sheetName, fmt.Sprintf("J%d", rowNum), fmt.Sprintf("%v", product.DescriptionHeading))
-		f.SetCellValue(sheetName, fmt.Sprintf("K%d", rowNum), fmt.Sprintf("%v", product.DescriptionTitle))
-		f.SetCellValue(sheetName, fmt.Sprintf("L%d", rowNum), fmt.Sprintf("%v", product.Description))
-		f.SetCellValue(sheetName, fmt.Sprintf("M%d", rowNum), fmt.Sprintf("%v", product.Specifications))
-		f.SetCellValue(sheetName, fmt.Sprintf("N%d", rowNum), fmt.Sprintf("%v", product.SpecialDescription))
-		f.SetCellValue(sheetName, fmt.Sprintf("O%d", rowNum), fmt.Sprintf("%v", product.SizeChart))
-		f.SetCellValue(sheetName, fmt.Sprintf("P%d", rowNum), fmt.Sprintf("%v", product.SizeRemarks))
-		f.SetCellValue(sheetName, fmt.Sprintf("Q%d", rowNum), fmt.Sprintf("%v", product.ReviewSummary))
-		f.SetCellValue(sheetName, fmt.Sprintf("R%d", rowNum), fmt.Sprintf("%v", product.Reviews))
-		f.SetCellValue(sheetName, fmt.Sprintf("S%d", rowNum), fmt.Sprintf("%v", product.Tags))
-	}
-
-	f.SetActiveSheet(index)
-
-	if err := f.SaveAs("products.xlsx"); err != nil {
-		log.Fatalf("Failed to save file: %v", err)
-	}
-
-	log.Println("Products exported to products.xlsx")
+	// The fields not taken from the structured data were read through
+	// selectors.
+	for key, found := range map[string]bool{
+		"title":        product.Title != "",
+		"price":        product.PriceText != "",
+		"availability": product.Availability != "",
+		"images":       countMedia(product.Media, "image") > 0,
+		"description":  product.Description != "",
+	} {
+		if _, ok := product.Provenance[key]; found && !ok {
+			product.Provenance[key] = provenanceDOM
+		}
+	}
+
+	return product, sectionErrs
 }
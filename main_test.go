@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestResolveURL(t *testing.T) {
+	const page = "https://shop.adidas.jp/products/GZ0127/"
+	tests := []struct {
+		base, ref, want string
+	}{
+		{page, "https://assets.adidas.com/images/w_600/GZ0127_01.jpg", "https://assets.adidas.com/images/w_600/GZ0127_01.jpg"},
+		{page, "//assets.adidas.com/images/GZ0127_01.jpg", "https://assets.adidas.com/images/GZ0127_01.jpg"},
+		{page, "/item/?category=shoes", "https://shop.adidas.jp/item/?category=shoes"},
+		{page, "images/01.jpg", "https://shop.adidas.jp/products/GZ0127/images/01.jpg"},
+		{page, "../HQ4199/", "https://shop.adidas.jp/products/HQ4199/"},
+		{page, "  /men/  ", "https://shop.adidas.jp/men/"},
+		{"", "/products/GZ0127/", "https://shop.adidas.jp/products/GZ0127/"},
+		{page, "", ""},
+		{page, "data:image/gif;base64,R0lGODlhAQABAAAAACw=", ""},
+		{page, "DATA:image/png;base64,iVBORw0KGgo=", ""},
+		{page, "http://[::1", ""},
+	}
+	for _, tt := range tests {
+		if got := resolveURL(tt.base, tt.ref); got != tt.want {
+			t.Errorf("resolveURL(%q, %q) = %q, want %q", tt.base, tt.ref, got, tt.want)
+		}
+	}
+}
+
+func TestCanonicalProductURL(t *testing.T) {
+	const listing = "https://shop.adidas.jp/men/shoes/?page=2"
+	tests := []struct {
+		name, href, want string
+	}{
+		{"canonical", "https://shop.adidas.jp/products/GZ0127/", "https://shop.adidas.jp/products/GZ0127/"},
+		{"utm parameters", "https://shop.adidas.jp/products/GZ0127/?utm_source=listing&utm_medium=card", "https://shop.adidas.jp/products/GZ0127/"},
+		{"anchor", "https://shop.adidas.jp/products/GZ0127/#reviews", "https://shop.adidas.jp/products/GZ0127/"},
+		{"parameters and anchor", "https://shop.adidas.jp/products/GZ0127/?utm_source=swatch#size", "https://shop.adidas.jp/products/GZ0127/"},
+		{"upper-case host", "https://SHOP.adidas.JP/products/GZ0127/", "https://shop.adidas.jp/products/GZ0127/"},
+		{"no trailing slash", "https://shop.adidas.jp/products/GZ0127", "https://shop.adidas.jp/products/GZ0127/"},
+		{"path after the code", "https://shop.adidas.jp/products/GZ0127/reviews/", "https://shop.adidas.jp/products/GZ0127/"},
+		{"root-relative", "/products/GZ0127/?utm_source=listing", "https://shop.adidas.jp/products/GZ0127/"},
+		{"relative", "../../products/GZ0127/#top", "https://shop.adidas.jp/products/GZ0127/"},
+		{"protocol-relative", "//shop.adidas.jp/products/GZ0127/?cm_sp=x", "https://shop.adidas.jp/products/GZ0127/"},
+		{"other host keeps its path", "https://www.adidas.com/products/GZ0127/extra?utm_source=x", "https://www.adidas.com/products/GZ0127/extra"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := canonicalProductURL(resolveURL(listing, tt.href)); got != tt.want {
+				t.Errorf("canonicalProductURL(%q) = %q, want %q", tt.href, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestStoreListingURLs checks that the links of a listing page to the same
+// product are stored once, by the canonical URL, with the first href kept.
+func TestStoreListingURLs(t *testing.T) {
+	ctx := context.Background()
+	store, err := openFileStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.close()
+	cfg := testConfig(t)
+	stats := &crawlStats{}
+
+	page := listingPage{Section: "men", URL: "https://shop.adidas.jp/men/shoes/?page=1"}
+	storeListingURLs(ctx, store, newThrottle(cfg, stats, nil), stats, page, "shoes", 1, []string{
+		"https://shop.adidas.jp/products/GZ0127/?utm_source=listing",
+		"https://shop.adidas.jp/products/GZ0127/#reviews",
+		"https://shop.adidas.jp/products/IK7351/",
+	}, nil)
+
+	got := map[string]ProductURL{}
+	store.eachPendingProductURL(ctx, nil, 0, func(u ProductURL) bool {
+		got[u.URL] = u
+		return true
+	})
+	if len(got) != 2 {
+		t.Fatalf("stored %d product URLs, want 2: %v", len(got), got)
+	}
+	if raw := got["https://shop.adidas.jp/products/GZ0127/"].RawURL; raw != "https://shop.adidas.jp/products/GZ0127/?utm_source=listing" {
+		t.Errorf("RawURL = %q, want the first href as found", raw)
+	}
+	if raw := got["https://shop.adidas.jp/products/IK7351/"].RawURL; raw != "" {
+		t.Errorf("RawURL = %q, want none for a canonical href", raw)
+	}
+}
+
+func TestParsePageTotal(t *testing.T) {
+	tests := []struct {
+		text string
+		want int
+		ok   bool
+	}{
+		{"42", 42, true},
+		{"1 / 42", 42, true},
+		{" 3/7 ", 7, true},
+		{"1 / 42ページ", 42, true},
+		{"全42ページ", 42, true},
+		{"1 / ", 0, false},
+		{"", 0, false},
+		{"0", 0, false},
+		{"次へ", 0, false},
+	}
+	for _, tt := range tests {
+		if got, ok := parsePageTotal(tt.text); got != tt.want || ok != tt.ok {
+			t.Errorf("parsePageTotal(%q) = %d, %v, want %d, %v", tt.text, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestGetPageCount(t *testing.T) {
+	const categoryURL = "https://shop.adidas.jp/men/golf/shoes/"
+	tests := []struct {
+		name     string
+		page     string
+		lastPage int // last page with cards when probing
+		want     int
+		strategy string
+	}{
+		{"page total", "listing_page_total.html", 0, 42, pageCountTotal},
+		{"pagination links", "listing_pagination_links.html", 0, 7, pageCountLinks},
+		{"single page", "listing_single_page.html", 1, 1, pageCountProbe},
+		{"no page total or links", "listing_single_page.html", 5, 5, pageCountProbe},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, "-max-rps=0")
+			full, empty := loadFixturePage(t, "listing_single_page.html"), loadFixturePage(t, "listing_empty.html")
+			wd := &fakeWebDriver{page: loadFixturePage(t, tt.page)}
+			wd.get = func(url string) error {
+				if page := extractPageNumber(url); page > 0 && page <= tt.lastPage {
+					wd.page = full
+				} else {
+					wd.page = empty
+				}
+				return nil
+			}
+
+			got, strategy, err := getPageCount(context.Background(), cfg, wd, newThrottle(cfg, &crawlStats{}, nil), categoryURL, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want || strategy != tt.strategy {
+				t.Errorf("getPageCount() = %d, %s, want %d, %s", got, strategy, tt.want, tt.strategy)
+			}
+			if tt.strategy != pageCountProbe && wd.gets.Load() > 0 {
+				t.Errorf("loaded %d pages, want the count read from the category page", wd.gets.Load())
+			}
+		})
+	}
+}
+
+func TestExtractCategory(t *testing.T) {
+	tests := []struct {
+		url, want string
+	}{
+		{"https://shop.adidas.jp/item/?category=shoes&gender=mens&page=2", "shoes"},
+		{"https://shop.adidas.jp/item/?gender=mens&category=wear", "wear"},
+		{"https://shop.adidas.jp/men/shoes/", "shoes"},
+		{"https://shop.adidas.jp/men/shoes/running/?page=3", "shoes/running"},
+		{"https://shop.adidas.jp/kids/wear", "wear"},
+		{"https://shop.adidas.jp/originals/", "originals"},
+		{"https://shop.adidas.jp/men/shoes/?category=sandals", "sandals"},
+		{"https://shop.adidas.jp/men/shoes/?category=", "shoes"},
+		{"https://shop.adidas.jp/men/", ""},
+		{"https://shop.adidas.jp/item/?gender=mens", ""},
+		{"https://shop.adidas.jp/products/GZ0127/", ""},
+		{"https://shop.adidas.jp/", ""},
+		{"http://[::1", ""},
+	}
+	for _, tt := range tests {
+		if got := extractCategory(tt.url); got != tt.want {
+			t.Errorf("extractCategory(%q) = %q, want %q", tt.url, got, tt.want)
+		}
+	}
+}
+
+func TestListingPageURL(t *testing.T) {
+	tests := []struct {
+		categoryURL string
+		page        int
+		want        string
+	}{
+		{"https://shop.adidas.jp/men/shoes/", 2, "https://shop.adidas.jp/men/shoes/?page=2"},
+		{"https://shop.adidas.jp/item/?gender=mens&category=shoes", 3, "https://shop.adidas.jp/item/?category=shoes&gender=mens&page=3"},
+		{"https://shop.adidas.jp/item/?category=shoes&page=1", 4, "https://shop.adidas.jp/item/?category=shoes&page=4"},
+		{"https://shop.adidas.jp/men/shoes/?page=7&page=8", 1, "https://shop.adidas.jp/men/shoes/?page=1"},
+		{"https://shop.adidas.jp/men/shoes/#top", 2, "https://shop.adidas.jp/men/shoes/?page=2#top"},
+		{"https://shop.adidas.jp/item/?q=%E3%82%B7%E3%83%A5%E3%83%BC%E3%82%BA", 2, "https://shop.adidas.jp/item/?page=2&q=%E3%82%B7%E3%83%A5%E3%83%BC%E3%82%BA"},
+	}
+	for _, tt := range tests {
+		got := listingPageURL(tt.categoryURL, tt.page)
+		if got != tt.want {
+			t.Errorf("listingPageURL(%q, %d) = %q, want %q", tt.categoryURL, tt.page, got, tt.want)
+		}
+		if page := extractPageNumber(got); page != tt.page {
+			t.Errorf("extractPageNumber(%q) = %d, want %d", got, page, tt.page)
+		}
+	}
+}
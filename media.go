@@ -0,0 +1,84 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/tebeka/selenium"
+)
+
+// imageSourceAttributes are the attributes an image URL may be read from, in
+// order of preference. Lazily loaded gallery images keep the real URL in the
+// data-* attributes and a placeholder in src until they scroll into view.
+var imageSourceAttributes = []string{"data-srcset", "srcset", "data-src", "src"}
+
+// placeholderPattern matches the transparent and spinner images used as
+// lazy-load placeholders.
+var placeholderPattern = regexp.MustCompile(`(?i)(placeholder|spacer|blank|transparent|loading)[^/]*\.(gif|png|svg)`)
+
+// imageURL returns the URL of the full-size image shown by img, resolved
+// against pageURL, or "" when img only has a placeholder. In a browser
+// session, wd not nil, the image is scrolled into view first so that lazy
+// loading fills in its source.
+func imageURL(wd selenium.WebDriver, img DOMElement, pageURL string) string {
+	if elem, ok := webElement(img); ok && wd != nil {
+		// Not fatal when it fails: the data-* attributes are usually set
+		// before the image is visible.
+		_, _ = wd.ExecuteScript(`arguments[0].scrollIntoView({block: "center"});`, []interface{}{elem})
+	}
+
+	for _, attr := range imageSourceAttributes {
+		value, err := img.attr(attr)
+		if err != nil || strings.TrimSpace(value) == "" {
+			continue
+		}
+		if strings.HasSuffix(attr, "srcset") {
+			value = largestSrcsetCandidate(value)
+		}
+		if u := resolveURL(pageURL, value); u != "" && !placeholderPattern.MatchString(u) {
+			return u
+		}
+	}
+	return ""
+}
+
+// largestSrcsetCandidate returns the URL of the widest candidate of a srcset
+// attribute. Candidates without a width or density descriptor count as 1x.
+func largestSrcsetCandidate(srcset string) string {
+	best, bestSize := "", -1.0
+	for _, candidate := range strings.Split(srcset, ",") {
+		fields := strings.Fields(candidate)
+		if len(fields) == 0 {
+			continue
+		}
+		size := 1.0
+		if len(fields) > 1 {
+			descriptor := fields[1]
+			if n, err := strconv.ParseFloat(descriptor[:len(descriptor)-1], 64); err == nil {
+				size = n
+			}
+		}
+		if size > bestSize {
+			best, bestSize = fields[0], size
+		}
+	}
+	return best
+}
+
+// dedupeMedia drops media whose URL was already listed, keeping the first
+// occurrence. URLs are compared without their query string, which only
+// selects the rendition size.
+func dedupeMedia(media []Media) []Media {
+	seen := make(map[string]bool)
+	var result []Media
+	for _, m := range media {
+		key := canonicalProductURL(m.Path)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		result = append(result, m)
+	}
+	return result
+}
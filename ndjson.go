@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// formatNDJSON writes one document per line as MongoDB extended JSON, which
+// keeps dates and number types intact for import.
+const formatNDJSON = "ndjson"
+
+// importBatchSize is the number of upserts sent to MongoDB at once by import.
+const importBatchSize = 500
+
+// exportNDJSON streams the documents of collection matching filter to path,
+// gzip-compressed when path ends in .gz.
+func exportNDJSON(ctx context.Context, collection *mongo.Collection, path string, filter bson.M) (int, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create %s: %v", path, err)
+	}
+	defer f.Close()
+
+	var out io.Writer = f
+	var gz *gzip.Writer
+	if strings.HasSuffix(path, ".gz") {
+		gz = gzip.NewWriter(f)
+		out = gz
+	}
+	buf := bufio.NewWriter(out)
+
+	cursor, err := collection.Find(ctx, filter)
+	if err != nil {
+		return 0, fmt.Errorf("failed to find documents: %v", err)
+	}
+	defer cursor.Close(context.Background())
+
+	exported := 0
+	for cursor.Next(ctx) {
+		line, err := bson.MarshalExtJSON(cursor.Current, false, false)
+		if err != nil {
+			return exported, fmt.Errorf("failed to encode document %v: %v", cursor.Current.Lookup("_id"), err)
+		}
+		buf.Write(line)
+		if err := buf.WriteByte('\n'); err != nil {
+			return exported, fmt.Errorf("failed to write %s: %v", path, err)
+		}
+		exported++
+	}
+	if err := cursor.Err(); err != nil {
+		return exported, fmt.Errorf("failed to iterate over documents: %v", err)
+	}
+
+	if err := buf.Flush(); err != nil {
+		return exported, fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	if gz != nil {
+		if err := gz.Close(); err != nil {
+			return exported, fmt.Errorf("failed to write %s: %v", path, err)
+		}
+	}
+	if err := f.Close(); err != nil {
+		return exported, fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	return exported, nil
+}
+
+// importNDJSON loads an NDJSON file written by exportNDJSON into collection,
+// gunzipping it when path ends in .gz. Each document replaces the stored one
+// with the same value of key, or is inserted when there is none. The _id of
+// the file is dropped, so documents can move between databases. It returns
+// the number of documents inserted and replaced.
+func importNDJSON(ctx context.Context, collection *mongo.Collection, path, key string) (inserted, replaced int64, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to open %s: %v", path, err)
+	}
+	defer f.Close()
+
+	var in io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return 0, 0, fmt.Errorf("failed to read %s: %v", path, err)
+		}
+		defer gz.Close()
+		in = gz
+	}
+
+	var batch []mongo.WriteModel
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		res, err := collection.BulkWrite(ctx, batch, options.BulkWrite().SetOrdered(false))
+		if err != nil {
+			return fmt.Errorf("failed to write documents: %v", err)
+		}
+		inserted += res.UpsertedCount
+		replaced += res.MatchedCount
+		batch = batch[:0]
+		return nil
+	}
+
+	scanner := bufio.NewScanner(in)
+	// Products with many reviews make for long lines.
+	scanner.Buffer(make([]byte, 0, 1024*1024), 64*1024*1024)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := scanner.Bytes()
+		if len(strings.TrimSpace(string(line))) == 0 {
+			continue
+		}
+
+		var doc bson.D
+		if err := bson.UnmarshalExtJSON(line, false, &doc); err != nil {
+			return inserted, replaced, fmt.Errorf("%s:%d: %v", path, lineNo, err)
+		}
+		var keyValue interface{}
+		fields := doc[:0]
+		for _, e := range doc {
+			switch e.Key {
+			case "_id":
+				continue
+			case key:
+				keyValue = e.Value
+			}
+			fields = append(fields, e)
+		}
+		if keyValue == nil || keyValue == "" {
+			slog.Warn("Skipping document without key", "file", path, "line", lineNo, "key", key)
+			continue
+		}
+
+		batch = append(batch, mongo.NewReplaceOneModel().
+			SetFilter(bson.M{key: keyValue}).
+			SetReplacement(fields).
+			SetUpsert(true))
+		if len(batch) >= importBatchSize {
+			if err := flush(); err != nil {
+				return inserted, replaced, err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return inserted, replaced, fmt.Errorf("failed to read %s: %v", path, err)
+	}
+	return inserted, replaced, flush()
+}
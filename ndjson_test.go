@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// testMongo returns a database of its own on the MongoDB server at
+// $ADIDAS_TEST_MONGO_URI, dropped when the test ends, and skips the test when
+// the variable is not set.
+func testMongo(t *testing.T) (*Config, *mongo.Database) {
+	t.Helper()
+	uri := os.Getenv("ADIDAS_TEST_MONGO_URI")
+	if uri == "" {
+		t.Skip("ADIDAS_TEST_MONGO_URI not set")
+	}
+	cfg := testConfig(t, "-mongo-uri", uri, "-db", fmt.Sprintf("adidas_test_%d", time.Now().UnixNano()))
+	client, err := connectMongo(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := client.Database(cfg.DBName)
+	t.Cleanup(func() {
+		db.Drop(context.Background())
+		disconnectMongo(client)
+	})
+	return cfg, db
+}
+
+// testProduct returns a product with a field of every kind NDJSON has to
+// carry over: dates, integers, floats, nested documents and maps.
+func testProduct() *Product {
+	scraped := time.Date(2024, 3, 14, 9, 12, 45, 123e6, time.UTC)
+	memberPrice := 15400
+	return &Product{
+		ProductURL:    "https://shop.adidas.jp/products/GZ0127/",
+		ProductNumber: "GZ0127",
+		Title:         "ウルトラブースト 22",
+		PriceInfo:     PriceInfo{PriceText: "¥19,800", PriceJPY: 19800},
+		MemberPrice:   &memberPrice,
+		AvailableSizes: []SizeOption{
+			{Size: "26.0cm", InStock: true},
+			{Size: "26.5cm", InStock: true, LowStock: true},
+		},
+		ReviewSummary: ReviewSummary{
+			Rating:          4.2,
+			NumberOfReviews: 25,
+			RatingHistogram: map[int]int{5: 14, 4: 5, 3: 3, 2: 2, 1: 1},
+		},
+		LastSeenAt: scraped,
+	}
+}
+
+// TestNDJSONRoundTrip checks that a product survives the extended JSON lines
+// of export and import with its types intact.
+func TestNDJSONRoundTrip(t *testing.T) {
+	want := testProduct()
+	doc, err := bson.Marshal(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	line, err := bson.MarshalExtJSON(bson.Raw(doc), false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var fields bson.D
+	if err := bson.UnmarshalExtJSON(line, false, &fields); err != nil {
+		t.Fatal(err)
+	}
+	doc, err = bson.Marshal(fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got Product
+	if err := bson.Unmarshal(doc, &got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&got, want) {
+		t.Errorf("round trip of %s\ngot  %+v\nwant %+v", line, got, *want)
+	}
+}
+
+// TestNDJSONExportImport exports the products of one database to a
+// compressed file and imports them into another.
+func TestNDJSONExportImport(t *testing.T) {
+	_, from := testMongo(t)
+	_, to := testMongo(t)
+	ctx := context.Background()
+
+	want := testProduct()
+	if _, err := from.Collection("products").InsertOne(ctx, want); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "products.ndjson.gz")
+	if n, err := exportNDJSON(ctx, from.Collection("products"), path, bson.M{}); err != nil || n != 1 {
+		t.Fatalf("exportNDJSON() = %d, %v, want 1 document", n, err)
+	}
+
+	// A second import replaces the document it inserted the first time.
+	for i, wantInserted := range []int64{1, 0} {
+		inserted, replaced, err := importNDJSON(ctx, to.Collection("products"), path, "producturl")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if inserted != wantInserted || replaced != 1-wantInserted {
+			t.Errorf("import %d: inserted, replaced = %d, %d", i+1, inserted, replaced)
+		}
+	}
+
+	var got Product
+	if err := to.Collection("products").FindOne(ctx, bson.M{"producturl": want.ProductURL}).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&got, want) {
+		t.Errorf("imported %+v, want %+v", got, *want)
+	}
+}
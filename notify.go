@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	neturl "net/url"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+)
+
+const (
+	// chatTopErrors is the number of failure reasons listed in a summary.
+	chatTopErrors = 5
+	// chatReasonLength is the length a failure reason is cut to.
+	chatReasonLength = 160
+)
+
+// Built-in -slack-template bodies. Discord webhooks take the message as
+// content, Slack and most others as text.
+const (
+	slackTemplate   = `{"text": {{json .Text}}}`
+	discordTemplate = `{"content": {{json .Text}}}`
+)
+
+// chatNotifier is the product sink that posts a human-readable summary of a
+// run to a Slack or Discord webhook once it finishes. It takes no products;
+// it only counts the reasons of the url_failed events.
+type chatNotifier struct {
+	cfg *Config
+
+	mu       sync.Mutex
+	failures map[string]int
+}
+
+func newChatNotifier(cfg *Config) *chatNotifier {
+	return &chatNotifier{cfg: cfg, failures: map[string]int{}}
+}
+
+func (n *chatNotifier) enqueue(ctx context.Context, product *Product) {}
+
+func (n *chatNotifier) close() {}
+
+func (n *chatNotifier) event(ctx context.Context, e runEvent) {
+	switch e.Type {
+	case eventURLFailed:
+		n.mu.Lock()
+		n.failures[failureReason(e.Error)]++
+		n.mu.Unlock()
+	case eventRunFinished:
+		if err := postChat(n.cfg, n.summary(e)); err != nil {
+			slog.Error("Failed to post the run summary", "err", err)
+		}
+	}
+}
+
+// failureReason shortens an error message to one line, so that the same
+// failure on different URLs is counted together as far as possible.
+func failureReason(msg string) string {
+	msg, _, _ = strings.Cut(msg, "\n")
+	return truncateText(strings.TrimSpace(msg), chatReasonLength)
+}
+
+// summary formats the run_finished event e with the failure reasons seen.
+func (n *chatNotifier) summary(e runEvent) string {
+	var b strings.Builder
+	outcome := "finished"
+	if e.Error != "" {
+		outcome = "failed: " + truncateText(e.Error, chatReasonLength)
+	}
+	fmt.Fprintf(&b, "adidas crawler %s %s\n", e.Phase, outcome)
+
+	products, created, unchanged := e.Stats["products"], e.Stats["new_products"], e.Stats["unchanged_products"]
+	elapsed := time.Duration(e.DurationSeconds * float64(time.Second)).Round(time.Second)
+	fmt.Fprintf(&b, "Products scraped: %d (%d new, %d changed, %d unchanged)\n", products, created, products-created-unchanged, unchanged)
+	fmt.Fprintf(&b, "Product URLs discovered: %d\n", e.Stats["product_urls"])
+	fmt.Fprintf(&b, "Failures: %d\n", e.Stats["failed"])
+	fmt.Fprintf(&b, "Elapsed: %v\n", elapsed)
+	if products > 0 {
+		fmt.Fprintf(&b, "Average: %.1fs per product\n", e.DurationSeconds/float64(products))
+	}
+
+	n.mu.Lock()
+	type reason struct {
+		text  string
+		count int
+	}
+	reasons := make([]reason, 0, len(n.failures))
+	for text, count := range n.failures {
+		reasons = append(reasons, reason{text, count})
+	}
+	n.mu.Unlock()
+	slices.SortFunc(reasons, func(a, b reason) int {
+		return cmp.Or(cmp.Compare(b.count, a.count), strings.Compare(a.text, b.text))
+	})
+	if len(reasons) > 0 {
+		b.WriteString("Top errors:\n")
+	}
+	for i, r := range reasons {
+		if i == chatTopErrors {
+			fmt.Fprintf(&b, "…and %d more\n", len(reasons)-i)
+			break
+		}
+		fmt.Fprintf(&b, "%d× %s\n", r.count, r.text)
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// fatalAlerts holds the config of the running command once it is parsed, so
+// that main can send an alert when the command dies.
+var fatalAlerts atomic.Pointer[Config]
+
+// sendFatalAlert posts an alert about a fatal error to -slack-webhook, when
+// the running command set one.
+func sendFatalAlert(msg string) {
+	cfg := fatalAlerts.Load()
+	if cfg == nil || cfg.SlackWebhook == "" {
+		return
+	}
+	text := "adidas crawler died: " + truncateText(msg, 1000)
+	if err := postChat(cfg, text); err != nil {
+		slog.Error("Failed to post the fatal error alert", "err", err)
+	}
+}
+
+// postChat posts text to -slack-webhook, with the body built from
+// -slack-template.
+func postChat(cfg *Config, text string) error {
+	tmpl, limit, err := chatTemplate(cfg)
+	if err != nil {
+		return err
+	}
+	var body bytes.Buffer
+	if err := tmpl.Execute(&body, struct{ Text string }{truncateText(text, limit)}); err != nil {
+		return fmt.Errorf("failed to render slack-template: %v", err)
+	}
+
+	client := &http.Client{Timeout: 15 * time.Second}
+	resp, err := client.Post(cfg.SlackWebhook, "application/json", &body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("webhook answered %s: %s", resp.Status, msg)
+	}
+	return nil
+}
+
+// chatTemplate returns the body template for cfg and the message length the
+// service accepts. Without -slack-template the body is chosen by the
+// webhook's host.
+func chatTemplate(cfg *Config) (*template.Template, int, error) {
+	text, limit := slackTemplate, 3500
+	if u, err := neturl.Parse(cfg.SlackWebhook); err == nil && (strings.HasSuffix(u.Hostname(), "discord.com") || strings.HasSuffix(u.Hostname(), "discordapp.com")) {
+		text, limit = discordTemplate, 1900
+	}
+	if cfg.SlackTemplate != "" {
+		text = cfg.SlackTemplate
+	}
+	tmpl, err := template.New("chat").Funcs(template.FuncMap{
+		"json": func(v any) (string, error) {
+			data, err := json.Marshal(v)
+			return string(data), err
+		},
+	}).Parse(text)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid slack-template: %v", err)
+	}
+	return tmpl, limit, nil
+}
+
+// truncateText cuts s to at most limit runes, marking the cut with an
+// ellipsis.
+func truncateText(s string, limit int) string {
+	runes := []rune(s)
+	if len(runes) <= limit {
+		return s
+	}
+	return string(runes[:limit-1]) + "…"
+}
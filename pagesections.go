@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+)
+
+// The sections of a product page -scrape-sections selects. The basic
+// section, the title, price, availability, description and everything else
+// that identifies the product, is always scraped.
+const (
+	sectionBasic       = "basic"
+	sectionMedia       = "media"       // images and videos
+	sectionSizes       = "sizes"       // the size options and their stock
+	sectionSizeChart   = "size_chart"  // size charts and remarks
+	sectionReviews     = "reviews"     // the review summary and reviews
+	sectionCoordinated = "coordinated" // the coordinated and recommended products
+	sectionTags        = "tags"
+)
+
+// pageSections are the sections in page order.
+var pageSections = []string{sectionBasic, sectionMedia, sectionSizes, sectionSizeChart, sectionReviews, sectionCoordinated, sectionTags}
+
+// defaultScrapeSections selects every section.
+const defaultScrapeSections = "all"
+
+// sectionFields are the Product fields of each section but basic, by Go
+// field name. Saving a product that skipped a section keeps the stored
+// values of its fields.
+var sectionFields = map[string][]string{
+	sectionMedia:       {"Media"},
+	sectionSizes:       {"AvailableSizes", "AvailableSizeLabels"},
+	sectionSizeChart:   {"SizeCharts", "SizeRemarks"},
+	sectionReviews:     {"ReviewSummary", "Reviews"},
+	sectionCoordinated: {"CoordinatedProducts", "RecommendedProducts"},
+	sectionTags:        {"Tags", "TagLinks"},
+}
+
+// fullScrapeFields describe the whole page, so they are only stored by a
+// scrape of every section.
+var fullScrapeFields = []string{"ContentHash", "CompletenessScore"}
+
+// fieldSections are the sections of the productFieldChecks outside basic.
+var fieldSections = map[string]string{
+	"images":      sectionMedia,
+	"sizes":       sectionSizes,
+	"size_chart":  sectionSizeChart,
+	"reviews":     sectionReviews,
+	"coordinated": sectionCoordinated,
+}
+
+// parseScrapeSections returns the sections a -scrape-sections value names,
+// always with basic.
+func parseScrapeSections(value string) (map[string]bool, error) {
+	sections := map[string]bool{sectionBasic: true}
+	for _, name := range splitList(value) {
+		if name == defaultScrapeSections {
+			for _, section := range pageSections {
+				sections[section] = true
+			}
+			continue
+		}
+		if !slices.Contains(pageSections, name) {
+			return nil, fmt.Errorf("unknown section %q, valid are all, %s", name, strings.Join(pageSections, ", "))
+		}
+		sections[name] = true
+	}
+	return sections, nil
+}
+
+// scrapedSections returns the sections -scrape-sections selects.
+func (c *Config) scrapedSections() map[string]bool {
+	sections, _ := parseScrapeSections(c.ScrapeSections) // checked by validate
+	return sections
+}
+
+// stampScrapedSections records on product that the sections were scraped now.
+func stampScrapedSections(product *Product, sections map[string]bool) {
+	now := time.Now().UTC()
+	product.ScrapedSections = make(map[string]time.Time, len(sections))
+	for section := range sections {
+		product.ScrapedSections[section] = now
+	}
+}
+
+// partialScrape reports whether product was scraped without some of its
+// sections. Products stored before sections were recorded have none, and
+// count as complete.
+func partialScrape(product *Product) bool {
+	return len(product.ScrapedSections) > 0 && len(product.ScrapedSections) < len(pageSections)
+}
+
+// hasSection reports whether the section of product was ever scraped.
+func hasSection(product *Product, section string) bool {
+	if len(product.ScrapedSections) == 0 {
+		return true
+	}
+	_, ok := product.ScrapedSections[section]
+	return ok
+}
+
+// skippedFields returns the Go names of the fields of product its scrape did
+// not refresh.
+func skippedFields(product *Product) []string {
+	if !partialScrape(product) {
+		return nil
+	}
+	fields := slices.Clone(fullScrapeFields)
+	for _, section := range pageSections {
+		if _, ok := product.ScrapedSections[section]; !ok {
+			fields = append(fields, sectionFields[section]...)
+		}
+	}
+	return fields
+}
+
+// keepSkippedFields copies the fields product did not refresh from the
+// stored product, and the times the sections it skipped were last scraped.
+func keepSkippedFields(product, stored *Product) {
+	if stored == nil {
+		return
+	}
+	dst, src := reflect.ValueOf(product).Elem(), reflect.ValueOf(stored).Elem()
+	for _, name := range skippedFields(product) {
+		dst.FieldByName(name).Set(src.FieldByName(name))
+	}
+	sections := maps.Clone(stored.ScrapedSections)
+	if sections == nil {
+		sections = make(map[string]time.Time, len(product.ScrapedSections))
+	}
+	maps.Copy(sections, product.ScrapedSections)
+	product.ScrapedSections = sections
+}
+
+// productBSONKey returns the key of the Product field called name in the
+// products collection: the name in its bson tag, or its lower-cased name.
+func productBSONKey(name string) string {
+	field, _ := reflect.TypeOf(Product{}).FieldByName(name)
+	if key, _, _ := strings.Cut(field.Tag.Get("bson"), ","); key != "" {
+		return key
+	}
+	return strings.ToLower(name)
+}
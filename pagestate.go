@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/tebeka/selenium"
+)
+
+// pageTextScript returns the start of the visible text of the page, enough to
+// recognise error templates without transferring the whole page.
+const pageTextScript = `return document.body ? document.body.innerText.slice(0, 3000) : "";`
+
+var (
+	notFoundMarkers = []string{"お探しのページが見つかりません", "ページが見つかりません", "page not found", "404 not found"}
+	blockedMarkers  = []string{"access denied", "アクセスが拒否されました", "you don't have permission to access", "this service is not available in your region"}
+)
+
+// pageStateError reports a product URL that does not lead to a product page.
+// State is one of statusNotFound, statusRedirected and statusBlocked.
+type pageStateError struct {
+	State    string
+	FinalURL string // where a redirected URL ended up
+}
+
+func (e *pageStateError) Error() string {
+	if e.State == statusRedirected {
+		return fmt.Sprintf("page %s to %s", e.State, e.FinalURL)
+	}
+	return "page " + strings.ReplaceAll(e.State, "_", " ")
+}
+
+// checkPageState inspects the page loaded for url and returns a
+// *pageStateError when it is a 404 template, an access-denied page or a
+// redirect away from the product.
+func checkPageState(wd selenium.WebDriver, url string) error {
+	title, _ := wd.Title()
+	text := ""
+	if result, err := wd.ExecuteScript(pageTextScript, nil); err == nil {
+		text, _ = result.(string)
+	}
+	finalURL, _ := wd.CurrentURL()
+	return pageState(title, text, finalURL, url)
+}
+
+// pageState returns a *pageStateError when the page with title and text,
+// which a load of url ended up at finalURL with, is no product page.
+func pageState(title, text, finalURL, url string) error {
+	page := strings.ToLower(title + "\n" + text)
+
+	switch {
+	case containsAny(page, blockedMarkers):
+		return &pageStateError{State: statusBlocked}
+	case containsAny(page, notFoundMarkers):
+		return &pageStateError{State: statusNotFound}
+	}
+
+	if finalURL == "" {
+		return nil
+	}
+	if extractProductNumber(finalURL) != extractProductNumber(url) {
+		return &pageStateError{State: statusRedirected, FinalURL: finalURL}
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+)
+
+// panicError is a panic recovered while scraping a page.
+type panicError struct {
+	Value any
+}
+
+func (e *panicError) Error() string {
+	return fmt.Sprintf("panic: %v", e.Value)
+}
+
+// scrapeSafely calls scrapeProduct and turns a panic in it into a page error
+// of the product, logged with its stack, so that one page that breaks the
+// extractors does not take down the run.
+func scrapeSafely(cfg *Config, ex Extractor, url string) (product *Product, sectionErrs []*SectionError) {
+	defer func() {
+		if r := recover(); r != nil {
+			slog.Error("Recovered from a panic while scraping product", "url", url, "panic", r, "stack", string(debug.Stack()))
+			product = &Product{ProductURL: url}
+			sectionErrs = []*SectionError{{Section: "page", Err: &panicError{Value: r}}}
+		}
+	}()
+	return scrapeProduct(cfg, ex, url)
+}
+
+// recoverWorker, deferred by a worker goroutine, reports a panic of the
+// worker on errs instead of crashing the process, so that the other workers
+// carry on.
+func recoverWorker(errs chan<- error, stats *crawlStats) {
+	if r := recover(); r != nil {
+		stats.Panics.Add(1)
+		slog.Error("Recovered from a panic in a worker", "panic", r, "stack", string(debug.Stack()))
+		errs <- &panicError{Value: r}
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+)
+
+// markRecorder records the status every product URL is marked with.
+type markRecorder struct {
+	Storage
+	mu     sync.Mutex
+	status map[string]string
+	errs   map[string]error
+}
+
+func (s *markRecorder) markProductURL(ctx context.Context, url, status string, scrapeErr error, fields map[string]any) error {
+	s.mu.Lock()
+	s.status[url], s.errs[url] = status, scrapeErr
+	s.mu.Unlock()
+	return s.Storage.markProductURL(ctx, url, status, scrapeErr, fields)
+}
+
+// panickingExtractor panics loading any page.
+type panickingExtractor struct {
+	fixtureExtractor
+}
+
+func (panickingExtractor) load(string) error {
+	panic("extractor bug")
+}
+
+func TestScrapeSafely(t *testing.T) {
+	product, sectionErrs := scrapeSafely(testConfig(t), &panickingExtractor{}, "https://shop.adidas.jp/products/GZ0127/")
+	if product == nil || product.ProductURL != "https://shop.adidas.jp/products/GZ0127/" {
+		t.Errorf("product = %+v, want one with the URL of the page", product)
+	}
+	var panicErr *panicError
+	if err := findSectionError(sectionErrs, "page"); !errors.As(err, &panicErr) {
+		t.Fatalf("page error = %v, want a panicError", err)
+	}
+	if panicErr.Value != "extractor bug" {
+		t.Errorf("panic value = %v, want the value of the panic", panicErr.Value)
+	}
+}
+
+// TestScrapeRecoversFromPanics scrapes pages whose extraction panics. Each
+// is marked failed with the panic, and the workers carry on until the queue
+// is drained.
+func TestScrapeRecoversFromPanics(t *testing.T) {
+	ctx := context.Background()
+	fileStore, err := openFileStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fileStore.close()
+	urls := []ProductURL{
+		{Section: "men", Category: "shoes", URL: "https://shop.adidas.jp/products/GZ0127/", Status: statusPending},
+		{Section: "men", Category: "wear", URL: "https://shop.adidas.jp/products/IK7351/", Status: statusPending},
+		{Section: "men", Category: "accessories", URL: "https://shop.adidas.jp/products/HT3432/", Status: statusPending},
+	}
+	if _, err := fileStore.saveProductURLs(ctx, urls); err != nil {
+		t.Fatal(err)
+	}
+	store := &markRecorder{Storage: fileStore, status: map[string]string{}, errs: map[string]error{}}
+
+	cfg := testConfig(t, "-workers=2", "-max-rps=0", "-ignore-robots")
+	stats := &crawlStats{}
+	sessions := newFakeSessions(cfg, stats, nil)
+	sessions.get = func(string) error { panic("extractor bug") }
+	defer sessions.close()
+
+	if err := scrape(ctx, cfg, scrapeOptions{}, sessions.sessionFactory, store, nil, stats); err != nil {
+		t.Fatalf("scrape() = %v, want the panics kept to their pages", err)
+	}
+
+	for _, u := range urls {
+		var panicErr *panicError
+		if status := store.status[u.URL]; status != statusFailed || !errors.As(store.errs[u.URL], &panicErr) {
+			t.Errorf("%s marked %q with %v, want %q with the panic", u.URL, status, store.errs[u.URL], statusFailed)
+		}
+	}
+	if n, err := fileStore.countPendingProductURLs(ctx, nil); err != nil || n != 0 {
+		t.Errorf("countPendingProductURLs() = %d, %v, want the queue drained", n, err)
+	}
+	if got := stats.Panics.Load(); got != int64(len(urls)) {
+		t.Errorf("Panics = %d, want %d", got, len(urls))
+	}
+	if got := stats.Failed.Load(); got != int64(len(urls)) {
+		t.Errorf("Failed = %d, want %d", got, len(urls))
+	}
+}
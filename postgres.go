@@ -0,0 +1,952 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// postgresMigrations create and evolve the PostgreSQL schema. They are
+// applied in order at startup and recorded in schema_migrations; append new
+// ones, never edit applied ones.
+//
+// Products keep their scalar fields as columns and their lists in child
+// tables, so they can be joined with other data. Nested data that is only
+// ever read whole, such as the size charts, is kept as JSONB.
+var postgresMigrations = []string{
+	`CREATE TABLE product_urls (
+		id              bigserial PRIMARY KEY,
+		url             text NOT NULL UNIQUE,
+		section         text NOT NULL DEFAULT '',
+		category        text NOT NULL DEFAULT '',
+		page_no         integer NOT NULL DEFAULT 0,
+		status          text NOT NULL DEFAULT 'pending',
+		error           text,
+		claimed_at      timestamptz,
+		availability    text,
+		final_url       text,
+		not_found_count integer NOT NULL DEFAULT 0,
+		fields          jsonb NOT NULL DEFAULT '{}'
+	);
+	CREATE INDEX product_urls_status ON product_urls (status);
+
+	CREATE TABLE products (
+		product_number      text PRIMARY KEY,
+		product_url         text NOT NULL,
+		model_code          text,
+		color_code          text,
+		section             text,
+		category            text,
+		breadcrumbs         text[],
+		breadcrumb_links    jsonb,
+		gender              text,
+		product_type        text,
+		sport               text,
+		title               text,
+		price_text          text,
+		price_jpy           integer,
+		price_min_jpy       integer,
+		price_max_jpy       integer,
+		currency            text,
+		tax_included        boolean,
+		original_price_jpy  integer,
+		sale_price_jpy      integer,
+		on_sale             boolean,
+		discount_percent    double precision,
+		availability        text,
+		release_date        timestamptz,
+		available_colors    jsonb,
+		description_heading text,
+		description_title   text,
+		description         text,
+		specifications      text[],
+		materials           text[],
+		care_instructions   text[],
+		country_of_origin   text,
+		special_description jsonb,
+		technology_badges   jsonb,
+		size_charts         jsonb,
+		size_remarks        text[],
+		review_summary      jsonb,
+		tags                text[],
+		proxy               text,
+		first_crawled_at    timestamptz NOT NULL,
+		updated_at          timestamptz NOT NULL
+	);
+
+	CREATE TABLE product_sizes (
+		product_number text NOT NULL REFERENCES products ON DELETE CASCADE,
+		position       integer NOT NULL,
+		size           text NOT NULL,
+		in_stock       boolean NOT NULL,
+		low_stock      boolean NOT NULL,
+		PRIMARY KEY (product_number, position)
+	);
+
+	CREATE TABLE product_media (
+		product_number text NOT NULL REFERENCES products ON DELETE CASCADE,
+		position       integer NOT NULL,
+		type           text NOT NULL,
+		path           text NOT NULL,
+		local_path     text,
+		sha256         text,
+		PRIMARY KEY (product_number, position)
+	);
+
+	CREATE TABLE product_reviews (
+		product_number  text NOT NULL REFERENCES products ON DELETE CASCADE,
+		position        integer NOT NULL,
+		review_id       text,
+		rating          double precision,
+		title           text,
+		description     text,
+		date_text       text,
+		submitted_at    timestamptz,
+		purchased_size  text,
+		usual_size      text,
+		height          text,
+		weight          text,
+		age             text,
+		gender          text,
+		location        text,
+		helpful_count   integer,
+		unhelpful_count integer,
+		photos          text[],
+		PRIMARY KEY (product_number, position)
+	);
+
+	CREATE TABLE product_coordinated (
+		product_number             text NOT NULL REFERENCES products ON DELETE CASCADE,
+		relation                   text NOT NULL, -- coordinated or recommended
+		position                   integer NOT NULL,
+		coordinated_product_number text,
+		title                      text,
+		price_text                 text,
+		price_jpy                  integer,
+		path                       text,
+		product_url                text,
+		PRIMARY KEY (product_number, relation, position)
+	);`,
+	`CREATE TABLE crawl_runs (
+		run_id           text PRIMARY KEY,
+		command          text NOT NULL,
+		config           jsonb NOT NULL,
+		started_at       timestamptz NOT NULL,
+		finished_at      timestamptz,
+		duration_seconds double precision,
+		status           text NOT NULL,
+		error            text,
+		stats            jsonb
+	);
+	CREATE INDEX crawl_runs_started_at ON crawl_runs (started_at);
+
+	ALTER TABLE product_urls ADD COLUMN run_id text;
+	ALTER TABLE products ADD COLUMN run_id text;`,
+	`CREATE TABLE failed_urls (
+		url             text PRIMARY KEY,
+		section         text NOT NULL DEFAULT '',
+		category        text NOT NULL DEFAULT '',
+		page_no         integer NOT NULL DEFAULT 0,
+		error_class     text NOT NULL,
+		error           text NOT NULL,
+		attempts        integer NOT NULL,
+		first_failed_at timestamptz NOT NULL,
+		last_failed_at  timestamptz NOT NULL,
+		permanent       boolean NOT NULL DEFAULT false
+	);
+	CREATE INDEX failed_urls_error_class ON failed_urls (error_class);`,
+	`CREATE TABLE product_history (
+		id             bigserial PRIMARY KEY,
+		product_number text NOT NULL,
+		field          text NOT NULL,
+		old            jsonb,
+		new            jsonb,
+		run_id         text,
+		changed_at     timestamptz NOT NULL
+	);
+	CREATE INDEX product_history_product ON product_history (product_number, changed_at);`,
+	`ALTER TABLE products ADD COLUMN content_hash text;
+	ALTER TABLE products ADD COLUMN last_seen_at timestamptz;`,
+	`CREATE INDEX products_product_url ON products (product_url);
+	CREATE INDEX products_last_seen_at ON products (last_seen_at);`,
+	`ALTER TABLE product_urls ADD COLUMN crawled_at timestamptz;
+	ALTER TABLE product_urls ADD COLUMN updated_at timestamptz;
+	ALTER TABLE product_urls ADD COLUMN crawler_version text;
+	ALTER TABLE product_urls ADD COLUMN source_worker text;
+	ALTER TABLE products ADD COLUMN crawler_version text;
+	ALTER TABLE products ADD COLUMN source_worker text;`,
+	`CREATE INDEX product_urls_category ON product_urls (category);
+	CREATE INDEX product_urls_updated_at ON product_urls (updated_at);
+	CREATE INDEX product_urls_run_id ON product_urls (run_id);
+	CREATE INDEX products_category ON products (category);
+	CREATE INDEX products_updated_at ON products (updated_at);
+	CREATE INDEX products_run_id ON products (run_id);`,
+	`ALTER TABLE failed_urls ADD COLUMN artifacts text[];`,
+	`ALTER TABLE failed_urls ADD COLUMN missing_fields text[];
+	ALTER TABLE products ADD COLUMN completeness_score double precision;`,
+	`ALTER TABLE crawl_runs ADD COLUMN categories jsonb;`,
+	`ALTER TABLE product_urls ADD COLUMN raw_url text;`,
+	`ALTER TABLE product_urls ADD COLUMN category_name text;`,
+	`ALTER TABLE products ADD COLUMN scraped_sections jsonb;`,
+	`ALTER TABLE products ADD COLUMN description_html text;
+	ALTER TABLE products ADD COLUMN specifications_html text[];`,
+	`ALTER TABLE products ADD COLUMN tag_links jsonb;`,
+	`ALTER TABLE products ADD COLUMN purchase_info jsonb;`,
+	`ALTER TABLE products ADD COLUMN points_earned integer;
+	ALTER TABLE products ADD COLUMN member_price_jpy integer;
+	ALTER TABLE products ADD COLUMN member_only boolean;`,
+	`ALTER TABLE products ADD COLUMN badges text[];
+	ALTER TABLE product_urls ADD COLUMN badges text[];`,
+}
+
+// productUpdateColumns are the columns of the products row an upsert
+// refreshes.
+var productUpdateColumns = []string{
+	"product_url", "model_code", "color_code", "section", "category", "breadcrumbs", "breadcrumb_links",
+	"gender", "product_type", "sport", "title",
+	"price_text", "price_jpy", "price_min_jpy", "price_max_jpy", "currency", "tax_included",
+	"original_price_jpy", "sale_price_jpy", "on_sale", "discount_percent",
+	"availability", "release_date", "available_colors",
+	"description_heading", "description_title", "description", "specifications", "materials", "care_instructions", "country_of_origin",
+	"special_description", "technology_badges", "size_charts", "size_remarks", "review_summary", "tags", "proxy",
+	"updated_at", "run_id", "last_seen_at", "content_hash", "crawler_version", "source_worker", "completeness_score",
+	"description_html", "specifications_html", "tag_links", "purchase_info",
+	"points_earned", "member_price_jpy", "member_only", "badges",
+}
+
+// productFieldStorage maps the Product fields of sections a scrape may skip,
+// see skippedFields, to the column or child table that holds them.
+var productFieldStorage = map[string]string{
+	"Media":               "product_media",
+	"AvailableSizes":      "product_sizes",
+	"SizeCharts":          "size_charts",
+	"SizeRemarks":         "size_remarks",
+	"ReviewSummary":       "review_summary",
+	"Reviews":             "product_reviews",
+	"CoordinatedProducts": "product_coordinated",
+	"RecommendedProducts": "product_coordinated",
+	"Tags":                "tags",
+	"TagLinks":            "tag_links",
+	"ContentHash":         "content_hash",
+	"CompletenessScore":   "completeness_score",
+}
+
+// productUpsertSet returns the SET clause of the upsert of product, which
+// leaves the columns of the sections it skipped alone, and the child tables
+// it replaces.
+func productUpsertSet(product *Product) (string, []string) {
+	skipped := make(map[string]bool)
+	for _, name := range skippedFields(product) {
+		skipped[productFieldStorage[name]] = true
+	}
+	var set []string
+	for _, column := range productUpdateColumns {
+		if !skipped[column] {
+			set = append(set, column+" = excluded."+column)
+		}
+	}
+	set = append(set, "scraped_sections = coalesce(products.scraped_sections, '{}') || excluded.scraped_sections")
+	var tables []string
+	for _, table := range []string{"product_sizes", "product_media", "product_reviews", "product_coordinated"} {
+		if !skipped[table] {
+			tables = append(tables, table)
+		}
+	}
+	return strings.Join(set, ", "), tables
+}
+
+// postgresStorage is the Storage backed by PostgreSQL, selected with
+// -storage=postgres.
+type postgresStorage struct {
+	pool *pgxpool.Pool
+}
+
+func openPostgresStorage(ctx context.Context, cfg *Config) (*postgresStorage, error) {
+	poolConfig, err := pgxpool.ParseConfig(cfg.PostgresDSN)
+	if err != nil {
+		return nil, fmt.Errorf("invalid postgres-dsn: %v", err)
+	}
+	// Every worker of a phase may hold a connection, plus the one listing the
+	// pending URLs.
+	poolConfig.MaxConns = max(poolConfig.MaxConns, int32(max(cfg.discoverWorkers(), cfg.scrapeWorkers())+2))
+
+	pool, err := pgxpool.NewWithConfig(ctx, poolConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to PostgreSQL: %v", err)
+	}
+	if err := migratePostgres(ctx, pool); err != nil {
+		pool.Close()
+		return nil, err
+	}
+	return &postgresStorage{pool: pool}, nil
+}
+
+// migratePostgres applies the migrations not applied yet, each in its own
+// transaction.
+func migratePostgres(ctx context.Context, pool *pgxpool.Pool) error {
+	_, err := pool.Exec(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    integer PRIMARY KEY,
+		applied_at timestamptz NOT NULL DEFAULT now()
+	)`)
+	if err != nil {
+		return fmt.Errorf("failed to create schema_migrations: %v", err)
+	}
+
+	var applied int
+	if err := pool.QueryRow(ctx, `SELECT coalesce(max(version), 0) FROM schema_migrations`).Scan(&applied); err != nil {
+		return fmt.Errorf("failed to read schema version: %v", err)
+	}
+	for version := applied + 1; version <= len(postgresMigrations); version++ {
+		err := pgx.BeginFunc(ctx, pool, func(tx pgx.Tx) error {
+			if _, err := tx.Exec(ctx, postgresMigrations[version-1]); err != nil {
+				return err
+			}
+			_, err := tx.Exec(ctx, `INSERT INTO schema_migrations (version) VALUES ($1)`, version)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to apply migration %d: %v", version, err)
+		}
+		slog.Info("Applied PostgreSQL migration", "version", version)
+	}
+	return nil
+}
+
+func (s *postgresStorage) prepare(ctx context.Context) error {
+	return nil
+}
+
+func (s *postgresStorage) close() error {
+	s.pool.Close()
+	return nil
+}
+
+func (s *postgresStorage) countProductURLs(ctx context.Context) (int64, error) {
+	var n int64
+	err := s.pool.QueryRow(ctx, `SELECT count(*) FROM product_urls`).Scan(&n)
+	return n, err
+}
+
+func (s *postgresStorage) countPendingProductURLs(ctx context.Context, categories *regexp.Regexp) (int64, error) {
+	query := `SELECT count(*) FROM product_urls WHERE status = $1`
+	args := []any{statusPending}
+	if categories != nil {
+		args = append(args, categories.String())
+		query += ` AND category ~ $2`
+	}
+	var n int64
+	err := s.pool.QueryRow(ctx, query, args...).Scan(&n)
+	return n, err
+}
+
+func (s *postgresStorage) saveProductURL(ctx context.Context, productURL ProductURL) (bool, error) {
+	status := productURL.Status
+	if status == "" {
+		status = statusPending
+	}
+	stampProductURL(ctx, &productURL, time.Now().UTC())
+	tag, err := s.pool.Exec(ctx,
+		`INSERT INTO product_urls (url, section, category, page_no, status, run_id, updated_at, crawler_version, source_worker, raw_url, category_name, badges)
+		VALUES ($1, $2, $3, $4, $5, nullif($6, ''), $7, $8, $9, nullif($10, ''), nullif($11, ''), $12)
+		ON CONFLICT (url) DO NOTHING`,
+		productURL.URL, productURL.Section, productURL.Category, productURL.PageNo, status, productURL.RunID,
+		productURL.UpdatedAt, productURL.CrawlerVersion, productURL.SourceWorker, productURL.RawURL, productURL.CategoryName, productURL.Badges)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+func (s *postgresStorage) saveProductURLs(ctx context.Context, productURLs []ProductURL) (int, error) {
+	if len(productURLs) == 0 {
+		return 0, nil
+	}
+	n := len(productURLs)
+	urls, sections, categories := make([]string, n), make([]string, n), make([]string, n)
+	pageNos, statuses, runIDs := make([]int32, n), make([]string, n), make([]string, n)
+	rawURLs, categoryNames, badges := make([]string, n), make([]string, n), make([]string, n)
+	for i, productURL := range productURLs {
+		urls[i], sections[i], categories[i] = productURL.URL, productURL.Section, productURL.Category
+		pageNos[i], statuses[i], runIDs[i] = int32(productURL.PageNo), productURL.Status, productURL.RunID
+		rawURLs[i], categoryNames[i] = productURL.RawURL, productURL.CategoryName
+		if statuses[i] == "" {
+			statuses[i] = statusPending
+		}
+		// unnest takes no arrays of arrays, so the badges of each URL are
+		// passed as a JSON array.
+		if len(productURL.Badges) > 0 {
+			encoded, _ := json.Marshal(productURL.Badges)
+			badges[i] = string(encoded)
+		}
+	}
+	var stamp ProductURL
+	stampProductURL(ctx, &stamp, time.Now().UTC())
+	tag, err := s.pool.Exec(ctx,
+		`INSERT INTO product_urls (url, section, category, page_no, status, run_id, updated_at, crawler_version, source_worker, raw_url, category_name, badges)
+		SELECT u.url, u.section, u.category, u.page_no, u.status, nullif(u.run_id, ''), $7, $8, $9, nullif(u.raw_url, ''), nullif(u.category_name, ''),
+			CASE WHEN u.badges <> '' THEN ARRAY(SELECT jsonb_array_elements_text(u.badges::jsonb)) END
+		FROM unnest($1::text[], $2::text[], $3::text[], $4::integer[], $5::text[], $6::text[], $10::text[], $11::text[], $12::text[])
+			AS u (url, section, category, page_no, status, run_id, raw_url, category_name, badges)
+		ON CONFLICT (url) DO NOTHING`,
+		urls, sections, categories, pageNos, statuses, runIDs, stamp.UpdatedAt, stamp.CrawlerVersion, stamp.SourceWorker, rawURLs, categoryNames, badges)
+	if err != nil {
+		return 0, err
+	}
+	return int(tag.RowsAffected()), nil
+}
+
+func (s *postgresStorage) eachPendingProductURL(ctx context.Context, categories *regexp.Regexp, limit int, fn func(ProductURL) bool) error {
+	query := `SELECT url, section, category, page_no, status FROM product_urls WHERE status = $1`
+	args := []any{statusPending}
+	if categories != nil {
+		args = append(args, categories.String())
+		query += fmt.Sprintf(` AND category ~ $%d`, len(args))
+	}
+	query += ` ORDER BY id`
+	if limit > 0 {
+		args = append(args, limit)
+		query += fmt.Sprintf(` LIMIT $%d`, len(args))
+	}
+
+	rows, err := s.pool.Query(ctx, query, args...)
+	if err != nil {
+		return fmt.Errorf("failed to find product URLs: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var u ProductURL
+		if err := rows.Scan(&u.URL, &u.Section, &u.Category, &u.PageNo, &u.Status); err != nil {
+			return fmt.Errorf("failed to read product URL: %v", err)
+		}
+		if !fn(u) {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil && ctx.Err() == nil {
+		return fmt.Errorf("failed to iterate over product URLs: %v", err)
+	}
+	return nil
+}
+
+func (s *postgresStorage) eachStaleProductURL(ctx context.Context, categories *regexp.Regexp, before time.Time, limit int, fn func(ProductURL) bool) error {
+	// Products saved before last_seen_at was recorded fall back to
+	// updated_at; a URL without a product has neither and sorts first.
+	query := `SELECT u.url, u.section, u.category, u.page_no, u.status
+		FROM product_urls u LEFT JOIN products p ON p.product_url = u.url
+		WHERE u.status = ANY($1) AND (coalesce(p.last_seen_at, p.updated_at) IS NULL OR coalesce(p.last_seen_at, p.updated_at) < $2)`
+	args := []any{[]string{statusPending, statusDone, statusFailed, statusComingSoon}, before}
+	if categories != nil {
+		args = append(args, categories.String())
+		query += fmt.Sprintf(` AND u.category ~ $%d`, len(args))
+	}
+	query += ` ORDER BY coalesce(p.last_seen_at, p.updated_at) NULLS FIRST, u.id`
+	if limit > 0 {
+		args = append(args, limit)
+		query += fmt.Sprintf(` LIMIT $%d`, len(args))
+	}
+
+	rows, err := s.pool.Query(ctx, query, args...)
+	if err != nil {
+		return fmt.Errorf("failed to find stale product URLs: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var u ProductURL
+		if err := rows.Scan(&u.URL, &u.Section, &u.Category, &u.PageNo, &u.Status); err != nil {
+			return fmt.Errorf("failed to read product URL: %v", err)
+		}
+		if !fn(u) {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil && ctx.Err() == nil {
+		return fmt.Errorf("failed to iterate over product URLs: %v", err)
+	}
+	return nil
+}
+
+func (s *postgresStorage) claimProductURL(ctx context.Context, url string) (bool, error) {
+	tag, err := s.pool.Exec(ctx,
+		`UPDATE product_urls SET status = $2, claimed_at = now(), updated_at = now(), crawler_version = $4, source_worker = $5
+		WHERE url = $1 AND status = $3`,
+		url, statusInProgress, statusPending, crawlerVersion, sourceWorker(ctx))
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+func (s *postgresStorage) markProductURL(ctx context.Context, url, status string, scrapeErr error, fields map[string]any) error {
+	var errText *string
+	if scrapeErr != nil {
+		msg := scrapeErr.Error()
+		errText = &msg
+	}
+	var availability, finalURL, runID *string
+	if v, ok := fields["availability"].(string); ok {
+		availability = &v
+	}
+	if v, ok := fields["final_url"].(string); ok {
+		finalURL = &v
+	}
+	if v, ok := fields["run_id"].(string); ok {
+		runID = &v
+	}
+	fieldsJSON, err := json.Marshal(fields)
+	if err != nil || fields == nil {
+		fieldsJSON = []byte("{}")
+	}
+
+	// Only consecutive misses count towards -prune-dead.
+	_, err = s.pool.Exec(ctx,
+		`UPDATE product_urls SET
+			status = $2,
+			error = $3,
+			claimed_at = NULL,
+			availability = coalesce($4, availability),
+			final_url = coalesce($5, final_url),
+			fields = fields || $6::jsonb,
+			not_found_count = CASE WHEN $2 = $7 THEN not_found_count ELSE 0 END,
+			run_id = coalesce($8, run_id),
+			updated_at = $9,
+			crawled_at = CASE WHEN $10 THEN $9 ELSE crawled_at END,
+			crawler_version = $11,
+			source_worker = $12
+		WHERE url = $1`,
+		url, status, errText, availability, finalURL, string(fieldsJSON), statusNotFound, runID,
+		time.Now().UTC(), urlScraped(status), crawlerVersion, sourceWorker(ctx))
+	return err
+}
+
+func (s *postgresStorage) releaseStaleClaims(ctx context.Context, timeout time.Duration) (int64, error) {
+	tag, err := s.pool.Exec(ctx,
+		`UPDATE product_urls SET status = $1, claimed_at = NULL, updated_at = now() WHERE status = $2 AND claimed_at < $3`,
+		statusPending, statusInProgress, time.Now().UTC().Add(-timeout))
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+func (s *postgresStorage) countNotFound(ctx context.Context, url string) (int, error) {
+	var n int
+	err := s.pool.QueryRow(ctx,
+		`UPDATE product_urls SET not_found_count = not_found_count + 1 WHERE url = $1 RETURNING not_found_count`,
+		url).Scan(&n)
+	return n, err
+}
+
+func (s *postgresStorage) deleteProductURL(ctx context.Context, url string) error {
+	_, err := s.pool.Exec(ctx, `DELETE FROM product_urls WHERE url = $1`, url)
+	return err
+}
+
+func (s *postgresStorage) hasProduct(ctx context.Context, productNumber string) (bool, error) {
+	var exists bool
+	err := s.pool.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM products WHERE product_number = $1)`, productNumber).Scan(&exists)
+	return exists, err
+}
+
+func (s *postgresStorage) eachProduct(ctx context.Context, fn func(*Product) bool) error {
+	rows, err := s.pool.Query(ctx,
+		`SELECT p.product_number, p.product_url, coalesce(p.title, ''), coalesce(p.category, ''), p.breadcrumbs,
+			coalesce(p.price_text, ''), coalesce(p.availability, ''), coalesce(p.description, ''), p.specifications,
+			p.available_colors, p.size_charts, coalesce(p.completeness_score, 0),
+			p.first_crawled_at, coalesce(p.last_seen_at, p.updated_at), p.scraped_sections,
+			ARRAY(SELECT type FROM product_media m WHERE m.product_number = p.product_number ORDER BY position),
+			ARRAY(SELECT size FROM product_sizes z WHERE z.product_number = p.product_number ORDER BY position)
+		FROM products p ORDER BY p.product_number`)
+	if err != nil {
+		return fmt.Errorf("failed to find products: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var p Product
+		var mediaTypes, sizes []string
+		if err := rows.Scan(&p.ProductNumber, &p.ProductURL, &p.Title, &p.Category, &p.Breadcrumbs,
+			&p.PriceText, &p.Availability, &p.Description, &p.Specifications,
+			&p.AvailableColors, &p.SizeCharts, &p.CompletenessScore,
+			&p.FirstCrawledAt, &p.LastSeenAt, &p.ScrapedSections, &mediaTypes, &sizes); err != nil {
+			return fmt.Errorf("failed to read product: %v", err)
+		}
+		for _, mediaType := range mediaTypes {
+			p.Media = append(p.Media, Media{Type: mediaType})
+		}
+		for _, size := range sizes {
+			p.AvailableSizes = append(p.AvailableSizes, SizeOption{Size: size})
+		}
+		if !fn(&p) {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil && ctx.Err() == nil {
+		return fmt.Errorf("failed to iterate over products: %v", err)
+	}
+	return nil
+}
+
+// saveProducts saves each product in a transaction of its own, as the child
+// rows are replaced per product anyway.
+func (s *postgresStorage) saveProducts(ctx context.Context, products []*Product) ([]string, []error) {
+	return saveEachProduct(ctx, s, products)
+}
+
+// saveProduct upserts the products row and replaces the child rows of
+// product in one transaction.
+func (s *postgresStorage) saveProduct(ctx context.Context, product *Product) (string, error) {
+	if product.ProductNumber == "" {
+		return "", fmt.Errorf("product %s has no product number", product.ProductURL)
+	}
+	now := time.Now().UTC()
+	product.LastSeenAt = now
+	if product.ContentHash != "" {
+		err := s.pool.QueryRow(ctx,
+			`UPDATE products SET last_seen_at = $3, scraped_sections = coalesce(scraped_sections, '{}') || $4
+			WHERE product_number = $1 AND content_hash = $2 RETURNING first_crawled_at, updated_at`,
+			product.ProductNumber, product.ContentHash, now, product.ScrapedSections).Scan(&product.FirstCrawledAt, &product.UpdatedAt)
+		if err == nil {
+			return productUnchanged, nil
+		}
+		if !errors.Is(err, pgx.ErrNoRows) {
+			return "", fmt.Errorf("failed to save product: %v", err)
+		}
+	}
+	product.UpdatedAt = now
+	stampProduct(ctx, product)
+
+	// xmax is 0 for a row the upsert inserted rather than updated.
+	var created bool
+	set, tables := productUpsertSet(product)
+	err := pgx.BeginFunc(ctx, s.pool, func(tx pgx.Tx) error {
+		p := product
+		stored, err := storedHistoryFields(ctx, tx, p.ProductNumber)
+		if err != nil {
+			return fmt.Errorf("failed to read stored product: %v", err)
+		}
+		err = tx.QueryRow(ctx,
+			`INSERT INTO products (
+				product_number, product_url, model_code, color_code, section, category, breadcrumbs, breadcrumb_links,
+				gender, product_type, sport, title,
+				price_text, price_jpy, price_min_jpy, price_max_jpy, currency, tax_included,
+				original_price_jpy, sale_price_jpy, on_sale, discount_percent,
+				availability, release_date, available_colors,
+				description_heading, description_title, description, specifications, materials, care_instructions, country_of_origin,
+				special_description, technology_badges, size_charts, size_remarks, review_summary, tags, proxy,
+				first_crawled_at, updated_at, run_id, last_seen_at, content_hash, crawler_version, source_worker, completeness_score,
+				scraped_sections, description_html, specifications_html, tag_links, purchase_info,
+				points_earned, member_price_jpy, member_only, badges
+			) VALUES (
+				$1, $2, $3, $4, $5, $6, $7, $8,
+				$9, $10, $11, $12,
+				$13, $14, $15, $16, $17, $18,
+				$19, $20, $21, $22,
+				$23, $24, $25,
+				$26, $27, $28, $29, $30, $31, $32,
+				$33, $34, $35, $36, $37, $38, $39,
+				$40, $40, nullif($41, ''), $40, nullif($42, ''), $43, $44, $45,
+				$46, nullif($47, ''), $48, $49, $50,
+				$51, $52, $53, $54
+			)
+			ON CONFLICT (product_number) DO UPDATE SET `+set+`
+			RETURNING first_crawled_at, xmax = 0`,
+			p.ProductNumber, p.ProductURL, p.ModelCode, p.ColorCode, p.Section, p.Category, p.Breadcrumbs, p.BreadcrumbLinks,
+			p.Gender, p.ProductType, p.Sport, p.Title,
+			p.PriceText, p.PriceJPY, p.PriceMinJPY, p.PriceMaxJPY, p.Currency, p.TaxIncluded,
+			p.OriginalPriceJPY, p.SalePriceJPY, p.OnSale, p.DiscountPercent,
+			p.Availability, p.ReleaseDate, p.AvailableColors,
+			p.DescriptionHeading, p.DescriptionTitle, p.Description, p.Specifications, p.Materials, p.CareInstructions, p.CountryOfOrigin,
+			p.SpecialDescription, p.TechnologyBadges, p.SizeCharts, p.SizeRemarks, p.ReviewSummary, p.Tags, p.Proxy,
+			now, p.RunID, p.ContentHash, p.CrawlerVersion, p.SourceWorker, p.CompletenessScore,
+			p.ScrapedSections, p.DescriptionHTML, p.SpecificationsHTML, p.TagLinks, p.PurchaseInfo,
+			p.PointsEarned, p.MemberPrice, p.MemberOnly, p.Badges,
+		).Scan(&product.FirstCrawledAt, &created)
+		if err != nil {
+			return fmt.Errorf("failed to save product: %v", err)
+		}
+
+		batch := &pgx.Batch{}
+		for _, table := range tables {
+			batch.Queue(`DELETE FROM `+table+` WHERE product_number = $1`, p.ProductNumber)
+		}
+		for i, size := range p.AvailableSizes {
+			batch.Queue(`INSERT INTO product_sizes VALUES ($1, $2, $3, $4, $5)`, p.ProductNumber, i, size.Size, size.InStock, size.LowStock)
+		}
+		queueMediaRows(batch, p)
+		for i, r := range p.Reviews {
+			batch.Queue(`INSERT INTO product_reviews VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18)`,
+				p.ProductNumber, i, r.ReviewId, r.Rating, r.Title, r.Description, r.DateText, r.SubmittedAt,
+				r.PurchasedSize, r.UsualSize, r.Height, r.Weight, r.Age, r.Gender, r.Location, r.HelpfulCount, r.UnhelpfulCount, r.Photos)
+		}
+		for _, rel := range []struct {
+			name     string
+			products []CoordinatedProduct
+		}{{"coordinated", p.CoordinatedProducts}, {"recommended", p.RecommendedProducts}} {
+			for i, c := range rel.products {
+				batch.Queue(`INSERT INTO product_coordinated VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+					p.ProductNumber, rel.name, i, c.ProductNumber, c.Title, c.PriceText, c.PriceJPY, c.Path, c.ProductURL)
+			}
+		}
+		for _, change := range productChanges(stored, p) {
+			// Marshalled here since pgx would take a string as JSON text.
+			oldValue, _ := json.Marshal(change.Old)
+			newValue, _ := json.Marshal(change.New)
+			batch.Queue(`INSERT INTO product_history (product_number, field, old, new, run_id, changed_at) VALUES ($1, $2, $3, $4, nullif($5, ''), $6)`,
+				change.ProductNumber, change.Field, oldValue, newValue, change.RunID, change.ChangedAt)
+		}
+		if err := tx.SendBatch(ctx, batch).Close(); err != nil {
+			return fmt.Errorf("failed to save the lists of product %s: %v", p.ProductNumber, err)
+		}
+		return nil
+	})
+	switch {
+	case err != nil:
+		return "", err
+	case created:
+		return productNew, nil
+	}
+	return productChanged, nil
+}
+
+// storedHistoryFields reads the fields of a stored product that
+// productChanges compares, locking its row until tx ends. It returns nil for a
+// product that is not stored yet.
+func storedHistoryFields(ctx context.Context, tx pgx.Tx, productNumber string) (*Product, error) {
+	var price *int
+	var onSale *bool
+	var availability, title, description *string
+	err := tx.QueryRow(ctx,
+		`SELECT price_jpy, on_sale, availability, title, description FROM products WHERE product_number = $1 FOR UPDATE`,
+		productNumber).Scan(&price, &onSale, &availability, &title, &description)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	stored := &Product{}
+	if price != nil {
+		stored.PriceJPY = *price
+	}
+	if onSale != nil {
+		stored.OnSale = *onSale
+	}
+	if availability != nil {
+		stored.Availability = *availability
+	}
+	if title != nil {
+		stored.Title = *title
+	}
+	if description != nil {
+		stored.Description = *description
+	}
+
+	rows, err := tx.Query(ctx, `SELECT size, in_stock, low_stock FROM product_sizes WHERE product_number = $1 ORDER BY position`, productNumber)
+	if err != nil {
+		return nil, err
+	}
+	stored.AvailableSizes, err = pgx.CollectRows(rows, func(row pgx.CollectableRow) (SizeOption, error) {
+		var size SizeOption
+		err := row.Scan(&size.Size, &size.InStock, &size.LowStock)
+		return size, err
+	})
+	return stored, err
+}
+
+func (s *postgresStorage) productHistory(ctx context.Context, productNumber string) ([]historyEntry, error) {
+	rows, err := s.pool.Query(ctx,
+		`SELECT product_number, field, old, new, coalesce(run_id, ''), changed_at FROM product_history
+		WHERE product_number = $1 ORDER BY changed_at, id`, productNumber)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find product history: %v", err)
+	}
+	entries, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (historyEntry, error) {
+		var e historyEntry
+		err := row.Scan(&e.ProductNumber, &e.Field, &e.Old, &e.New, &e.RunID, &e.ChangedAt)
+		return e, err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read product history: %v", err)
+	}
+	return entries, nil
+}
+
+// queueMediaRows queues the product_media rows of product on batch.
+func queueMediaRows(batch *pgx.Batch, product *Product) {
+	for i, m := range product.Media {
+		batch.Queue(`INSERT INTO product_media VALUES ($1, $2, $3, $4, $5, $6)`,
+			product.ProductNumber, i, m.Type, m.Path, m.LocalPath, m.SHA256)
+	}
+}
+
+func (s *postgresStorage) eachHistory(ctx context.Context, afterRunID, untilRunID string, fn func(historyEntry) bool) error {
+	rows, err := s.pool.Query(ctx,
+		`SELECT product_number, field, old, new, run_id, changed_at FROM product_history
+		WHERE run_id > $1 AND run_id <= $2 ORDER BY changed_at, id`, afterRunID, untilRunID)
+	if err != nil {
+		return fmt.Errorf("failed to find product history: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var e historyEntry
+		if err := rows.Scan(&e.ProductNumber, &e.Field, &e.Old, &e.New, &e.RunID, &e.ChangedAt); err != nil {
+			return fmt.Errorf("failed to read product history: %v", err)
+		}
+		if !fn(e) {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil && ctx.Err() == nil {
+		return fmt.Errorf("failed to iterate over product history: %v", err)
+	}
+	return nil
+}
+
+func (s *postgresStorage) updateProductMedia(ctx context.Context, product *Product) error {
+	return pgx.BeginFunc(ctx, s.pool, func(tx pgx.Tx) error {
+		tag, err := tx.Exec(ctx, `UPDATE products SET available_colors = $2 WHERE product_number = $1`, product.ProductNumber, product.AvailableColors)
+		if err != nil {
+			return err
+		}
+		if tag.RowsAffected() == 0 {
+			return errors.New("product not found")
+		}
+		batch := &pgx.Batch{}
+		batch.Queue(`DELETE FROM product_media WHERE product_number = $1`, product.ProductNumber)
+		queueMediaRows(batch, product)
+		return tx.SendBatch(ctx, batch).Close()
+	})
+}
+
+func (s *postgresStorage) startRun(ctx context.Context, run *crawlRun) error {
+	config, err := json.Marshal(run.Config)
+	if err != nil {
+		return err
+	}
+	_, err = s.pool.Exec(ctx,
+		`INSERT INTO crawl_runs (run_id, command, config, started_at, status) VALUES ($1, $2, $3, $4, $5)`,
+		run.ID, run.Command, string(config), run.StartedAt, run.Status)
+	return err
+}
+
+func (s *postgresStorage) finishRun(ctx context.Context, run *crawlRun) error {
+	stats, err := json.Marshal(run.Stats)
+	if err != nil {
+		return err
+	}
+	_, err = s.pool.Exec(ctx,
+		`UPDATE crawl_runs SET finished_at = $2, duration_seconds = $3, status = $4, error = nullif($5, ''), stats = $6, categories = $7 WHERE run_id = $1`,
+		run.ID, run.FinishedAt, run.DurationSeconds, run.Status, run.Error, string(stats), run.Categories)
+	return err
+}
+
+func (s *postgresStorage) recentRuns(ctx context.Context, limit int) ([]crawlRun, error) {
+	return s.queryRuns(ctx, `SELECT run_id, command, config, started_at, finished_at, duration_seconds, status, error, stats, categories
+		FROM crawl_runs ORDER BY started_at DESC LIMIT $1`, limit)
+}
+
+func (s *postgresStorage) findRun(ctx context.Context, id string) (*crawlRun, error) {
+	runs, err := s.queryRuns(ctx, `SELECT run_id, command, config, started_at, finished_at, duration_seconds, status, error, stats, categories
+		FROM crawl_runs WHERE run_id = $1`, id)
+	if err != nil || len(runs) == 0 {
+		return nil, err
+	}
+	return &runs[0], nil
+}
+
+func (s *postgresStorage) lastScrapeRun(ctx context.Context, before time.Time) (*crawlRun, error) {
+	runs, err := s.queryRuns(ctx, `SELECT run_id, command, config, started_at, finished_at, duration_seconds, status, error, stats, categories
+		FROM crawl_runs WHERE started_at < $1 AND status <> $2 AND (stats->>'completed')::bigint > 0
+		ORDER BY started_at DESC LIMIT 1`, before, runRunning)
+	if err != nil || len(runs) == 0 {
+		return nil, err
+	}
+	return &runs[0], nil
+}
+
+// queryRuns returns the runs selected by query, which selects the columns of
+// crawl_runs in table order.
+func (s *postgresStorage) queryRuns(ctx context.Context, query string, args ...any) ([]crawlRun, error) {
+	rows, err := s.pool.Query(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find runs: %v", err)
+	}
+	defer rows.Close()
+
+	var runs []crawlRun
+	for rows.Next() {
+		var run crawlRun
+		var finishedAt *time.Time
+		var duration *float64
+		var runErr *string
+		if err := rows.Scan(&run.ID, &run.Command, &run.Config, &run.StartedAt, &finishedAt, &duration, &run.Status, &runErr, &run.Stats, &run.Categories); err != nil {
+			return nil, fmt.Errorf("failed to read runs: %v", err)
+		}
+		if finishedAt != nil {
+			run.FinishedAt = *finishedAt
+		}
+		if duration != nil {
+			run.DurationSeconds = *duration
+		}
+		if runErr != nil {
+			run.Error = *runErr
+		}
+		runs = append(runs, run)
+	}
+	return runs, rows.Err()
+}
+
+func (s *postgresStorage) recordFailure(ctx context.Context, failure failedURL, maxAttempts int) error {
+	_, err := s.pool.Exec(ctx,
+		`INSERT INTO failed_urls (url, section, category, page_no, error_class, error, attempts, first_failed_at, last_failed_at, permanent, artifacts, missing_fields)
+		VALUES ($1, $2, $3, $4, $5, $6, 1, $7, $7, 1 >= $8, $9, $10)
+		ON CONFLICT (url) DO UPDATE SET
+			section = EXCLUDED.section, category = EXCLUDED.category, page_no = EXCLUDED.page_no,
+			error_class = EXCLUDED.error_class, error = EXCLUDED.error,
+			attempts = failed_urls.attempts + 1, last_failed_at = EXCLUDED.last_failed_at,
+			permanent = failed_urls.attempts + 1 >= $8, artifacts = EXCLUDED.artifacts, missing_fields = EXCLUDED.missing_fields`,
+		failure.URL, failure.Section, failure.Category, failure.PageNo, failure.ErrorClass, failure.Error, failure.LastFailedAt, maxAttempts, failure.Artifacts, failure.MissingFields)
+	return err
+}
+
+func (s *postgresStorage) clearFailure(ctx context.Context, url string) error {
+	_, err := s.pool.Exec(ctx, `DELETE FROM failed_urls WHERE url = $1`, url)
+	return err
+}
+
+func (s *postgresStorage) eachFailure(ctx context.Context, classes []string, fn func(failedURL) bool) error {
+	query := `SELECT url, section, category, page_no, error_class, error, attempts, first_failed_at, last_failed_at, permanent, artifacts, missing_fields
+		FROM failed_urls WHERE NOT permanent`
+	var args []any
+	if classes != nil {
+		args = append(args, classes)
+		query += ` AND error_class = ANY($1)`
+	}
+	query += ` ORDER BY last_failed_at`
+
+	rows, err := s.pool.Query(ctx, query, args...)
+	if err != nil {
+		return fmt.Errorf("failed to find failed URLs: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var f failedURL
+		if err := rows.Scan(&f.URL, &f.Section, &f.Category, &f.PageNo, &f.ErrorClass, &f.Error, &f.Attempts, &f.FirstFailedAt, &f.LastFailedAt, &f.Permanent, &f.Artifacts, &f.MissingFields); err != nil {
+			return fmt.Errorf("failed to read failed URL: %v", err)
+		}
+		if !fn(f) {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil && ctx.Err() == nil {
+		return fmt.Errorf("failed to iterate over failed URLs: %v", err)
+	}
+	return nil
+}
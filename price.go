@@ -0,0 +1,119 @@
+package main
+
+import (
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// PriceInfo is a displayed price together with its parsed amounts. The
+// original text is kept in PriceText; the amounts are 0 when it could not be
+// parsed. A range such as "¥5,489〜¥7,689" fills PriceMinJPY and PriceMaxJPY
+// and sets PriceJPY to the lower bound.
+type PriceInfo struct {
+	PriceText   string `json:"price_text" bson:"price_text"`
+	PriceJPY    int    `json:"price_jpy" bson:"price_jpy"`
+	PriceMinJPY int    `json:"price_min_jpy" bson:"price_min_jpy"`
+	PriceMaxJPY int    `json:"price_max_jpy" bson:"price_max_jpy"`
+	Currency    string `json:"currency" bson:"currency"`
+	TaxIncluded bool   `json:"tax_included" bson:"tax_included"`
+}
+
+var (
+	// yenAmountPattern matches amounts written as ¥12,100 or 12,100円.
+	yenAmountPattern = regexp.MustCompile(`[¥￥]\s*([\d,]+)|([\d,]+)\s*円`)
+	// taxIncludedPattern matches the 税込 marker shown next to prices.
+	taxIncludedPattern = regexp.MustCompile(`税込`)
+	// pointsPattern matches adiClub points written as 1,210ポイント or 1,210pt.
+	pointsPattern = regexp.MustCompile(`([\d,]+)\s*(?:ポイント|pt)`)
+)
+
+// parsePrice parses the price text and the text around it, which carries the
+// tax marker. It reports false when no amount could be found.
+func parsePrice(text, surrounding string) (PriceInfo, bool) {
+	info := PriceInfo{PriceText: strings.TrimSpace(text)}
+
+	amounts := parseYenAmounts(text)
+	if len(amounts) == 0 {
+		return info, false
+	}
+
+	info.Currency = "JPY"
+	info.PriceMinJPY, info.PriceMaxJPY = amounts[0], amounts[0]
+	for _, amount := range amounts[1:] {
+		info.PriceMinJPY = min(info.PriceMinJPY, amount)
+		info.PriceMaxJPY = max(info.PriceMaxJPY, amount)
+	}
+	info.PriceJPY = info.PriceMinJPY
+	info.TaxIncluded = taxIncludedPattern.MatchString(text) || taxIncludedPattern.MatchString(surrounding)
+	return info, true
+}
+
+// parseYenAmounts returns every yen amount in text, in order.
+func parseYenAmounts(text string) []int {
+	var amounts []int
+	for _, match := range yenAmountPattern.FindAllStringSubmatch(text, -1) {
+		digits := match[1]
+		if digits == "" {
+			digits = match[2]
+		}
+		amount, err := strconv.Atoi(strings.ReplaceAll(digits, ",", ""))
+		if err != nil {
+			continue
+		}
+		amounts = append(amounts, amount)
+	}
+	return amounts
+}
+
+// parsePoints returns the adiClub points in text, 0 when it names none.
+func parsePoints(text string) int {
+	match := pointsPattern.FindStringSubmatch(text)
+	if match == nil {
+		return 0
+	}
+	points, err := strconv.Atoi(strings.ReplaceAll(match[1], ",", ""))
+	if err != nil {
+		return 0
+	}
+	return points
+}
+
+// applySalePrice fills the sale fields of product from the text of the
+// crossed-out original price, which is only shown for discounted products.
+// Without a sale the original price is the current price and SalePriceJPY
+// stays 0.
+func applySalePrice(product *Product, originalText string) {
+	product.OriginalPriceJPY = product.PriceJPY
+	product.SalePriceJPY = 0
+	product.OnSale = false
+	product.DiscountPercent = 0
+
+	amounts := parseYenAmounts(originalText)
+	if len(amounts) == 0 || product.PriceJPY == 0 || amounts[0] <= product.PriceJPY {
+		return
+	}
+
+	product.OriginalPriceJPY = amounts[0]
+	product.SalePriceJPY = product.PriceJPY
+	product.OnSale = true
+	discount := float64(product.OriginalPriceJPY-product.SalePriceJPY) / float64(product.OriginalPriceJPY) * 100
+	product.DiscountPercent = math.Round(discount*10) / 10
+}
+
+// applySaleBadge marks product as on sale when the page shows a sale badge
+// with a discount, such as 30%OFF, but no crossed-out price. The price then
+// is the sale price and the discount that of the badge; the original price is
+// not shown, so OriginalPriceJPY is 0. A sale found by applySalePrice is
+// left as it is.
+func applySaleBadge(product *Product, labels []string) {
+	percent, ok := saleBadgePercent(labels)
+	if !ok || product.OnSale || product.PriceJPY == 0 {
+		return
+	}
+	product.OriginalPriceJPY = 0
+	product.SalePriceJPY = product.PriceJPY
+	product.OnSale = true
+	product.DiscountPercent = percent
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestParsePrice(t *testing.T) {
+	tests := []struct {
+		text, surrounding string
+		want              PriceInfo
+		ok                bool
+	}{
+		{"¥12,100", "¥12,100 (税込)", PriceInfo{PriceText: "¥12,100", Currency: "JPY", PriceJPY: 12100, PriceMinJPY: 12100, PriceMaxJPY: 12100, TaxIncluded: true}, true},
+		{" 12,100円（税込） ", "", PriceInfo{PriceText: "12,100円（税込）", Currency: "JPY", PriceJPY: 12100, PriceMinJPY: 12100, PriceMaxJPY: 12100, TaxIncluded: true}, true},
+		{"￥ 8,470", "", PriceInfo{PriceText: "￥ 8,470", Currency: "JPY", PriceJPY: 8470, PriceMinJPY: 8470, PriceMaxJPY: 8470}, true},
+		{"¥13,200 ~ ¥9,900", "税込", PriceInfo{PriceText: "¥13,200 ~ ¥9,900", Currency: "JPY", PriceJPY: 9900, PriceMinJPY: 9900, PriceMaxJPY: 13200, TaxIncluded: true}, true},
+		{"価格未定", "", PriceInfo{PriceText: "価格未定"}, false},
+		{"", "", PriceInfo{}, false},
+	}
+	for _, tt := range tests {
+		got, ok := parsePrice(tt.text, tt.surrounding)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("parsePrice(%q, %q) = %+v, %v, want %+v, %v", tt.text, tt.surrounding, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestParseYenAmounts(t *testing.T) {
+	tests := []struct {
+		text string
+		want []int
+	}{
+		{"¥12,100", []int{12100}},
+		{"12,100円", []int{12100}},
+		{"通常価格 ¥16,500 → セール価格 11,550円", []int{16500, 11550}},
+		{"￥990", []int{990}},
+		{"30%OFF", nil},
+		{"", nil},
+	}
+	for _, tt := range tests {
+		if got := parseYenAmounts(tt.text); !slices.Equal(got, tt.want) {
+			t.Errorf("parseYenAmounts(%q) = %v, want %v", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestParsePoints(t *testing.T) {
+	tests := []struct {
+		text string
+		want int
+	}{
+		{"1,210ポイント", 1210},
+		{"121 ポイント獲得", 121},
+		{"adiClubメンバーは1,210pt", 1210},
+		{"最大 2,420pt 獲得", 2420},
+		{"ポイント", 0},
+		{"¥12,100", 0},
+		{"", 0},
+	}
+	for _, tt := range tests {
+		if got := parsePoints(tt.text); got != tt.want {
+			t.Errorf("parsePoints(%q) = %d, want %d", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestApplySalePrice(t *testing.T) {
+	type sale struct {
+		original, price int
+		onSale          bool
+		discount        float64
+	}
+	tests := []struct {
+		name         string
+		price        int
+		originalText string
+		want         sale
+	}{
+		{"on sale", 8470, "¥12,100", sale{12100, 8470, true, 30}},
+		{"discount rounded to one decimal", 9900, "¥14,300", sale{14300, 9900, true, 30.8}},
+		{"no crossed-out price", 12100, "", sale{12100, 0, false, 0}},
+		{"crossed-out price not above the price", 12100, "¥12,100", sale{12100, 0, false, 0}},
+		{"no price", 0, "¥12,100", sale{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var product Product
+			product.PriceJPY = tt.price
+			// A sale of an earlier scrape is cleared.
+			product.OnSale, product.DiscountPercent = true, 50
+			applySalePrice(&product, tt.originalText)
+			got := sale{product.OriginalPriceJPY, product.SalePriceJPY, product.OnSale, product.DiscountPercent}
+			if got != tt.want {
+				t.Errorf("original, sale price, on sale, discount = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// progressInterval is how often the progress line is redrawn.
+const progressInterval = 500 * time.Millisecond
+
+// progressRateWindow is the span the current rate is measured over.
+const progressRateWindow = time.Minute
+
+// progress is the progress display of the run, nil unless -progress is on
+// and stderr is a terminal, see setupProgress.
+var progress *progressDisplay
+
+// progressDisplay keeps a status line with the counts of the running phase at
+// the bottom of the terminal. Log records are written through it, so that
+// the line is cleared before a record and drawn again below it.
+type progressDisplay struct {
+	out  *os.File
+	mu   sync.Mutex
+	line string // "" when no line is shown
+}
+
+// setupProgress turns the progress display on when cfg asks for it and
+// stderr is a terminal. JSON logs are meant for machines, so they get none.
+func setupProgress(cfg *Config) {
+	progress = nil
+	if !cfg.Progress || cfg.LogFormat == logFormatJSON || !isTerminal(os.Stderr) {
+		return
+	}
+	progress = &progressDisplay{out: os.Stderr}
+}
+
+// isTerminal reports whether f is a character device, such as a terminal,
+// rather than a file or pipe as under cron.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// Write writes a log record above the progress line.
+func (p *progressDisplay) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.clearLine()
+	n, err := p.out.Write(b)
+	if p.line != "" {
+		fmt.Fprint(p.out, p.line)
+	}
+	return n, err
+}
+
+// show replaces the progress line with line, "" to remove it.
+func (p *progressDisplay) show(line string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.clearLine()
+	p.line = line
+	fmt.Fprint(p.out, line)
+}
+
+// clearLine erases the progress line. The caller holds p.mu.
+func (p *progressDisplay) clearLine() {
+	if p.line != "" {
+		fmt.Fprint(p.out, "\r\033[K")
+	}
+}
+
+// track draws the progress of the run of command from stats until the
+// returned function is called, which removes the line and prints the summary
+// of the run. Without a progress display both do nothing.
+func (p *progressDisplay) track(command string, stats *crawlStats) (stop func()) {
+	if p == nil {
+		return func() {}
+	}
+	start := time.Now()
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		rate := &rateMeter{}
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				p.show(progressLine(command, stats, rate.add(now, stats.Completed.Load()), now.Sub(start)))
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-finished
+		p.show("")
+		p.printSummary(command, stats, time.Since(start))
+	}
+}
+
+// progressLine formats the progress line: the discovery counts until the
+// first product URL is dispatched, then the scrape counts with the rate in
+// products per minute and, once it is known, the estimated time left.
+func progressLine(command string, stats *crawlStats, perMinute float64, elapsed time.Duration) string {
+	elapsed = elapsed.Truncate(time.Second)
+	if stats.Dispatched.Load() == 0 {
+		return fmt.Sprintf("%s  %d listing pages  %d new product URLs  %v", command, stats.ListingPages.Load(), stats.ProductURLs.Load(), elapsed)
+	}
+
+	completed := stats.Completed.Load()
+	total := stats.Pending.Load() + stats.Variants.Load()
+	// The count at the start is an estimate; never show more done than
+	// there is.
+	total = max(total, stats.Dispatched.Load())
+	eta := "ETA -"
+	if perMinute > 0 && total > completed {
+		left := time.Duration(float64(total-completed) / perMinute * float64(time.Minute))
+		eta = "ETA " + left.Truncate(time.Second).String()
+	}
+	return fmt.Sprintf("%s  %d/%d URLs  %.1f products/min  %d failed  %s  %v",
+		command, completed, total, perMinute, stats.Failed.Load(), eta, elapsed)
+}
+
+// rateMeter measures the rate of a growing count over the last
+// progressRateWindow.
+type rateMeter struct {
+	samples []rateSample
+}
+
+type rateSample struct {
+	at    time.Time
+	count int64
+}
+
+// add records count at now and returns the rate per minute since the oldest
+// sample within the window.
+func (m *rateMeter) add(now time.Time, count int64) float64 {
+	m.samples = append(m.samples, rateSample{now, count})
+	for len(m.samples) > 2 && now.Sub(m.samples[1].at) >= progressRateWindow {
+		m.samples = m.samples[1:]
+	}
+	oldest := m.samples[0]
+	elapsed := now.Sub(oldest.at)
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(count-oldest.count) / elapsed.Minutes()
+}
+
+// printSummary prints the counts of the finished run of command as a table.
+func (p *progressDisplay) printSummary(command string, stats *crawlStats, elapsed time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	fmt.Fprintf(p.out, "\n%s finished in %v\n", command, elapsed.Truncate(time.Second))
+	w := tabwriter.NewWriter(p.out, 0, 0, 2, ' ', 0)
+	rows := []struct {
+		name  string
+		count int64
+	}{
+		{"listing pages", stats.ListingPages.Load()},
+		{"discovered product URLs", stats.ProductURLs.Load()},
+		{"scraped", stats.Completed.Load()},
+		{"new", stats.NewProducts.Load()},
+		{"updated", stats.ChangedProducts.Load()},
+		{"skipped unchanged", stats.UnchangedProducts.Load()},
+		{"failed", stats.Failed.Load()},
+		{"gone", stats.Dead.Load()},
+	}
+	for _, row := range rows {
+		fmt.Fprintf(w, "  %s\t%d\n", row.name, row.count)
+	}
+	failures := stats.failureCounts()
+	if len(failures) > 0 {
+		fmt.Fprintf(w, "  by reason\n")
+	}
+	classes := make([]string, 0, len(failures))
+	for class := range failures {
+		classes = append(classes, class)
+	}
+	slices.Sort(classes)
+	for _, class := range classes {
+		fmt.Fprintf(w, "    %s\t%d\n", strings.ReplaceAll(class, "_", " "), failures[class])
+	}
+	w.Flush()
+
+	timings := stats.timingPercentiles()
+	if len(timings) == 0 {
+		return
+	}
+	fmt.Fprintf(p.out, "\ntime per product page section, slowest first\n")
+	w = tabwriter.NewWriter(p.out, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "  section\tp50\tp95\tshare\n")
+	for _, t := range timings {
+		fmt.Fprintf(w, "  %s\t%dms\t%dms\t%.0f%%\n", strings.ReplaceAll(t.Section, "_", " "), t.P50, t.P95, t.Share*100)
+	}
+	w.Flush()
+}
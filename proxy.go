@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"math/rand"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/tebeka/selenium"
+	"github.com/tebeka/selenium/chrome"
+	"github.com/tebeka/selenium/firefox"
+)
+
+// proxyPool hands out proxies round-robin.
+type proxyPool struct {
+	proxies []string
+	next    atomic.Uint64
+}
+
+// loadProxies returns the proxies configured with -proxy or -proxy-file, or
+// nil when sessions connect directly.
+func loadProxies(cfg *Config) (*proxyPool, error) {
+	if cfg.Proxy != "" {
+		return &proxyPool{proxies: []string{cfg.Proxy}}, nil
+	}
+	if cfg.ProxyFile == "" {
+		return nil, nil
+	}
+
+	proxies, err := readListFile(cfg.ProxyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read proxy file: %v", err)
+	}
+	if len(proxies) == 0 {
+		return nil, fmt.Errorf("proxy file %s lists no proxies", cfg.ProxyFile)
+	}
+	return &proxyPool{proxies: proxies}, nil
+}
+
+// loadUserAgents returns the user agents configured with -user-agent or
+// -user-agent-file, or nil to keep the browser's own.
+func loadUserAgents(cfg *Config) ([]string, error) {
+	if cfg.UserAgent != "" {
+		return []string{cfg.UserAgent}, nil
+	}
+	if cfg.UserAgentFile == "" {
+		return nil, nil
+	}
+	userAgents, err := readListFile(cfg.UserAgentFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read user agent file: %v", err)
+	}
+	if len(userAgents) == 0 {
+		return nil, fmt.Errorf("user agent file %s lists no user agents", cfg.UserAgentFile)
+	}
+	return userAgents, nil
+}
+
+// readListFile returns the non-empty lines of a file, skipping # comments.
+func readListFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readList(f)
+}
+
+// readList returns the non-empty lines read from r, skipping # comments.
+func readList(r io.Reader) ([]string, error) {
+	var lines []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines, scanner.Err()
+}
+
+// take returns the next proxy in turn.
+func (p *proxyPool) take() string {
+	i := p.next.Add(1) - 1
+	return p.proxies[i%uint64(len(p.proxies))]
+}
+
+// sessionFactory opens the browser sessions of the workers, each through the
+// next proxy of the pool when proxies are configured and with a user agent
+// picked at random when user agents are configured. Workers borrow them from
+// its sessionPool, see checkout, which close quits once the command is done.
+type sessionFactory struct {
+	cfg         *Config
+	ctx         context.Context // of the phase, with pace
+	pace        *throttle       // nil outside of a phase, see paced
+	caps        selenium.Capabilities
+	liteProfile bool // see lite
+	proxies     *proxyPool
+	userAgents  []string
+	pool        *sessionPool
+	jar         *cookieJar // nil when cookies are not kept
+	// connect starts a session with caps, newWebDriver outside of tests.
+	connect func(caps selenium.Capabilities) (selenium.WebDriver, error)
+}
+
+// newSessionFactory returns the session factory of cfg, counting the sessions
+// of its pool into stats, nil for none.
+func newSessionFactory(cfg *Config, stats *crawlStats) (*sessionFactory, error) {
+	proxies, err := loadProxies(cfg)
+	if err != nil {
+		return nil, err
+	}
+	userAgents, err := loadUserAgents(cfg)
+	if err != nil {
+		return nil, err
+	}
+	jar, err := openCookieJar(cfg)
+	if err != nil {
+		return nil, err
+	}
+	connect := func(caps selenium.Capabilities) (selenium.WebDriver, error) {
+		return newWebDriver(cfg, caps)
+	}
+	return &sessionFactory{cfg: cfg, caps: browserCapabilities(cfg), proxies: proxies, userAgents: userAgents, pool: newSessionPool(cfg, stats), jar: jar, connect: connect}, nil
+}
+
+// open starts a browser session and returns it with the proxy it goes
+// through, "" for none, and the cookies of the jar restored. A proxy that
+// no session can be opened through or that cannot load the shop's home page
+// is skipped in favour of the next one, until every proxy was tried once.
+func (f *sessionFactory) open() (selenium.WebDriver, string, error) {
+	wd, proxy, err := f.openSession()
+	if err == nil && f.jar != nil {
+		f.jar.restore(wd, f.cfg.Browser, proxy)
+	}
+	return wd, proxy, err
+}
+
+func (f *sessionFactory) openSession() (selenium.WebDriver, string, error) {
+	caps := f.caps
+	if userAgent := f.userAgent(); userAgent != "" {
+		slog.Debug("Opening browser session", "user_agent", userAgent)
+		caps = withUserAgent(caps, userAgent)
+	}
+	if f.proxies == nil {
+		wd, err := f.connect(caps)
+		return wd, "", err
+	}
+
+	var lastErr error
+	for range f.proxies.proxies {
+		proxy := f.proxies.take()
+		proxyCaps, err := withProxy(caps, proxy)
+		if err != nil {
+			return nil, "", err
+		}
+		wd, err := f.connect(proxyCaps)
+		if err != nil {
+			slog.Warn("Could not open a session through the proxy, trying the next one", "proxy", proxy, "err", err)
+			lastErr = err
+			continue
+		}
+		if err := f.checkProxy(wd); err != nil {
+			slog.Warn("Proxy failed its health check, trying the next one", "proxy", proxy, "err", err)
+			wd.Quit()
+			lastErr = err
+			continue
+		}
+		return wd, proxy, nil
+	}
+	return nil, "", fmt.Errorf("no working proxy among %d, last error: %v", len(f.proxies.proxies), lastErr)
+}
+
+// checkProxy loads the shop's home page in wd, a session opened through a
+// proxy. Within a phase the page load waits for the throttle of the phase
+// like any other, and a challenge page backs off every worker and is loaded
+// again once the backoff has passed.
+func (f *sessionFactory) checkProxy(wd selenium.WebDriver) error {
+	if f.pace == nil {
+		return wd.Get(siteURL + "/")
+	}
+	for f.pace.wait(f.ctx) {
+		if err := wd.Get(siteURL + "/"); err != nil {
+			return err
+		}
+		if isChallengePage(wd) {
+			f.pace.challenged(siteURL + "/")
+			continue
+		}
+		f.pace.passed()
+		return nil
+	}
+	return f.ctx.Err()
+}
+
+// paced returns a copy of f whose proxy health checks wait for pace, the
+// throttle of the phase run under ctx. It shares the pool of f.
+func (f *sessionFactory) paced(ctx context.Context, pace *throttle) *sessionFactory {
+	paced := *f
+	paced.ctx, paced.pace = ctx, pace
+	return &paced
+}
+
+// lite returns a copy of f whose sessions load no images and autoplay no
+// videos, for pages that are only read for their links. It shares the pool
+// of f, which keeps the sessions of either profile apart.
+func (f *sessionFactory) lite() *sessionFactory {
+	lite := *f
+	lite.liteProfile = true
+	if isFirefox(f.caps) {
+		lite.caps = withPrefs(f.caps, map[string]any{"permissions.default.image": 2, "media.autoplay.default": 5})
+	} else {
+		lite.caps = withPrefs(withChromeArgs(f.caps, "--autoplay-policy=user-gesture-required"),
+			map[string]any{"profile.managed_default_content_settings.images": 2})
+	}
+	return &lite
+}
+
+// userAgent returns a user agent picked at random among the configured
+// ones, or "" when none are configured.
+func (f *sessionFactory) userAgent() string {
+	if len(f.userAgents) == 0 {
+		return ""
+	}
+	return f.userAgents[rand.Intn(len(f.userAgents))]
+}
+
+// withChromeArgs returns a copy of caps that starts Chrome with the extra
+// command line args.
+func withChromeArgs(caps selenium.Capabilities, args ...string) selenium.Capabilities {
+	extended := make(selenium.Capabilities, len(caps))
+	for k, v := range caps {
+		if chromeCaps, ok := v.(chrome.Capabilities); ok {
+			chromeCaps.Args = append(append([]string(nil), chromeCaps.Args...), args...)
+			v = chromeCaps
+		}
+		extended[k] = v
+	}
+	return extended
+}
+
+// withPrefs returns a copy of caps that starts Chrome or Firefox with the
+// extra profile preferences.
+func withPrefs(caps selenium.Capabilities, prefs map[string]any) selenium.Capabilities {
+	merge := func(base map[string]interface{}) map[string]interface{} {
+		merged := make(map[string]interface{}, len(base)+len(prefs))
+		maps.Copy(merged, base)
+		maps.Copy(merged, prefs)
+		return merged
+	}
+	extended := make(selenium.Capabilities, len(caps))
+	for k, v := range caps {
+		switch browserCaps := v.(type) {
+		case chrome.Capabilities:
+			browserCaps.Prefs = merge(browserCaps.Prefs)
+			v = browserCaps
+		case firefox.Capabilities:
+			browserCaps.Prefs = merge(browserCaps.Prefs)
+			v = browserCaps
+		}
+		extended[k] = v
+	}
+	return extended
+}
+
+// isFirefox reports whether caps start Firefox rather than Chrome.
+func isFirefox(caps selenium.Capabilities) bool {
+	return caps["browserName"] == browserFirefox
+}
+
+// withUserAgent returns a copy of caps whose browser sends userAgent.
+func withUserAgent(caps selenium.Capabilities, userAgent string) selenium.Capabilities {
+	if isFirefox(caps) {
+		return withPrefs(caps, map[string]any{"general.useragent.override": userAgent})
+	}
+	return withChromeArgs(caps, "--user-agent="+userAgent)
+}
+
+// withProxy returns a copy of caps whose browser connects through proxy,
+// host:port or a URL such as socks5://host:port. Chrome takes it as is,
+// Firefox as profile preferences.
+func withProxy(caps selenium.Capabilities, proxy string) (selenium.Capabilities, error) {
+	if !isFirefox(caps) {
+		return withChromeArgs(caps, "--proxy-server="+proxy), nil
+	}
+	raw := proxy
+	if !strings.Contains(raw, "://") {
+		raw = "http://" + raw
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy %q: %v", proxy, err)
+	}
+	host, portText, err := net.SplitHostPort(u.Host)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy %q: %v", proxy, err)
+	}
+	port, err := strconv.Atoi(portText)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy port in %q", proxy)
+	}
+	prefs := map[string]any{"network.proxy.type": 1}
+	switch u.Scheme {
+	case "socks4", "socks5":
+		prefs["network.proxy.socks"] = host
+		prefs["network.proxy.socks_port"] = port
+		prefs["network.proxy.socks_version"] = int(u.Scheme[5] - '0')
+		prefs["network.proxy.socks_remote_dns"] = true
+	case "http", "https":
+		prefs["network.proxy.http"] = host
+		prefs["network.proxy.http_port"] = port
+		prefs["network.proxy.ssl"] = host
+		prefs["network.proxy.ssl_port"] = port
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme in %q", proxy)
+	}
+	return withPrefs(caps, prefs), nil
+}
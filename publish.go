@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	neturl "net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+const (
+	// publishBuffer is the number of messages held while the broker is slow.
+	// Further messages are dropped rather than holding up the workers.
+	publishBuffer = 1000
+	// publishBatchSize is the number of messages sent to the broker at once.
+	publishBatchSize = 100
+)
+
+// publishMessage is a message for the message bus.
+type publishMessage struct {
+	Key   string
+	Type  string // product or event
+	Value []byte
+}
+
+// Publisher sends messages to a message bus. Kafka is the only one so far;
+// another bus only needs its scheme in newPublisher.
+type Publisher interface {
+	publish(ctx context.Context, msgs []publishMessage) error
+	close() error
+}
+
+// newPublisher returns the Publisher for a -publish URL.
+func newPublisher(rawURL string) (Publisher, error) {
+	u, err := neturl.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid publish URL %q: %v", rawURL, err)
+	}
+	switch u.Scheme {
+	case "kafka":
+		topic := strings.Trim(u.Path, "/")
+		if u.Host == "" || topic == "" {
+			return nil, fmt.Errorf("publish URL %q must name brokers and a topic, as in kafka://broker:9092/topic", rawURL)
+		}
+		return newKafkaPublisher(strings.Split(u.Host, ","), topic), nil
+	}
+	return nil, fmt.Errorf("unsupported publish URL %q, expected kafka://broker/topic", rawURL)
+}
+
+// kafkaPublisher publishes to one Kafka topic. Messages are partitioned by
+// key, so all messages about one product keep their order.
+type kafkaPublisher struct {
+	writer *kafka.Writer
+}
+
+func newKafkaPublisher(brokers []string, topic string) *kafkaPublisher {
+	return &kafkaPublisher{writer: &kafka.Writer{
+		Addr:         kafka.TCP(brokers...),
+		Topic:        topic,
+		Balancer:     &kafka.Hash{},
+		BatchTimeout: 50 * time.Millisecond,
+		RequiredAcks: kafka.RequireAll,
+	}}
+}
+
+func (p *kafkaPublisher) publish(ctx context.Context, msgs []publishMessage) error {
+	kafkaMsgs := make([]kafka.Message, len(msgs))
+	for i, msg := range msgs {
+		kafkaMsgs[i] = kafka.Message{
+			Key:     []byte(msg.Key),
+			Value:   msg.Value,
+			Headers: []kafka.Header{{Key: "type", Value: []byte(msg.Type)}},
+		}
+	}
+	return p.writer.WriteMessages(ctx, kafkaMsgs...)
+}
+
+func (p *kafkaPublisher) close() error {
+	return p.writer.Close()
+}
+
+// runEvent is a lifecycle event of a run: its start and end, and every
+// product URL that failed.
+type runEvent struct {
+	Type  string           `json:"type"` // run_started, run_finished or url_failed
+	Time  time.Time        `json:"time"`
+	RunID string           `json:"run_id,omitempty"`
+	Phase string           `json:"phase,omitempty"` // crawl, discover or scrape
+	URL   string           `json:"url,omitempty"`
+	Error string           `json:"error,omitempty"`
+	Stats map[string]int64 `json:"stats,omitempty"`
+
+	DurationSeconds float64 `json:"duration_seconds,omitempty"`
+}
+
+// Types of runEvent.
+const (
+	eventRunStarted  = "run_started"
+	eventRunFinished = "run_finished"
+	eventURLFailed   = "url_failed"
+)
+
+// eventSink is implemented by sinks that also want the lifecycle events of
+// a run.
+type eventSink interface {
+	event(ctx context.Context, e runEvent)
+}
+
+// emitEvent hands e to every sink that takes events.
+func emitEvent(ctx context.Context, sinks []productSink, e runEvent) {
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	for _, sink := range sinks {
+		if events, ok := sink.(eventSink); ok {
+			events.event(ctx, e)
+		}
+	}
+}
+
+// busPublisher is the product sink that publishes every product, keyed by
+// product number, and every lifecycle event to a message bus. Messages are
+// sent by a background worker from a bounded buffer.
+type busPublisher struct {
+	cfg       *Config
+	publisher Publisher
+	queue     chan publishMessage
+	done      chan struct{}
+	// flushCtx is cancelled when close gives up waiting for the broker.
+	flushCtx    context.Context
+	cancelFlush context.CancelFunc
+
+	published atomic.Int64
+	dropped   atomic.Int64
+	failed    atomic.Int64
+}
+
+func newBusPublisher(cfg *Config) (*busPublisher, error) {
+	publisher, err := newPublisher(cfg.Publish)
+	if err != nil {
+		return nil, err
+	}
+	flushCtx, cancelFlush := context.WithCancel(context.Background())
+	p := &busPublisher{
+		cfg:         cfg,
+		publisher:   publisher,
+		queue:       make(chan publishMessage, publishBuffer),
+		done:        make(chan struct{}),
+		flushCtx:    flushCtx,
+		cancelFlush: cancelFlush,
+	}
+	go p.run()
+	return p, nil
+}
+
+func (p *busPublisher) enqueue(ctx context.Context, product *Product) {
+	value, err := json.Marshal(product)
+	if err != nil {
+		slog.Error("Failed to encode product for publishing", "product_number", product.ProductNumber, "err", err)
+		return
+	}
+	p.add(publishMessage{Key: product.ProductNumber, Type: "product", Value: value})
+}
+
+func (p *busPublisher) event(ctx context.Context, e runEvent) {
+	value, err := json.Marshal(e)
+	if err != nil {
+		slog.Error("Failed to encode event for publishing", "event", e.Type, "err", err)
+		return
+	}
+	key := e.URL
+	if key == "" {
+		key = e.Type
+	}
+	p.add(publishMessage{Key: key, Type: "event", Value: value})
+}
+
+// add queues msg, dropping it when the buffer is full.
+func (p *busPublisher) add(msg publishMessage) {
+	select {
+	case p.queue <- msg:
+	default:
+		if p.dropped.Add(1) == 1 {
+			slog.Warn("Publish buffer full, dropping messages until the broker catches up")
+		}
+	}
+}
+
+// run sends the queued messages in batches until the queue is closed and
+// drained, or close gives up.
+func (p *busPublisher) run() {
+	defer close(p.done)
+	for {
+		msg, ok := <-p.queue
+		if !ok {
+			return
+		}
+		batch := []publishMessage{msg}
+	fill:
+		for len(batch) < publishBatchSize {
+			select {
+			case msg, ok := <-p.queue:
+				if !ok {
+					break fill
+				}
+				batch = append(batch, msg)
+			default:
+				break fill
+			}
+		}
+
+		if err := p.publisher.publish(p.flushCtx, batch); err != nil {
+			slog.Error("Failed to publish messages", "messages", len(batch), "err", err)
+			p.failed.Add(int64(len(batch)))
+			continue
+		}
+		p.published.Add(int64(len(batch)))
+	}
+}
+
+// close waits up to cfg.PublishFlushTimeout for the queued messages to be
+// sent and reports the messages that were not.
+func (p *busPublisher) close() {
+	close(p.queue)
+	timer := time.NewTimer(p.cfg.PublishFlushTimeout)
+	select {
+	case <-p.done:
+		timer.Stop()
+	case <-timer.C:
+		slog.Warn("Gave up flushing published messages", "after", p.cfg.PublishFlushTimeout)
+		p.cancelFlush()
+		<-p.done
+	}
+	p.cancelFlush()
+	if err := p.publisher.close(); err != nil {
+		slog.Error("Failed to close publisher", "err", err)
+	}
+
+	unsent := p.failed.Load() + p.dropped.Load() + int64(len(p.queue))
+	if unsent > 0 {
+		slog.Warn("Some messages were not published", "published", p.published.Load(), "unsent", unsent, "dropped", p.dropped.Load())
+		return
+	}
+	slog.Info("Published messages", "published", p.published.Load())
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"strings"
+	"time"
+	"unicode"
+)
+
+// PurchaseInfo is the notes of the purchase panel of a product page, as
+// shown: the delivery estimate, the return policy and the shipping fee or
+// free shipping threshold.
+type PurchaseInfo struct {
+	DeliveryNote string `json:"delivery_note,omitempty" bson:"delivery_note,omitempty"`
+	ReturnPolicy string `json:"return_policy,omitempty" bson:"return_policy,omitempty"`
+	ShippingNote string `json:"shipping_note,omitempty" bson:"shipping_note,omitempty"`
+}
+
+// Selectors of the notes of the purchase panel next to the add-to-cart
+// button. The delivery estimate only renders once the delivery accordion of
+// the panel is opened.
+const (
+	purchasePanelSelector   = ".purchaseInformation, .test-purchaseInformation"
+	deliveryToggleSelector  = ".deliveryInformation .accordionTitle, .test-deliveryInformation-toggle"
+	deliveryNoteSelector    = ".deliveryInformation .deliveryDate, .test-deliveryDate"
+	returnPolicySelector    = ".returnPolicy, .test-returnPolicy"
+	shippingNoteSelector    = ".shippingFee, .freeShippingMessage, .test-shippingFee"
+	deliveryNoteWaitTimeout = 5 * time.Second
+)
+
+// extractPurchaseInfo reads the delivery, return and shipping notes of the
+// purchase panel of the page loaded by ex, opening the delivery accordion
+// first in a browser session. It returns nil for a page without the panel or
+// without any of the notes, such as that of a gift card.
+func extractPurchaseInfo(cfg *Config, ex Extractor) (*PurchaseInfo, error) {
+	panel, err := firstElement(ex.dom(), purchasePanelSelector)
+	if panel == nil {
+		return nil, err
+	}
+	if wd := ex.browser(); wd != nil {
+		if toggle, _ := firstElement(panel, deliveryToggleSelector); toggle != nil {
+			if elem, ok := webElement(toggle); ok && elem.Click() == nil {
+				// An estimate that does not show up is left empty.
+				_ = waitForElement(wd, deliveryNoteSelector, min(cfg.WaitTimeout, deliveryNoteWaitTimeout))
+			}
+		}
+	}
+
+	var info PurchaseInfo
+	for selector, note := range map[string]*string{
+		deliveryNoteSelector: &info.DeliveryNote,
+		returnPolicySelector: &info.ReturnPolicy,
+		shippingNoteSelector: &info.ShippingNote,
+	} {
+		elem, err := firstElement(panel, selector)
+		if err != nil {
+			return nil, err
+		}
+		if elem == nil {
+			continue
+		}
+		text, err := elem.text()
+		if err != nil {
+			return nil, err
+		}
+		*note = cleanNoteText(text)
+	}
+	if info == (PurchaseInfo{}) {
+		return nil, nil
+	}
+	return &info, nil
+}
+
+// cleanNoteText returns the text of a note without the icons drawn with
+// symbol and private use characters, one line per line of the note with its
+// white space collapsed.
+func cleanNoteText(text string) string {
+	text = strings.Map(func(r rune) rune {
+		if unicode.Is(unicode.So, r) || unicode.Is(unicode.Co, r) || r == '\uFE0F' {
+			return -1
+		}
+		return r
+	}, text)
+	var lines []string
+	for _, line := range strings.Split(text, "\n") {
+		if line = strings.Join(strings.Fields(line), " "); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// reportFields are the fields whose fill rate the report gives, those of
+// completenessFields followed by the sections a product page may lack.
+var reportFields = append(append([]string{}, completenessFields...), "reviews", "coordinated")
+
+// reportPriceBands are the lower bounds in yen of the bands of the price
+// distribution; the last band is open.
+var reportPriceBands = []int{1, 5000, 10000, 20000, 50000}
+
+// reportLimit is the number of products listed as duplicates and as the
+// least complete.
+const reportLimit = 20
+
+// productReport is the data-quality report of the products collection.
+type productReport struct {
+	RunID       string             `json:"run_id,omitempty"`
+	Category    string             `json:"category,omitempty"`
+	Products    int64              `json:"products"`
+	FillRates   []reportFillRate   `json:"fill_rates"`
+	Prices      reportPrices       `json:"prices"`
+	Duplicates  reportDuplicates   `json:"duplicates"`
+	Stale       *reportStale       `json:"stale,omitempty"` // nil before the first run that scraped
+	MostMissing []reportIncomplete `json:"most_missing"`
+}
+
+type reportFillRate struct {
+	Field    string  `json:"field"`
+	Products int64   `json:"products"`
+	Rate     float64 `json:"rate"` // 0 to 1
+}
+
+type reportPrices struct {
+	Priced int64             `json:"priced"` // products with a price
+	Min    int64             `json:"min_jpy"`
+	Max    int64             `json:"max_jpy"`
+	Mean   float64           `json:"mean_jpy"`
+	StdDev float64           `json:"std_dev_jpy"`
+	OnSale int64             `json:"on_sale"`
+	Bands  []reportPriceBand `json:"bands"`
+}
+
+type reportPriceBand struct {
+	From     int   `json:"from_jpy"`
+	To       int   `json:"to_jpy,omitempty"` // exclusive, 0 for the open band
+	Products int64 `json:"products"`
+}
+
+type reportDuplicates struct {
+	ProductNumbers int64             `json:"product_numbers"` // stored more than once
+	Top            []reportDuplicate `json:"top"`
+}
+
+type reportDuplicate struct {
+	ProductNumber string `json:"product_number" bson:"_id"`
+	Documents     int64  `json:"documents" bson:"n"`
+}
+
+// reportStale counts the products the last run that scraped did not see.
+type reportStale struct {
+	RunID     string    `json:"run_id"`
+	StartedAt time.Time `json:"started_at"`
+	Products  int64     `json:"products"`
+}
+
+type reportIncomplete struct {
+	ProductNumber string   `json:"product_number" bson:"product_number"`
+	URL           string   `json:"url" bson:"producturl"`
+	Missing       []string `json:"missing" bson:"missing"`
+}
+
+// productFieldExprs are the aggregation expressions of productFieldChecks,
+// true when a product document has the field.
+var productFieldExprs = map[string]bson.M{
+	"product_number": nonEmptyString("product_number"),
+	"title":          nonEmptyString("title"),
+	"category":       nonEmptyString("category"),
+	"breadcrumbs":    nonEmptyArray("$breadcrumbs"),
+	"price":          nonEmptyString("price_text"),
+	"images": nonEmptyArray(bson.M{"$filter": bson.M{
+		"input": bson.M{"$ifNull": bson.A{"$media", bson.A{}}},
+		"cond":  bson.M{"$eq": bson.A{"$$this.type", "image"}},
+	}}),
+	"colors":         nonEmptyArray("$availablecolors"),
+	"sizes":          nonEmptyArray("$size_options"),
+	"availability":   nonEmptyString("availability"),
+	"description":    nonEmptyString("description"),
+	"specifications": nonEmptyArray("$specifications"),
+	"size_chart":     nonEmptyArray("$size_charts"),
+	"reviews": {"$or": bson.A{
+		bson.M{"$gt": bson.A{bson.M{"$ifNull": bson.A{"$reviewsummary.numberofreviews", 0}}, 0}},
+		nonEmptyArray("$reviews"),
+	}},
+	"coordinated": nonEmptyArray("$coordinatedproducts"),
+}
+
+func nonEmptyString(field string) bson.M {
+	return bson.M{"$gt": bson.A{bson.M{"$ifNull": bson.A{"$" + field, ""}}, ""}}
+}
+
+func nonEmptyArray(array any) bson.M {
+	return bson.M{"$gt": bson.A{bson.M{"$size": bson.M{"$ifNull": bson.A{array, bson.A{}}}}, 0}}
+}
+
+// buildProductReport aggregates the report over the products matching
+// filter in one pipeline, so that the products are never loaded.
+func buildProductReport(ctx context.Context, s *mongoStorage, filter bson.M) (*productReport, error) {
+	report := &productReport{}
+
+	last, err := s.lastScrapeRun(ctx, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	var stale *reportStale
+	if last != nil {
+		stale = &reportStale{RunID: last.ID, StartedAt: last.StartedAt}
+	}
+
+	fills := bson.M{"_id": nil}
+	for _, name := range reportFields {
+		fills[name] = bson.M{"$sum": bson.M{"$cond": bson.A{productFieldExprs[name], 1, 0}}}
+	}
+	missing := bson.A{}
+	for _, name := range completenessFields {
+		missing = append(missing, bson.M{"$cond": bson.A{productFieldExprs[name], nil, name}})
+	}
+	priced := bson.D{{Key: "$match", Value: bson.M{"price_jpy": bson.M{"$gt": 0}}}}
+	duplicates := bson.D{{Key: "$group", Value: bson.M{"_id": "$product_number", "n": bson.M{"$sum": 1}}}}
+	facets := bson.M{
+		"total": bson.A{bson.D{{Key: "$count", Value: "n"}}},
+		"fills": bson.A{bson.D{{Key: "$group", Value: fills}}},
+		"prices": bson.A{priced, bson.D{{Key: "$group", Value: bson.M{
+			"_id":     nil,
+			"n":       bson.M{"$sum": 1},
+			"min":     bson.M{"$min": "$price_jpy"},
+			"max":     bson.M{"$max": "$price_jpy"},
+			"mean":    bson.M{"$avg": "$price_jpy"},
+			"std_dev": bson.M{"$stdDevPop": "$price_jpy"},
+			"on_sale": bson.M{"$sum": bson.M{"$cond": bson.A{"$on_sale", 1, 0}}},
+		}}}},
+		"bands": bson.A{priced, bson.D{{Key: "$bucket", Value: bson.M{
+			"groupBy":    "$price_jpy",
+			"boundaries": append(slices.Clone(reportPriceBands), math.MaxInt32),
+			"output":     bson.M{"n": bson.M{"$sum": 1}},
+		}}}},
+		"duplicate_count": bson.A{duplicates,
+			bson.D{{Key: "$match", Value: bson.M{"n": bson.M{"$gt": 1}}}},
+			bson.D{{Key: "$count", Value: "n"}},
+		},
+		"duplicates": bson.A{duplicates,
+			bson.D{{Key: "$match", Value: bson.M{"n": bson.M{"$gt": 1}}}},
+			bson.D{{Key: "$sort", Value: bson.D{{Key: "n", Value: -1}, {Key: "_id", Value: 1}}}},
+			bson.D{{Key: "$limit", Value: reportLimit}},
+		},
+		"most_missing": bson.A{
+			bson.D{{Key: "$project", Value: bson.M{
+				"product_number": 1,
+				"producturl":     1,
+				"missing":        bson.M{"$filter": bson.M{"input": missing, "cond": bson.M{"$ne": bson.A{"$$this", nil}}}},
+			}}},
+			bson.D{{Key: "$addFields", Value: bson.M{"missing_count": bson.M{"$size": "$missing"}}}},
+			bson.D{{Key: "$match", Value: bson.M{"missing_count": bson.M{"$gt": 0}}}},
+			bson.D{{Key: "$sort", Value: bson.D{{Key: "missing_count", Value: -1}, {Key: "product_number", Value: 1}}}},
+			bson.D{{Key: "$limit", Value: reportLimit}},
+		},
+	}
+	if stale != nil {
+		// Products saved before last_seen_at was recorded fall back to
+		// updated_at.
+		facets["stale"] = bson.A{
+			bson.D{{Key: "$match", Value: bson.M{"$expr": bson.M{"$lt": bson.A{
+				bson.M{"$ifNull": bson.A{"$last_seen_at", "$updated_at"}}, stale.StartedAt,
+			}}}}},
+			bson.D{{Key: "$count", Value: "n"}},
+		}
+	}
+
+	cursor, err := s.products.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: filter}},
+		{{Key: "$facet", Value: facets}},
+	}, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return nil, fmt.Errorf("failed to aggregate products: %v", err)
+	}
+	var results []struct {
+		Total  []struct{ N int64 } `bson:"total"`
+		Fills  []bson.M            `bson:"fills"`
+		Prices []struct {
+			N      int64   `bson:"n"`
+			Min    int64   `bson:"min"`
+			Max    int64   `bson:"max"`
+			Mean   float64 `bson:"mean"`
+			StdDev float64 `bson:"std_dev"`
+			OnSale int64   `bson:"on_sale"`
+		} `bson:"prices"`
+		Bands []struct {
+			ID int   `bson:"_id"`
+			N  int64 `bson:"n"`
+		} `bson:"bands"`
+		DuplicateCount []struct{ N int64 } `bson:"duplicate_count"`
+		Duplicates     []reportDuplicate   `bson:"duplicates"`
+		Stale          []struct{ N int64 } `bson:"stale"`
+		MostMissing    []reportIncomplete  `bson:"most_missing"`
+	}
+	if err := cursor.All(ctx, &results); err != nil {
+		return nil, fmt.Errorf("failed to read product report: %v", err)
+	}
+	if len(results) == 0 {
+		return report, nil
+	}
+	r := results[0]
+
+	if len(r.Total) > 0 {
+		report.Products = r.Total[0].N
+	}
+	for _, name := range reportFields {
+		rate := reportFillRate{Field: name}
+		if len(r.Fills) > 0 {
+			rate.Products = bsonInt(r.Fills[0][name])
+		}
+		if report.Products > 0 {
+			rate.Rate = float64(rate.Products) / float64(report.Products)
+		}
+		report.FillRates = append(report.FillRates, rate)
+	}
+	if len(r.Prices) > 0 {
+		p := r.Prices[0]
+		report.Prices = reportPrices{Priced: p.N, Min: p.Min, Max: p.Max, Mean: p.Mean, StdDev: p.StdDev, OnSale: p.OnSale}
+	}
+	for i, from := range reportPriceBands {
+		band := reportPriceBand{From: from}
+		if i+1 < len(reportPriceBands) {
+			band.To = reportPriceBands[i+1]
+		}
+		for _, b := range r.Bands {
+			if b.ID == from {
+				band.Products = b.N
+			}
+		}
+		report.Prices.Bands = append(report.Prices.Bands, band)
+	}
+	if len(r.DuplicateCount) > 0 {
+		report.Duplicates.ProductNumbers = r.DuplicateCount[0].N
+	}
+	report.Duplicates.Top = r.Duplicates
+	if stale != nil {
+		report.Stale = stale
+		if len(r.Stale) > 0 {
+			report.Stale.Products = r.Stale[0].N
+		}
+	}
+	report.MostMissing = r.MostMissing
+	return report, nil
+}
+
+// bsonInt returns a number decoded from BSON as an int64.
+func bsonInt(v any) int64 {
+	switch n := v.(type) {
+	case int32:
+		return int64(n)
+	case int64:
+		return n
+	case float64:
+		return int64(n)
+	}
+	return 0
+}
+
+// writeReport writes report as tables.
+func writeReport(out io.Writer, report *productReport) error {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	scope := "all products"
+	if report.RunID != "" || report.Category != "" {
+		var filters []string
+		if report.RunID != "" {
+			filters = append(filters, "run "+report.RunID)
+		}
+		if report.Category != "" {
+			filters = append(filters, "categories "+report.Category)
+		}
+		scope = strings.Join(filters, ", ")
+	}
+	fmt.Fprintf(w, "products\t%d\t(%s)\n", report.Products, scope)
+	if report.Stale != nil {
+		fmt.Fprintf(w, "not seen by the last run\t%d\t(run %s, started %s)\n",
+			report.Stale.Products, report.Stale.RunID, report.Stale.StartedAt.Local().Format("2006-01-02 15:04:05"))
+	}
+	fmt.Fprintf(w, "duplicated product numbers\t%d\n", report.Duplicates.ProductNumbers)
+	w.Flush()
+
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "FIELD\tFILLED\tRATE")
+	for _, rate := range report.FillRates {
+		fmt.Fprintf(w, "%s\t%d\t%.1f%%\n", rate.Field, rate.Products, rate.Rate*100)
+	}
+	w.Flush()
+
+	p := report.Prices
+	fmt.Fprintln(w)
+	fmt.Fprintf(w, "priced\t%d\n", p.Priced)
+	if p.Priced > 0 {
+		fmt.Fprintf(w, "min / mean / max\t¥%d / ¥%.0f / ¥%d\n", p.Min, p.Mean, p.Max)
+		fmt.Fprintf(w, "standard deviation\t¥%.0f\n", p.StdDev)
+		fmt.Fprintf(w, "on sale\t%d\n", p.OnSale)
+		for _, band := range p.Bands {
+			label := fmt.Sprintf("¥%d and more", band.From)
+			if band.To > 0 {
+				label = fmt.Sprintf("¥%d to ¥%d", band.From, band.To-1)
+			}
+			fmt.Fprintf(w, "  %s\t%d\n", label, band.Products)
+		}
+	}
+	w.Flush()
+
+	if len(report.Duplicates.Top) > 0 {
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "DUPLICATED PRODUCT NUMBER\tDOCUMENTS")
+		for _, d := range report.Duplicates.Top {
+			fmt.Fprintf(w, "%s\t%d\n", d.ProductNumber, d.Documents)
+		}
+		w.Flush()
+	}
+
+	if len(report.MostMissing) > 0 {
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "PRODUCT NUMBER\tMISSING\tFIELDS\tURL")
+		for _, p := range report.MostMissing {
+			fmt.Fprintf(w, "%s\t%d\t%s\t%s\n", p.ProductNumber, len(p.Missing), strings.Join(p.Missing, ","), p.URL)
+		}
+	}
+	return w.Flush()
+}
@@ -0,0 +1,451 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tebeka/selenium"
+)
+
+const (
+	// reviewSelector matches the reviews rendered by the BazaarVoice widget.
+	reviewSelector = ".BVRRDisplayContent .BVRRDisplayContentBody .BVRRContentReview" // BVRRReviewDisplayStyle5
+	// reviewNextSelector matches the control that loads the next batch of
+	// reviews, either a "次へ" page link or a "show more" link.
+	reviewNextSelector = ".BVRRDisplayContent .BVRRNextPage a, .BVRRDisplayContent .BVRRDisplayContentLinkMore a, .BVRRDisplayContent a.BVRRDisplayContentLinkMore"
+	// reviewFrameSelector matches the iframe some widget versions render in.
+	reviewFrameSelector = "iframe[src*='bazaarvoice'], iframe[id^='BVRR'], iframe[name^='BVRR']"
+)
+
+// scrapeReviews reads the reviews of the product page, following the widget's
+// pagination until there is no next batch or maxReviews reviews have been
+// read. maxReviews 0 means no limit. Reviews re-rendered on a later batch are
+// only kept once.
+func scrapeReviews(cfg *Config, wd selenium.WebDriver, maxReviews int) ([]Review, error) {
+	if elems, err := wd.FindElements(selenium.ByCSSSelector, reviewSelector); err == nil && len(elems) == 0 {
+		if frame, err := wd.FindElement(selenium.ByCSSSelector, reviewFrameSelector); err == nil {
+			if err := wd.SwitchFrame(frame); err != nil {
+				return nil, fmt.Errorf("failed to switch to the review frame: %v", err)
+			}
+			defer wd.SwitchFrame(nil)
+		}
+	}
+
+	var reviews []Review
+	seen := make(map[string]bool)
+	for {
+		elems, err := wd.FindElements(selenium.ByCSSSelector, reviewSelector)
+		if err != nil {
+			return reviews, fmt.Errorf("failed to find reviews: %v", err)
+		}
+		firstText, added := "", 0
+		for i, elem := range elems {
+			review := readReview(elem)
+			if i == 0 {
+				firstText, _ = elem.Text()
+			}
+			key := review.ReviewId + "\x00" + review.DateText
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			added++
+			reviews = append(reviews, review)
+			if maxReviews > 0 && len(reviews) >= maxReviews {
+				return reviews, nil
+			}
+		}
+
+		// A batch without new reviews means the widget is stuck on its last page.
+		next, err := wd.FindElement(selenium.ByCSSSelector, reviewNextSelector)
+		if err != nil || added == 0 {
+			return reviews, nil
+		}
+		if err := next.Click(); err != nil {
+			return reviews, fmt.Errorf("failed to load the next reviews: %v", err)
+		}
+		if err := waitForNextReviews(wd, firstText, cfg.WaitTimeout); err != nil {
+			return reviews, err
+		}
+	}
+}
+
+// waitForNextReviews waits until the first rendered review is no longer the
+// one whose text was previousFirst, i.e. the next batch has replaced it.
+// "Show more" links append to the list instead; for those the wait ends when
+// the list has grown, which the caller notices through the seen set.
+func waitForNextReviews(wd selenium.WebDriver, previousFirst string, timeout time.Duration) error {
+	previousCount := -1
+	if elems, err := wd.FindElements(selenium.ByCSSSelector, reviewSelector); err == nil {
+		previousCount = len(elems)
+	}
+	err := wd.WaitWithTimeout(func(wd selenium.WebDriver) (bool, error) {
+		elems, err := wd.FindElements(selenium.ByCSSSelector, reviewSelector)
+		if err != nil || len(elems) == 0 {
+			return false, nil
+		}
+		if len(elems) != previousCount {
+			return true, nil
+		}
+		text, err := elems[0].Text()
+		return err == nil && text != previousFirst, nil
+	}, timeout)
+	if err != nil {
+		return fmt.Errorf("next reviews did not render within %v", timeout)
+	}
+	return nil
+}
+
+// scrapeReviewSummary reads the rating summary shown above the reviews.
+func scrapeReviewSummary(dom DOM) ReviewSummary {
+	var reviewSummary ReviewSummary
+
+	ratingElement, err := findElement(dom, ".BVRRRating.BVRRRatingNormal.BVRRRatingOverall .BVRRRatingNormalOutOf .BVRRRatingNumber")
+	if err == nil {
+		totalRating, err := ratingElement.text()
+		if err == nil {
+			convertedRating, err := strconv.ParseFloat(totalRating, 64)
+			if err == nil {
+				reviewSummary.Rating = convertedRating
+			} else {
+				reviewSummary.Rating = 0.0
+			}
+		} else {
+			reviewSummary.Rating = 0.0
+		}
+	}
+
+	// The "(NNN件)" total next to the stars.
+	numberOfReviewsElement, err := findElement(dom, ".BVRRRatingSummary .BVRRCount .BVRRNumber, .BVRRRatingOverall .BVRRCount .BVRRNumber")
+	if err == nil {
+		numberOfReviews, err := numberOfReviewsElement.text()
+		if err == nil {
+			reviewSummary.NumberOfReviews, _ = parseCount(numberOfReviews)
+		}
+	}
+
+	// The "buy again" total is the number of reviewers the recommendation rate
+	// is based on, not the number of reviews.
+	recommendedCountElement, err := findElement(dom, ".BVRRQuickTakeCustomWrapper .BVRRBuyAgainTotal")
+	if err == nil {
+		recommendedCount, err := recommendedCountElement.text()
+		if err == nil {
+			reviewSummary.RecommendedCount, _ = parseCount(recommendedCount)
+		}
+	}
+
+	recommededElement, err := findElement(dom, ".BVRRQuickTakeCustomWrapper .BVRRBuyAgainPercentage")
+	if err == nil {
+		recommeded_percentage, err := recommededElement.text()
+		if err == nil {
+			reviewSummary.RecommendedRateText = strings.TrimSpace(recommeded_percentage)
+			reviewSummary.RecommendedRate, _ = parsePercent(recommeded_percentage)
+		}
+	}
+
+	reviewSummary.RatingHistogram = make(map[int]int)
+	histogramRows, err := dom.findElements(".BVRRHistogramContent .BVRRHistogramBarRow")
+	if err == nil {
+		for _, row := range histogramRows {
+			stars, count := 0, 0
+			if labelElement, err := findElement(row, ".BVRRHistStarLabelText, .BVRRHistStarLabel"); err == nil {
+				label, _ := labelElement.text()
+				stars, _ = parseCount(label)
+			}
+			if countElement, err := findElement(row, ".BVRRHistAbsLabel"); err == nil {
+				text, _ := countElement.text()
+				count, _ = parseCount(text)
+			}
+			if stars >= 1 && stars <= 5 {
+				reviewSummary.RatingHistogram[stars] = count
+			}
+		}
+	}
+
+	ratingEntries, err := dom.findElements(".BVRRSecondaryRatingsContainer .BVRRRatingEntry")
+	if err == nil {
+		for _, entry := range ratingEntries {
+			labelElement, err := findElement(entry, ".BVRRRatingHeader, .BVRRLabel")
+			if err != nil {
+				continue
+			}
+			label, _ := labelElement.text()
+			imgElement, err := findElement(entry, ".BVRRRatingRadioImage img")
+			if err != nil {
+				continue
+			}
+			text, err := imgElement.attr("title")
+			if err == nil {
+				setSecondaryRating(&reviewSummary, label, text)
+			}
+		}
+	}
+
+	return reviewSummary
+}
+
+// reviewDateLayouts are the date formats the review widget has used. Dates
+// without a zone are Japan time.
+var reviewDateLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02",
+	"2006/01/02",
+	"2006年1月2日",
+}
+
+var jst = time.FixedZone("JST", 9*60*60)
+
+// parseReviewDate parses the date of a review in any of reviewDateLayouts.
+func parseReviewDate(text string) (time.Time, bool) {
+	text = strings.TrimSpace(text)
+	for _, layout := range reviewDateLayouts {
+		if t, err := time.ParseInLocation(layout, text, jst); err == nil {
+			return t.UTC(), true
+		}
+	}
+	return time.Time{}, false
+}
+
+// reviewSubmittedAt returns the parsed date of a review, or nil with a
+// warning when the date is in a format not seen before.
+func reviewSubmittedAt(text string) *time.Time {
+	t, ok := parseReviewDate(text)
+	if !ok {
+		slog.Warn("Unrecognised review date", "date", text)
+		return nil
+	}
+	return &t
+}
+
+// secondaryRatingFields maps the label, or the API id, of a secondary rating
+// to the named ReviewSummary field it is also stored in.
+var secondaryRatingFields = []struct {
+	keys  []string
+	field func(s *ReviewSummary) *string
+}{
+	{[]string{"サイズ感", "fit"}, func(s *ReviewSummary) *string { return &s.Fit }},
+	{[]string{"丈", "長さ", "length"}, func(s *ReviewSummary) *string { return &s.Length }},
+	{[]string{"品質", "quality"}, func(s *ReviewSummary) *string { return &s.Quality }},
+	{[]string{"心地", "快適", "comfort"}, func(s *ReviewSummary) *string { return &s.Comfort }},
+}
+
+// setSecondaryRating records a secondary rating such as "3.2 / 5" under its
+// label, and in the matching named field when there is one.
+func setSecondaryRating(summary *ReviewSummary, label, text string) {
+	label, text = strings.TrimSpace(label), strings.TrimSpace(text)
+	if label == "" || text == "" {
+		return
+	}
+	if summary.SecondaryRatings == nil {
+		summary.SecondaryRatings = make(map[string]string)
+		summary.SecondaryRatingValues = make(map[string]float64)
+	}
+	summary.SecondaryRatings[label] = text
+	if value, ok := parseRating(text); ok {
+		summary.SecondaryRatingValues[label] = value
+	}
+
+	setSecondaryRatingField(summary, label, text)
+}
+
+// setSecondaryRatingField stores text in the named field key maps to. It
+// reports false when key matches none.
+func setSecondaryRatingField(summary *ReviewSummary, key, text string) bool {
+	key = strings.ToLower(key)
+	for _, f := range secondaryRatingFields {
+		for _, k := range f.keys {
+			if strings.Contains(key, k) {
+				*f.field(summary) = text
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// parseRating reads the score of a rating written as "3.2/5" or "3.2 / 5".
+func parseRating(text string) (float64, bool) {
+	score, _, _ := strings.Cut(text, "/")
+	n, err := strconv.ParseFloat(strings.TrimSpace(score), 64)
+	return n, err == nil
+}
+
+// histogramTotal returns the number of reviews counted in histogram.
+func histogramTotal(histogram map[int]int) int {
+	total := 0
+	for _, count := range histogram {
+		total += count
+	}
+	return total
+}
+
+// parseCount reads a count such as "1,234" or "(1,234件)", ignoring every
+// character that is not a digit.
+func parseCount(text string) (int, bool) {
+	digits := strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, text)
+	n, err := strconv.Atoi(digits)
+	return n, err == nil
+}
+
+// parsePercent reads a percentage such as "85%" or "85.5 %" as a number
+// between 0 and 100.
+func parsePercent(text string) (float64, bool) {
+	text = strings.TrimSpace(strings.TrimRight(strings.TrimSpace(text), "%％"))
+	n, err := strconv.ParseFloat(text, 64)
+	if err != nil || n < 0 || n > 100 {
+		return 0, false
+	}
+	return n, true
+}
+
+// readReview reads one review of the BazaarVoice widget. Parts that are
+// missing are left empty.
+func readReview(review selenium.WebElement) Review {
+	var reviewInfo Review
+
+	// Get Rating Value
+	ratingValueElement, err := review.FindElement(selenium.ByCSSSelector, ".BVRRReviewDisplayStyle5Header .BVRRRatingNormalImage img")
+	if err == nil {
+		ratingValueText, err := ratingValueElement.GetAttribute("title")
+		ratingText := strings.Split(ratingValueText, "/")
+		if err == nil && len(ratingText) > 1 {
+			convertedRating, err := strconv.ParseFloat(strings.Trim(ratingText[1], " "), 64)
+			if err == nil {
+				reviewInfo.Rating = convertedRating
+			}
+		}
+	}
+
+	// Get Review Date
+	reviewDateElement, err := review.FindElement(selenium.ByCSSSelector, ".BVRRReviewDateContainer meta")
+	if err == nil {
+		reviewDateText, err := reviewDateElement.GetAttribute("content")
+		if err == nil && reviewDateText != "" {
+			reviewInfo.DateText = reviewDateText
+			reviewInfo.SubmittedAt = reviewSubmittedAt(reviewDateText)
+		}
+	}
+
+	// Get Review Title
+	titleText, err := review.FindElement(selenium.ByCSSSelector, ".BVRRReviewTitleContainer .BVRRReviewTitle")
+	if err == nil {
+		reviewTitle, err := titleText.Text()
+		if err == nil && reviewTitle != "" {
+			reviewInfo.Title = reviewTitle
+		}
+	}
+
+	// Get Review Comment
+	reviewComment, err := review.FindElement(selenium.ByCSSSelector, ".BVRRReviewTextContainer .BVRRReviewText")
+	if err == nil {
+		commentText, err := reviewComment.Text()
+		if err == nil && commentText != "" {
+			reviewInfo.Description = commentText
+		}
+	}
+
+	// Get Review Author
+	reviewId, err := review.FindElement(selenium.ByCSSSelector, ".BVRRUserNicknameContainer .BVRRUserNickname .BVRRNickname")
+	if err == nil {
+		authorText, err := reviewId.Text()
+		if err == nil && authorText != "" {
+			reviewInfo.ReviewId = authorText
+		}
+	}
+
+	// Reviewer attributes, each a label and a value
+	contextElements, err := review.FindElements(selenium.ByCSSSelector, ".BVRRContextDataValueContainer")
+	if err == nil {
+		for _, contextElement := range contextElements {
+			label, value := "", ""
+			if labelElement, err := contextElement.FindElement(selenium.ByCSSSelector, ".BVRRLabel"); err == nil {
+				label, _ = labelElement.Text()
+			}
+			if valueElement, err := contextElement.FindElement(selenium.ByCSSSelector, ".BVRRValue"); err == nil {
+				value, _ = valueElement.Text()
+			}
+			class, _ := contextElement.GetAttribute("class")
+			if !setReviewerAttribute(&reviewInfo, label, value) {
+				setReviewerAttribute(&reviewInfo, class, value)
+			}
+		}
+	}
+
+	if locationElement, err := review.FindElement(selenium.ByCSSSelector, ".BVRRUserLocation"); err == nil {
+		location, _ := locationElement.Text()
+		reviewInfo.Location = strings.TrimSpace(location)
+	}
+
+	// Get Helpful Votes
+	if yesElement, err := review.FindElement(selenium.ByCSSSelector, ".BVDI_FVVotesYes .BVDINumber"); err == nil {
+		yes, _ := yesElement.Text()
+		reviewInfo.HelpfulCount, _ = parseCount(yes)
+	}
+	if noElement, err := review.FindElement(selenium.ByCSSSelector, ".BVDI_FVVotesNo .BVDINumber"); err == nil {
+		no, _ := noElement.Text()
+		reviewInfo.UnhelpfulCount, _ = parseCount(no)
+	}
+
+	// Get Reviewer Photos
+	photoElements, err := review.FindElements(selenium.ByCSSSelector, ".BVRRReviewPhotoList img, .BVRRPhotoThumbnail img")
+	if err == nil {
+		for _, photoElement := range photoElements {
+			if len(reviewInfo.Photos) >= maxReviewPhotos {
+				break
+			}
+			src, _ := photoElement.GetAttribute("src")
+			if photo := resolveURL(siteURL, src); photo != "" {
+				reviewInfo.Photos = append(reviewInfo.Photos, photo)
+			}
+		}
+	}
+
+	return reviewInfo
+}
+
+// maxReviewPhotos is the number of reviewer photos kept per review.
+const maxReviewPhotos = 5
+
+// reviewerAttributes maps the label, or the BazaarVoice context data id, of a
+// reviewer attribute to the Review field it is stored in. Labels are matched
+// by substring, so "購入したサイズ" and "BVRRContextDataValuePurchasedSize" both
+// find PurchasedSize; more specific keys come first.
+var reviewerAttributes = []struct {
+	keys  []string
+	field func(r *Review) *string
+}{
+	{[]string{"普段", "usualsize"}, func(r *Review) *string { return &r.UsualSize }},
+	{[]string{"購入", "purchasedsize"}, func(r *Review) *string { return &r.PurchasedSize }},
+	{[]string{"身長", "height"}, func(r *Review) *string { return &r.Height }},
+	{[]string{"体重", "weight"}, func(r *Review) *string { return &r.Weight }},
+	{[]string{"年齢", "年代", "age"}, func(r *Review) *string { return &r.Age }},
+	{[]string{"性別", "gender"}, func(r *Review) *string { return &r.Gender }},
+	{[]string{"地域", "住まい", "location"}, func(r *Review) *string { return &r.Location }},
+}
+
+// setReviewerAttribute stores value in the Review field named by key. It
+// reports false when key names no known attribute.
+func setReviewerAttribute(review *Review, key, value string) bool {
+	key = strings.ToLower(key)
+	value = strings.TrimSpace(value)
+	for _, attr := range reviewerAttributes {
+		for _, k := range attr.keys {
+			if strings.Contains(key, k) {
+				if value != "" {
+					*attr.field(review) = value
+				}
+				return true
+			}
+		}
+	}
+	return false
+}
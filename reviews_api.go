@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	neturl "net/url"
+	"strconv"
+	"strings"
+)
+
+// bvPageSize is the largest page the BazaarVoice Conversations API returns.
+const bvPageSize = 100
+
+// bvReviewsResponse is the part of a BazaarVoice reviews.json response the
+// crawler uses.
+type bvReviewsResponse struct {
+	TotalResults int  `json:"TotalResults"`
+	HasErrors    bool `json:"HasErrors"`
+	Errors       []struct {
+		Code    string `json:"Code"`
+		Message string `json:"Message"`
+	} `json:"Errors"`
+	Results  []bvReview `json:"Results"`
+	Includes struct {
+		Products map[string]struct {
+			ReviewStatistics bvReviewStatistics `json:"ReviewStatistics"`
+		} `json:"Products"`
+	} `json:"Includes"`
+}
+
+type bvReview struct {
+	ID                         string  `json:"Id"`
+	Rating                     float64 `json:"Rating"`
+	Title                      string  `json:"Title"`
+	ReviewText                 string  `json:"ReviewText"`
+	SubmissionTime             string  `json:"SubmissionTime"`
+	UserNickname               string  `json:"UserNickname"`
+	TotalPositiveFeedbackCount int     `json:"TotalPositiveFeedbackCount"`
+	TotalNegativeFeedbackCount int     `json:"TotalNegativeFeedbackCount"`
+	UserLocation               string  `json:"UserLocation"`
+	ContextDataValues          map[string]struct {
+		ID         string `json:"Id"`
+		ValueLabel string `json:"ValueLabel"`
+	} `json:"ContextDataValues"`
+	Photos []struct {
+		Sizes map[string]struct {
+			URL string `json:"Url"`
+		} `json:"Sizes"`
+	} `json:"Photos"`
+}
+
+type bvReviewStatistics struct {
+	AverageOverallRating     float64                      `json:"AverageOverallRating"`
+	TotalReviewCount         int                          `json:"TotalReviewCount"`
+	RecommendedCount         int                          `json:"RecommendedCount"`
+	NotRecommendedCount      int                          `json:"NotRecommendedCount"`
+	RatingDistribution       []bvRatingCount              `json:"RatingDistribution"`
+	SecondaryRatingsAverages map[string]bvSecondaryRating `json:"SecondaryRatingsAverages"`
+}
+
+type bvRatingCount struct {
+	RatingValue int `json:"RatingValue"`
+	Count       int `json:"Count"`
+}
+
+type bvSecondaryRating struct {
+	AverageRating float64 `json:"AverageRating"`
+	ValueRange    int     `json:"ValueRange"`
+	Label         string  `json:"Label"`
+}
+
+// fetchAPIReviews pulls the review summary and up to cfg.MaxReviews reviews of
+// a product from the BazaarVoice API, paging through the results.
+func fetchAPIReviews(ctx context.Context, cfg *Config, productNumber string) (ReviewSummary, []Review, error) {
+	if productNumber == "" {
+		return ReviewSummary{}, nil, fmt.Errorf("no product number to look up reviews for")
+	}
+	client := &http.Client{Timeout: cfg.PageLoadTimeout}
+
+	var summary ReviewSummary
+	var reviews []Review
+	for offset := 0; ; offset += bvPageSize {
+		limit := bvPageSize
+		if cfg.MaxReviews > 0 {
+			limit = min(limit, cfg.MaxReviews-len(reviews))
+		}
+		// The first page is always requested, for the statistics.
+		limit = max(limit, 1)
+
+		page, err := fetchBVReviewsPage(ctx, client, cfg, productNumber, offset, limit)
+		if err != nil {
+			return summary, reviews, err
+		}
+		if offset == 0 {
+			summary = page.summary(productNumber)
+		}
+		for _, r := range page.Results {
+			reviews = append(reviews, r.review())
+		}
+
+		if len(page.Results) == 0 || offset+len(page.Results) >= page.TotalResults ||
+			(cfg.MaxReviews > 0 && len(reviews) >= cfg.MaxReviews) {
+			return summary, reviews, nil
+		}
+	}
+}
+
+// fetchBVReviewsPage requests one page of reviews.
+func fetchBVReviewsPage(ctx context.Context, client *http.Client, cfg *Config, productNumber string, offset, limit int) (*bvReviewsResponse, error) {
+	query := neturl.Values{}
+	query.Set("apiversion", "5.4")
+	query.Set("passkey", cfg.BVPasskey)
+	query.Set("Filter", "ProductId:"+productNumber)
+	query.Set("Include", "Products")
+	query.Set("Stats", "Reviews")
+	query.Set("Sort", "SubmissionTime:desc")
+	query.Set("Offset", strconv.Itoa(offset))
+	query.Set("Limit", strconv.Itoa(limit))
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, cfg.BVAPIURL+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("review API request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("review API returned %s", resp.Status)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read review API response: %v", err)
+	}
+	return parseBVReviewsResponse(body)
+}
+
+// parseBVReviewsResponse decodes a reviews.json response, turning the errors
+// the API reports in the body into a Go error.
+func parseBVReviewsResponse(body []byte) (*bvReviewsResponse, error) {
+	var page bvReviewsResponse
+	if err := json.Unmarshal(body, &page); err != nil {
+		return nil, fmt.Errorf("failed to decode review API response: %v", err)
+	}
+	if page.HasErrors {
+		var messages []string
+		for _, e := range page.Errors {
+			messages = append(messages, e.Code+": "+e.Message)
+		}
+		return nil, fmt.Errorf("review API error: %s", strings.Join(messages, "; "))
+	}
+	return &page, nil
+}
+
+// summary builds the ReviewSummary of productNumber from the statistics
+// included in the response.
+func (r *bvReviewsResponse) summary(productNumber string) ReviewSummary {
+	stats := r.Includes.Products[productNumber].ReviewStatistics
+	summary := ReviewSummary{
+		Rating:          stats.AverageOverallRating,
+		NumberOfReviews: stats.TotalReviewCount,
+		RatingHistogram: make(map[int]int),
+	}
+	for _, bucket := range stats.RatingDistribution {
+		summary.RatingHistogram[bucket.RatingValue] = bucket.Count
+	}
+	if voters := stats.RecommendedCount + stats.NotRecommendedCount; voters > 0 {
+		summary.RecommendedCount = voters
+		summary.RecommendedRate = math.Round(1000*float64(stats.RecommendedCount)/float64(voters)) / 10
+		summary.RecommendedRateText = fmt.Sprintf("%.0f%%", summary.RecommendedRate)
+	}
+	for id, rating := range stats.SecondaryRatingsAverages {
+		label := rating.Label
+		if label == "" {
+			label = id
+		}
+		text := fmt.Sprintf("%.1f / %d", rating.AverageRating, rating.ValueRange)
+		setSecondaryRating(&summary, label, text)
+		if !strings.EqualFold(label, id) {
+			// Also match on the id, for labels the table does not know.
+			setSecondaryRatingField(&summary, id, text)
+		}
+	}
+	return summary
+}
+
+// review converts an API review into the shape the DOM scrape produces.
+func (r bvReview) review() Review {
+	review := Review{
+		Rating:         r.Rating,
+		Title:          r.Title,
+		Description:    r.ReviewText,
+		DateText:       r.SubmissionTime,
+		SubmittedAt:    reviewSubmittedAt(r.SubmissionTime),
+		ReviewId:       r.ID,
+		Location:       r.UserLocation,
+		HelpfulCount:   r.TotalPositiveFeedbackCount,
+		UnhelpfulCount: r.TotalNegativeFeedbackCount,
+	}
+	for id, value := range r.ContextDataValues {
+		setReviewerAttribute(&review, id, value.ValueLabel)
+	}
+	for _, photo := range r.Photos {
+		if len(review.Photos) >= maxReviewPhotos {
+			break
+		}
+		size, ok := photo.Sizes["normal"]
+		if !ok {
+			size = photo.Sizes["thumbnail"]
+		}
+		if size.URL != "" {
+			review.Photos = append(review.Photos, size.URL)
+		}
+	}
+	return review
+}
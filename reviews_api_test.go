@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseBVReviewsResponse(t *testing.T) {
+	body, err := os.ReadFile("testdata/bv_reviews.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, err := parseBVReviewsResponse(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	summary := page.summary("GZ0127")
+	wantSummary := ReviewSummary{
+		Rating:              4.2,
+		NumberOfReviews:     25,
+		RecommendedCount:    20,
+		RecommendedRate:     85,
+		RecommendedRateText: "85%",
+		Fit:                 "2.6 / 5",
+		Comfort:             "4.5 / 5",
+		RatingHistogram:     map[int]int{5: 14, 4: 5, 3: 3, 2: 2, 1: 1},
+		SecondaryRatings:    map[string]string{"サイズ感": "2.6 / 5", "履き心地": "4.5 / 5"},
+		SecondaryRatingValues: map[string]float64{
+			"サイズ感": 2.6,
+			"履き心地": 4.5,
+		},
+	}
+	if !reflect.DeepEqual(summary, wantSummary) {
+		t.Errorf("summary = %+v, want %+v", summary, wantSummary)
+	}
+
+	if len(page.Results) != 2 {
+		t.Fatalf("got %d reviews, want 2", len(page.Results))
+	}
+	submitted := time.Date(2024, 3, 14, 9, 12, 45, 0, time.UTC)
+	wantReview := Review{
+		Rating:         5,
+		Title:          "履き心地最高",
+		Description:    "軽くてクッション性が高く、毎日のランニングに使っています。",
+		DateText:       "2024-03-14T09:12:45.000+00:00",
+		SubmittedAt:    &submitted,
+		ReviewId:       "318820441",
+		PurchasedSize:  "27.0cm",
+		UsualSize:      "26.5cm",
+		Age:            "35～44歳",
+		Location:       "東京都",
+		HelpfulCount:   12,
+		UnhelpfulCount: 1,
+		Photos: []string{
+			"https://photos-us.bazaarvoice.com/photo/2/cGhvdG9zZXJ2/adidasjp/p1-normal.jpg",
+			"https://photos-us.bazaarvoice.com/photo/2/cGhvdG9zZXJ2/adidasjp/p2-thumb.jpg",
+		},
+	}
+	if got := page.Results[0].review(); !reflect.DeepEqual(got, wantReview) {
+		t.Errorf("review = %+v, want %+v", got, wantReview)
+	}
+	if got := page.Results[1].review(); got.Location != "" || got.Photos != nil || got.PurchasedSize != "" {
+		t.Errorf("review without attributes = %+v", got)
+	}
+}
+
+func TestParseBVReviewsResponseError(t *testing.T) {
+	body := []byte(`{"HasErrors": true, "Errors": [{"Code": "ERROR_ACCESS_DENIED", "Message": "Invalid passkey"}], "Results": []}`)
+	if _, err := parseBVReviewsResponse(body); err == nil || err.Error() != "review API error: ERROR_ACCESS_DENIED: Invalid passkey" {
+		t.Errorf("err = %v", err)
+	}
+}
+
+func TestFetchAPIReviews(t *testing.T) {
+	body, err := os.ReadFile("testdata/bv_reviews.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if got := r.URL.Query().Get("Filter"); got != "ProductId:GZ0127" {
+			t.Errorf("Filter = %q", got)
+		}
+		w.Write(body)
+	}))
+	defer server.Close()
+
+	cfg := testConfig(t, "-bv-api-url", server.URL)
+	summary, reviews, err := fetchAPIReviews(context.Background(), cfg, "GZ0127")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requests != 1 {
+		t.Errorf("made %d requests, want 1 for a single page", requests)
+	}
+	if summary.NumberOfReviews != 25 || len(reviews) != 2 {
+		t.Errorf("got %d reviews of %d, want 2 of 25", len(reviews), summary.NumberOfReviews)
+	}
+}
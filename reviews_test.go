@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseReviewDate(t *testing.T) {
+	tests := []struct {
+		text string
+		want time.Time
+		ok   bool
+	}{
+		{"2024-03-14T09:12:45.000+00:00", time.Date(2024, 3, 14, 9, 12, 45, 0, time.UTC), true},
+		{"2024-03-14T18:12:45+09:00", time.Date(2024, 3, 14, 9, 12, 45, 0, time.UTC), true},
+		{"2024-03-14T18:12:45", time.Date(2024, 3, 14, 9, 12, 45, 0, time.UTC), true},
+		{"2024-03-14", time.Date(2024, 3, 13, 15, 0, 0, 0, time.UTC), true},
+		{"2024/03/14", time.Date(2024, 3, 13, 15, 0, 0, 0, time.UTC), true},
+		{" 2024年3月14日 ", time.Date(2024, 3, 13, 15, 0, 0, 0, time.UTC), true},
+		{"3日前", time.Time{}, false},
+		{"", time.Time{}, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseReviewDate(tt.text)
+		if ok != tt.ok || !got.Equal(tt.want) {
+			t.Errorf("parseReviewDate(%q) = %v, %v, want %v, %v", tt.text, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+// TestScrapeSecondaryRatings checks that the secondary ratings are taken by
+// their label: a widget showing only comfort and fit, in that order, leaves
+// length and quality empty.
+func TestScrapeSecondaryRatings(t *testing.T) {
+	dom := parseDOM(t, `
+<div class="BVRRSecondaryRatingsContainer">
+  <div class="BVRRRatingEntry">
+    <div class="BVRRRatingHeader">履き心地</div>
+    <div class="BVRRRatingRadioImage"><img src="/rating_4_5.gif" title="4.5 / 5"></div>
+  </div>
+  <div class="BVRRRatingEntry">
+    <div class="BVRRRatingHeader">サイズ感</div>
+    <div class="BVRRRatingRadioImage"><img src="/rating_2_6.gif" title="2.6 / 5"></div>
+  </div>
+</div>`)
+
+	summary := scrapeReviewSummary(dom)
+	if summary.Fit != "2.6 / 5" || summary.Comfort != "4.5 / 5" {
+		t.Errorf("fit, comfort = %q, %q, want 2.6 / 5, 4.5 / 5", summary.Fit, summary.Comfort)
+	}
+	if summary.Length != "" || summary.Quality != "" {
+		t.Errorf("length, quality = %q, %q, want both empty", summary.Length, summary.Quality)
+	}
+	if len(summary.SecondaryRatings) != 2 || summary.SecondaryRatingValues["サイズ感"] != 2.6 {
+		t.Errorf("secondary ratings = %v, %v", summary.SecondaryRatings, summary.SecondaryRatingValues)
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	neturl "net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// robotsRule is one Allow or Disallow line of a robots.txt group.
+type robotsRule struct {
+	pattern string
+	allow   bool
+}
+
+// robotsRules are the robots.txt rules that apply to the crawler: those of
+// each user agent its sessions present, without duplicates, and the longest
+// crawl delay of any of them.
+type robotsRules struct {
+	rules      [][]robotsRule
+	crawlDelay time.Duration
+}
+
+// robotsGroup is a group of robots.txt lines sharing their User-agent lines.
+type robotsGroup struct {
+	agents     []string
+	rules      []robotsRule
+	crawlDelay time.Duration
+}
+
+// loadRobots fetches the shop's robots.txt and returns the rules that apply
+// to the user agents of -user-agent or -user-agent-file. A missing
+// robots.txt allows everything.
+func loadRobots(cfg *Config) (*robotsRules, error) {
+	if cfg.IgnoreRobots {
+		return nil, nil
+	}
+	userAgents, err := loadUserAgents(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	robotsURL := siteURL + "/robots.txt"
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Get(robotsURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch %s: %v", robotsURL, err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 400 && resp.StatusCode < 500:
+		slog.Info("No robots.txt, crawling without restrictions", "url", robotsURL, "status", resp.Status)
+		return nil, nil
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("%s answered %s", robotsURL, resp.Status)
+	}
+
+	rules, err := parseRobots(resp.Body, userAgents)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", robotsURL, err)
+	}
+	slog.Info("Loaded robots.txt", "rules", len(slices.Concat(rules.rules...)), "crawl_delay", rules.crawlDelay)
+	return rules, nil
+}
+
+// parseRobots reads a robots.txt file and returns the rules that apply to
+// each of userAgents, the agents the sessions present in turn. None stands
+// for the browser's own, which only the "*" group names. The rules of an
+// agent are those of the group that names it most specifically, falling back
+// to the "*" group. A group applies when its User-agent token is part of the
+// agent, compared case insensitively; groups naming the same token are
+// merged.
+func parseRobots(r io.Reader, userAgents []string) (*robotsRules, error) {
+	var groups []*robotsGroup
+	var current *robotsGroup
+	inAgents := false
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+
+		switch key {
+		case "user-agent":
+			// Consecutive User-agent lines share the group that follows.
+			if !inAgents {
+				current = &robotsGroup{}
+				groups = append(groups, current)
+				inAgents = true
+			}
+			current.agents = append(current.agents, strings.ToLower(value))
+		case "allow", "disallow":
+			inAgents = false
+			// An empty Disallow allows everything, which is the default.
+			if current == nil || value == "" {
+				continue
+			}
+			current.rules = append(current.rules, robotsRule{pattern: value, allow: key == "allow"})
+		case "crawl-delay":
+			inAgents = false
+			if current == nil {
+				continue
+			}
+			if seconds, err := strconv.ParseFloat(value, 64); err == nil && seconds > 0 {
+				current.crawlDelay = time.Duration(seconds * float64(time.Second))
+			}
+		default:
+			// Sitemap and unknown lines do not end the list of agents.
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(userAgents) == 0 {
+		userAgents = []string{""}
+	}
+	rules := &robotsRules{}
+	for _, userAgent := range userAgents {
+		agent := agentGroup(groups, userAgent)
+		rules.crawlDelay = max(rules.crawlDelay, agent.crawlDelay)
+		if !slices.ContainsFunc(rules.rules, func(r []robotsRule) bool { return slices.Equal(r, agent.rules) }) {
+			rules.rules = append(rules.rules, agent.rules)
+		}
+	}
+	return rules, nil
+}
+
+// agentGroup merges the groups of groups that apply to userAgent. The group
+// naming the longest matching token wins over the others.
+func agentGroup(groups []*robotsGroup, userAgent string) *robotsGroup {
+	userAgent = strings.ToLower(userAgent)
+	best := ""
+	merged := &robotsGroup{}
+	for _, group := range groups {
+		for _, agent := range group.agents {
+			if agent == "*" || !strings.Contains(userAgent, agent) || len(agent) < len(best) {
+				continue
+			}
+			if len(agent) > len(best) {
+				best = agent
+				merged = &robotsGroup{}
+			}
+			merged.merge(group)
+			break
+		}
+	}
+	if best != "" {
+		return merged
+	}
+	for _, group := range groups {
+		if slices.Contains(group.agents, "*") {
+			merged.merge(group)
+		}
+	}
+	return merged
+}
+
+func (g *robotsGroup) merge(other *robotsGroup) {
+	g.rules = append(g.rules, other.rules...)
+	g.crawlDelay = max(g.crawlDelay, other.crawlDelay)
+}
+
+// allowed reports whether rawURL may be crawled: whether the rules of every
+// user agent allow it. The longest matching rule decides, Allow winning a
+// tie; a nil *robotsRules allows everything.
+func (r *robotsRules) allowed(rawURL string) bool {
+	if r == nil {
+		return true
+	}
+	u, err := neturl.Parse(rawURL)
+	if err != nil {
+		return true
+	}
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	if u.RawQuery != "" {
+		path += "?" + u.RawQuery
+	}
+
+	for _, rules := range r.rules {
+		if !robotsAllow(rules, path) {
+			return false
+		}
+	}
+	return true
+}
+
+// robotsAllow reports whether rules allow path.
+func robotsAllow(rules []robotsRule, path string) bool {
+	allow, longest := true, -1
+	for _, rule := range rules {
+		if !robotsMatch(rule.pattern, path) {
+			continue
+		}
+		if n := len(rule.pattern); n > longest || (n == longest && rule.allow) {
+			allow, longest = rule.allow, n
+		}
+	}
+	return allow
+}
+
+// robotsMatch reports whether path matches a robots.txt path pattern, where
+// "*" matches any run of characters and a trailing "$" anchors the end.
+func robotsMatch(pattern, path string) bool {
+	anchored := strings.HasSuffix(pattern, "$")
+	if anchored {
+		pattern = strings.TrimSuffix(pattern, "$")
+	}
+
+	parts := strings.Split(pattern, "*")
+	if !strings.HasPrefix(path, parts[0]) {
+		return false
+	}
+	rest := path[len(parts[0]):]
+	for i, part := range parts[1:] {
+		if anchored && i == len(parts)-2 {
+			return strings.HasSuffix(rest, part)
+		}
+		j := strings.Index(rest, part)
+		if j < 0 {
+			return false
+		}
+		rest = rest[j+len(part):]
+	}
+	return !anchored || rest == ""
+}
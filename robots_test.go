@@ -0,0 +1,126 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRobotsMatch(t *testing.T) {
+	tests := []struct {
+		pattern, path string
+		want          bool
+	}{
+		{"/", "/products/GZ0127/", true},
+		{"/item/", "/item/?gender=mens", true},
+		{"/item/", "/items/", false},
+		{"/*?", "/item/?page=2", true},
+		{"/*?", "/item/", false},
+		{"/search*sort=", "/search?q=shoes&sort=price", true},
+		{"/*.json$", "/api/products.json", true},
+		{"/*.json$", "/api/products.json?page=2", false},
+		{"/cart$", "/cart", true},
+		{"/cart$", "/cart/", false},
+		{"/*/reviews/*/edit", "/products/GZ0127/reviews/1/edit", true},
+		{"/*/reviews/*/edit", "/products/GZ0127/reviews/1", false},
+	}
+	for _, tt := range tests {
+		if got := robotsMatch(tt.pattern, tt.path); got != tt.want {
+			t.Errorf("robotsMatch(%q, %q) = %v, want %v", tt.pattern, tt.path, got, tt.want)
+		}
+	}
+}
+
+const testRobots = `# robots.txt of the shop
+User-agent: *
+Disallow: /cart
+Disallow: /*?*sort=
+Allow: /item/?*sort=new
+Crawl-delay: 1
+
+User-agent: AdidasCrawler
+User-agent: OtherBot
+Disallow: /products/*/reviews
+Crawl-delay: 2.5
+
+User-agent: adidascrawler
+Disallow: /item/
+
+Sitemap: https://shop.adidas.jp/sitemap.xml
+`
+
+func TestParseRobots(t *testing.T) {
+	tests := []struct {
+		name       string
+		userAgents []string
+		crawlDelay time.Duration
+		allowed    map[string]bool
+	}{
+		{
+			name:       "any agent",
+			userAgents: []string{"Mozilla/5.0 (X11; Linux x86_64) Chrome/126.0"},
+			crawlDelay: time.Second,
+			allowed: map[string]bool{
+				"https://shop.adidas.jp/products/GZ0127/":             true,
+				"https://shop.adidas.jp/cart":                         false,
+				"https://shop.adidas.jp/item/?gender=mens&sort=price": false,
+				// The longer Allow wins over the Disallow.
+				"https://shop.adidas.jp/item/?sort=new": true,
+			},
+		},
+		{
+			// Both groups naming the crawler apply, and nothing of "*".
+			name:       "named agent",
+			userAgents: []string{"Mozilla/5.0 AdidasCrawler/1.0"},
+			crawlDelay: 2500 * time.Millisecond,
+			allowed: map[string]bool{
+				"https://shop.adidas.jp/cart":                     true,
+				"https://shop.adidas.jp/products/GZ0127/reviews/": false,
+				"https://shop.adidas.jp/item/?gender=mens":        false,
+			},
+		},
+		{
+			// Sessions rotating through both agents obey the rules of each.
+			name:       "agents of -user-agent-file",
+			userAgents: []string{"Mozilla/5.0 (X11; Linux x86_64) Chrome/126.0", "Mozilla/5.0 AdidasCrawler/1.0"},
+			crawlDelay: 2500 * time.Millisecond,
+			allowed: map[string]bool{
+				"https://shop.adidas.jp/products/GZ0127/":         true,
+				"https://shop.adidas.jp/cart":                     false,
+				"https://shop.adidas.jp/products/GZ0127/reviews/": false,
+				"https://shop.adidas.jp/item/?sort=new":           false,
+			},
+		},
+		{
+			name:       "browser's own agent",
+			crawlDelay: time.Second,
+			allowed: map[string]bool{
+				"https://shop.adidas.jp/cart":           false,
+				"https://shop.adidas.jp/item/?sort=new": true,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules, err := parseRobots(strings.NewReader(testRobots), tt.userAgents)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rules.crawlDelay != tt.crawlDelay {
+				t.Errorf("crawl delay = %v, want %v", rules.crawlDelay, tt.crawlDelay)
+			}
+			for url, want := range tt.allowed {
+				if got := rules.allowed(url); got != want {
+					t.Errorf("allowed(%q) = %v, want %v", url, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRobotsRulesNilAllowsEverything(t *testing.T) {
+	var rules *robotsRules
+	if !rules.allowed("https://shop.adidas.jp/cart") {
+		t.Error("nil rules disallowed a URL")
+	}
+}
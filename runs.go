@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"slices"
+	"time"
+)
+
+// crawlRun records one run of a crawl command in the crawl_runs collection:
+// what it was asked to do, when it ran and what it did.
+type crawlRun struct {
+	ID              string           `json:"run_id" bson:"run_id"`
+	Command         string           `json:"command" bson:"command"` // crawl, discover or scrape
+	Config          map[string]any   `json:"config" bson:"config"`
+	StartedAt       time.Time        `json:"started_at" bson:"started_at"`
+	FinishedAt      time.Time        `json:"finished_at,omitempty" bson:"finished_at,omitempty"`
+	DurationSeconds float64          `json:"duration_seconds,omitempty" bson:"duration_seconds,omitempty"`
+	Status          string           `json:"status" bson:"status"`
+	Error           string           `json:"error,omitempty" bson:"error,omitempty"`
+	Stats           map[string]int64 `json:"stats,omitempty" bson:"stats,omitempty"`
+	// Categories counts the products saved per category, the coverage of
+	// the run that diff compares.
+	Categories map[string]int64 `json:"categories,omitempty" bson:"categories,omitempty"`
+}
+
+// Status values of a crawlRun.
+const (
+	runRunning     = "running"
+	runCompleted   = "completed"
+	runInterrupted = "interrupted"
+	runFailed      = "failed"
+)
+
+// newRunID returns a run ID that sorts by start time, such as
+// 20240601T030000Z-a1b2c3.
+func newRunID(start time.Time) string {
+	suffix := make([]byte, 3)
+	rand.Read(suffix)
+	return start.UTC().Format("20060102T150405Z") + "-" + hex.EncodeToString(suffix)
+}
+
+// runIDKey is the context key of withRunID.
+type runIDKey struct{}
+
+// withRunID makes withRun record its run under id instead of a new run ID, for
+// callers that hand out the ID before the run starts.
+func withRunID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, runIDKey{}, id)
+}
+
+// secretConfigFields are left out of the configuration recorded with a run.
+var secretConfigFields = []string{"MongoURI", "MongoPassword", "PostgresDSN", "BVPasskey", "WebhookURL", "WebhookSecret", "SlackWebhook", "Publish"}
+
+// configSnapshot returns cfg as recorded with a run, with connection strings
+// and secrets redacted.
+func configSnapshot(cfg *Config) map[string]any {
+	v := reflect.ValueOf(cfg).Elem()
+	snapshot := make(map[string]any, v.NumField())
+	for i := 0; i < v.NumField(); i++ {
+		name := v.Type().Field(i).Name
+		value := v.Field(i).Interface()
+		switch value := value.(type) {
+		case time.Duration:
+			snapshot[name] = value.String()
+		case string:
+			if value != "" && slices.Contains(secretConfigFields, name) {
+				snapshot[name] = "redacted"
+			} else {
+				snapshot[name] = value
+			}
+		default:
+			snapshot[name] = value
+		}
+	}
+	return snapshot
+}
+
+// withRun records a run of command in store, opens the sinks for it and
+// calls fn with a store that tags every product URL and product written with
+// the run ID. The run is announced to the sinks with run_started and
+// run_finished events, the latter with the counts of stats.
+func withRun(ctx context.Context, cfg *Config, store Storage, command string, stats *crawlStats, fn func(store Storage, sinks []productSink) error) error {
+	start := time.Now().UTC()
+	id, ok := ctx.Value(runIDKey{}).(string)
+	if !ok {
+		id = newRunID(start)
+	}
+	run := &crawlRun{
+		ID:        id,
+		Command:   command,
+		Config:    configSnapshot(cfg),
+		StartedAt: start,
+		Status:    runRunning,
+	}
+	if err := store.startRun(ctx, run); err != nil {
+		return fmt.Errorf("failed to record run: %v", err)
+	}
+	ctx = withLogAttrs(ctx, "run_id", run.ID)
+	slog.InfoContext(ctx, "Run started", "command", command)
+
+	sinks, err := openSinks(ctx, cfg, store)
+	if err != nil {
+		finishRun(ctx, store, run, stats, err)
+		return err
+	}
+	defer closeSinks(sinks)
+
+	emitEvent(ctx, sinks, runEvent{Type: eventRunStarted, RunID: run.ID, Phase: command})
+	stopProgress := progress.track(command, stats)
+	err = fn(&runStorage{Storage: store, runID: run.ID}, sinks)
+	stopProgress()
+	finishRun(ctx, store, run, stats, err)
+
+	finished := runEvent{Type: eventRunFinished, RunID: run.ID, Phase: command, Stats: run.Stats, DurationSeconds: run.DurationSeconds, Error: run.Error}
+	emitEvent(context.Background(), sinks, finished)
+	return err
+}
+
+// finishRun records the outcome of run.
+func finishRun(ctx context.Context, store Storage, run *crawlRun, stats *crawlStats, err error) {
+	run.finish(ctx, stats, err)
+	if err := store.finishRun(context.WithoutCancel(ctx), run); err != nil {
+		slog.ErrorContext(ctx, "Failed to record the end of the run", "err", err)
+	}
+}
+
+// finish sets the end, counts and status of run, which ended with err or,
+// when ctx is cancelled, was interrupted.
+func (run *crawlRun) finish(ctx context.Context, stats *crawlStats, err error) {
+	run.FinishedAt = time.Now().UTC()
+	run.DurationSeconds = run.FinishedAt.Sub(run.StartedAt).Seconds()
+	run.Stats = stats.snapshot()
+	run.Categories = stats.categoryCounts()
+	switch {
+	case err != nil:
+		run.Status, run.Error = runFailed, err.Error()
+	case ctx.Err() != nil:
+		run.Status = runInterrupted
+	default:
+		run.Status = runCompleted
+	}
+}
+
+// runStorage is the Storage handed to the phases of a run. It tags the
+// product URLs and products they write with the run ID.
+type runStorage struct {
+	Storage
+	runID string
+}
+
+func (s *runStorage) saveProductURL(ctx context.Context, productURL ProductURL) (bool, error) {
+	productURL.RunID = s.runID
+	return s.Storage.saveProductURL(ctx, productURL)
+}
+
+func (s *runStorage) saveProductURLs(ctx context.Context, productURLs []ProductURL) (int, error) {
+	for i := range productURLs {
+		productURLs[i].RunID = s.runID
+	}
+	return s.Storage.saveProductURLs(ctx, productURLs)
+}
+
+func (s *runStorage) markProductURL(ctx context.Context, url, status string, scrapeErr error, fields map[string]any) error {
+	tagged := map[string]any{"run_id": s.runID}
+	for k, v := range fields {
+		tagged[k] = v
+	}
+	return s.Storage.markProductURL(ctx, url, status, scrapeErr, tagged)
+}
+
+func (s *runStorage) saveProduct(ctx context.Context, product *Product) (string, error) {
+	product.RunID = s.runID
+	return s.Storage.saveProduct(ctx, product)
+}
+
+func (s *runStorage) saveProducts(ctx context.Context, products []*Product) ([]string, []error) {
+	for _, product := range products {
+		product.RunID = s.runID
+	}
+	return s.Storage.saveProducts(ctx, products)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// droppedElements are the elements sanitizeHTML removes with their content:
+// what runs or embeds rather than what reads.
+var droppedElements = map[string]bool{
+	"script": true, "style": true, "noscript": true, "template": true, "iframe": true,
+	"object": true, "embed": true, "link": true, "meta": true, "base": true,
+}
+
+// urlAttributes are the attributes holding a URL, which sanitizeHTML makes
+// absolute.
+var urlAttributes = map[string]bool{"href": true, "src": true, "poster": true}
+
+// sanitizeHTML returns the markup of an element of the page at base fit for
+// storing and re-rendering: scripts, styles and embeds are dropped, and so
+// are event handler attributes, inline styles, srcset lists and javascript:
+// links, and relative links and images are resolved against base. Lists,
+// paragraphs and line breaks are kept as they are. The markup is returned
+// trimmed, empty when nothing is left of it.
+func sanitizeHTML(markup, base string) string {
+	if strings.TrimSpace(markup) == "" {
+		return ""
+	}
+	context := &html.Node{Type: html.ElementNode, Data: "div", DataAtom: atom.Div}
+	nodes, err := html.ParseFragment(strings.NewReader(markup), context)
+	if err != nil {
+		return ""
+	}
+	var b strings.Builder
+	for _, n := range nodes {
+		if !sanitizeNode(n, base) {
+			continue
+		}
+		if err := html.Render(&b, n); err != nil {
+			return ""
+		}
+	}
+	return strings.TrimSpace(b.String())
+}
+
+// sanitizeNode sanitizes n and its descendants in place, and returns false
+// when n itself is to be dropped.
+func sanitizeNode(n *html.Node, base string) bool {
+	switch n.Type {
+	case html.CommentNode:
+		return false
+	case html.ElementNode:
+		if droppedElements[n.Data] {
+			return false
+		}
+		attrs := n.Attr[:0]
+		for _, a := range n.Attr {
+			key := strings.ToLower(a.Key)
+			if strings.HasPrefix(key, "on") || key == "style" || key == "srcset" {
+				continue
+			}
+			if urlAttributes[key] {
+				if strings.HasPrefix(strings.ToLower(strings.TrimSpace(a.Val)), "javascript:") {
+					continue
+				}
+				if a.Val = resolveURL(base, a.Val); a.Val == "" {
+					continue
+				}
+			}
+			attrs = append(attrs, a)
+		}
+		n.Attr = attrs
+	}
+	for c := n.FirstChild; c != nil; {
+		next := c.NextSibling
+		if !sanitizeNode(c, base) {
+			n.RemoveChild(c)
+		}
+		c = next
+	}
+	return true
+}
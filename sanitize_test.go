@@ -0,0 +1,44 @@
+package main
+
+import "testing"
+
+func TestSanitizeHTML(t *testing.T) {
+	const base = "https://shop.adidas.jp/products/GZ0127/"
+	tests := []struct {
+		name, markup, want string
+	}{
+		{"script and style dropped",
+			`<p>軽量</p><script>track("view")</script><style>p{color:red}</style>`,
+			`<p>軽量</p>`},
+		{"embeds dropped",
+			`<p>動画</p><iframe src="https://www.youtube.com/embed/x"></iframe><noscript><img src="/pixel.gif"></noscript>`,
+			`<p>動画</p>`},
+		{"event handlers and inline styles dropped",
+			`<p onclick="buy()" ONMOUSEOVER="x()" style="color:red" class="lead">軽量</p>`,
+			`<p class="lead">軽量</p>`},
+		{"javascript links dropped",
+			`<a href=" JavaScript:alert(1)">詳細</a>`,
+			`<a>詳細</a>`},
+		{"relative links and images resolved",
+			`<a href="../HQ4199/">別の色</a><img src="/images/GZ0127_01.jpg" srcset="a.jpg 1x, b.jpg 2x" alt="">`,
+			`<a href="https://shop.adidas.jp/products/HQ4199/">別の色</a><img src="https://shop.adidas.jp/images/GZ0127_01.jpg" alt=""/>`},
+		{"absolute links kept",
+			`<a href="https://www.adidas.com/us/">adidas.com</a>`,
+			`<a href="https://www.adidas.com/us/">adidas.com</a>`},
+		{"lists and line breaks kept",
+			"<ul>\n<li>素材：合成繊維</li>\n<li>原産国：ベトナム</li>\n</ul><p>1行目<br>2行目</p>",
+			"<ul>\n<li>素材：合成繊維</li>\n<li>原産国：ベトナム</li>\n</ul><p>1行目<br/>2行目</p>"},
+		{"comments dropped", `<p>軽量<!-- cms block 12 --></p>`, `<p>軽量</p>`},
+		{"text escaped", `<p>1 &lt; 2 &amp; 3</p>`, `<p>1 &lt; 2 &amp; 3</p>`},
+		{"surrounding space trimmed", "\n  <p>軽量</p>\n", `<p>軽量</p>`},
+		{"nothing left", `<script>track()</script>`, ``},
+		{"empty", "  ", ``},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sanitizeHTML(tt.markup, base); got != tt.want {
+				t.Errorf("sanitizeHTML(%q) =\n%q, want\n%q", tt.markup, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+// TestScrapeProductWithoutSizeChart checks that a product page without a
+// size chart, such as that of socks, is still scraped, with only the size
+// chart reported as failed.
+func TestScrapeProductWithoutSizeChart(t *testing.T) {
+	cfg := testConfig(t)
+	ex := &fixtureExtractor{path: "testdata/product_no_size_chart.html"}
+	product, errs := scrapeProduct(cfg, ex, "https://shop.adidas.jp/products/HT3432/")
+
+	if got := sectionErrorNames(errs); !slices.Equal(got, []string{"size chart"}) {
+		t.Errorf("section errors = %q, want only the size chart", got)
+	}
+	if product.Title != "アディダス ソックス 3足組" {
+		t.Errorf("title = %q", product.Title)
+	}
+	if product.PriceJPY != 1639 {
+		t.Errorf("price = %d, want 1639", product.PriceJPY)
+	}
+	if len(product.AvailableSizes) != 3 {
+		t.Errorf("sizes = %v, want S, M and L", product.AvailableSizeLabels)
+	}
+	if len(product.SizeCharts) != 0 {
+		t.Errorf("size charts = %v, want none", product.SizeCharts)
+	}
+	if product.Description == "" {
+		t.Error("description is empty")
+	}
+	if len(product.Tags) != 1 {
+		t.Errorf("tags = %q", product.Tags)
+	}
+}
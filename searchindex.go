@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// indexBatchSize is the number of products sent per bulk request.
+	indexBatchSize = 200
+	// indexFlushInterval is how long indexed products wait for a batch to
+	// fill before it is sent anyway.
+	indexFlushInterval = 5 * time.Second
+	// indexAttempts is how often a product is sent before it is given up on.
+	indexAttempts = 5
+)
+
+// searchIndexer indexes scraped products into Elasticsearch or OpenSearch
+// for full-text search, through the bulk API. Products are batched by one
+// background worker; products the cluster rejects or could not take, such as
+// on 429 Too Many Requests, are retried with the next batch.
+type searchIndexer struct {
+	cfg    *Config
+	client *http.Client
+	jobs   chan indexDoc
+	done   chan struct{}
+
+	indexed   int
+	unindexed int
+}
+
+// indexDoc is a product encoded for indexing.
+type indexDoc struct {
+	id       string
+	source   []byte
+	attempts int
+}
+
+// newSearchIndexer creates the search index when it does not exist yet and
+// starts the indexing worker.
+func newSearchIndexer(ctx context.Context, cfg *Config) (*searchIndexer, error) {
+	ix := &searchIndexer{
+		cfg:    cfg,
+		client: &http.Client{Timeout: time.Minute},
+		jobs:   make(chan indexDoc, indexBatchSize*4),
+		done:   make(chan struct{}),
+	}
+	if err := ix.createIndex(ctx); err != nil {
+		return nil, err
+	}
+	go ix.run()
+	return ix, nil
+}
+
+// searchTextFields are the product fields searched as full text.
+var searchTextFields = []string{"title", "description_heading", "description_title", "description", "specifications"}
+
+// indexMapping returns the mapping of the search index, analyzing Japanese
+// text with analyzer.
+func indexMapping(analyzer string) map[string]any {
+	text := map[string]any{"type": "text", "analyzer": analyzer}
+	properties := map[string]any{
+		"product_number": map[string]any{"type": "keyword"},
+		"category":       map[string]any{"type": "keyword"},
+		"section":        map[string]any{"type": "keyword"},
+		"tags":           map[string]any{"type": "keyword"},
+		"reviews": map[string]any{"properties": map[string]any{
+			"title":       text,
+			"description": text,
+		}},
+	}
+	for _, field := range searchTextFields {
+		properties[field] = text
+	}
+	return map[string]any{"mappings": map[string]any{"properties": properties}}
+}
+
+// createIndex creates the index with the kuromoji analyzer for Japanese, or
+// with the standard analyzer when the cluster lacks the kuromoji plugin.
+func (ix *searchIndexer) createIndex(ctx context.Context) error {
+	indexURL := ix.indexURL()
+	resp, err := ix.do(ctx, http.MethodHead, indexURL, "", nil)
+	if err != nil {
+		return fmt.Errorf("search index %s is unreachable: %v", indexURL, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	for _, analyzer := range []string{"kuromoji", "standard"} {
+		body, _ := json.Marshal(indexMapping(analyzer))
+		resp, err := ix.do(ctx, http.MethodPut, indexURL, "application/json", body)
+		if err != nil {
+			return fmt.Errorf("failed to create search index: %v", err)
+		}
+		msg, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			slog.Info("Created search index", "index", ix.cfg.ESIndex, "analyzer", analyzer)
+			return nil
+		}
+		if analyzer == "kuromoji" && resp.StatusCode == http.StatusBadRequest && strings.Contains(string(msg), "analyzer") {
+			slog.Warn("Search cluster has no kuromoji analyzer, falling back to the standard analyzer")
+			continue
+		}
+		return fmt.Errorf("failed to create search index: %s: %s", resp.Status, msg)
+	}
+	return nil
+}
+
+func (ix *searchIndexer) indexURL() string {
+	return strings.TrimSuffix(ix.cfg.ESURL, "/") + "/" + ix.cfg.ESIndex
+}
+
+func (ix *searchIndexer) do(ctx context.Context, method, url, contentType string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	return ix.client.Do(req)
+}
+
+// enqueue encodes product for indexing. It is encoded right away, since
+// sinks after this one may still change the product.
+func (ix *searchIndexer) enqueue(ctx context.Context, product *Product) {
+	source, err := json.Marshal(product)
+	if err != nil {
+		slog.Error("Failed to encode product for the search index", "product_number", product.ProductNumber, "err", err)
+		return
+	}
+	send(ctx, ix.jobs, indexDoc{id: product.ProductNumber, source: source})
+}
+
+// close sends the products still queued and reports those that could not
+// be indexed.
+func (ix *searchIndexer) close() {
+	close(ix.jobs)
+	<-ix.done
+	if ix.unindexed > 0 {
+		slog.Warn("Some products could not be indexed", "index", ix.cfg.ESIndex, "indexed", ix.indexed, "unindexed", ix.unindexed)
+		return
+	}
+	slog.Info("Indexed products", "index", ix.cfg.ESIndex, "indexed", ix.indexed)
+}
+
+// run batches queued products into bulk requests until the queue is closed.
+// It does not stop on shutdown signals, so close can still flush the queue.
+func (ix *searchIndexer) run() {
+	defer close(ix.done)
+	ticker := time.NewTicker(indexFlushInterval)
+	defer ticker.Stop()
+
+	var pending []indexDoc
+	for {
+		select {
+		case doc, ok := <-ix.jobs:
+			if !ok {
+				// Flush what is left, retrying a bounded number of times.
+				for len(pending) > 0 {
+					pending = ix.flush(pending)
+				}
+				return
+			}
+			pending = append(pending, doc)
+			if len(pending) >= indexBatchSize {
+				pending = ix.flush(pending)
+			}
+		case <-ticker.C:
+			if len(pending) > 0 {
+				pending = ix.flush(pending)
+			}
+		}
+	}
+}
+
+// bulkResponse is the part of a bulk API response the indexer reads.
+type bulkResponse struct {
+	Errors bool `json:"errors"`
+	Items  []map[string]struct {
+		Status int `json:"status"`
+		Error  *struct {
+			Type   string `json:"type"`
+			Reason string `json:"reason"`
+		} `json:"error"`
+	} `json:"items"`
+}
+
+// flush sends up to indexBatchSize of docs in one bulk request and returns
+// the docs still to be sent: those not sent and those to retry.
+func (ix *searchIndexer) flush(docs []indexDoc) []indexDoc {
+	n := min(len(docs), indexBatchSize)
+	batch, rest := docs[:n], docs[n:]
+
+	var body bytes.Buffer
+	for _, doc := range batch {
+		action, _ := json.Marshal(map[string]any{"index": map[string]any{"_index": ix.cfg.ESIndex, "_id": doc.id}})
+		body.Write(action)
+		body.WriteByte('\n')
+		body.Write(doc.source)
+		body.WriteByte('\n')
+	}
+
+	retry := func(docs []indexDoc, reason string) []indexDoc {
+		var again []indexDoc
+		for _, doc := range docs {
+			doc.attempts++
+			if doc.attempts >= indexAttempts {
+				slog.Error("Giving up indexing product", "product_number", doc.id, "attempts", doc.attempts, "reason", reason)
+				ix.unindexed++
+				continue
+			}
+			again = append(again, doc)
+		}
+		return again
+	}
+
+	url := strings.TrimSuffix(ix.cfg.ESURL, "/") + "/_bulk"
+	resp, err := ix.do(context.Background(), http.MethodPost, url, "application/x-ndjson", body.Bytes())
+	if err != nil {
+		slog.Warn("Bulk indexing failed", "products", len(batch), "err", err)
+		time.Sleep(indexBackoff(batch))
+		return append(rest, retry(batch, err.Error())...)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+		slog.Warn("Search cluster is busy, retrying later", "status", resp.Status, "products", len(batch))
+		time.Sleep(indexBackoff(batch))
+		return append(rest, retry(batch, resp.Status)...)
+	}
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		slog.Error("Bulk indexing was rejected", "products", len(batch), "status", resp.Status, "response", string(msg))
+		ix.unindexed += len(batch)
+		return rest
+	}
+
+	var result bulkResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		slog.Warn("Failed to decode bulk response", "err", err)
+		return append(rest, retry(batch, err.Error())...)
+	}
+	var failed []indexDoc
+	for i, item := range result.Items {
+		if i >= len(batch) {
+			break
+		}
+		for _, status := range item {
+			switch {
+			case status.Status == http.StatusTooManyRequests:
+				failed = append(failed, batch[i])
+			case status.Error != nil:
+				slog.Error("Failed to index product", "product_number", batch[i].id, "error_type", status.Error.Type, "reason", status.Error.Reason)
+				ix.unindexed++
+			default:
+				ix.indexed++
+			}
+		}
+	}
+	if len(failed) > 0 {
+		time.Sleep(indexBackoff(failed))
+	}
+	return append(rest, retry(failed, "429 Too Many Requests")...)
+}
+
+// indexBackoff returns how long to wait before sending docs again, doubling
+// with every attempt of the most tried one.
+func indexBackoff(docs []indexDoc) time.Duration {
+	attempts := 0
+	for _, doc := range docs {
+		attempts = max(attempts, doc.attempts)
+	}
+	return time.Second << attempts
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/tebeka/selenium"
+)
+
+// pooledSession is a browser session of a sessionPool.
+type pooledSession struct {
+	wd     selenium.WebDriver
+	proxy  string    // "" for none
+	lite   bool      // opened without images, see sessionFactory.lite
+	pages  int       // times it was checked out
+	opened time.Time // when checkout opened it
+}
+
+// sessionPool keeps the browser sessions of a command open between the pages,
+// workers and phases that use them, so that Chrome starts once per session
+// rather than once per worker and phase. At most max sessions are open at
+// once; a session is recycled after maxPages pages, 0 for never, as Chrome
+// grows with every page it loads.
+type sessionPool struct {
+	max      int
+	maxPages int
+	stats    *crawlStats // nil to count nothing
+
+	mu     sync.Mutex
+	cond   *sync.Cond // signalled when a session is returned or quit
+	idle   []*pooledSession
+	open   int // sessions idle or checked out
+	closed bool
+}
+
+func newSessionPool(cfg *Config, stats *crawlStats) *sessionPool {
+	p := &sessionPool{max: cfg.browserSessions(), maxPages: cfg.SessionMaxPages, stats: stats}
+	p.cond = sync.NewCond(&p.mu)
+	return p
+}
+
+// checkout returns an idle session of the pool opened with the profile of f
+// or, while fewer than the pool's max are open, a new one. Otherwise it waits
+// for one to be returned.
+func (f *sessionFactory) checkout() (*pooledSession, error) {
+	p := f.pool
+	p.mu.Lock()
+	for {
+		if i := slices.IndexFunc(p.idle, func(s *pooledSession) bool { return s.lite == f.liteProfile }); i >= 0 {
+			s := p.idle[i]
+			p.idle = slices.Delete(p.idle, i, i+1)
+			p.mu.Unlock()
+			return s, nil
+		}
+		if p.open < p.max {
+			break
+		}
+		if len(p.idle) > 0 {
+			// Only sessions of the other profile are idle; one makes room.
+			s := p.idle[0]
+			p.idle = p.idle[1:]
+			p.open--
+			p.mu.Unlock()
+			s.wd.Quit()
+			p.mu.Lock()
+			continue
+		}
+		p.cond.Wait()
+	}
+	p.open++
+	p.mu.Unlock()
+
+	wd, proxy, err := f.open()
+	if err != nil {
+		p.mu.Lock()
+		p.open--
+		p.cond.Signal()
+		p.mu.Unlock()
+		if p.stats != nil {
+			p.stats.SessionsFailed.Add(1)
+		}
+		return nil, err
+	}
+	if p.stats != nil {
+		p.stats.SessionsCreated.Add(1)
+	}
+	return &pooledSession{wd: wd, proxy: proxy, lite: f.liteProfile, opened: time.Now()}, nil
+}
+
+// release returns s to the pool after a page. A session that is broken, does
+// not answer or served maxPages pages is quit instead. After the first page
+// of a session its cookies go into the cookie jar, and the time it took from
+// opening the session is counted, see crawlStats.addFirstPageTime.
+func (f *sessionFactory) release(s *pooledSession, broken bool) {
+	p := f.pool
+	s.pages++
+	if !broken {
+		if _, err := s.wd.CurrentURL(); err != nil {
+			slog.Debug("Browser session failed its health check", "err", err)
+			broken = true
+		}
+	}
+	if !broken && s.pages == 1 {
+		if f.jar != nil {
+			f.jar.store(s.wd, f.cfg.Browser, s.proxy)
+		}
+		if p.stats != nil {
+			p.stats.addFirstPageTime(time.Since(s.opened))
+		}
+	}
+	recycle := !broken && p.maxPages > 0 && s.pages >= p.maxPages
+	if p.stats != nil {
+		switch {
+		case broken:
+			p.stats.SessionsFailed.Add(1)
+		case recycle:
+			p.stats.SessionsRecycled.Add(1)
+		}
+	}
+
+	p.mu.Lock()
+	if broken || recycle || p.closed {
+		p.open--
+		p.cond.Signal()
+		p.mu.Unlock()
+		s.wd.Quit()
+		return
+	}
+	p.idle = append(p.idle, s)
+	p.cond.Signal()
+	p.mu.Unlock()
+}
+
+// close quits the idle sessions of the pool, and those still checked out as
+// they are returned.
+func (f *sessionFactory) close() {
+	p := f.pool
+	p.mu.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.open -= len(idle)
+	p.closed = true
+	p.mu.Unlock()
+	for _, s := range idle {
+		s.wd.Quit()
+	}
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/tebeka/selenium"
+)
+
+// fakeWebDriver stands in for a browser session. Only the calls the session
+// pool and the workers make are implemented; any other panics.
+type fakeWebDriver struct {
+	selenium.WebDriver
+	id     int
+	get    func(url string) error // loads a page, nil to fail every load
+	broken atomic.Bool            // fails the health check of release
+	quit   atomic.Bool            // Quit was called
+	gets   atomic.Int64           // pages loaded
+	page   *goquery.Document      // the loaded page, for FindElement(s)
+}
+
+func (wd *fakeWebDriver) CurrentURL() (string, error) {
+	if wd.broken.Load() {
+		return "", errors.New("invalid session id")
+	}
+	return siteURL + "/", nil
+}
+
+func (wd *fakeWebDriver) Get(url string) error {
+	wd.gets.Add(1)
+	if wd.get != nil {
+		return wd.get(url)
+	}
+	return errors.New("fake session loads no pages")
+}
+
+func (wd *fakeWebDriver) Quit() error {
+	wd.quit.Store(true)
+	return nil
+}
+
+func (wd *fakeWebDriver) FindElement(by, value string) (selenium.WebElement, error) {
+	elems, err := wd.FindElements(by, value)
+	if err != nil {
+		return nil, err
+	}
+	if len(elems) == 0 {
+		return nil, fmt.Errorf("no such element: %s", value)
+	}
+	return elems[0], nil
+}
+
+func (wd *fakeWebDriver) FindElements(by, value string) ([]selenium.WebElement, error) {
+	if by != selenium.ByCSSSelector {
+		return nil, fmt.Errorf("fake session finds elements by CSS selector only, not %s", by)
+	}
+	if wd.page == nil {
+		return nil, nil
+	}
+	var elems []selenium.WebElement
+	wd.page.Find(value).Each(func(_ int, s *goquery.Selection) {
+		elems = append(elems, fakeWebElement{s: s})
+	})
+	return elems, nil
+}
+
+// WaitWithTimeout asks condition once, as the fake page never changes.
+func (wd *fakeWebDriver) WaitWithTimeout(condition selenium.Condition, _ time.Duration) error {
+	if ok, err := condition(wd); err != nil || !ok {
+		return errors.New("timeout")
+	}
+	return nil
+}
+
+// fakeWebElement is an element of the page of a fakeWebDriver.
+type fakeWebElement struct {
+	selenium.WebElement
+	s *goquery.Selection
+}
+
+func (e fakeWebElement) Text() (string, error) {
+	return strings.TrimSpace(e.s.Text()), nil
+}
+
+func (e fakeWebElement) GetAttribute(name string) (string, error) {
+	value, ok := e.s.Attr(name)
+	if !ok {
+		return "", fmt.Errorf("no attribute %s", name)
+	}
+	return value, nil
+}
+
+// loadFixturePage parses testdata/name as the page of a fakeWebDriver.
+func loadFixturePage(t *testing.T, name string) *goquery.Document {
+	t.Helper()
+	ex := &fixtureExtractor{path: filepath.Join("testdata", name)}
+	if err := ex.load(""); err != nil {
+		t.Fatal(err)
+	}
+	return ex.doc
+}
+
+// fakeSessions is a session factory for cfg whose sessions are fake
+// WebDrivers. Opening a session fails for the calls fail reports true for,
+// counted from 1.
+type fakeSessions struct {
+	*sessionFactory
+	get     func(url string) error // see fakeWebDriver.get
+	mu      sync.Mutex
+	calls   int
+	drivers []*fakeWebDriver
+}
+
+func newFakeSessions(cfg *Config, stats *crawlStats, fail func(call int) bool) *fakeSessions {
+	s := &fakeSessions{}
+	s.sessionFactory = &sessionFactory{cfg: cfg, caps: selenium.Capabilities{}, pool: newSessionPool(cfg, stats)}
+	s.connect = func(selenium.Capabilities) (selenium.WebDriver, error) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.calls++
+		if fail != nil && fail(s.calls) {
+			return nil, fmt.Errorf("session %d refused", s.calls)
+		}
+		wd := &fakeWebDriver{id: s.calls, get: s.get}
+		s.drivers = append(s.drivers, wd)
+		return wd, nil
+	}
+	return s
+}
+
+func (s *fakeSessions) checkoutFake(t *testing.T) (*pooledSession, *fakeWebDriver) {
+	t.Helper()
+	session, err := s.checkout()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return session, session.wd.(*fakeWebDriver)
+}
+
+func TestSessionPoolRecyclesAfterMaxPages(t *testing.T) {
+	var stats crawlStats
+	sessions := newFakeSessions(testConfig(t, "-session-max-pages=2", "-workers=1"), &stats, nil)
+
+	session, first := sessions.checkoutFake(t)
+	sessions.release(session, false)
+	if first.quit.Load() {
+		t.Fatal("session quit after its first page, want it kept for -session-max-pages=2")
+	}
+
+	session, wd := sessions.checkoutFake(t)
+	if wd != first {
+		t.Fatalf("got session %d on the second checkout, want the idle session %d", wd.id, first.id)
+	}
+	sessions.release(session, false)
+	if !first.quit.Load() {
+		t.Fatal("session not quit after -session-max-pages pages")
+	}
+
+	_, wd = sessions.checkoutFake(t)
+	if wd == first {
+		t.Fatal("recycled session checked out again")
+	}
+	if got := stats.SessionsCreated.Load(); got != 2 {
+		t.Errorf("SessionsCreated = %d, want 2", got)
+	}
+	if got := stats.SessionsRecycled.Load(); got != 1 {
+		t.Errorf("SessionsRecycled = %d, want 1", got)
+	}
+}
+
+func TestSessionPoolDiscardsBrokenSessions(t *testing.T) {
+	tests := []struct {
+		name    string
+		release func(sessions *fakeSessions, session *pooledSession, wd *fakeWebDriver)
+	}{
+		{"reported broken", func(sessions *fakeSessions, session *pooledSession, _ *fakeWebDriver) {
+			sessions.release(session, true)
+		}},
+		{"failed health check", func(sessions *fakeSessions, session *pooledSession, wd *fakeWebDriver) {
+			wd.broken.Store(true)
+			sessions.release(session, false)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stats crawlStats
+			sessions := newFakeSessions(testConfig(t, "-workers=1"), &stats, nil)
+
+			session, broken := sessions.checkoutFake(t)
+			tt.release(sessions, session, broken)
+			if !broken.quit.Load() {
+				t.Fatal("broken session not quit")
+			}
+			if _, wd := sessions.checkoutFake(t); wd == broken {
+				t.Fatal("broken session checked out again")
+			}
+			if got := stats.SessionsFailed.Load(); got != 1 {
+				t.Errorf("SessionsFailed = %d, want 1", got)
+			}
+		})
+	}
+}
+
+func TestSessionPoolClose(t *testing.T) {
+	sessions := newFakeSessions(testConfig(t, "-workers=2"), &crawlStats{}, nil)
+
+	idle, idleWD := sessions.checkoutFake(t)
+	busy, busyWD := sessions.checkoutFake(t)
+	sessions.release(idle, false)
+
+	sessions.close()
+	if !idleWD.quit.Load() {
+		t.Error("idle session not quit on close")
+	}
+	if busyWD.quit.Load() {
+		t.Error("checked out session quit on close, want it quit once returned")
+	}
+	sessions.release(busy, false)
+	if !busyWD.quit.Load() {
+		t.Error("session returned after close not quit")
+	}
+	if sessions.pool.open != 0 || len(sessions.pool.idle) != 0 {
+		t.Errorf("pool holds %d open and %d idle sessions after close, want none", sessions.pool.open, len(sessions.pool.idle))
+	}
+}
+
+// TestOpenSessionSkipsFailingProxies checks that a proxy no session can be
+// opened through is skipped like one failing its health check.
+func TestOpenSessionSkipsFailingProxies(t *testing.T) {
+	proxies := []string{"http://proxy1.internal:8080", "http://proxy2.internal:8080", "http://proxy3.internal:8080"}
+	tests := []struct {
+		name     string
+		fail     func(call int) bool
+		want     string // proxy of the session, "" for an error
+		connects int
+	}{
+		{"first proxy refuses", func(call int) bool { return call == 1 }, proxies[1], 2},
+		{"every proxy refuses", func(int) bool { return true }, "", 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sessions := newFakeSessions(testConfig(t, "-workers=1"), &crawlStats{}, tt.fail)
+			sessions.get = func(string) error { return nil }
+			sessions.proxies = &proxyPool{proxies: proxies}
+
+			wd, proxy, err := sessions.openSession()
+			if tt.want == "" {
+				if err == nil || !strings.Contains(err.Error(), "refused") {
+					t.Errorf("openSession() = %v, want the last connect error", err)
+				}
+			} else if err != nil || proxy != tt.want || wd == nil {
+				t.Errorf("openSession() = %v, %q, %v, want a session through %s", wd, proxy, err, tt.want)
+			}
+			if sessions.calls != tt.connects {
+				t.Errorf("%d sessions opened, want %d", sessions.calls, tt.connects)
+			}
+		})
+	}
+}
+
+// TestProcessURLsWorkerFailures runs discovery workers of which the first
+// two cannot open a browser session. They report why and stop; the third
+// reads every remaining listing page.
+func TestProcessURLsWorkerFailures(t *testing.T) {
+	const workers, pages, failing = 3, 6, 2
+	cfg := testConfig(t, fmt.Sprintf("-workers=%d", workers), "-max-rps=0")
+	stats := &crawlStats{}
+	sessions := newFakeSessions(cfg, stats, func(call int) bool { return call <= failing })
+	pace := newThrottle(cfg, stats, nil)
+
+	ctx := context.Background()
+	pageChan := make(chan listingPage)
+	errs := make(chan error, workers)
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			processURLs(ctx, cfg, pageChan, sessions.sessionFactory, nil, nil, pace, stats, errs)
+		}()
+	}
+	for i := range pages {
+		pageChan <- listingPage{Section: "men", URL: listingPageURL(siteURL+"/men/shoes", i+1)}
+	}
+	close(pageChan)
+	wg.Wait()
+	close(errs)
+
+	failed := 0
+	for err := range errs {
+		t.Log(err)
+		failed++
+	}
+	if failed != failing {
+		t.Errorf("%d workers reported a failure, want %d", failed, failing)
+	}
+	if len(sessions.drivers) != 1 {
+		t.Fatalf("%d sessions opened, want 1", len(sessions.drivers))
+	}
+	if got := sessions.drivers[0].gets.Load(); got != pages-failing {
+		t.Errorf("remaining worker loaded %d listing pages, want %d", got, pages-failing)
+	}
+	if got := stats.SessionsFailed.Load(); got != failing {
+		t.Errorf("SessionsFailed = %d, want %d", got, failing)
+	}
+}
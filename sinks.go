@@ -0,0 +1,50 @@
+package main
+
+import "context"
+
+// productSink receives every product once it is stored. Sinks work in the
+// background, so a slow sink never holds up the browser workers, and close
+// waits for what they still have queued.
+type productSink interface {
+	enqueue(ctx context.Context, product *Product)
+	close()
+}
+
+// openSinks starts the sinks enabled in cfg. The media downloader comes
+// last, since it changes the products it is handed while the sinks before it
+// take theirs as they are.
+func openSinks(ctx context.Context, cfg *Config, store Storage) ([]productSink, error) {
+	var sinks []productSink
+	if cfg.ESURL != "" {
+		indexer, err := newSearchIndexer(ctx, cfg)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, indexer)
+	}
+	if cfg.Publish != "" {
+		publisher, err := newBusPublisher(cfg)
+		if err != nil {
+			closeSinks(sinks)
+			return nil, err
+		}
+		sinks = append(sinks, publisher)
+	}
+	if cfg.WebhookURL != "" {
+		sinks = append(sinks, newWebhookSink(cfg))
+	}
+	if cfg.SlackWebhook != "" {
+		sinks = append(sinks, newChatNotifier(cfg))
+	}
+	if cfg.DownloadMedia != "" {
+		sinks = append(sinks, newMediaDownloader(ctx, cfg, store))
+	}
+	return sinks, nil
+}
+
+// closeSinks waits for every sink to finish its queue.
+func closeSinks(sinks []productSink) {
+	for _, sink := range sinks {
+		sink.close()
+	}
+}
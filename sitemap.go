@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	neturl "net/url"
+	"strings"
+)
+
+// Sources of discover.
+const (
+	sourceListing = "listing" // walk the category listing pages in the browser
+	sourceSitemap = "sitemap" // read the product URLs from the sitemap
+)
+
+// sitemapURL is the sitemap, or sitemap index, discovery starts from.
+const sitemapURL = siteURL + "/sitemap.xml"
+
+// maxSitemapDepth bounds how deep sitemap indexes may nest.
+const maxSitemapDepth = 5
+
+// sitemapDocument is a sitemap index, listing child sitemaps, or a URL set,
+// listing pages.
+type sitemapDocument struct {
+	XMLName  xml.Name
+	Sitemaps []sitemapEntry `xml:"sitemap"`
+	URLs     []sitemapEntry `xml:"url"`
+}
+
+type sitemapEntry struct {
+	Loc string `xml:"loc"`
+}
+
+// discoverSitemap reads the product URLs from the sitemap of the shop, and
+// the sitemaps nested in it, over plain HTTP and stores them in the
+// product_urls collection. No browser is needed. The section and category
+// of a URL are inferred from it where it tells them; opts.Categories skips
+// the URLs whose category is not matched.
+func discoverSitemap(ctx context.Context, cfg *Config, opts discoverOptions, store Storage, stats *crawlStats) error {
+	ctx = withLogAttrs(ctx, "phase", "discover", "source", sourceSitemap)
+	if err := store.prepare(ctx); err != nil {
+		return err
+	}
+	robots, err := loadRobots(cfg)
+	if err != nil {
+		return err
+	}
+	pace := newThrottle(cfg, stats, robots)
+	client := &http.Client{Timeout: cfg.PageLoadTimeout}
+
+	newURLs, knownURLs := 0, 0
+	visited := make(map[string]bool)
+	var walk func(url string, depth int) error
+	walk = func(url string, depth int) error {
+		if visited[url] || ctx.Err() != nil {
+			return nil
+		}
+		visited[url] = true
+		if !pace.wait(ctx) {
+			return nil
+		}
+		doc, err := fetchSitemap(ctx, client, cfg, url)
+		if err != nil {
+			return err
+		}
+		stats.ListingPages.Add(1)
+
+		for _, child := range doc.Sitemaps {
+			if depth >= maxSitemapDepth {
+				slog.WarnContext(ctx, "Skipping sitemap nested too deep", "sitemap", child.Loc, "depth", depth+1)
+				continue
+			}
+			if err := walk(strings.TrimSpace(child.Loc), depth+1); err != nil {
+				slog.ErrorContext(ctx, "Skipping sitemap", "sitemap", child.Loc, "err", err)
+			}
+		}
+
+		pageNew, pageKnown := 0, 0
+		for _, entry := range doc.URLs {
+			productURL, ok := sitemapProductURL(strings.TrimSpace(entry.Loc))
+			if !ok || !pace.allowed(productURL.URL) {
+				continue
+			}
+			if opts.Categories != nil && !opts.Categories.MatchString(productURL.Category) {
+				continue
+			}
+			inserted, err := store.saveProductURL(ctx, productURL)
+			if err != nil {
+				slog.ErrorContext(ctx, "Failed to store product URL", "product_url", productURL.URL, "err", err)
+				continue
+			}
+			if inserted {
+				pageNew++
+				stats.ProductURLs.Add(1)
+			} else {
+				pageKnown++
+			}
+		}
+		if len(doc.URLs) > 0 {
+			slog.InfoContext(ctx, "Stored product URLs of sitemap", "sitemap", url, "new", pageNew, "known", pageKnown, "entries", len(doc.URLs))
+		}
+		newURLs += pageNew
+		knownURLs += pageKnown
+		return nil
+	}
+	if err := walk(sitemapURL, 0); err != nil {
+		return err
+	}
+	slog.InfoContext(ctx, "Stored product URLs from the sitemap", "new", newURLs, "known", knownURLs, "sitemaps", len(visited))
+	return nil
+}
+
+// fetchSitemap fetches and parses the sitemap at url, gzip-compressed or not.
+func fetchSitemap(ctx context.Context, client *http.Client, cfg *Config, url string) (*sitemapDocument, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.UserAgent != "" {
+		req.Header.Set("User-Agent", cfg.UserAgent)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s answered %s", url, resp.Status)
+	}
+
+	// A .xml.gz part is served as is, so the transport does not decompress
+	// it; recognize it by the gzip magic number.
+	var body io.Reader = bufio.NewReader(resp.Body)
+	if magic, _ := body.(*bufio.Reader).Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress %s: %v", url, err)
+		}
+		defer gz.Close()
+		body = gz
+	}
+
+	var doc sitemapDocument
+	if err := xml.NewDecoder(body).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", url, err)
+	}
+	if doc.XMLName.Local != "sitemapindex" && doc.XMLName.Local != "urlset" {
+		return nil, fmt.Errorf("%s is not a sitemap, its root element is <%s>", url, doc.XMLName.Local)
+	}
+	return &doc, nil
+}
+
+// sitemapProductURL returns the product URL of a sitemap entry, with the
+// section and category inferred from it, and reports false for pages that
+// are not product pages of the shop.
+func sitemapProductURL(loc string) (ProductURL, bool) {
+	u, err := neturl.Parse(loc)
+	site, _ := neturl.Parse(siteURL)
+	if err != nil || !strings.EqualFold(u.Hostname(), site.Hostname()) || extractProductNumber(loc) == "" {
+		return ProductURL{}, false
+	}
+	tokens := urlTokens(loc)
+	productURL := ProductURL{
+		Section:  matchTerm(genderTerms, tokens, nil),
+		Category: matchTerm(productTypeTerms, tokens, nil),
+		URL:      canonicalProductURL(loc),
+		Status:   statusPending,
+	}
+	if productURL.URL != loc {
+		productURL.RawURL = loc
+	}
+	return productURL, true
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/tebeka/selenium"
+)
+
+// SizeOption is one button of the size selector.
+type SizeOption struct {
+	Size     string `json:"size" bson:"size"`
+	InStock  bool   `json:"in_stock" bson:"in_stock"`
+	LowStock bool   `json:"low_stock" bson:"low_stock"`
+}
+
+// Markers in the class list or text of a size button.
+var (
+	soldOutClassMarkers  = []string{"disable", "soldout", "sold-out", "outofstock", "out-of-stock"}
+	lowStockClassMarkers = []string{"lowstock", "low-stock", "few"}
+	lowStockTextMarkers  = []string{"残りわずか", "残り僅か"}
+)
+
+// readSizeOption reads the label and stock state of a size selector button.
+// Sold out sizes are rendered disabled, through the disabled or aria-disabled
+// attributes or a class.
+func readSizeOption(button DOMElement) (SizeOption, error) {
+	text, err := button.text()
+	if err != nil {
+		return SizeOption{}, err
+	}
+	class, _ := button.attr("class")
+	ariaDisabled, _ := button.attr("aria-disabled")
+	disabled, _ := button.attr("disabled")
+
+	return sizeOption(text, class, ariaDisabled, disabled), nil
+}
+
+// sizeOption builds a SizeOption from the text and attributes of a size button.
+func sizeOption(text, class, ariaDisabled, disabled string) SizeOption {
+	lines := strings.Split(strings.TrimSpace(text), "\n")
+	option := SizeOption{Size: strings.TrimSpace(lines[0]), InStock: true}
+
+	class = strings.ToLower(class)
+	if ariaDisabled == "true" || disabled == "true" || containsAny(class, soldOutClassMarkers) {
+		option.InStock = false
+	}
+	if option.InStock && (containsAny(class, lowStockClassMarkers) || containsAny(text, lowStockTextMarkers)) {
+		option.LowStock = true
+	}
+	return option
+}
+
+// containsAny reports whether s contains any of the substrings.
+func containsAny(s string, substrings []string) bool {
+	for _, sub := range substrings {
+		if strings.Contains(s, sub) {
+			return true
+		}
+	}
+	return false
+}
+
+// SizeChart is a size chart table: the size labels and, per measurement, the
+// value for each size.
+type SizeChart struct {
+	Sizes        []string      `json:"sizes" bson:"sizes"`
+	Measurements []Measurement `json:"measurements" bson:"measurements"`
+}
+
+// Measurement is one row of a size chart, e.g. chest width, with its value
+// keyed by size label.
+type Measurement struct {
+	Name   string            `json:"name" bson:"name"`
+	Values map[string]string `json:"values" bson:"values"`
+}
+
+// sizeChartRow is the text of one body row of a size chart table. Label is
+// the row's own header cell, if it has one.
+type sizeChartRow struct {
+	Label string
+	Cells []string
+}
+
+// readSizeChartTable reads the header cells and body rows of a size chart
+// table element.
+func readSizeChartTable(table DOMElement) (SizeChart, error) {
+	headerElems, err := table.findElements("thead .sizeChartTHeaderCell")
+	if err != nil {
+		return SizeChart{}, fmt.Errorf("failed to find header elements: %v", err)
+	}
+	var headers []string
+	for _, elem := range headerElems {
+		text, err := elem.text()
+		if err != nil {
+			return SizeChart{}, fmt.Errorf("failed to get header text: %v", err)
+		}
+		headers = append(headers, strings.TrimSpace(text))
+	}
+
+	rowElems, err := table.findElements("tbody .sizeChartTRow")
+	if err != nil {
+		return SizeChart{}, fmt.Errorf("failed to find row elements: %v", err)
+	}
+	var rows []sizeChartRow
+	for _, rowElem := range rowElems {
+		var row sizeChartRow
+		if labelElem, err := findElement(rowElem, "th, .sizeChartTHeaderCell"); err == nil {
+			label, _ := labelElem.text()
+			row.Label = strings.TrimSpace(label)
+		}
+		cellElems, err := rowElem.findElements("td, .sizeChartTCell")
+		if err != nil {
+			return SizeChart{}, fmt.Errorf("failed to find cell elements: %v", err)
+		}
+		for _, cellElem := range cellElems {
+			text, err := cellElem.text()
+			if err != nil {
+				return SizeChart{}, fmt.Errorf("failed to get cell text: %v", err)
+			}
+			row.Cells = append(row.Cells, strings.TrimSpace(text))
+		}
+		rows = append(rows, row)
+	}
+
+	return buildSizeChart(headers, rows), nil
+}
+
+// buildSizeChart turns the text of a size chart table into a SizeChart. Two
+// layouts are in use: apparel charts put the sizes in the header and label
+// every body row with its measurement, while shoe charts repeat the sizes as
+// the first body row and name the measurements in the header, in row order.
+func buildSizeChart(headers []string, rows []sizeChartRow) SizeChart {
+	var chart SizeChart
+	if len(rows) == 0 {
+		return chart
+	}
+
+	measurementRows := rows
+	var measurementNames []string
+	if sizesInHeader(headers, rows) {
+		chart.Sizes = nonEmpty(headers)
+		// Drop the corner cell above the measurement labels.
+		if len(chart.Sizes) == len(rows[0].Cells)+1 {
+			chart.Sizes = chart.Sizes[1:]
+		}
+	} else {
+		chart.Sizes = rows[0].Cells
+		measurementRows = rows[1:]
+		measurementNames = nonEmpty(headers)
+	}
+
+	for i, row := range measurementRows {
+		name := row.Label
+		if name == "" && i < len(measurementNames) {
+			name = measurementNames[i]
+		}
+		if name == "" {
+			name = fmt.Sprintf("measurement %d", i+1)
+		}
+
+		values := make(map[string]string)
+		for j, value := range row.Cells {
+			if j >= len(chart.Sizes) {
+				break
+			}
+			values[chart.Sizes[j]] = value
+		}
+		chart.Measurements = append(chart.Measurements, Measurement{Name: name, Values: values})
+	}
+
+	return chart
+}
+
+// sizesInHeader reports whether the table header holds the size labels, which
+// is the case when every body row carries its own measurement label.
+func sizesInHeader(headers []string, rows []sizeChartRow) bool {
+	if len(nonEmpty(headers)) == 0 {
+		return false
+	}
+	for _, row := range rows {
+		if row.Label == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// nonEmpty returns the non-empty strings of items.
+func nonEmpty(items []string) []string {
+	var result []string
+	for _, item := range items {
+		if item != "" {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+// SizeChartTable is one size chart on a product page. Sets such as tracksuits
+// have a chart for the top and one for the bottoms, each under its own
+// heading.
+type SizeChartTable struct {
+	Label     string `json:"label,omitempty" bson:"label,omitempty"`
+	SizeChart `bson:",inline"`
+}
+
+// sizeChartLabelScript returns the text of the heading closest before the
+// table passed as the first argument, searching the preceding siblings of the
+// table and of its ancestors.
+const sizeChartLabelScript = `
+var heading = /^H[1-6]$/;
+for (var node = arguments[0]; node && node !== document.body; node = node.parentElement) {
+	for (var prev = node.previousElementSibling; prev; prev = prev.previousElementSibling) {
+		if (heading.test(prev.tagName) || /title/i.test(prev.className)) {
+			return prev.textContent.trim();
+		}
+		if (prev.querySelector && prev.querySelector("table")) {
+			return "";
+		}
+	}
+}
+return "";
+`
+
+// sizeChartLabel returns the heading of a size chart table, or "" when it has
+// none.
+func sizeChartLabel(wd selenium.WebDriver, table selenium.WebElement) string {
+	result, err := wd.ExecuteScript(sizeChartLabelScript, []interface{}{table})
+	if err != nil {
+		return ""
+	}
+	label, _ := result.(string)
+	return strings.TrimSpace(label)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSizeOption(t *testing.T) {
+	tests := []struct {
+		name                                string
+		text, class, ariaDisabled, disabled string
+		want                                SizeOption
+	}{
+		{"in stock", "26.0cm", "sizeSelectorListItemButton", "", "", SizeOption{Size: "26.0cm", InStock: true}},
+		{"disabled class", "26.0cm", "sizeSelectorListItemButton disable", "", "", SizeOption{Size: "26.0cm"}},
+		{"sold out class", "26.0cm", "sizeSelectorListItemButton--soldOut", "", "", SizeOption{Size: "26.0cm"}},
+		{"aria-disabled", "M", "sizeSelectorListItemButton", "true", "", SizeOption{Size: "M"}},
+		{"disabled", "M", "sizeSelectorListItemButton", "", "true", SizeOption{Size: "M"}},
+		{"low stock text", "M\n残りわずか", "sizeSelectorListItemButton", "", "", SizeOption{Size: "M", InStock: true, LowStock: true}},
+		{"low stock class", "M", "sizeSelectorListItemButton lowStock", "", "", SizeOption{Size: "M", InStock: true, LowStock: true}},
+		{"sold out is not low stock", "M\n残りわずか", "sizeSelectorListItemButton disable", "", "", SizeOption{Size: "M"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sizeOption(tt.text, tt.class, tt.ariaDisabled, tt.disabled); got != tt.want {
+				t.Errorf("sizeOption(%q, %q) = %+v, want %+v", tt.text, tt.class, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestScrapeSoldOutProduct checks that a product whose every size is sold
+// out keeps its sizes, each out of stock, and is itself out of stock.
+func TestScrapeSoldOutProduct(t *testing.T) {
+	ex := &fixtureExtractor{path: "testdata/product_sold_out.html"}
+	product, _ := scrapeProduct(testConfig(t), ex, "https://shop.adidas.jp/products/FX5502/")
+
+	wantSizes := []string{"24.5cm", "25.0cm", "25.5cm", "26.0cm"}
+	if len(product.AvailableSizes) != len(wantSizes) {
+		t.Fatalf("sizes = %+v, want %q", product.AvailableSizes, wantSizes)
+	}
+	for i, size := range product.AvailableSizes {
+		if size.Size != wantSizes[i] || size.InStock || size.LowStock {
+			t.Errorf("size %d = %+v, want %s out of stock", i, size, wantSizes[i])
+		}
+	}
+	if product.Availability != availabilityOutOfStock {
+		t.Errorf("availability = %q, want %q", product.Availability, availabilityOutOfStock)
+	}
+}
+
+func TestExtractSizeCharts(t *testing.T) {
+	tests := []struct {
+		fixture string
+		want    []SizeChartTable
+	}{
+		{
+			// Shoe charts repeat the sizes as their first row and name the
+			// measurements in the header.
+			fixture: "size_chart_shoes.html",
+			want: []SizeChartTable{{SizeChart: SizeChart{
+				Sizes: []string{"24.5cm", "25.0cm", "25.5cm"},
+				Measurements: []Measurement{
+					{Name: "US", Values: map[string]string{"24.5cm": "6.5", "25.0cm": "7", "25.5cm": "7.5"}},
+					{Name: "UK", Values: map[string]string{"24.5cm": "6", "25.0cm": "6.5", "25.5cm": "7"}},
+					{Name: "EU", Values: map[string]string{"24.5cm": "39 1/3", "25.0cm": "40", "25.5cm": "40 2/3"}},
+				},
+			}}},
+		},
+		{
+			// Apparel charts put the sizes in the header and label each row,
+			// one table per part of a set.
+			fixture: "size_chart_apparel.html",
+			want: []SizeChartTable{
+				{SizeChart: SizeChart{
+					Sizes: []string{"S", "M", "L"},
+					Measurements: []Measurement{
+						{Name: "胸囲", Values: map[string]string{"S": "85-91cm", "M": "92-98cm", "L": "99-105cm"}},
+						{Name: "ウエスト", Values: map[string]string{"S": "71-77cm", "M": "78-84cm", "L": "85-91cm"}},
+					},
+				}},
+				{SizeChart: SizeChart{
+					Sizes: []string{"S", "M"},
+					Measurements: []Measurement{
+						{Name: "ヒップ", Values: map[string]string{"S": "88-94cm", "M": "95-101cm"}},
+					},
+				}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.fixture, func(t *testing.T) {
+			ex := &fixtureExtractor{path: filepath.Join("testdata", tt.fixture)}
+			if err := ex.load(""); err != nil {
+				t.Fatal(err)
+			}
+			got, err := extractSizeCharts(ex)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("extractSizeCharts() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+// crawlerVersion is the version of the crawler recorded on the documents it
+// writes. Release builds set it with
+//
+//	go build -ldflags "-X main.crawlerVersion=$(git describe --tags --always)"
+var crawlerVersion = "dev"
+
+// sourceProcess names this crawler process in SourceWorker, as host/pid.
+var sourceProcess = func() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s/%d", host, os.Getpid())
+}()
+
+// sourceWorker names the worker writing a document for SourceWorker: the
+// process, followed by the phase and the worker number that ctx was tagged
+// with by withLogAttrs, e.g. "crawler-1/4242/scrape/3".
+func sourceWorker(ctx context.Context) string {
+	parts := []string{sourceProcess}
+	attrs, _ := ctx.Value(logAttrsKey{}).([]slog.Attr)
+	for _, key := range []string{"phase", "worker"} {
+		// The innermost tag wins, as it does in the log records.
+		for i := len(attrs) - 1; i >= 0; i-- {
+			if attrs[i].Key == key {
+				parts = append(parts, attrs[i].Value.String())
+				break
+			}
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+// stampProductURL sets the metadata every storage records on a product URL
+// it inserts.
+func stampProductURL(ctx context.Context, productURL *ProductURL, now time.Time) {
+	productURL.UpdatedAt = now
+	productURL.CrawlerVersion = crawlerVersion
+	productURL.SourceWorker = sourceWorker(ctx)
+}
+
+// stampProduct sets the metadata every storage records on a product it
+// saves. The worker is kept when already set, as batchStorage does before
+// the product is written without the worker's context.
+func stampProduct(ctx context.Context, product *Product) {
+	product.CrawlerVersion = crawlerVersion
+	if product.SourceWorker == "" {
+		product.SourceWorker = sourceWorker(ctx)
+	}
+}
+
+// urlScraped reports whether a product URL marked with status has had its
+// page scraped, so that its CrawledAt is set.
+func urlScraped(status string) bool {
+	return status != statusPending && status != statusInProgress
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// crawlStats counts the work completed during a run. It is shared by all
+// workers, so every field is updated atomically.
+type crawlStats struct {
+	ListingPages      atomic.Int64
+	ProductURLs       atomic.Int64
+	Dispatched        atomic.Int64 // product URLs handed to scrape workers
+	Completed         atomic.Int64 // product URLs scraped, successfully or not
+	Products          atomic.Int64
+	NewProducts       atomic.Int64 // products saved for the first time
+	ChangedProducts   atomic.Int64 // stored products whose content changed
+	UnchangedProducts atomic.Int64 // stored products seen again unchanged, see contentHash
+	Failed            atomic.Int64
+	Dead              atomic.Int64 // product URLs that were not found, redirected or blocked
+	Timeouts          atomic.Int64 // page loads that hit the page load timeout
+	Challenges        atomic.Int64 // bot challenge pages served instead of content
+	Variants          atomic.Int64 // color variant URLs queued by -expand-colors
+	Requests          atomic.Int64 // page loads let through by the throttle
+	BrowserFallbacks  atomic.Int64 // product pages the HTTP engine left to the browser
+	Panics            atomic.Int64 // panics recovered from, see scrapeSafely and recoverWorker
+	URLWrites         atomic.Int64 // storage writes of product URLs, one per listing page
+	ProductWrites     atomic.Int64 // storage writes of products, one per batch, see batchStorage
+	SessionsCreated   atomic.Int64 // browser sessions opened by the session pool
+	SessionsRecycled  atomic.Int64 // browser sessions quit after -session-max-pages pages
+	SessionsFailed    atomic.Int64 // browser sessions that could not be opened or broke
+
+	RobotsSkipped atomic.Int64 // URLs not queued because robots.txt disallows them
+
+	// Pending is the number of product URLs the scrape phase expected to
+	// dispatch when it started, for the progress display's estimate.
+	Pending atomic.Int64
+
+	firstRequest atomic.Int64 // Unix nanoseconds of the first page load
+
+	mu         sync.Mutex
+	failures   map[string]int64   // product URLs per failure class, see countFailure
+	timings    map[string][]int64 // milliseconds per section of the scraped products, see addTimings
+	categories map[string]int64   // saved products per category, see countCategory
+	listing    []int64            // milliseconds per listing page read in the browser, see addListingTime
+	firstPages []int64            // milliseconds from opening a browser session to its first page read, see addFirstPageTime
+}
+
+// addListingTime records the time a listing page took to load and read in
+// the browser.
+func (s *crawlStats) addListingTime(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.listing = append(s.listing, d.Milliseconds())
+}
+
+// listingPercentiles returns the median and 95th percentile time of the
+// listing pages read in the browser, in milliseconds, and their number.
+func (s *crawlStats) listingPercentiles() (p50, p95 int64, n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sorted := slices.Clone(s.listing)
+	slices.Sort(sorted)
+	return percentile(sorted, 0.50), percentile(sorted, 0.95), len(sorted)
+}
+
+// addFirstPageTime records the time from opening a browser session to the
+// end of its first page, which includes restoring its cookies and dismissing
+// the overlays a new visitor is shown.
+func (s *crawlStats) addFirstPageTime(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.firstPages = append(s.firstPages, d.Milliseconds())
+}
+
+// firstPagePercentiles is listingPercentiles for the first pages of the
+// browser sessions.
+func (s *crawlStats) firstPagePercentiles() (p50, p95 int64, n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sorted := slices.Clone(s.firstPages)
+	slices.Sort(sorted)
+	return percentile(sorted, 0.50), percentile(sorted, 0.95), len(sorted)
+}
+
+// countCategory records a saved product of category.
+func (s *crawlStats) countCategory(category string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.categories == nil {
+		s.categories = make(map[string]int64)
+	}
+	s.categories[category]++
+}
+
+// categoryCounts returns the number of saved products per category, nil
+// when none was saved.
+func (s *crawlStats) categoryCounts() map[string]int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.categories) == 0 {
+		return nil
+	}
+	counts := make(map[string]int64, len(s.categories))
+	for category, n := range s.categories {
+		counts[category] = n
+	}
+	return counts
+}
+
+// addTimings records the timing of a scraped product.
+func (s *crawlStats) addTimings(timing ScrapeTiming) {
+	if len(timing) == 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.timings == nil {
+		s.timings = make(map[string][]int64)
+	}
+	for section, ms := range timing {
+		s.timings[section] = append(s.timings[section], ms)
+	}
+}
+
+// timingPercentiles returns the percentiles of the timings recorded so far,
+// see timingPercentiles.
+func (s *crawlStats) timingPercentiles() []sectionPercentiles {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return timingPercentiles(s.timings)
+}
+
+// countFailure records a product URL that failed with the failure class.
+func (s *crawlStats) countFailure(class string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failures == nil {
+		s.failures = make(map[string]int64)
+	}
+	s.failures[class]++
+}
+
+// failureCounts returns the number of product URLs per failure class.
+func (s *crawlStats) failureCounts() map[string]int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	counts := make(map[string]int64, len(s.failures))
+	for class, n := range s.failures {
+		counts[class] = n
+	}
+	return counts
+}
+
+// countRequest records a page load.
+func (s *crawlStats) countRequest() {
+	s.firstRequest.CompareAndSwap(0, time.Now().UnixNano())
+	s.Requests.Add(1)
+}
+
+// requestRate returns the average number of page loads per second since the
+// first one.
+func (s *crawlStats) requestRate() float64 {
+	first := s.firstRequest.Load()
+	if first == 0 {
+		return 0
+	}
+	elapsed := time.Since(time.Unix(0, first)).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(s.Requests.Load()) / elapsed
+}
+
+// snapshot returns the current counts by name, for events sent elsewhere.
+// Failure classes are counted as failed_<class>.
+func (s *crawlStats) snapshot() map[string]int64 {
+	counts := map[string]int64{
+		"listing_pages":      s.ListingPages.Load(),
+		"product_urls":       s.ProductURLs.Load(),
+		"dispatched":         s.Dispatched.Load(),
+		"completed":          s.Completed.Load(),
+		"products":           s.Products.Load(),
+		"new_products":       s.NewProducts.Load(),
+		"changed_products":   s.ChangedProducts.Load(),
+		"unchanged_products": s.UnchangedProducts.Load(),
+		"failed":             s.Failed.Load(),
+		"gone":               s.Dead.Load(),
+		"timeouts":           s.Timeouts.Load(),
+		"challenges":         s.Challenges.Load(),
+		"variants":           s.Variants.Load(),
+		"page_loads":         s.Requests.Load(),
+		"browser_fallbacks":  s.BrowserFallbacks.Load(),
+		"panics":             s.Panics.Load(),
+		"product_url_writes": s.URLWrites.Load(),
+		"product_writes":     s.ProductWrites.Load(),
+		"robots_skipped":     s.RobotsSkipped.Load(),
+		"sessions_created":   s.SessionsCreated.Load(),
+		"sessions_recycled":  s.SessionsRecycled.Load(),
+		"sessions_failed":    s.SessionsFailed.Load(),
+		"pending":            s.Pending.Load(),
+	}
+	for class, n := range s.failureCounts() {
+		counts["failed_"+class] = n
+	}
+	if p50, p95, n := s.listingPercentiles(); n > 0 {
+		counts["listing_page_ms_p50"], counts["listing_page_ms_p95"] = p50, p95
+	}
+	if p50, p95, n := s.firstPagePercentiles(); n > 0 {
+		counts["first_page_ms_p50"], counts["first_page_ms_p95"] = p50, p95
+	}
+	return counts
+}
+
+func (s *crawlStats) String() string {
+	return fmt.Sprintf("%d listing pages, %d product URLs, %d of %d dispatched product URLs (%d products saved: %d new, %d changed, %d unchanged; %d failed, %d gone, %d page load timeouts, %d bot challenges, %d panics), %d page loads at %.2f/s, %d URLs disallowed by robots.txt, %d product URL writes, %d product writes",
+		s.ListingPages.Load(), s.ProductURLs.Load(), s.Completed.Load(), s.Dispatched.Load(), s.Products.Load(), s.NewProducts.Load(), s.ChangedProducts.Load(), s.UnchangedProducts.Load(), s.Failed.Load(), s.Dead.Load(), s.Timeouts.Load(), s.Challenges.Load(), s.Panics.Load(),
+		s.Requests.Load(), s.requestRate(), s.RobotsSkipped.Load(), s.URLWrites.Load(), s.ProductWrites.Load())
+}
+
+// logSummary reports what a phase completed, noting when it was cut short by
+// a shutdown signal.
+func logSummary(ctx context.Context, phase string, stats *crawlStats) {
+	if ctx.Err() != nil {
+		slog.Warn(phase+" interrupted, stopped after completing part of the work", stats.logAttrs()...)
+	} else {
+		slog.Info(phase+" finished", stats.logAttrs()...)
+	}
+	if timings := stats.timingPercentiles(); len(timings) > 0 {
+		attrs := make([]any, 0, len(timings))
+		for _, t := range timings {
+			attrs = append(attrs, slog.String(t.Section, fmt.Sprintf("p50=%dms p95=%dms share=%.0f%%", t.P50, t.P95, t.Share*100)))
+		}
+		slog.Info(phase+" time per product page section, slowest first", attrs...)
+	}
+	if panics := stats.Panics.Load(); panics > 0 {
+		slog.Error(phase+" recovered from panics, see the logged stacks", "panics", panics)
+	}
+}
+
+// logAttrs returns the counts as log attributes, for structured log output.
+func (s *crawlStats) logAttrs() []any {
+	counts := s.snapshot()
+	names := make([]string, 0, len(counts))
+	for name := range counts {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	attrs := make([]any, 0, len(names)+1)
+	for _, name := range names {
+		attrs = append(attrs, slog.Int64(name, counts[name]))
+	}
+	return append(attrs, slog.String("page_loads_per_second", fmt.Sprintf("%.2f", s.requestRate())))
+}
@@ -0,0 +1,663 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Storage keeps the product URLs found by discovery, their scrape status and
+// the scraped products. MongoDB is the default and PostgreSQL is selected
+// with -storage=postgres; with -output dir://PATH everything is written to
+// files instead, see fileStorage.
+type Storage interface {
+	// prepare sets up what the storage needs before a phase runs, such as
+	// the indexes of the MongoDB collections.
+	prepare(ctx context.Context) error
+	close() error
+
+	countProductURLs(ctx context.Context) (int64, error)
+	// countPendingProductURLs counts the URLs eachPendingProductURL would
+	// select without a limit.
+	countPendingProductURLs(ctx context.Context, categories *regexp.Regexp) (int64, error)
+	// saveProductURL stores productURL unless its URL is already known and
+	// reports whether it was new.
+	saveProductURL(ctx context.Context, productURL ProductURL) (bool, error)
+	// saveProductURLs stores the product URLs whose URL is not known yet, in
+	// one round trip where the storage allows, and returns how many were new.
+	saveProductURLs(ctx context.Context, productURLs []ProductURL) (int, error)
+	// eachPendingProductURL calls fn with every pending product URL in a
+	// category matched by categories, nil for all, up to limit URLs, 0 for
+	// all, until fn returns false.
+	eachPendingProductURL(ctx context.Context, categories *regexp.Regexp, limit int, fn func(ProductURL) bool) error
+	// eachStaleProductURL calls fn with the product URLs in a category
+	// matched by categories whose product was never saved or last seen
+	// before before, the stalest first, up to limit URLs, 0 for all, until
+	// fn returns false. URLs claimed by a worker or leading to no product
+	// page are left out.
+	eachStaleProductURL(ctx context.Context, categories *regexp.Regexp, before time.Time, limit int, fn func(ProductURL) bool) error
+	// claimProductURL moves url from pending to in_progress. It reports false
+	// when the URL was already claimed.
+	claimProductURL(ctx context.Context, url string) (bool, error)
+	// markProductURL records the outcome of scraping url, see markProductURL.
+	markProductURL(ctx context.Context, url, status string, scrapeErr error, fields map[string]any) error
+	releaseStaleClaims(ctx context.Context, timeout time.Duration) (int64, error)
+	countNotFound(ctx context.Context, url string) (int, error)
+	deleteProductURL(ctx context.Context, url string) error
+
+	// saveProduct inserts product or refreshes the stored one with the same
+	// product number, keeping its first crawl time, and records the changes
+	// of its price and stock in the product history. A stored product with
+	// the same content hash only gets its last_seen_at bumped. It returns
+	// productNew, productChanged or productUnchanged.
+	saveProduct(ctx context.Context, product *Product) (string, error)
+	// saveProducts saves products as saveProduct does, in as few round trips
+	// as the storage allows. It returns the outcome of every product, or the
+	// error it failed with at the same index of errs.
+	saveProducts(ctx context.Context, products []*Product) (outcomes []string, errs []error)
+	hasProduct(ctx context.Context, productNumber string) (bool, error)
+	// eachProduct calls fn with every stored product, by product number,
+	// until fn returns false. PostgreSQL only fills in the fields of
+	// completenessFields and the first and last crawl times.
+	eachProduct(ctx context.Context, fn func(*Product) bool) error
+	// productHistory returns the recorded changes of a product, the oldest
+	// first.
+	productHistory(ctx context.Context, productNumber string) ([]historyEntry, error)
+	// eachHistory calls fn with the recorded changes of the runs after
+	// afterRunID up to and including untilRunID, the oldest first, until fn
+	// returns false. Run IDs sort by start time.
+	eachHistory(ctx context.Context, afterRunID, untilRunID string, fn func(historyEntry) bool) error
+	// updateProductMedia stores the media and color options of product,
+	// after their files were downloaded.
+	updateProductMedia(ctx context.Context, product *Product) error
+
+	// startRun records a run as it starts and finishRun records its outcome.
+	startRun(ctx context.Context, run *crawlRun) error
+	finishRun(ctx context.Context, run *crawlRun) error
+	// recentRuns returns up to limit runs, the most recent first.
+	recentRuns(ctx context.Context, limit int) ([]crawlRun, error)
+	// findRun returns the run with the given ID, or nil when there is none.
+	findRun(ctx context.Context, id string) (*crawlRun, error)
+	// lastScrapeRun returns the most recent finished run started before
+	// before that scraped products, or nil when there is none.
+	lastScrapeRun(ctx context.Context, before time.Time) (*crawlRun, error)
+
+	// recordFailure adds failure to the failed URLs or, for a URL already
+	// among them, counts another attempt. The URL is flagged permanent once
+	// its attempts reach maxAttempts.
+	recordFailure(ctx context.Context, failure failedURL, maxAttempts int) error
+	clearFailure(ctx context.Context, url string) error
+	// eachFailure calls fn with every failed URL that is not permanent, of
+	// an error class in classes, nil for all, until fn returns false.
+	eachFailure(ctx context.Context, classes []string, fn func(failedURL) bool) error
+}
+
+// Outcomes of saveProduct.
+const (
+	productNew       = "new"
+	productChanged   = "changed"
+	productUnchanged = "unchanged"
+)
+
+// saveEachProduct implements saveProducts with one saveProduct per product,
+// for storages that have nothing to gain from batching.
+func saveEachProduct(ctx context.Context, store Storage, products []*Product) ([]string, []error) {
+	outcomes, errs := make([]string, len(products)), make([]error, len(products))
+	for i, product := range products {
+		outcomes[i], errs[i] = store.saveProduct(ctx, product)
+	}
+	return outcomes, errs
+}
+
+// openStorage opens the storage selected by cfg.Output and cfg.Storage.
+func openStorage(cfg *Config) (Storage, error) {
+	if dir, ok := strings.CutPrefix(cfg.Output, outputDirPrefix); ok {
+		return openFileStorage(dir)
+	}
+	if cfg.Storage == storagePostgres {
+		return openPostgresStorage(context.Background(), cfg)
+	}
+
+	client, err := connectMongo(cfg)
+	if err != nil {
+		return nil, err
+	}
+	db := client.Database(cfg.DBName)
+	return &mongoStorage{
+		client:      client,
+		productURLs: db.Collection(cfg.ProductURLCollection),
+		products:    db.Collection(cfg.ProductCollection),
+		runs:        db.Collection(cfg.RunCollection),
+		failures:    db.Collection(cfg.FailedCollection),
+		history:     db.Collection(cfg.HistoryCollection),
+
+		writeAttempts: cfg.MongoWriteAttempts,
+	}, nil
+}
+
+// Databases selectable with -storage.
+const (
+	storageMongo    = "mongo"
+	storagePostgres = "postgres"
+)
+
+// mongoStorage is the Storage backed by the product_urls, products,
+// product_history, crawl_runs and failed_urls collections.
+type mongoStorage struct {
+	client      *mongo.Client
+	productURLs *mongo.Collection
+	products    *mongo.Collection
+	runs        *mongo.Collection
+	failures    *mongo.Collection
+	history     *mongo.Collection
+
+	writeAttempts int // see retryWrite
+}
+
+func (s *mongoStorage) prepare(ctx context.Context) error {
+	return s.ensureIndexes(ctx)
+}
+
+// ensureIndexes creates every index the crawler relies on. It is idempotent
+// and fails with a pointer to init-db -dedupe when duplicates stand in the
+// way of a unique index.
+func (s *mongoStorage) ensureIndexes(ctx context.Context) error {
+	if err := ensureProductURLIndexes(ctx, s.productURLs); err != nil {
+		return err
+	}
+	if err := ensureProductIndexes(ctx, s.products); err != nil {
+		return err
+	}
+	_, err := s.failures.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "url", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create failed URL index: %v", err)
+	}
+	_, err = s.history.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "product_number", Value: 1}, {Key: "changed_at", Value: 1}},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create product history index: %v", err)
+	}
+	return nil
+}
+
+// dedupe deletes the product URLs and products that share their URL or
+// product number with a newer one, so that the unique indexes can be built.
+func (s *mongoStorage) dedupe(ctx context.Context) error {
+	for _, c := range []struct {
+		collection *mongo.Collection
+		field      string
+	}{{s.productURLs, "url"}, {s.products, "product_number"}} {
+		deleted, err := dedupeCollection(ctx, c.collection, c.field)
+		if err != nil {
+			return err
+		}
+		slog.InfoContext(ctx, "Removed duplicate documents", "collection", c.collection.Name(), "key", c.field, "deleted", deleted)
+	}
+	return nil
+}
+
+func (s *mongoStorage) close() error {
+	disconnectMongo(s.client)
+	return nil
+}
+
+func (s *mongoStorage) countProductURLs(ctx context.Context) (int64, error) {
+	return s.productURLs.CountDocuments(ctx, bson.M{})
+}
+
+func (s *mongoStorage) countPendingProductURLs(ctx context.Context, categories *regexp.Regexp) (int64, error) {
+	filter := pendingFilter()
+	if categories != nil {
+		filter["category"] = bson.M{"$regex": categories.String()}
+	}
+	return s.productURLs.CountDocuments(ctx, filter)
+}
+
+func (s *mongoStorage) saveProductURL(ctx context.Context, productURL ProductURL) (bool, error) {
+	var inserted bool
+	err := retryWrite(ctx, s.writeAttempts, func() (err error) {
+		inserted, err = saveProductURL(ctx, s.productURLs, productURL)
+		return err
+	})
+	return inserted, err
+}
+
+func (s *mongoStorage) saveProductURLs(ctx context.Context, productURLs []ProductURL) (int, error) {
+	// An attempt that failed part way still inserted some; the next one
+	// finds those known.
+	inserted := 0
+	err := retryWrite(ctx, s.writeAttempts, func() error {
+		n, err := saveProductURLs(ctx, s.productURLs, productURLs)
+		inserted += n
+		return err
+	})
+	return inserted, err
+}
+
+func (s *mongoStorage) eachPendingProductURL(ctx context.Context, categories *regexp.Regexp, limit int, fn func(ProductURL) bool) error {
+	filter := pendingFilter()
+	if categories != nil {
+		filter["category"] = bson.M{"$regex": categories.String()}
+	}
+	findOptions := options.Find()
+	if limit > 0 {
+		findOptions.SetLimit(int64(limit))
+	}
+
+	cursor, err := s.productURLs.Find(ctx, filter, findOptions)
+	if err != nil {
+		return fmt.Errorf("failed to find documents: %v", err)
+	}
+	defer cursor.Close(context.Background())
+
+	// Documents are handed on as the cursor returns them, so memory use does
+	// not grow with the size of the catalog.
+	for cursor.Next(ctx) {
+		var productURL ProductURL
+		if err := cursor.Decode(&productURL); err != nil {
+			slog.WarnContext(ctx, "Failed to decode product URL", "err", err)
+			continue
+		}
+		if !fn(productURL) {
+			return nil
+		}
+	}
+	if err := cursor.Err(); err != nil && ctx.Err() == nil {
+		return fmt.Errorf("failed to iterate over cursor: %v", err)
+	}
+	return nil
+}
+
+// staleStatuses are the statuses of product URLs eachStaleProductURL selects
+// from: all but those claimed by a worker and those leading to no product
+// page. Documents discovered before statuses were recorded have none.
+var staleStatuses = []any{statusPending, statusDone, statusFailed, statusComingSoon, nil}
+
+func (s *mongoStorage) eachStaleProductURL(ctx context.Context, categories *regexp.Regexp, before time.Time, limit int, fn func(ProductURL) bool) error {
+	match := bson.M{"status": bson.M{"$in": staleStatuses}}
+	if categories != nil {
+		match["category"] = bson.M{"$regex": categories.String()}
+	}
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: match}},
+		// Products store their URL as producturl, having no bson tag for it.
+		{{Key: "$lookup", Value: bson.M{"from": s.products.Name(), "localField": "url", "foreignField": "producturl", "as": "product"}}},
+		// Products saved before last_seen_at was recorded fall back to
+		// updated_at; a URL without a product has neither and sorts first.
+		{{Key: "$addFields", Value: bson.M{"seen_at": bson.M{"$ifNull": bson.A{
+			bson.M{"$max": "$product.last_seen_at"},
+			bson.M{"$max": "$product.updated_at"},
+		}}}}},
+		{{Key: "$match", Value: bson.M{"$or": bson.A{bson.M{"seen_at": nil}, bson.M{"seen_at": bson.M{"$lt": before}}}}}},
+		{{Key: "$sort", Value: bson.D{{Key: "seen_at", Value: 1}, {Key: "_id", Value: 1}}}},
+	}
+	if limit > 0 {
+		pipeline = append(pipeline, bson.D{{Key: "$limit", Value: limit}})
+	}
+	pipeline = append(pipeline, bson.D{{Key: "$project", Value: bson.M{"product": 0, "seen_at": 0}}})
+
+	cursor, err := s.productURLs.Aggregate(ctx, pipeline)
+	if err != nil {
+		return fmt.Errorf("failed to find stale product URLs: %v", err)
+	}
+	defer cursor.Close(context.Background())
+	for cursor.Next(ctx) {
+		var productURL ProductURL
+		if err := cursor.Decode(&productURL); err != nil {
+			slog.WarnContext(ctx, "Failed to decode product URL", "err", err)
+			continue
+		}
+		if !fn(productURL) {
+			return nil
+		}
+	}
+	if err := cursor.Err(); err != nil && ctx.Err() == nil {
+		return fmt.Errorf("failed to iterate over cursor: %v", err)
+	}
+	return nil
+}
+
+func (s *mongoStorage) claimProductURL(ctx context.Context, url string) (bool, error) {
+	return claimProductURL(ctx, s.productURLs, url)
+}
+
+func (s *mongoStorage) markProductURL(ctx context.Context, url, status string, scrapeErr error, fields map[string]any) error {
+	return retryWrite(ctx, s.writeAttempts, func() error {
+		return markProductURL(ctx, s.productURLs, url, status, scrapeErr, fields)
+	})
+}
+
+func (s *mongoStorage) releaseStaleClaims(ctx context.Context, timeout time.Duration) (int64, error) {
+	return releaseStaleClaims(ctx, s.productURLs, timeout)
+}
+
+func (s *mongoStorage) countNotFound(ctx context.Context, url string) (int, error) {
+	return countNotFound(ctx, s.productURLs, url)
+}
+
+func (s *mongoStorage) deleteProductURL(ctx context.Context, url string) error {
+	return deleteProductURL(ctx, s.productURLs, url)
+}
+
+func (s *mongoStorage) saveProduct(ctx context.Context, product *Product) (string, error) {
+	var touched bool
+	err := retryWrite(ctx, s.writeAttempts, func() (err error) {
+		touched, err = touchProduct(ctx, s.products, product)
+		return err
+	})
+	if err != nil || touched {
+		return productUnchanged, err
+	}
+	// A retry after an attempt that did write sees the product as stored
+	// already, so it counts as changed rather than new.
+	var stored *Product
+	err = retryWrite(ctx, s.writeAttempts, func() (err error) {
+		stored, err = saveProduct(ctx, s.products, product)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	if changes := productChanges(stored, product); len(changes) > 0 {
+		docs := make([]any, len(changes))
+		for i, change := range changes {
+			docs[i] = change
+		}
+		if _, err := s.history.InsertMany(ctx, docs); err != nil {
+			// The product itself is saved; only this scrape's changes are lost.
+			slog.ErrorContext(ctx, "Failed to record product history", "product_number", product.ProductNumber, "err", err)
+		}
+	}
+	if stored == nil {
+		return productNew, nil
+	}
+	return productChanged, nil
+}
+
+// saveProducts looks up the stored versions of products at once and writes
+// them in one bulk write, their history in one more. A product saved by
+// another worker in between is written over like with saveProduct, only its
+// history entries may be off.
+func (s *mongoStorage) saveProducts(ctx context.Context, products []*Product) ([]string, []error) {
+	outcomes, errs := make([]string, len(products)), make([]error, len(products))
+	var numbers []string
+	for i, product := range products {
+		if product.ProductNumber == "" {
+			errs[i] = fmt.Errorf("product %s has no product number", product.ProductURL)
+			continue
+		}
+		numbers = append(numbers, product.ProductNumber)
+	}
+	if len(numbers) == 0 {
+		return outcomes, errs
+	}
+	failAll := func(err error) ([]string, []error) {
+		for i := range errs {
+			if errs[i] == nil {
+				errs[i] = err
+			}
+		}
+		return outcomes, errs
+	}
+
+	projection := bson.M{"product_number": 1, "content_hash": 1, "first_crawled_at": 1, "updated_at": 1}
+	for field := range historyProjection {
+		projection[field] = 1
+	}
+	cursor, err := s.products.Find(ctx, bson.M{"product_number": bson.M{"$in": numbers}}, options.Find().SetProjection(projection))
+	if err != nil {
+		return failAll(fmt.Errorf("failed to find stored products: %v", err))
+	}
+	var found []Product
+	if err := cursor.All(ctx, &found); err != nil {
+		return failAll(fmt.Errorf("failed to read stored products: %v", err))
+	}
+	stored := make(map[string]*Product, len(found))
+	for i := range found {
+		stored[found[i].ProductNumber] = &found[i]
+	}
+
+	now := time.Now().UTC()
+	var writes []mongo.WriteModel
+	var changes []any
+	for i, product := range products {
+		if errs[i] != nil {
+			continue
+		}
+		before := stored[product.ProductNumber]
+		product.LastSeenAt = now
+		stampProduct(ctx, product)
+		if before != nil && product.ContentHash != "" && before.ContentHash == product.ContentHash {
+			product.FirstCrawledAt, product.UpdatedAt = before.FirstCrawledAt, before.UpdatedAt
+			set := scrapedSectionsSet(product)
+			set["last_seen_at"] = now
+			writes = append(writes, mongo.NewUpdateOneModel().
+				SetFilter(bson.M{"product_number": product.ProductNumber}).
+				SetUpdate(bson.M{"$set": set}))
+			outcomes[i] = productUnchanged
+			continue
+		}
+
+		product.FirstCrawledAt = time.Time{}
+		product.UpdatedAt = now
+		update, err := productUpdate(product, now)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		writes = append(writes, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"product_number": product.ProductNumber}).
+			SetUpdate(update).
+			SetUpsert(true))
+		for _, change := range productChanges(before, product) {
+			changes = append(changes, change)
+		}
+		outcomes[i] = productChanged
+		if before == nil {
+			outcomes[i] = productNew
+		}
+	}
+
+	err = retryWrite(ctx, s.writeAttempts, func() error {
+		_, err := s.products.BulkWrite(ctx, writes, options.BulkWrite().SetOrdered(false))
+		return err
+	})
+	if err != nil {
+		return failAll(fmt.Errorf("failed to write products: %v", err))
+	}
+	if len(changes) > 0 {
+		if _, err := s.history.InsertMany(ctx, changes); err != nil {
+			// The products themselves are saved; only this batch's changes are lost.
+			slog.ErrorContext(ctx, "Failed to record product history", "products", len(products), "err", err)
+		}
+	}
+	return outcomes, errs
+}
+
+func (s *mongoStorage) productHistory(ctx context.Context, productNumber string) ([]historyEntry, error) {
+	cursor, err := s.history.Find(ctx, bson.M{"product_number": productNumber}, options.Find().SetSort(bson.D{{Key: "changed_at", Value: 1}}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to find product history: %v", err)
+	}
+	var entries []historyEntry
+	if err := cursor.All(ctx, &entries); err != nil {
+		return nil, fmt.Errorf("failed to read product history: %v", err)
+	}
+	return entries, nil
+}
+
+func (s *mongoStorage) eachHistory(ctx context.Context, afterRunID, untilRunID string, fn func(historyEntry) bool) error {
+	cursor, err := s.history.Find(ctx,
+		bson.M{"run_id": bson.M{"$gt": afterRunID, "$lte": untilRunID}},
+		options.Find().SetSort(bson.D{{Key: "changed_at", Value: 1}}))
+	if err != nil {
+		return fmt.Errorf("failed to find product history: %v", err)
+	}
+	defer cursor.Close(context.Background())
+	for cursor.Next(ctx) {
+		var e historyEntry
+		if err := cursor.Decode(&e); err != nil {
+			slog.WarnContext(ctx, "Failed to decode product history", "err", err)
+			continue
+		}
+		if !fn(e) {
+			return nil
+		}
+	}
+	if err := cursor.Err(); err != nil && ctx.Err() == nil {
+		return fmt.Errorf("failed to iterate over product history: %v", err)
+	}
+	return nil
+}
+
+func (s *mongoStorage) hasProduct(ctx context.Context, productNumber string) (bool, error) {
+	n, err := s.products.CountDocuments(ctx, bson.M{"product_number": productNumber})
+	return n > 0, err
+}
+
+func (s *mongoStorage) eachProduct(ctx context.Context, fn func(*Product) bool) error {
+	cursor, err := s.products.Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "product_number", Value: 1}}))
+	if err != nil {
+		return fmt.Errorf("failed to find products: %v", err)
+	}
+	defer cursor.Close(context.Background())
+	for cursor.Next(ctx) {
+		var product Product
+		if err := cursor.Decode(&product); err != nil {
+			slog.WarnContext(ctx, "Failed to decode product", "err", err)
+			continue
+		}
+		if !fn(&product) {
+			return nil
+		}
+	}
+	if err := cursor.Err(); err != nil && ctx.Err() == nil {
+		return fmt.Errorf("failed to iterate over products: %v", err)
+	}
+	return nil
+}
+
+func (s *mongoStorage) updateProductMedia(ctx context.Context, product *Product) error {
+	_, err := s.products.UpdateOne(ctx,
+		bson.M{"product_number": product.ProductNumber},
+		bson.M{"$set": bson.M{"media": product.Media, "availablecolors": product.AvailableColors}},
+	)
+	return err
+}
+
+func (s *mongoStorage) startRun(ctx context.Context, run *crawlRun) error {
+	_, err := s.runs.InsertOne(ctx, run)
+	return err
+}
+
+func (s *mongoStorage) finishRun(ctx context.Context, run *crawlRun) error {
+	_, err := s.runs.ReplaceOne(ctx, bson.M{"run_id": run.ID}, run)
+	return err
+}
+
+func (s *mongoStorage) findRun(ctx context.Context, id string) (*crawlRun, error) {
+	var run crawlRun
+	err := s.runs.FindOne(ctx, bson.M{"run_id": id}).Decode(&run)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to find run: %v", err)
+	}
+	return &run, nil
+}
+
+func (s *mongoStorage) lastScrapeRun(ctx context.Context, before time.Time) (*crawlRun, error) {
+	var run crawlRun
+	err := s.runs.FindOne(ctx,
+		bson.M{"started_at": bson.M{"$lt": before}, "status": bson.M{"$ne": runRunning}, "stats.completed": bson.M{"$gt": 0}},
+		options.FindOne().SetSort(bson.D{{Key: "started_at", Value: -1}}),
+	).Decode(&run)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to find the last run: %v", err)
+	}
+	return &run, nil
+}
+
+func (s *mongoStorage) recentRuns(ctx context.Context, limit int) ([]crawlRun, error) {
+	cursor, err := s.runs.Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "started_at", Value: -1}}).SetLimit(int64(limit)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to find runs: %v", err)
+	}
+	var runs []crawlRun
+	if err := cursor.All(ctx, &runs); err != nil {
+		return nil, fmt.Errorf("failed to read runs: %v", err)
+	}
+	return runs, nil
+}
+
+// recordFailure upserts failure with an update pipeline, so that counting the
+// attempt and flagging the URL permanent happen in one atomic write.
+func (s *mongoStorage) recordFailure(ctx context.Context, failure failedURL, maxAttempts int) error {
+	update := mongo.Pipeline{
+		{{Key: "$set", Value: bson.D{
+			{Key: "url", Value: failure.URL},
+			{Key: "section", Value: failure.Section},
+			{Key: "category", Value: failure.Category},
+			{Key: "pageno", Value: failure.PageNo},
+			{Key: "error_class", Value: failure.ErrorClass},
+			{Key: "error", Value: failure.Error},
+			{Key: "attempts", Value: bson.M{"$add": bson.A{bson.M{"$ifNull": bson.A{"$attempts", 0}}, 1}}},
+			{Key: "first_failed_at", Value: bson.M{"$ifNull": bson.A{"$first_failed_at", failure.LastFailedAt}}},
+			{Key: "last_failed_at", Value: failure.LastFailedAt},
+			{Key: "artifacts", Value: failure.Artifacts},
+			{Key: "missing_fields", Value: failure.MissingFields},
+		}}},
+		{{Key: "$set", Value: bson.D{
+			{Key: "permanent", Value: bson.M{"$gte": bson.A{"$attempts", maxAttempts}}},
+		}}},
+	}
+	_, err := s.failures.UpdateOne(ctx, bson.M{"url": failure.URL}, update, options.Update().SetUpsert(true))
+	return err
+}
+
+func (s *mongoStorage) clearFailure(ctx context.Context, url string) error {
+	_, err := s.failures.DeleteOne(ctx, bson.M{"url": url})
+	return err
+}
+
+func (s *mongoStorage) eachFailure(ctx context.Context, classes []string, fn func(failedURL) bool) error {
+	filter := bson.M{"permanent": bson.M{"$ne": true}}
+	if classes != nil {
+		filter["error_class"] = bson.M{"$in": classes}
+	}
+	cursor, err := s.failures.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "last_failed_at", Value: 1}}))
+	if err != nil {
+		return fmt.Errorf("failed to find failed URLs: %v", err)
+	}
+	defer cursor.Close(context.Background())
+	for cursor.Next(ctx) {
+		var failure failedURL
+		if err := cursor.Decode(&failure); err != nil {
+			slog.WarnContext(ctx, "Failed to decode failed URL", "err", err)
+			continue
+		}
+		if !fn(failure) {
+			return nil
+		}
+	}
+	if err := cursor.Err(); err != nil && ctx.Err() == nil {
+		return fmt.Errorf("failed to iterate over failed URLs: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestFileStorage(t *testing.T) {
+	store, err := openFileStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	storageSuite(t, store)
+}
+
+func TestMongoStorage(t *testing.T) {
+	cfg, _ := testMongo(t)
+	store, err := openStorage(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storageSuite(t, store)
+}
+
+// TestProductUpdate checks the MongoDB update of a product without a
+// server: empty fields are unset, except those of skipped sections.
+func TestProductUpdate(t *testing.T) {
+	product := &Product{ProductURL: "https://shop.adidas.jp/products/GZ0127/", ProductNumber: "GZ0127"}
+	stampScrapedSections(product, map[string]bool{sectionBasic: true, sectionMedia: true})
+	update, err := productUpdate(product, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	set, _ := update["$set"].(bson.M)
+	unset, _ := update["$unset"].(bson.M)
+	for _, key := range []string{"badges", "member_price_jpy", "release_date", "materials"} {
+		if _, ok := unset[key]; !ok {
+			t.Errorf("%s not unset", key)
+		}
+	}
+	if memberOnly, ok := set["member_only"]; !ok || memberOnly != false {
+		t.Errorf("member_only set to %v, want false", memberOnly)
+	}
+	// tag_links is a field of the skipped tags section.
+	for _, key := range []string{"tag_links", "first_crawled_at", "scraped_sections"} {
+		if _, ok := unset[key]; ok {
+			t.Errorf("%s unset", key)
+		}
+	}
+	for key := range unset {
+		if _, ok := set[key]; ok {
+			t.Errorf("%s both set and unset", key)
+		}
+	}
+}
+
+// TestPostgresStorage runs against a schema of its own on the server at
+// $ADIDAS_TEST_POSTGRES_DSN, dropped when the test ends.
+func TestPostgresStorage(t *testing.T) {
+	dsn := os.Getenv("ADIDAS_TEST_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("ADIDAS_TEST_POSTGRES_DSN not set")
+	}
+	ctx := context.Background()
+	conn, err := pgx.Connect(ctx, dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema := fmt.Sprintf("adidas_test_%d", time.Now().UnixNano())
+	if _, err := conn.Exec(ctx, "CREATE SCHEMA "+schema); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Exec(ctx, "DROP SCHEMA "+schema+" CASCADE")
+		conn.Close(ctx)
+	})
+	if strings.Contains(dsn, "://") {
+		if strings.Contains(dsn, "?") {
+			dsn += "&search_path=" + schema
+		} else {
+			dsn += "?search_path=" + schema
+		}
+	} else {
+		dsn += " search_path=" + schema
+	}
+
+	store, err := openStorage(testConfig(t, "-storage", storagePostgres, "-postgres-dsn", dsn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	storageSuite(t, store)
+}
+
+// storageSuite checks the behaviour every Storage shares: the life cycle of
+// a product URL from discovery through its claim to its outcome, saving
+// products and picking the stale ones for a refresh. store must be empty; it
+// is closed when the test ends.
+func storageSuite(t *testing.T, store Storage) {
+	t.Helper()
+	ctx := context.Background()
+	t.Cleanup(func() {
+		if err := store.close(); err != nil {
+			t.Error(err)
+		}
+	})
+	if err := store.prepare(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	const (
+		shoeURL   = "https://shop.adidas.jp/products/GZ0127/"
+		jacketURL = "https://shop.adidas.jp/products/IK7351/"
+		socksURL  = "https://shop.adidas.jp/products/HT3432/"
+	)
+	urls := []ProductURL{
+		{Section: "men", Category: "shoes", PageNo: 1, URL: shoeURL, Status: statusPending},
+		{Section: "men", Category: "wear", PageNo: 1, URL: jacketURL, Status: statusPending},
+		{Section: "men", Category: "accessories", PageNo: 2, URL: socksURL, Status: statusPending},
+	}
+
+	pending := func(categories *regexp.Regexp) []string {
+		t.Helper()
+		var got []string
+		err := store.eachPendingProductURL(ctx, categories, 0, func(u ProductURL) bool {
+			got = append(got, u.URL)
+			return true
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		slices.Sort(got)
+		return got
+	}
+	stale := func(before time.Time) []string {
+		t.Helper()
+		var got []string
+		err := store.eachStaleProductURL(ctx, nil, before, 0, func(u ProductURL) bool {
+			got = append(got, u.URL)
+			return true
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+
+	t.Run("save product URLs", func(t *testing.T) {
+		if n, err := store.saveProductURLs(ctx, urls); err != nil || n != 3 {
+			t.Fatalf("saveProductURLs() = %d, %v, want 3 new", n, err)
+		}
+		if n, err := store.saveProductURLs(ctx, urls[:2]); err != nil || n != 0 {
+			t.Errorf("saving known URLs again = %d, %v, want 0 new", n, err)
+		}
+		if isNew, err := store.saveProductURL(ctx, urls[2]); err != nil || isNew {
+			t.Errorf("saveProductURL(known) = %v, %v, want false", isNew, err)
+		}
+		if n, err := store.countProductURLs(ctx); err != nil || n != 3 {
+			t.Errorf("countProductURLs() = %d, %v, want 3", n, err)
+		}
+		shoes := regexp.MustCompile("^shoes$")
+		if n, err := store.countPendingProductURLs(ctx, shoes); err != nil || n != 1 {
+			t.Errorf("countPendingProductURLs(shoes) = %d, %v, want 1", n, err)
+		}
+		if got := pending(shoes); !slices.Equal(got, []string{shoeURL}) {
+			t.Errorf("pending shoes = %q", got)
+		}
+	})
+
+	t.Run("claim, release and mark", func(t *testing.T) {
+		if ok, err := store.claimProductURL(ctx, shoeURL); err != nil || !ok {
+			t.Fatalf("claimProductURL() = %v, %v, want true", ok, err)
+		}
+		if ok, err := store.claimProductURL(ctx, shoeURL); err != nil || ok {
+			t.Errorf("claiming a claimed URL = %v, %v, want false", ok, err)
+		}
+		if got := pending(nil); !slices.Equal(got, []string{socksURL, jacketURL}) {
+			t.Errorf("pending after the claim = %q", got)
+		}
+
+		// A fresh claim is kept, one older than the timeout is released.
+		if n, err := store.releaseStaleClaims(ctx, time.Hour); err != nil || n != 0 {
+			t.Errorf("releaseStaleClaims(1h) = %d, %v, want 0", n, err)
+		}
+		if n, err := store.releaseStaleClaims(ctx, -time.Minute); err != nil || n != 1 {
+			t.Errorf("releaseStaleClaims(-1m) = %d, %v, want 1", n, err)
+		}
+		if ok, err := store.claimProductURL(ctx, shoeURL); err != nil || !ok {
+			t.Fatalf("claiming a released URL = %v, %v, want true", ok, err)
+		}
+
+		if err := store.markProductURL(ctx, shoeURL, statusDone, nil, map[string]any{"availability": availabilityInStock}); err != nil {
+			t.Fatal(err)
+		}
+		if ok, err := store.claimProductURL(ctx, shoeURL); err != nil || ok {
+			t.Errorf("claiming a done URL = %v, %v, want false", ok, err)
+		}
+		if ok, err := store.claimProductURL(ctx, jacketURL); err != nil || !ok {
+			t.Fatalf("claimProductURL(jacket) = %v, %v, want true", ok, err)
+		}
+		if err := store.markProductURL(ctx, jacketURL, statusFailed, errors.New("page load timed out"), nil); err != nil {
+			t.Fatal(err)
+		}
+		if n, err := store.countPendingProductURLs(ctx, nil); err != nil || n != 1 {
+			t.Errorf("countPendingProductURLs() = %d, %v, want 1", n, err)
+		}
+	})
+
+	t.Run("save products", func(t *testing.T) {
+		shoe := &Product{ProductURL: shoeURL, ProductNumber: "GZ0127", Title: "ウルトラブースト 22", ContentHash: "a1"}
+		socks := &Product{ProductURL: socksURL, ProductNumber: "HT3432", Title: "ソックス 3足組", ContentHash: "b1"}
+		outcomes, errs := store.saveProducts(ctx, []*Product{shoe, socks})
+		if !slices.Equal(outcomes, []string{productNew, productNew}) || errors.Join(errs...) != nil {
+			t.Fatalf("saveProducts() = %q, %v, want both new", outcomes, errs)
+		}
+
+		shoe = &Product{ProductURL: shoeURL, ProductNumber: "GZ0127", Title: "ウルトラブースト 22", ContentHash: "a1"}
+		socks = &Product{ProductURL: socksURL, ProductNumber: "HT3432", Title: "ソックス 3足組 (白)", ContentHash: "b2"}
+		outcomes, errs = store.saveProducts(ctx, []*Product{shoe, socks})
+		if !slices.Equal(outcomes, []string{productUnchanged, productChanged}) || errors.Join(errs...) != nil {
+			t.Errorf("saving again = %q, %v, want unchanged and changed", outcomes, errs)
+		}
+		if shoe.FirstCrawledAt.IsZero() {
+			t.Error("the first crawl time of an unchanged product is not kept")
+		}
+
+		if ok, err := store.hasProduct(ctx, "GZ0127"); err != nil || !ok {
+			t.Errorf("hasProduct(GZ0127) = %v, %v, want true", ok, err)
+		}
+		if ok, err := store.hasProduct(ctx, "IK7351"); err != nil || ok {
+			t.Errorf("hasProduct(IK7351) = %v, %v, want false", ok, err)
+		}
+		var numbers []string
+		err := store.eachProduct(ctx, func(p *Product) bool {
+			numbers = append(numbers, p.ProductNumber)
+			return true
+		})
+		if err != nil || !slices.Equal(numbers, []string{"GZ0127", "HT3432"}) {
+			t.Errorf("eachProduct() = %q, %v", numbers, err)
+		}
+	})
+
+	t.Run("clear emptied fields", func(t *testing.T) {
+		shoe := &Product{ProductURL: shoeURL, ProductNumber: "GZ0127", Title: "ウルトラブースト 22", ContentHash: "a2"}
+		shoe.Badges, shoe.MemberOnly = []string{badgeNew, badgeMembersOnly}, true
+		memberPrice := 10890
+		shoe.MemberPrice = &memberPrice
+		releaseDate := time.Date(2024, 3, 14, 0, 0, 0, 0, time.UTC)
+		shoe.ReleaseDate = &releaseDate
+		if _, err := store.saveProduct(ctx, shoe); err != nil {
+			t.Fatal(err)
+		}
+		// The page no longer shows them.
+		shoe = &Product{ProductURL: shoeURL, ProductNumber: "GZ0127", Title: "ウルトラブースト 22", ContentHash: "a3"}
+		if _, err := store.saveProduct(ctx, shoe); err != nil {
+			t.Fatal(err)
+		}
+
+		var stored *Product
+		err := store.eachProduct(ctx, func(p *Product) bool {
+			if p.ProductNumber == "GZ0127" {
+				stored = p
+			}
+			return true
+		})
+		if err != nil || stored == nil {
+			t.Fatalf("eachProduct() = %v, found GZ0127 %v", err, stored != nil)
+		}
+		if len(stored.Badges) != 0 || stored.MemberOnly {
+			t.Errorf("badges %q, member only %v, want both cleared", stored.Badges, stored.MemberOnly)
+		}
+		if stored.MemberPrice != nil {
+			t.Errorf("member price %d, want it cleared", *stored.MemberPrice)
+		}
+		if stored.ReleaseDate != nil {
+			t.Errorf("release date %v, want it cleared once the product is released", stored.ReleaseDate)
+		}
+	})
+
+	t.Run("sale ends", func(t *testing.T) {
+		socks := &Product{ProductURL: socksURL, ProductNumber: "HT3432", Title: "ソックス 3足組", ContentHash: "b3"}
+		socks.PriceJPY = 1078
+		applySaleBadge(socks, []string{"30%OFF"})
+		socks.Badges = normalizeBadges([]string{"30%OFF"})
+		if _, err := store.saveProduct(ctx, socks); err != nil {
+			t.Fatal(err)
+		}
+		socks = &Product{ProductURL: socksURL, ProductNumber: "HT3432", Title: "ソックス 3足組", ContentHash: "b4"}
+		socks.PriceJPY = 1540
+		applySaleBadge(socks, nil)
+		if _, err := store.saveProduct(ctx, socks); err != nil {
+			t.Fatal(err)
+		}
+
+		var stored *Product
+		err := store.eachProduct(ctx, func(p *Product) bool {
+			if p.ProductNumber == "HT3432" {
+				stored = p
+			}
+			return true
+		})
+		if err != nil || stored == nil {
+			t.Fatalf("eachProduct() = %v, found HT3432 %v", err, stored != nil)
+		}
+		if len(stored.Badges) != 0 || stored.OnSale || stored.DiscountPercent != 0 {
+			t.Errorf("badges %q, on sale %v, discount %v, want the sale cleared", stored.Badges, stored.OnSale, stored.DiscountPercent)
+		}
+	})
+
+	t.Run("stale product URLs", func(t *testing.T) {
+		// The jacket has no product, the shoe and the socks were just seen.
+		if got := stale(time.Now().Add(-time.Hour)); !slices.Equal(got, []string{jacketURL}) {
+			t.Errorf("stale an hour ago = %q, want only the URL without a product", got)
+		}
+		got := stale(time.Now().Add(time.Hour))
+		if len(got) != 3 || got[0] != jacketURL {
+			t.Errorf("stale in an hour = %q, want all three, the one never seen first", got)
+		}
+
+		// A claimed URL is left to the worker that claimed it.
+		if ok, err := store.claimProductURL(ctx, socksURL); err != nil || !ok {
+			t.Fatalf("claimProductURL(socks) = %v, %v, want true", ok, err)
+		}
+		if got := stale(time.Now().Add(time.Hour)); slices.Contains(got, socksURL) {
+			t.Errorf("stale in an hour = %q, want the claimed URL left out", got)
+		}
+	})
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Modes of -pdp-mode.
+const (
+	pdpModeDOM    = "dom"    // every field from the CSS selectors
+	pdpModeHybrid = "hybrid" // the structured data first, the selectors for the rest
+)
+
+// Sources of a field in Product.Provenance.
+const (
+	provenanceJSONLD = "json_ld" // the schema.org JSON-LD of the page
+	provenanceState  = "state"   // the state blob the page's scripts render from
+	provenanceDOM    = "dom"     // the rendered page, through CSS selectors
+)
+
+// structuredDataScript returns the JSON-LD blocks of the page and its
+// embedded application state, serialized, in one round trip.
+const structuredDataScript = `
+var ld = [];
+document.querySelectorAll('script[type="application/ld+json"]').forEach(function (s) {
+	ld.push(s.textContent);
+});
+var state = window.__NEXT_DATA__ || window.__INITIAL_STATE__ || window.__PRELOADED_STATE__ || null;
+var stateJSON = null;
+try {
+	stateJSON = state ? JSON.stringify(state) : null;
+} catch (e) {}
+return {ld: ld, state: stateJSON};
+`
+
+// structuredProduct is what the structured data of a product page tells about
+// it. Empty fields were not found.
+type structuredProduct struct {
+	Title        string
+	Description  string
+	PriceJPY     int
+	PriceMinJPY  int
+	PriceMaxJPY  int
+	Availability string
+	Images       []string
+	// Sources has the source of every field set, by the Provenance key.
+	Sources map[string]string
+}
+
+// readStructuredData reads the JSON-LD product and the embedded state of the
+// product page loaded by ex. The JSON-LD wins where both carry a field.
+func readStructuredData(ex Extractor, productNumber string) (*structuredProduct, error) {
+	blocks, stateJSON, err := ex.structuredData()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read structured data: %v", err)
+	}
+	data := &structuredProduct{Sources: make(map[string]string)}
+
+	for _, text := range blocks {
+		var doc any
+		if err := json.Unmarshal([]byte(text), &doc); err != nil {
+			continue
+		}
+		if product := findJSONLDProduct(doc); product != nil {
+			data.applyJSONLD(product)
+			break
+		}
+	}
+
+	if stateJSON != "" && productNumber != "" {
+		var state any
+		if err := json.Unmarshal([]byte(stateJSON), &state); err == nil {
+			if product := findStateProduct(state, productNumber); product != nil {
+				data.applyState(product)
+			}
+		}
+	}
+
+	if len(data.Sources) == 0 {
+		return nil, fmt.Errorf("no product in the structured data")
+	}
+	return data, nil
+}
+
+// findJSONLDProduct returns the first object of @type Product in a JSON-LD
+// document, looking into arrays and @graph.
+func findJSONLDProduct(doc any) map[string]any {
+	switch v := doc.(type) {
+	case []any:
+		for _, item := range v {
+			if product := findJSONLDProduct(item); product != nil {
+				return product
+			}
+		}
+	case map[string]any:
+		if hasJSONLDType(v, "Product") {
+			return v
+		}
+		if graph, ok := v["@graph"]; ok {
+			return findJSONLDProduct(graph)
+		}
+	}
+	return nil
+}
+
+// hasJSONLDType reports whether the @type of obj, a string or a list, is typ.
+func hasJSONLDType(obj map[string]any, typ string) bool {
+	switch t := obj["@type"].(type) {
+	case string:
+		return t == typ
+	case []any:
+		for _, item := range t {
+			if item == typ {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// applyJSONLD takes the fields of a schema.org Product.
+func (d *structuredProduct) applyJSONLD(product map[string]any) {
+	d.set("title", &d.Title, jsonString(product["name"]), provenanceJSONLD)
+	d.set("description", &d.Description, jsonString(product["description"]), provenanceJSONLD)
+	if images := jsonStrings(product["image"]); len(images) > 0 {
+		d.Images = images
+		d.Sources["images"] = provenanceJSONLD
+	}
+
+	// offers is an Offer, a list of them or an AggregateOffer.
+	var offers []map[string]any
+	switch v := product["offers"].(type) {
+	case map[string]any:
+		offers = append(offers, v)
+	case []any:
+		for _, item := range v {
+			if offer, ok := item.(map[string]any); ok {
+				offers = append(offers, offer)
+			}
+		}
+	}
+	for _, offer := range offers {
+		if currency := jsonString(offer["priceCurrency"]); currency != "" && currency != "JPY" {
+			continue
+		}
+		for _, key := range []string{"price", "lowPrice", "highPrice"} {
+			if amount := jsonInt(offer[key]); amount > 0 {
+				if d.PriceMinJPY == 0 || amount < d.PriceMinJPY {
+					d.PriceMinJPY = amount
+				}
+				d.PriceMaxJPY = max(d.PriceMaxJPY, amount)
+			}
+		}
+		if d.Availability == "" {
+			d.set("availability", &d.Availability, schemaAvailability(jsonString(offer["availability"])), provenanceJSONLD)
+		}
+	}
+	if d.PriceMinJPY > 0 {
+		d.PriceJPY = d.PriceMinJPY
+		d.Sources["price"] = provenanceJSONLD
+	}
+}
+
+// findStateProduct returns the object of the embedded state that describes
+// the product, recognized by one of the usual ID keys holding productNumber.
+// The state has no published shape, so it is searched rather than walked by
+// path.
+func findStateProduct(state any, productNumber string) map[string]any {
+	switch v := state.(type) {
+	case []any:
+		for _, item := range v {
+			if product := findStateProduct(item, productNumber); product != nil {
+				return product
+			}
+		}
+	case map[string]any:
+		for _, key := range []string{"article_id", "articleId", "product_id", "productId", "sku"} {
+			if id := jsonString(v[key]); id != "" && strings.EqualFold(id, productNumber) {
+				if _, ok := v["name"]; ok {
+					return v
+				}
+			}
+		}
+		for _, item := range v {
+			if product := findStateProduct(item, productNumber); product != nil {
+				return product
+			}
+		}
+	}
+	return nil
+}
+
+// applyState takes the fields of the product object of the embedded state
+// that the JSON-LD left empty.
+func (d *structuredProduct) applyState(product map[string]any) {
+	if d.Title == "" {
+		d.set("title", &d.Title, jsonString(product["name"]), provenanceState)
+	}
+	if d.Description == "" {
+		d.set("description", &d.Description, jsonString(product["description"]), provenanceState)
+	}
+	if d.PriceJPY == 0 {
+		for _, key := range []string{"price", "sale_price", "salePrice"} {
+			if price := jsonInt(product[key]); price > 0 {
+				d.PriceJPY, d.PriceMinJPY, d.PriceMaxJPY = price, price, price
+				d.Sources["price"] = provenanceState
+				break
+			}
+		}
+	}
+	if len(d.Images) == 0 {
+		for _, key := range []string{"images", "image_urls", "imageUrls"} {
+			if images := jsonStrings(product[key]); len(images) > 0 {
+				d.Images = images
+				d.Sources["images"] = provenanceState
+				break
+			}
+		}
+	}
+}
+
+// priceInfo returns the price as if read from the page. Prices in Japan are
+// shown with the consumption tax included.
+func (d *structuredProduct) priceInfo() PriceInfo {
+	text := formatYen(d.PriceMinJPY)
+	if d.PriceMaxJPY > d.PriceMinJPY {
+		text += "〜" + formatYen(d.PriceMaxJPY)
+	}
+	return PriceInfo{
+		PriceText:   text,
+		PriceJPY:    d.PriceJPY,
+		PriceMinJPY: d.PriceMinJPY,
+		PriceMaxJPY: d.PriceMaxJPY,
+		Currency:    "JPY",
+		TaxIncluded: true,
+	}
+}
+
+// set stores value in field and records its source, unless value is empty.
+func (d *structuredProduct) set(key string, field *string, value, source string) {
+	if value = strings.TrimSpace(value); value != "" {
+		*field = value
+		d.Sources[key] = source
+	}
+}
+
+// schemaAvailability maps a schema.org ItemAvailability, as a URL or a bare
+// name, to the availability of a Product, or "" for unknown values.
+func schemaAvailability(value string) string {
+	switch value[strings.LastIndex(value, "/")+1:] {
+	case "InStock", "LimitedAvailability", "OnlineOnly", "InStoreOnly":
+		return availabilityInStock
+	case "OutOfStock", "SoldOut":
+		return availabilityOutOfStock
+	case "PreOrder", "PreSale", "BackOrder":
+		return availabilityComingSoon
+	case "Discontinued":
+		return availabilityDiscontinued
+	}
+	return ""
+}
+
+// jsonString returns v if it is a string or a number, otherwise "".
+func jsonString(v any) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return ""
+}
+
+// jsonInt returns the whole yen amount of v, a number or a numeric string,
+// or 0.
+func jsonInt(v any) int {
+	switch v := v.(type) {
+	case float64:
+		return int(v)
+	case string:
+		if f, err := strconv.ParseFloat(strings.ReplaceAll(v, ",", ""), 64); err == nil {
+			return int(f)
+		}
+	}
+	return 0
+}
+
+// jsonStrings returns the URLs of v: a string, a list of strings or a list
+// of ImageObjects with a url or contentUrl.
+func jsonStrings(v any) []string {
+	switch v := v.(type) {
+	case string:
+		if v != "" {
+			return []string{v}
+		}
+	case []any:
+		var values []string
+		for _, item := range v {
+			switch item := item.(type) {
+			case string:
+				values = append(values, item)
+			case map[string]any:
+				if url := jsonString(item["url"]); url != "" {
+					values = append(values, url)
+				} else if url := jsonString(item["contentUrl"]); url != "" {
+					values = append(values, url)
+				}
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// formatYen formats amount as the shop shows prices, e.g. ¥12,100.
+func formatYen(amount int) string {
+	digits := strconv.Itoa(amount)
+	var b strings.Builder
+	for i, c := range digits {
+		if i > 0 && (len(digits)-i)%3 == 0 {
+			b.WriteByte(',')
+		}
+		b.WriteRune(c)
+	}
+	return "¥" + b.String()
+}
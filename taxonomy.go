@@ -0,0 +1,108 @@
+package main
+
+import (
+	"log/slog"
+	neturl "net/url"
+	"strings"
+)
+
+// taxonomyTerm is a value of a taxonomy field and the words that signal it in
+// URLs, breadcrumbs and tags.
+type taxonomyTerm struct {
+	Value string
+	Words []string
+}
+
+var genderTerms = []taxonomyTerm{
+	{"women", []string{"women", "womens", "レディース", "ウィメンズ"}},
+	{"men", []string{"men", "mens", "メンズ"}},
+	{"kids", []string{"kids", "キッズ", "ジュニア", "ベビー"}},
+}
+
+var productTypeTerms = []taxonomyTerm{
+	{"shoes", []string{"shoes", "footwear", "シューズ", "スニーカー", "サンダル"}},
+	{"wear", []string{"wear", "apparel", "clothing", "ウェア", "ウエア"}},
+	{"accessories", []string{"accessories", "アクセサリー", "バッグ", "bags", "帽子", "ソックス"}},
+}
+
+var sportTerms = []taxonomyTerm{
+	{"running", []string{"running", "ランニング"}},
+	{"soccer", []string{"soccer", "football", "サッカー"}},
+	{"basketball", []string{"basketball", "バスケットボール"}},
+	{"tennis", []string{"tennis", "テニス"}},
+	{"golf", []string{"golf", "ゴルフ"}},
+	{"training", []string{"training", "トレーニング"}},
+	{"outdoor", []string{"outdoor", "アウトドア"}},
+	{"swim", []string{"swim", "swimming", "スイム"}},
+	{"originals", []string{"originals", "オリジナルス"}},
+}
+
+// classifyProduct sets the Gender, ProductType and Sport of product from its
+// breadcrumb trail, its URL and the section it was listed in, and its tags.
+// The breadcrumb wins when it disagrees with the URL.
+func classifyProduct(product *Product) {
+	var crumbLabels, crumbTokens []string
+	for _, link := range product.BreadcrumbLinks {
+		crumbLabels = append(crumbLabels, link.Label)
+		crumbTokens = append(crumbTokens, urlTokens(link.URL)...)
+	}
+	urlSignals := append(urlTokens(product.ProductURL), strings.ToLower(product.Section))
+
+	pick := func(field string, terms []taxonomyTerm, extraLabels []string) string {
+		fromCrumbs := matchTerm(terms, crumbTokens, crumbLabels)
+		fromURL := matchTerm(terms, urlSignals, extraLabels)
+		if fromCrumbs != "" && fromURL != "" && fromCrumbs != fromURL {
+			slog.Debug("Breadcrumb and URL disagree, using the breadcrumb", "field", field, "url", product.ProductURL, "breadcrumb", fromCrumbs, "from_url", fromURL)
+		}
+		if fromCrumbs != "" {
+			return fromCrumbs
+		}
+		return fromURL
+	}
+
+	product.Gender = pick("Gender", genderTerms, nil)
+	product.ProductType = pick("Product type", productTypeTerms, nil)
+	product.Sport = pick("Sport", sportTerms, product.Tags)
+}
+
+// matchTerm returns the first term signalled by tokens, which must equal one
+// of its words, or by labels, which must contain one.
+func matchTerm(terms []taxonomyTerm, tokens, labels []string) string {
+	for _, term := range terms {
+		for _, word := range term.Words {
+			for _, token := range tokens {
+				if token == word {
+					return term.Value
+				}
+			}
+			for _, label := range labels {
+				if strings.Contains(strings.ToLower(label), word) {
+					return term.Value
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// urlTokens splits a URL into its lower-cased path segments and query values.
+func urlTokens(rawURL string) []string {
+	u, err := neturl.Parse(rawURL)
+	if err != nil {
+		return nil
+	}
+	var tokens []string
+	for _, segment := range strings.Split(u.Path, "/") {
+		if segment != "" {
+			tokens = append(tokens, strings.ToLower(segment))
+		}
+	}
+	for _, values := range u.Query() {
+		for _, v := range values {
+			for _, part := range strings.Split(v, ",") {
+				tokens = append(tokens, strings.ToLower(part))
+			}
+		}
+	}
+	return tokens
+}
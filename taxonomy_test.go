@@ -0,0 +1,65 @@
+package main
+
+import "testing"
+
+func TestClassifyProduct(t *testing.T) {
+	tests := []struct {
+		name                       string
+		product                    Product
+		gender, productType, sport string
+	}{
+		{
+			name: "shoes",
+			product: Product{
+				ProductURL: "https://shop.adidas.jp/products/GZ0127/",
+				Section:    "men",
+				BreadcrumbLinks: []BreadcrumbLink{
+					{Label: "メンズ", URL: "https://shop.adidas.jp/item/?gender=mens"},
+					{Label: "シューズ", URL: "https://shop.adidas.jp/item/?gender=mens&category=footwear"},
+					{Label: "ランニング", URL: "https://shop.adidas.jp/item/?gender=mens&category=footwear&sport=running"},
+				},
+			},
+			gender: "men", productType: "shoes", sport: "running",
+		},
+		{
+			name: "apparel",
+			product: Product{
+				ProductURL: "https://shop.adidas.jp/products/IK7351/",
+				BreadcrumbLinks: []BreadcrumbLink{
+					{Label: "レディース", URL: "https://shop.adidas.jp/women/"},
+					{Label: "ウェア・服", URL: "https://shop.adidas.jp/item/?gender=womens&category=wear"},
+				},
+				Tags: []string{"オリジナルス", "トラックジャケット"},
+			},
+			gender: "women", productType: "wear", sport: "originals",
+		},
+		{
+			// The breadcrumb wins over the section the product was listed in.
+			name: "accessories",
+			product: Product{
+				ProductURL: "https://shop.adidas.jp/products/HT3432/",
+				Section:    "men",
+				BreadcrumbLinks: []BreadcrumbLink{
+					{Label: "キッズ", URL: "https://shop.adidas.jp/kids/"},
+					{Label: "アクセサリー", URL: "https://shop.adidas.jp/item/?gender=kids&category=accessories"},
+				},
+			},
+			gender: "kids", productType: "accessories",
+		},
+		{
+			name:    "url only",
+			product: Product{ProductURL: "https://shop.adidas.jp/item/?gender=mens&category=bags", Section: "men"},
+			gender:  "men", productType: "accessories",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			product := tt.product
+			classifyProduct(&product)
+			if product.Gender != tt.gender || product.ProductType != tt.productType || product.Sport != tt.sport {
+				t.Errorf("gender, type, sport = %q, %q, %q, want %q, %q, %q",
+					product.Gender, product.ProductType, product.Sport, tt.gender, tt.productType, tt.sport)
+			}
+		})
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math/rand/v2"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tebeka/selenium"
+)
+
+// errChallenge reports that the site answered with a bot challenge or
+// interstitial instead of the requested page.
+var errChallenge = errors.New("bot challenge page served instead of the requested page")
+
+var (
+	challengeMarkers = []string{"captcha", "verify you are a human", "are you a robot", "ロボットではありません", "アクセスが集中", "please wait while we verify", "bm-verify"}
+	// challengeSelector matches the elements of the known challenge pages.
+	challengeSelector = "#sec-if-cpt-container, #sec-cpt-if, #challenge-form, .g-recaptcha, #px-captcha, iframe[src*='captcha']"
+)
+
+// isChallengePage reports whether the loaded page is a bot challenge. It is
+// only asked once the expected content failed to render.
+func isChallengePage(wd selenium.WebDriver) bool {
+	if elems, err := wd.FindElements(selenium.ByCSSSelector, challengeSelector); err == nil && len(elems) > 0 {
+		return true
+	}
+	title, _ := wd.Title()
+	text := ""
+	if result, err := wd.ExecuteScript(pageTextScript, nil); err == nil {
+		text, _ = result.(string)
+	}
+	return containsAny(strings.ToLower(title+"\n"+text), challengeMarkers)
+}
+
+// throttle paces the page loads of every worker of a phase. Page loads are
+// spaced evenly to stay below cfg.MaxRPS and at least cfg.MinDelay apart, or
+// the Crawl-delay of robots.txt when that is longer, plus up to cfg.Jitter of
+// random delay, across all workers together. It also keeps URLs disallowed by
+// robots.txt out of the queues, see allowed.
+//
+// When the site starts serving challenge pages all workers back off together,
+// for a delay that doubles with every further challenge; after
+// cfg.ChallengePauseAfter challenges in a row the whole run pauses for
+// cfg.ChallengePause.
+type throttle struct {
+	cfg      *Config
+	stats    *crawlStats
+	interval time.Duration // between two page loads, 0 for no limit
+	robots   *robotsRules  // nil with -ignore-robots
+
+	mu          sync.Mutex
+	next        time.Time // earliest start of the next page load
+	until       time.Time // no page loads before this time
+	delay       time.Duration
+	consecutive int
+}
+
+func newThrottle(cfg *Config, stats *crawlStats, robots *robotsRules) *throttle {
+	interval := cfg.MinDelay
+	if cfg.MaxRPS > 0 {
+		interval = max(interval, time.Duration(float64(time.Second)/cfg.MaxRPS))
+	}
+	if robots != nil {
+		interval = max(interval, robots.crawlDelay)
+	}
+	return &throttle{cfg: cfg, stats: stats, interval: interval, robots: robots}
+}
+
+// allowed reports whether url may be queued under robots.txt, logging and
+// counting the URLs that may not.
+func (t *throttle) allowed(url string) bool {
+	if t.robots.allowed(url) {
+		return true
+	}
+	t.stats.RobotsSkipped.Add(1)
+	slog.Debug("Skipping URL disallowed by robots.txt", "url", url)
+	return false
+}
+
+// wait blocks until the next page load is allowed. It reports false when ctx
+// was cancelled first.
+func (t *throttle) wait(ctx context.Context) bool {
+	for {
+		t.mu.Lock()
+		now := time.Now()
+		slot := now
+		if t.until.After(slot) {
+			slot = t.until
+		}
+		backingOff := slot.After(now)
+		if !backingOff && t.next.After(slot) {
+			slot = t.next
+		}
+		if !backingOff {
+			// Reserve the slot, so workers waiting concurrently get the
+			// following ones.
+			t.next = slot.Add(t.interval)
+			if t.cfg.Jitter > 0 {
+				t.next = t.next.Add(time.Duration(rand.Int64N(int64(t.cfg.Jitter))))
+			}
+		}
+		t.mu.Unlock()
+
+		if d := time.Until(slot); d > 0 {
+			timer := time.NewTimer(d)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return false
+			case <-timer.C:
+			}
+		}
+		if ctx.Err() != nil {
+			return false
+		}
+		if !backingOff {
+			t.stats.countRequest()
+			return true
+		}
+		// The backoff may have been extended meanwhile; check again.
+	}
+}
+
+// challenged records a challenge page served for url and holds back every
+// worker.
+func (t *throttle) challenged(url string) {
+	t.stats.Challenges.Add(1)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.consecutive++
+	if t.consecutive >= t.cfg.ChallengePauseAfter {
+		t.until = time.Now().Add(t.cfg.ChallengePause)
+		slog.Error("Too many bot challenges in a row, pausing all workers", "challenges", t.consecutive, "url", url, "pause", t.cfg.ChallengePause)
+		t.consecutive = 0
+		t.delay = 0
+		return
+	}
+
+	if t.delay == 0 {
+		t.delay = t.cfg.ChallengeBackoff
+	} else {
+		t.delay = min(2*t.delay, t.cfg.ChallengeMaxBackoff)
+	}
+	if until := time.Now().Add(t.delay); until.After(t.until) {
+		t.until = until
+	}
+	slog.Warn("Bot challenge served, backing off all workers", "url", url, "backoff", t.delay)
+}
+
+// passed records a page that loaded normally, ending the backoff.
+func (t *throttle) passed() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.consecutive = 0
+	t.delay = 0
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestThrottleBackoff(t *testing.T) {
+	cfg := testConfig(t, "-max-rps=0", "-challenge-backoff=1s", "-challenge-max-backoff=5s", "-challenge-pause-after=5", "-challenge-pause=1m")
+	pace := newThrottle(cfg, &crawlStats{}, nil)
+
+	// The backoff doubles with every challenge in a row, up to its bound.
+	for i, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second} {
+		pace.challenged("https://shop.adidas.jp/products/GZ0127/")
+		if pace.delay != want {
+			t.Errorf("backoff after %d challenges = %v, want %v", i+1, pace.delay, want)
+		}
+		if until := time.Until(pace.until); until <= want-time.Second || until > want {
+			t.Errorf("workers held back for %v after %d challenges, want %v", until, i+1, want)
+		}
+	}
+
+	// One more pauses the run and starts the backoff over.
+	pace.challenged("https://shop.adidas.jp/products/GZ0127/")
+	if until := time.Until(pace.until); until <= 59*time.Second || until > time.Minute {
+		t.Errorf("workers held back for %v after -challenge-pause-after challenges, want -challenge-pause", until)
+	}
+	pace.challenged("https://shop.adidas.jp/products/GZ0127/")
+	if pace.delay != time.Second {
+		t.Errorf("backoff after the pause = %v, want -challenge-backoff", pace.delay)
+	}
+
+	// A page that loads ends the run of challenges.
+	pace.passed()
+	pace.challenged("https://shop.adidas.jp/products/GZ0127/")
+	if pace.delay != time.Second || pace.consecutive != 1 {
+		t.Errorf("backoff %v after %d challenges following a passed page, want -challenge-backoff after 1", pace.delay, pace.consecutive)
+	}
+	if got := pace.stats.Challenges.Load(); got != 7 {
+		t.Errorf("Challenges = %d, want 7", got)
+	}
+}
+
+func TestThrottleWaitsOutBackoff(t *testing.T) {
+	cfg := testConfig(t, "-max-rps=0", "-challenge-backoff=100ms")
+	pace := newThrottle(cfg, &crawlStats{}, nil)
+
+	start := time.Now()
+	pace.challenged("https://shop.adidas.jp/products/GZ0127/")
+	if !pace.wait(context.Background()) {
+		t.Fatal("wait() = false without a cancelled context")
+	}
+	if waited := time.Since(start); waited < 100*time.Millisecond {
+		t.Errorf("wait() returned after %v, within the backoff", waited)
+	}
+
+	pace.challenged("https://shop.adidas.jp/products/GZ0127/")
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if pace.wait(ctx) {
+		t.Error("wait() = true for a context cancelled during the backoff")
+	}
+}
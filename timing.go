@@ -0,0 +1,112 @@
+package main
+
+import (
+	"cmp"
+	"math"
+	"slices"
+	"time"
+)
+
+// ScrapeTiming is the time in milliseconds a scrape of a product page spent
+// in each of its sections, such as "navigation" or "reviews", and in all of
+// them as "total".
+type ScrapeTiming map[string]int64
+
+// Sections of a ScrapeTiming, in the order scrapeProduct goes through them.
+const (
+	timingNavigation     = "navigation"      // loading the page
+	timingWait           = "wait"            // waiting for the title, expanding the gallery and closing modals
+	timingScroll         = "scroll"          // scrolling down for the lazily loaded sections
+	timingStructuredData = "structured_data" // reading the structured data with -pdp-mode=hybrid
+	timingDetails        = "details"         // breadcrumbs, title, price, colors, sizes, availability and purchase notes
+	timingMedia          = "media"           // images and videos
+	timingCarousels      = "carousels"       // the coordinated and recommended products
+	timingDescription    = "description"     // description, specifications, features and badges
+	timingSizeChart      = "size_chart"      // size charts and remarks
+	timingReviews        = "reviews"
+	timingTags           = "tags"
+	timingTotal          = "total"
+)
+
+// sectionTimer splits the time of a scrape into the sections of a
+// ScrapeTiming.
+type sectionTimer struct {
+	timing ScrapeTiming
+	start  time.Time
+	last   time.Time
+}
+
+func newSectionTimer() *sectionTimer {
+	now := time.Now()
+	return &sectionTimer{timing: make(ScrapeTiming), start: now, last: now}
+}
+
+// lap adds the time since the previous lap, or the start, to section.
+func (t *sectionTimer) lap(section string) {
+	now := time.Now()
+	t.timing[section] += now.Sub(t.last).Milliseconds()
+	t.last = now
+}
+
+// done returns the timing, with the time since the start as its total.
+func (t *sectionTimer) done() ScrapeTiming {
+	t.timing[timingTotal] = time.Since(t.start).Milliseconds()
+	return t.timing
+}
+
+// sectionPercentiles are the timings of one section over the products of a
+// run.
+type sectionPercentiles struct {
+	Section string
+	P50     int64   // milliseconds
+	P95     int64   // milliseconds
+	Share   float64 // of the time spent in all sections, 0 to 1
+}
+
+// timingPercentiles returns the median and 95th percentile of each section of
+// timings, the slowest section in total first, without the total itself.
+func timingPercentiles(timings map[string][]int64) []sectionPercentiles {
+	var all int64
+	totals := make(map[string]int64, len(timings))
+	for section, samples := range timings {
+		if section == timingTotal {
+			continue
+		}
+		for _, ms := range samples {
+			totals[section] += ms
+		}
+		all += totals[section]
+	}
+
+	percentiles := make([]sectionPercentiles, 0, len(totals))
+	for section, total := range totals {
+		samples := slices.Clone(timings[section])
+		slices.Sort(samples)
+		p := sectionPercentiles{
+			Section: section,
+			P50:     percentile(samples, 0.50),
+			P95:     percentile(samples, 0.95),
+		}
+		if all > 0 {
+			p.Share = float64(total) / float64(all)
+		}
+		percentiles = append(percentiles, p)
+	}
+	slices.SortFunc(percentiles, func(a, b sectionPercentiles) int {
+		if c := cmp.Compare(b.Share, a.Share); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.Section, b.Section)
+	})
+	return percentiles
+}
+
+// percentile returns the nearest-rank percentile q, 0 to 1, of the sorted
+// samples.
+func percentile(sorted []int64, q float64) int64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(q*float64(len(sorted)))) - 1
+	return sorted[min(max(rank, 0), len(sorted)-1)]
+}
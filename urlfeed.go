@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	neturl "net/url"
+	"os"
+	"strings"
+)
+
+// feedStorage is the Storage of a scrape of URLs given with -urls-file. They
+// are not in the product_urls collection, so there is nothing to claim and no
+// scrape status to record; products and failed URLs are stored as usual.
+type feedStorage struct {
+	Storage
+}
+
+func (s *feedStorage) claimProductURL(ctx context.Context, url string) (bool, error) {
+	return true, nil
+}
+
+func (s *feedStorage) markProductURL(ctx context.Context, url, status string, scrapeErr error, fields map[string]any) error {
+	return nil
+}
+
+// loadURLFeed reads the product URLs to scrape from path, one per line, or
+// from stdin when path is -. Blank lines, # comments and URLs that are not
+// product pages of the site are skipped, and so are the products already
+// stored unless force is set.
+func loadURLFeed(ctx context.Context, store Storage, path string, force bool) ([]ProductURL, error) {
+	var lines []string
+	var err error
+	if path == "-" {
+		lines, err = readList(os.Stdin)
+	} else {
+		lines, err = readListFile(path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read URLs file: %v", err)
+	}
+
+	site, _ := neturl.Parse(siteURL)
+	seen := make(map[string]struct{})
+	// Never nil, so that an empty feed scrapes nothing rather than the
+	// pending product URLs.
+	feed := []ProductURL{}
+	rejected, scraped := 0, 0
+	for _, line := range lines {
+		u, err := neturl.Parse(line)
+		productNumber := extractProductNumber(line)
+		if err != nil || !strings.EqualFold(u.Hostname(), site.Hostname()) || productNumber == "" {
+			slog.WarnContext(ctx, "Skipping URL that is not a product page of "+site.Hostname(), "url", line)
+			rejected++
+			continue
+		}
+		canonical := canonicalProductURL(line)
+		if contains(seen, canonical) {
+			continue
+		}
+		seen[canonical] = struct{}{}
+
+		if !force {
+			stored, err := store.hasProduct(ctx, productNumber)
+			if err != nil {
+				return nil, fmt.Errorf("failed to look up product %s: %v", productNumber, err)
+			}
+			if stored {
+				scraped++
+				continue
+			}
+		}
+		feed = append(feed, ProductURL{URL: canonical, Status: statusPending})
+	}
+	slog.InfoContext(ctx, "Read product URLs", "file", path, "urls", len(feed), "rejected", rejected, "already_scraped", scraped)
+	return feed, nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"math"
+	"strings"
+)
+
+// productFieldChecks are the product fields -required-fields and
+// -critical-fields can name, each with whether a scraped product has it.
+var productFieldChecks = map[string]func(*Product) bool{
+	"product_number": func(p *Product) bool { return p.ProductNumber != "" },
+	"title":          func(p *Product) bool { return p.Title != "" },
+	"category":       func(p *Product) bool { return p.Category != "" },
+	"breadcrumbs":    func(p *Product) bool { return len(p.Breadcrumbs) > 0 },
+	"price":          func(p *Product) bool { return p.PriceText != "" },
+	"images":         func(p *Product) bool { return countMedia(p.Media, "image") > 0 },
+	"colors":         func(p *Product) bool { return len(p.AvailableColors) > 0 },
+	"sizes":          func(p *Product) bool { return len(p.AvailableSizes) > 0 },
+	"availability":   func(p *Product) bool { return p.Availability != "" },
+	"description":    func(p *Product) bool { return p.Description != "" },
+	"specifications": func(p *Product) bool { return len(p.Specifications) > 0 },
+	"size_chart":     func(p *Product) bool { return len(p.SizeCharts) > 0 },
+	"reviews":        func(p *Product) bool { return p.ReviewSummary.NumberOfReviews > 0 || len(p.Reviews) > 0 },
+	"coordinated":    func(p *Product) bool { return len(p.CoordinatedProducts) > 0 },
+}
+
+// completenessFields are the sections a complete product page has, the
+// fields CompletenessScore is the populated fraction of.
+var completenessFields = []string{
+	"product_number", "title", "category", "breadcrumbs", "price", "images",
+	"colors", "sizes", "availability", "description", "specifications", "size_chart",
+}
+
+// missingFields returns the fields of names that product came back without.
+// Fields of sections the product was never scraped with are not missing.
+func missingFields(product *Product, names []string) []string {
+	var missing []string
+	for _, name := range names {
+		if section := fieldSections[name]; section != "" && !hasSection(product, section) {
+			continue
+		}
+		if has := productFieldChecks[name]; has != nil && !has(product) {
+			missing = append(missing, name)
+		}
+	}
+	return missing
+}
+
+// completenessScore returns the fraction of completenessFields product has,
+// from 0 to 1, rounded to three decimals.
+func completenessScore(product *Product) float64 {
+	populated := len(completenessFields) - len(missingFields(product, completenessFields))
+	return math.Round(float64(populated)/float64(len(completenessFields))*1000) / 1000
+}
+
+// incompleteError is the error of a scraped product that lacks one of the
+// -required-fields and is not stored.
+type incompleteError struct {
+	Fields []string
+}
+
+func (e *incompleteError) Error() string {
+	return "missing required fields: " + strings.Join(e.Fields, ", ")
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+)
+
+// queueColorVariants stores the product pages of the other colorways of
+// product as pending product URLs, under the listing the product itself was
+// found in. Variants that are already known, as a product URL or as a scraped
+// product, are skipped, so colorways linking back to each other are each
+// scraped once. Variants disallowed by robots.txt are not queued. Like the
+// links of a listing, variants are queued by their canonical URL, see
+// canonicalProductURL.
+func queueColorVariants(ctx context.Context, store Storage, parent ProductURL, product *Product, pace *throttle, stats *crawlStats) {
+	ctx = context.WithoutCancel(ctx)
+	queued := 0
+	for _, color := range product.AvailableColors {
+		if color.ProductURL == "" || color.ProductNumber == "" || color.ProductNumber == product.ProductNumber {
+			continue
+		}
+		canonical := canonicalProductURL(color.ProductURL)
+		if !pace.allowed(canonical) {
+			continue
+		}
+
+		scraped, err := store.hasProduct(ctx, color.ProductNumber)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to look up color variant", "product_number", color.ProductNumber, "err", err)
+			continue
+		}
+		if scraped {
+			continue
+		}
+
+		variant := ProductURL{
+			Section:  parent.Section,
+			Category: parent.Category,
+			PageNo:   parent.PageNo,
+			URL:      canonical,
+			Status:   statusPending,
+		}
+		if canonical != color.ProductURL {
+			variant.RawURL = color.ProductURL
+		}
+		inserted, err := store.saveProductURL(ctx, variant)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to queue color variant", "variant_url", color.ProductURL, "err", err)
+			continue
+		}
+		if inserted {
+			queued++
+		}
+	}
+
+	if queued > 0 {
+		stats.Variants.Add(int64(queued))
+		slog.InfoContext(ctx, "Queued color variants", "product_number", product.ProductNumber, "variants", queued)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestQueueColorVariants(t *testing.T) {
+	ctx := context.Background()
+	store, err := openFileStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.close()
+	cfg := testConfig(t)
+	stats := &crawlStats{}
+
+	parent := ProductURL{Section: "men", Category: "shoes", PageNo: 1, URL: "https://shop.adidas.jp/products/GZ0127/"}
+	product := &Product{
+		ProductNumber: "GZ0127",
+		AvailableColors: []ColorOption{
+			{Color: "core black", ProductURL: "https://shop.adidas.jp/products/GZ0127/", ProductNumber: "GZ0127"},
+			{Color: "cloud white", ProductURL: "https://shop.adidas.jp/products/GZ0128/?utm_source=swatch", ProductNumber: "GZ0128"},
+			{Color: "solar red", ProductURL: "https://shop.adidas.jp/products/GZ0129/", ProductNumber: "GZ0129"},
+		},
+	}
+	queueColorVariants(ctx, store, parent, product, newThrottle(cfg, stats, nil), stats)
+	// A later listing links to a variant again with other parameters.
+	storeListingURLs(ctx, store, newThrottle(cfg, stats, nil), stats, listingPage{Section: "men"}, "shoes", 2,
+		[]string{"https://shop.adidas.jp/products/GZ0128/?utm_source=listing"}, nil)
+
+	got := map[string]ProductURL{}
+	store.eachPendingProductURL(ctx, nil, 0, func(u ProductURL) bool {
+		got[u.URL] = u
+		return true
+	})
+	if len(got) != 2 {
+		t.Fatalf("queued %d product URLs, want the 2 other colorways: %v", len(got), got)
+	}
+	variant, ok := got["https://shop.adidas.jp/products/GZ0128/"]
+	if !ok {
+		t.Fatalf("variant not queued by its canonical URL: %v", got)
+	}
+	if variant.RawURL != "https://shop.adidas.jp/products/GZ0128/?utm_source=swatch" || variant.Category != "shoes" {
+		t.Errorf("variant = %+v, want the swatch link as RawURL under the parent's category", variant)
+	}
+	if got := stats.Variants.Load(); got != 2 {
+		t.Errorf("Variants = %d, want 2", got)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// webhookBuffer is the number of notifications held while the endpoint
+	// is slow. Further notifications are dropped.
+	webhookBuffer = 500
+	// webhookAttempts is how often a notification is sent before it is
+	// given up on.
+	webhookAttempts = 3
+	// webhookSignatureHeader carries the HMAC-SHA256 of the request body,
+	// keyed with -webhook-secret, as sha256=<hex>.
+	webhookSignatureHeader = "X-Adidas-Signature"
+)
+
+// webhookPayload is the JSON body POSTed to -webhook-url.
+type webhookPayload struct {
+	Event string    `json:"event"` // run_started, run_finished or product_scraped
+	Time  time.Time `json:"time"`
+	RunID string    `json:"run_id,omitempty"`
+	Phase string    `json:"phase,omitempty"`
+
+	// Set on run_finished.
+	DiscoveredURLs  *int64           `json:"discovered_urls,omitempty"`
+	Products        *int64           `json:"products,omitempty"`
+	Failed          *int64           `json:"failed,omitempty"`
+	DurationSeconds float64          `json:"duration_seconds,omitempty"`
+	Stats           map[string]int64 `json:"stats,omitempty"`
+	Error           string           `json:"error,omitempty"`
+
+	// Set on product_scraped.
+	Product *Product `json:"product,omitempty"`
+}
+
+// eventProductScraped is the webhook event sent per product with
+// -webhook-per-product.
+const eventProductScraped = "product_scraped"
+
+// webhookSink is the product sink that notifies -webhook-url of the start and
+// end of a run, and of every scraped product with -webhook-per-product.
+// Notifications are sent by a background worker, so a slow endpoint never
+// holds up the browser workers.
+type webhookSink struct {
+	cfg    *Config
+	client *http.Client
+	queue  chan []byte
+	done   chan struct{}
+
+	sent    atomic.Int64
+	dropped atomic.Int64
+	failed  atomic.Int64
+}
+
+func newWebhookSink(cfg *Config) *webhookSink {
+	w := &webhookSink{
+		cfg:    cfg,
+		client: &http.Client{Timeout: 30 * time.Second},
+		queue:  make(chan []byte, webhookBuffer),
+		done:   make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+func (w *webhookSink) enqueue(ctx context.Context, product *Product) {
+	if !w.cfg.WebhookPerProduct {
+		return
+	}
+	w.add(webhookPayload{Event: eventProductScraped, Time: time.Now().UTC(), RunID: product.RunID, Product: product})
+}
+
+func (w *webhookSink) event(ctx context.Context, e runEvent) {
+	payload := webhookPayload{Event: e.Type, Time: e.Time, RunID: e.RunID, Phase: e.Phase, Error: e.Error}
+	switch e.Type {
+	case eventRunStarted:
+	case eventRunFinished:
+		discovered, products, failed := e.Stats["product_urls"], e.Stats["products"], e.Stats["failed"]
+		payload.DiscoveredURLs = &discovered
+		payload.Products = &products
+		payload.Failed = &failed
+		payload.DurationSeconds = e.DurationSeconds
+		payload.Stats = e.Stats
+	default:
+		// Failed URLs are only counted in run_finished.
+		return
+	}
+	w.add(payload)
+}
+
+// add encodes payload right away, since sinks after this one may still
+// change the product, and queues it, dropping it when the buffer is full.
+func (w *webhookSink) add(payload webhookPayload) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		slog.Error("Failed to encode webhook", "event", payload.Event, "err", err)
+		return
+	}
+	select {
+	case w.queue <- body:
+	default:
+		if w.dropped.Add(1) == 1 {
+			slog.Warn("Webhook buffer full, dropping notifications until the endpoint catches up")
+		}
+	}
+}
+
+// run sends the queued notifications until the queue is closed and drained.
+func (w *webhookSink) run() {
+	defer close(w.done)
+	for body := range w.queue {
+		if err := w.deliver(body); err != nil {
+			slog.Error("Giving up webhook", "attempts", webhookAttempts, "err", err)
+			w.failed.Add(1)
+			continue
+		}
+		w.sent.Add(1)
+	}
+}
+
+// deliver POSTs body, retrying with a doubling backoff on network errors,
+// 429 Too Many Requests and 5xx responses.
+func (w *webhookSink) deliver(body []byte) error {
+	var err error
+	for attempt := 0; attempt < webhookAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Second << (attempt - 1))
+		}
+		var retry bool
+		if retry, err = w.post(body); err == nil || !retry {
+			return err
+		}
+	}
+	return err
+}
+
+// post sends body once and reports whether a failure is worth retrying.
+func (w *webhookSink) post(body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, w.cfg.WebhookURL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if w.cfg.WebhookSecret != "" {
+		req.Header.Set(webhookSignatureHeader, signWebhook(w.cfg.WebhookSecret, body))
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	retry := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	return retry, fmt.Errorf("webhook endpoint answered %s", resp.Status)
+}
+
+// signWebhook returns the signature header value of body.
+func signWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// close sends the notifications still queued, including run_finished, and
+// reports those that were not delivered.
+func (w *webhookSink) close() {
+	close(w.queue)
+	<-w.done
+	if unsent := w.failed.Load() + w.dropped.Load(); unsent > 0 {
+		slog.Warn("Some webhooks were not delivered", "sent", w.sent.Load(), "undelivered", unsent, "dropped", w.dropped.Load())
+		return
+	}
+	slog.Info("Sent webhooks", "sent", w.sent.Load())
+}